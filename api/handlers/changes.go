@@ -0,0 +1,168 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// changeLogSize is how many changes are kept in the change log.
+// Consumers that fall further behind than this must resync.
+const changeLogSize = 10000
+
+// change is one entry in the change log: a peridot resource that
+// was created, updated or deleted.
+type change struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Resource string    `json:"resource"`
+	Action   string    `json:"action"`
+	// Data is the resource after the change, or its last known
+	// state if it was deleted.
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// changeFromEvent converts an event into a change log entry.
+func changeFromEvent(ev *event) (*change, error) {
+	resource := ev.Type
+	action := ""
+	if i := strings.LastIndex(ev.Type, "."); i >= 0 {
+		resource, action = ev.Type[:i], ev.Type[i+1:]
+	}
+	switch action {
+	case "status_changed", "inactive":
+		action = "updated"
+	}
+
+	c := &change{Seq: ev.Seq, Time: ev.Time, Resource: resource, Action: action}
+	if data, ok := ev.Data.(map[string]interface{}); ok {
+		if v, ok := data[resource]; ok {
+			js, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			c.Data = js
+		}
+	}
+	return c, nil
+}
+
+// changeLog records every event as a change, so that consumers can
+// catch up with what has changed since they last looked. If
+// APISTATEDIR is set, it is saved there, so that sequence numbers
+// keep increasing across restarts.
+type changeLog struct {
+	mu       sync.Mutex
+	stateDir string
+	// changes holds the most recent changes, oldest first
+	changes []*change
+	// saved is how many lines have been appended to the saved
+	// log since it was last rewritten
+	saved int
+}
+
+// newChangeLog creates a change log, loading any saved changes
+// from stateDir.
+func newChangeLog(stateDir string) (*changeLog, error) {
+	cl := &changeLog{stateDir: stateDir, changes: []*change{}}
+	err := loadStateLines(stateDir, "changes", func(line []byte) error {
+		c := &change{}
+		if err := json.Unmarshal(line, c); err != nil {
+			return err
+		}
+		cl.changes = append(cl.changes, c)
+		cl.saved++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(cl.changes) > changeLogSize {
+		cl.changes = cl.changes[len(cl.changes)-changeLogSize:]
+	}
+	return cl, nil
+}
+
+// lastSeq returns the sequence number of the most recent change,
+// or 0 if there are none.
+func (cl *changeLog) lastSeq() uint64 {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if len(cl.changes) == 0 {
+		return 0
+	}
+	return cl.changes[len(cl.changes)-1].Seq
+}
+
+// record adds an event to the change log. It is called from the
+// event bus.
+func (cl *changeLog) record(ev *event) {
+	c, err := changeFromEvent(ev)
+	if err != nil {
+		log.Printf("error recording change %d: %v", ev.Seq, err)
+		return
+	}
+	line, err := json.Marshal(c)
+	if err != nil {
+		log.Printf("error recording change %d: %v", ev.Seq, err)
+		return
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.changes = append(cl.changes, c)
+	if len(cl.changes) > changeLogSize {
+		cl.changes = cl.changes[len(cl.changes)-changeLogSize:]
+	}
+
+	// append to the saved log, and rewrite it once it has grown
+	// to twice the size that is kept
+	if cl.stateDir == "" {
+		return
+	}
+	if err := appendStateLine(cl.stateDir, "changes", line); err != nil {
+		log.Printf("error saving change %d: %v", ev.Seq, err)
+	}
+	cl.saved++
+	if cl.saved >= 2*changeLogSize {
+		lines := [][]byte{}
+		for _, c := range cl.changes {
+			js, _ := json.Marshal(c)
+			lines = append(lines, js)
+		}
+		if err := saveStateLines(cl.stateDir, "changes", lines); err != nil {
+			log.Printf("error saving changes: %v", err)
+			return
+		}
+		cl.saved = len(lines)
+	}
+}
+
+// since returns up to limit changes after seq, and the sequence
+// number of the most recent change. It returns false if some of the
+// changes after seq are no longer in the log, or if seq is later
+// than the most recent change.
+func (cl *changeLog) since(seq uint64, limit int) ([]*change, uint64, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if len(cl.changes) == 0 {
+		return []*change{}, 0, seq == 0
+	}
+	first := cl.changes[0].Seq
+	last := cl.changes[len(cl.changes)-1].Seq
+	if seq+1 < first || seq > last {
+		return nil, last, false
+	}
+
+	i := sort.Search(len(cl.changes), func(i int) bool { return cl.changes[i].Seq > seq })
+	cs := []*change{}
+	for ; i < len(cl.changes) && len(cs) < limit; i++ {
+		cs = append(cs, cl.changes[i])
+	}
+	return cs, last, true
+}
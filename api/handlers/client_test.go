@@ -0,0 +1,367 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/swinslow/peridot-api/internal/auth"
+	"github.com/swinslow/peridot-api/pkg/client"
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// setupClientTestServer starts a test server with the full set of
+// API routes, and returns a client logged in as the given mock
+// user. The caller must close the server.
+func setupClientTestServer(t *testing.T, ghUsername string) (*httptest.Server, *client.Client, *Env) {
+	env := getTestEnv()
+	router := mux.NewRouter()
+	env.RegisterHandlers(router)
+	srv := httptest.NewServer(router)
+
+	token, err := auth.EncodeToken(env.jwtSecretKey, ghUsername)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	c, err := client.New(srv.URL, client.WithToken(token))
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return srv, c, env
+}
+
+func TestClientCanGetAndListProjects(t *testing.T) {
+	srv, c, _ := setupClientTestServer(t, "viewer")
+	defer srv.Close()
+	ctx := context.Background()
+
+	projects, err := c.ListProjects(ctx, nil)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(projects) != 3 {
+		t.Fatalf("expected %d, got %d", 3, len(projects))
+	}
+	if projects[1].Name != "prj2" {
+		t.Errorf("expected %s, got %s", "prj2", projects[1].Name)
+	}
+
+	projects, err = c.ListProjects(ctx, &client.ListOptions{Offset: 1, Limit: 1})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(projects) != 1 || projects[0].ID != 2 {
+		t.Errorf("expected only project 2, got %#v", projects)
+	}
+
+	p, err := c.GetProject(ctx, 3)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if p.ID != 3 || p.Name != "prj3" {
+		t.Errorf("expected project 3, got %#v", p)
+	}
+}
+
+func TestClientIteratorsFetchAllPages(t *testing.T) {
+	srv, c, _ := setupClientTestServer(t, "viewer")
+	defer srv.Close()
+	ctx := context.Background()
+
+	ids := []uint32{}
+	it := c.Subprojects(3)
+	for it.Next(ctx) {
+		ids = append(ids, it.Subproject().ID)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(ids) != 4 || ids[0] != 1 || ids[3] != 4 {
+		t.Errorf("expected subprojects 1-4, got %v", ids)
+	}
+
+	branches := []string{}
+	bit := c.Branches(2, 1)
+	for bit.Next(ctx) {
+		branches = append(branches, bit.Branch())
+	}
+	if err := bit.Err(); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(branches) != 3 || branches[0] != "alpha" || branches[2] != "master" {
+		t.Errorf("expected sorted branches, got %v", branches)
+	}
+}
+
+func TestClientCanCreateResourceHierarchy(t *testing.T) {
+	srv, c, env := setupClientTestServer(t, "operator")
+	defer srv.Close()
+	ctx := context.Background()
+
+	prjID, err := c.CreateProject(ctx, "prj4", "project 4")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	spID, err := c.CreateSubproject(ctx, prjID, "subprj5", "subproject 5")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	repoID, err := c.CreateRepo(ctx, spID, "repo5", "https://example.com/repo5.git")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if err = c.CreateBranch(ctx, repoID, "main"); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	pullID, err := c.StartRepoPull(ctx, repoID, "main", &client.RepoPullRequest{Commit: "abcdef012345abcdef012345abcdef0123451234"})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	jobID, err := c.CreateJob(ctx, pullID, &client.JobRequest{AgentID: 4})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if err = c.SetJobReady(ctx, jobID, true); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// and verify state of database now
+	job, err := env.db.GetJobByID(jobID)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if job.RepoPullID != pullID || !job.IsReady {
+		t.Errorf("expected ready job for repo pull %d, got %#v", pullID, job)
+	}
+	pulls, err := c.ListRepoPulls(ctx, repoID, "main", nil)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(pulls) != 1 || pulls[0].ID != pullID {
+		t.Errorf("expected only pull %d, got %#v", pullID, pulls)
+	}
+}
+
+func TestClientCanUseBranchWithSlash(t *testing.T) {
+	srv, c, _ := setupClientTestServer(t, "operator")
+	defer srv.Close()
+	ctx := context.Background()
+
+	if err := c.CreateBranch(ctx, 4, "feature/foo"); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	pullID, err := c.StartRepoPull(ctx, 4, "feature/foo", &client.RepoPullRequest{Commit: "abcdef012345abcdef012345abcdef0123451234"})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	pulls, err := c.ListRepoPulls(ctx, 4, "feature/foo", nil)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(pulls) != 1 || pulls[0].ID != pullID || pulls[0].Branch != "feature/foo" {
+		t.Errorf("unexpected pulls: %#v", pulls)
+	}
+}
+
+func TestClientCanUpdateAndDeleteAgent(t *testing.T) {
+	srv, c, env := setupClientTestServer(t, "admin")
+	defer srv.Close()
+	ctx := context.Background()
+
+	err := c.UpdateAgent(ctx, 1, &client.AgentUpdate{Port: client.Int(9999)})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	a, err := c.GetAgent(ctx, 1)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if a.Port != 9999 {
+		t.Errorf("expected %d, got %d", 9999, a.Port)
+	}
+
+	if err = c.DeleteAgent(ctx, 1); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if _, err = env.db.GetAgentByID(1); err == nil {
+		t.Errorf("expected non-nil error, got nil")
+	}
+}
+
+func TestClientCanDeleteAndRestoreRepo(t *testing.T) {
+	srv, c, _ := setupClientTestServer(t, "admin")
+	defer srv.Close()
+	ctx := context.Background()
+
+	if err := c.DeleteSubproject(ctx, 4); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	// repos in a subproject in the trash are hidden too
+	if _, err := c.GetRepo(ctx, 2); !client.IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	if err := c.RestoreSubproject(ctx, 4); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	repo, err := c.GetRepo(ctx, 2)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if repo.Name != "repo2" {
+		t.Errorf("expected %s, got %s", "repo2", repo.Name)
+	}
+}
+
+func TestClientCanSearch(t *testing.T) {
+	srv, c, _ := setupClientTestServer(t, "viewer")
+	defer srv.Close()
+	ctx := context.Background()
+
+	results, err := c.Search(ctx, "https://example.com/repo3", []string{"repo"}, &client.ListOptions{Limit: 1})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+	if results[0].ID != 3 || results[0].ProjectID != 1 || results[0].Score != 100 {
+		t.Errorf("expected repo 3 in project 1 with score 100, got %#v", results[0])
+	}
+}
+
+func TestClientCanFindRepoPulls(t *testing.T) {
+	srv, c, _ := setupClientTestServer(t, "viewer")
+	defer srv.Close()
+	ctx := context.Background()
+
+	pulls, err := c.FindRepoPulls(ctx, &client.RepoPullFilter{SubprojectID: 4, Healths: []string{"error", "degraded"}, Recent: true}, nil)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(pulls) != 3 || pulls[0].ID != 3 || pulls[1].ID != 2 || pulls[2].ID != 1 {
+		t.Errorf("expected repo pulls 3, 2 and 1, got %#v", pulls)
+	}
+}
+
+func TestClientCanGetLatestRepoPulls(t *testing.T) {
+	srv, c, env := setupClientTestServer(t, "viewer")
+	defer srv.Close()
+	ctx := context.Background()
+	stopRepoPull2Jobs(t, env)
+
+	summaries, err := c.ListBranchSummaries(ctx, 2, nil)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(summaries) != 3 || summaries[2].Branch != "master" || summaries[2].Pulls != 2 || summaries[2].Latest == nil || summaries[2].Latest.ID != 2 {
+		t.Errorf("expected master with 2 pulls, latest 2; got %#v", summaries)
+	}
+
+	rp, err := c.GetLatestRepoPull(ctx, 2, "master", true)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if rp.ID != 2 {
+		t.Errorf("expected repo pull 2, got %d", rp.ID)
+	}
+}
+
+func TestClientCanCompareRepoPulls(t *testing.T) {
+	srv, c, _ := setupClientTestServer(t, "viewer")
+	defer srv.Close()
+	ctx := context.Background()
+
+	cmp, err := c.CompareRepoPulls(ctx, 1, 2, &client.ListOptions{Limit: 1})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if cmp.Summary.Files.Modified != 1 || len(cmp.Files) != 1 || cmp.Files[0].Path != "src/main.go" || cmp.Files[0].To.SHA256 == "" {
+		t.Errorf("expected 1 modified file, listing src/main.go first; got %#v", cmp)
+	}
+	if cmp.Summary.Jobs.Added != 4 || cmp.Summary.Jobs.Changed != 1 || len(cmp.Jobs) != 5 || cmp.Jobs[0].To.ID != 5 {
+		t.Errorf("expected 4 added and 1 changed, listing job 5 first; got %#v", cmp)
+	}
+}
+
+func TestClientCanLabelAndSelectRepos(t *testing.T) {
+	srv, c, _ := setupClientTestServer(t, "operator")
+	defer srv.Close()
+	ctx := context.Background()
+
+	if err := c.SetLabels(ctx, client.LabelsRepo, 3, map[string]string{"team": "infra", "tier": "low"}); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	labels, err := c.UpdateLabels(ctx, client.LabelsRepo, 3, map[string]*string{"tier": nil})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(labels) != 1 || labels["team"] != "infra" {
+		t.Errorf("expected only team=infra, got %v", labels)
+	}
+
+	repos, err := c.ListRepos(ctx, &client.ListOptions{Label: "team=infra"})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(repos) != 1 || repos[0].ID != 3 {
+		t.Errorf("expected only repo 3, got %v", repos)
+	}
+}
+
+func TestClientReturnsTypedErrors(t *testing.T) {
+	srv, c, _ := setupClientTestServer(t, "commenter")
+	defer srv.Close()
+	ctx := context.Background()
+
+	_, err := c.CreateProject(ctx, "prj4", "project 4")
+	if !client.IsForbidden(err) {
+		t.Errorf("expected forbidden error, got %v", err)
+	}
+	if e, ok := err.(*client.Error); !ok || e.Message != ErrAuthAccess {
+		t.Errorf("expected %q, got %v", ErrAuthAccess, err)
+	}
+
+	c.SetToken("not-a-valid-token")
+	_, err = c.ListProjects(ctx, nil)
+	if !client.IsUnauthorized(err) {
+		t.Errorf("expected unauthorized error, got %v", err)
+	}
+	if e, ok := err.(*client.Error); !ok || e.Message != ErrAuthBearer {
+		t.Errorf("expected %q, got %v", ErrAuthBearer, err)
+	}
+}
+
+func TestClientUserAccessLevels(t *testing.T) {
+	srv, c, _ := setupClientTestServer(t, "admin")
+	defer srv.Close()
+	ctx := context.Background()
+
+	id, err := c.CreateUser(ctx, "Jane Doe", "janedoe", datastore.AccessOperator)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	u, err := c.GetUser(ctx, id)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if u.Github != "janedoe" || u.AccessLevel != datastore.AccessOperator {
+		t.Errorf("expected operator janedoe, got %#v", u)
+	}
+
+	err = c.UpdateUser(ctx, id, &client.UserUpdate{Name: client.String("Jane Q. Doe")})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	u, err = c.GetUser(ctx, id)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if u.Name != "Jane Q. Doe" {
+		t.Errorf("expected %s, got %s", "Jane Q. Doe", u.Name)
+	}
+}
@@ -0,0 +1,144 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// commitIDRegexp matches a full SHA-1 or SHA-256 commit ID.
+var commitIDRegexp = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// checkCommitID returns an error saying what is wrong if id is not a
+// full SHA-1 (40 character) or SHA-256 (64 character) commit ID in
+// lower-case hex.
+func checkCommitID(id string) error {
+	if !commitIDRegexp.MatchString(id) {
+		return fmt.Errorf("must be a full 40- or 64-character hex commit ID")
+	}
+	return nil
+}
+
+// Reasons that a commit cannot be pulled from a local repository.
+var (
+	errUnknownBranch     = errors.New("unknown branch")
+	errUnknownCommit     = errors.New("unknown commit")
+	errCommitNotOnBranch = errors.New("commit is not on branch")
+)
+
+// runGit runs git with the given arguments, and returns its output
+// and exit code. The error is only set if git could not be run or
+// was stopped.
+func runGit(ctx context.Context, args ...string) ([]byte, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, lsRemoteTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", args...)
+	// never prompt for credentials
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+		return out, exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return nil, -1, fmt.Errorf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, 0, nil
+}
+
+// lsRemoteRefs lists the branches and tags of the repository at
+// address by running `git ls-remote --heads --tags`, as a map from
+// each ref to its commit. An annotated tag maps to the commit that
+// it tags, not to the tag object.
+func lsRemoteRefs(ctx context.Context, address string) (map[string]string, error) {
+	out, code, err := runGit(ctx, "ls-remote", "--heads", "--tags", "--", address)
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("git ls-remote exited with code %d", code)
+	}
+
+	refs := map[string]string{}
+	peeled := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// each line is "<commit>\t<ref>", with "<ref>^{}" for the
+		// commit that an annotated tag points to
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if ref := strings.TrimSuffix(fields[1], "^{}"); ref != fields[1] {
+			peeled[ref] = fields[0]
+		} else {
+			refs[ref] = fields[0]
+		}
+	}
+	for ref, commit := range peeled {
+		refs[ref] = commit
+	}
+	return refs, scanner.Err()
+}
+
+// localRepoPath returns the directory of a repository on the API
+// server's own file system, given its address as a file URL naming
+// a directory within root. It returns false for other addresses,
+// and for every address if root is empty.
+func localRepoPath(root string, address string) (string, bool) {
+	if root == "" || !strings.HasPrefix(address, "file://") {
+		return "", false
+	}
+	u, err := url.Parse(address)
+	if err != nil || (u.Host != "" && u.Host != "localhost") {
+		return "", false
+	}
+	dir := filepath.Clean(filepath.FromSlash(u.Path))
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return dir, true
+}
+
+// gitCommitOnBranch checks that commit is on branch, in the git
+// repository in dir: that it is the head of the branch or one of its
+// ancestors. It returns errUnknownBranch, errUnknownCommit or
+// errCommitNotOnBranch if not, or another error if the repository
+// could not be checked.
+func gitCommitOnBranch(ctx context.Context, dir string, branch string, commit string) error {
+	head := "refs/heads/" + branch
+	checks := []struct {
+		args    []string
+		failure error
+	}{
+		{[]string{"rev-parse", "--verify", "--quiet", head + "^{commit}"}, errUnknownBranch},
+		{[]string{"rev-parse", "--verify", "--quiet", commit + "^{commit}"}, errUnknownCommit},
+		{[]string{"merge-base", "--is-ancestor", commit, head}, errCommitNotOnBranch},
+	}
+	for _, c := range checks {
+		// each exits with 1 if the check fails, and something else
+		// if it could not be made, e.g. if dir is not a repository
+		_, code, err := runGit(ctx, append([]string{"-C", dir}, c.args...)...)
+		switch {
+		case err != nil:
+			return err
+		case code == 1:
+			return c.failure
+		case code != 0:
+			return fmt.Errorf("git %s exited with code %d", c.args[0], code)
+		}
+	}
+	return nil
+}
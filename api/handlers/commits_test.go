@@ -0,0 +1,149 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// makeTestGitRepo creates a git repository with a commit on branch
+// main, tagged v1.0 (an annotated tag), and a later commit only on
+// branch topic. It returns the repository's directory and the two
+// commits.
+func makeTestGitRepo(t *testing.T) (string, string, string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "peridot-commits")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	git := func(args ...string) string {
+		args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %v failed: %v", args, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	git("symbolic-ref", "HEAD", "refs/heads/main")
+	git("commit", "-q", "--allow-empty", "-m", "initial")
+	git("tag", "-a", "-m", "release", "v1.0")
+	mainCommit := git("rev-parse", "HEAD")
+	git("checkout", "-q", "-b", "topic")
+	git("commit", "-q", "--allow-empty", "-m", "topic")
+	topicCommit := git("rev-parse", "HEAD")
+	return dir, mainCommit, topicCommit
+}
+
+func TestCheckCommitID(t *testing.T) {
+	cases := map[string]bool{
+		"123490ab56123490ab56123490ab56123490ab56":                         true,
+		"123490ab56123490ab56123490ab56123490ab56123490ab56123490ab561234": true,
+		"123490ab": false,
+		"123490ab56123490ab56123490ab56123490ab5":  false,
+		"123490AB56123490AB56123490AB56123490AB56": false,
+		"g23490ab56123490ab56123490ab56123490ab56": false,
+		"master": false,
+	}
+	for id, wanted := range cases {
+		if got := checkCommitID(id) == nil; got != wanted {
+			t.Errorf("%s: expected %v, got %v", id, wanted, got)
+		}
+	}
+}
+
+func TestLocalRepoPath(t *testing.T) {
+	cases := []struct {
+		root    string
+		address string
+		dir     string
+		ok      bool
+	}{
+		{"/srv/git", "file:///srv/git/x.git", "/srv/git/x.git", true},
+		{"/srv/git", "file://localhost/srv/git/a/x", "/srv/git/a/x", true},
+		{"/srv/git", "file:///srv/git", "/srv/git", true},
+		{"/srv/git", "file:///srv/other/x", "", false},
+		{"/srv/git", "file:///srv/git/../other/x", "", false},
+		{"/srv/git", "file:///srv/gitx/x", "", false},
+		{"/srv/git", "/srv/git/x", "", false},
+		{"/srv/git", "file://example.com/srv/git/x", "", false},
+		{"/srv/git", "https://example.com/x.git", "", false},
+		{"/srv/git", "git@example.com:x.git", "", false},
+		{"", "file:///srv/git/x.git", "", false},
+	}
+	for _, tc := range cases {
+		dir, ok := localRepoPath(tc.root, tc.address)
+		if dir != tc.dir || ok != tc.ok {
+			t.Errorf("%s in %q: expected %q, %v, got %q, %v", tc.address, tc.root, tc.dir, tc.ok, dir, ok)
+		}
+	}
+}
+
+func TestCanListRemoteRefsWithGit(t *testing.T) {
+	dir, mainCommit, topicCommit := makeTestGitRepo(t)
+	defer os.RemoveAll(dir)
+
+	refs, err := lsRemoteRefs(context.Background(), "file://"+dir)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	wanted := map[string]string{
+		"refs/heads/main":  mainCommit,
+		"refs/heads/topic": topicCommit,
+		// the annotated tag's commit, not the tag object
+		"refs/tags/v1.0": mainCommit,
+	}
+	if len(refs) != len(wanted) {
+		t.Errorf("expected %v, got %v", wanted, refs)
+	}
+	for ref, commit := range wanted {
+		if refs[ref] != commit {
+			t.Errorf("%s: expected %s, got %s", ref, commit, refs[ref])
+		}
+	}
+}
+
+func TestCanCheckCommitOnBranchWithGit(t *testing.T) {
+	dir, mainCommit, topicCommit := makeTestGitRepo(t)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	cases := []struct {
+		branch string
+		commit string
+		wanted error
+	}{
+		{"main", mainCommit, nil},
+		{"topic", mainCommit, nil},
+		{"topic", topicCommit, nil},
+		{"main", topicCommit, errCommitNotOnBranch},
+		{"main", "123490ab56123490ab56123490ab56123490ab56", errUnknownCommit},
+		{"nope", mainCommit, errUnknownBranch},
+	}
+	for _, tc := range cases {
+		if err := gitCommitOnBranch(ctx, dir, tc.branch, tc.commit); err != tc.wanted {
+			t.Errorf("%s on %s: expected %v, got %v", tc.commit, tc.branch, tc.wanted, err)
+		}
+	}
+
+	// and a directory that is not a repository can't be checked
+	notRepo, err := ioutil.TempDir("", "peridot-commits")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	defer os.RemoveAll(notRepo)
+	err = gitCommitOnBranch(ctx, notRepo, "main", mainCommit)
+	if err == nil || err == errUnknownBranch {
+		t.Errorf("expected git error, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// computeETag returns a strong entity tag for the given resource.
+// The datastore does not keep a version counter for its rows, so
+// the tag is derived from a hash of the resource's JSON
+// representation: any change to a stored value yields a new tag.
+func computeETag(resource interface{}) (string, error) {
+	js, err := json.Marshal(resource)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(js)
+	return `"` + hex.EncodeToString(sum[:]) + `"`, nil
+}
+
+// etagMatches reports whether etag appears in the list of entity
+// tags in an If-Match or If-None-Match header value. "*" matches
+// any current tag. If weak is true, a "W/" prefix on the listed
+// tags is ignored, per the weak comparison rules of RFC 7232.
+func etagMatches(header string, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeETag sets the ETag header for a GET of the given resource.
+// If the request's If-None-Match header matches the current tag,
+// it also writes a 304 Not Modified response and returns true, in
+// which case the caller must not write a body.
+func writeETag(w http.ResponseWriter, r *http.Request, resource interface{}) bool {
+	etag, err := computeETag(resource)
+	if err != nil {
+		// no tag; the caller will just send the full response
+		return false
+	}
+	w.Header().Set("ETag", etag)
+
+	inm := r.Header.Get("If-None-Match")
+	if inm != "" && etagMatches(inm, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// checkIfMatch confirms that a PUT or DELETE request's If-Match
+// header, if any, matches the current version of the resource. A
+// nil resource means it does not currently exist, which never
+// matches. On mismatch it writes a 412 Precondition Failed
+// response and returns false; requests without If-Match always
+// pass.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, resource interface{}) bool {
+	im := r.Header.Get("If-Match")
+	if im == "" {
+		return true
+	}
+
+	if resource != nil {
+		etag, err := computeETag(resource)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"error": "Unable to compute ETag"}`)
+			return false
+		}
+		if etagMatches(im, etag, false) {
+			return true
+		}
+	}
+
+	w.WriteHeader(http.StatusPreconditionFailed)
+	fmt.Fprintf(w, `{"error": "Precondition failed; resource has been modified"}`)
+	return false
+}
@@ -3,13 +3,21 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 
 	"golang.org/x/oauth2"
 	githuboauth "golang.org/x/oauth2/github"
 
 	"github.com/swinslow/peridot-db/pkg/datastore"
+
+	"github.com/swinslow/peridot-api/internal/auth"
 )
 
 // Env is the environment for the web handlers.
@@ -18,6 +26,70 @@ type Env struct {
 	jwtSecretKey string
 	oauthConf    *oauth2.Config
 	oauthState   string
+
+	// batchMu ensures that only one batch request runs at a time.
+	// It is a pointer so that a batch can run its operations with a
+	// copy of the Env (see batchEnv).
+	batchMu *sync.Mutex
+
+	// idempotency holds recent responses to POST requests that
+	// were sent with an Idempotency-Key header.
+	idempotency *idempotencyStore
+
+	// events passes along events about peridot resources, and
+	// watcher notices changes made outside the API so that they
+	// can be published too.
+	events        *eventBus
+	watcher       *watcher
+	watchInterval time.Duration
+
+	// webhooks holds webhook subscriptions and delivery logs.
+	webhooks *webhookStore
+
+	// changes records every event, for /changes.
+	changes *changeLog
+
+	// githubAPIURL and githubToken are used to list repositories
+	// when importing them from Github.
+	githubAPIURL string
+	githubToken  string
+
+	// tracking holds each repo's branch tracking rules, and
+	// lsRemote lists a remote repository's branches when syncing
+	// them.
+	tracking *trackingStore
+	lsRemote func(ctx context.Context, address string) ([]string, error)
+
+	// lsRefs lists a remote repository's branches and tags, to
+	// resolve one to a commit when creating a repo pull, and
+	// commitOnBranch checks that a commit is on a branch of a
+	// repository on the API server's own file system.
+	// localRepoRoot is the directory that such repositories must be
+	// within; if empty, none are.
+	lsRefs         func(ctx context.Context, address string) (map[string]string, error)
+	commitOnBranch func(ctx context.Context, dir string, branch string, commit string) error
+	localRepoRoot  string
+
+	// trash records the projects, subprojects and repos that have
+	// been deleted but not yet purged.
+	trash *trashStore
+
+	// labels holds the labels on projects, subprojects and repos.
+	labels *labelStore
+
+	// cliLogins holds the logins started by command-line clients,
+	// and validateGithub checks the code that GitHub sends back to
+	// finish a login.
+	cliLogins      *cliLoginStore
+	validateGithub func(r *http.Request, oauthConf *oauth2.Config, oauthState string) (string, error)
+
+	// locks serializes requests that check and then change the same
+	// resource.
+	locks *resourceLocks
+
+	// deleteConfirmThreshold is how many other resources a deletion
+	// may remove or change before it must be confirmed.
+	deleteConfirmThreshold int
 }
 
 // SetupEnv sets up systems (such as the data store) and variables
@@ -54,6 +126,99 @@ func SetupEnv() (*Env, error) {
 		return nil, fmt.Errorf("No OAuth state string found; set environment variable OAUTHSTATE before starting")
 	}
 
+	// set up replay window for idempotency keys (from environment),
+	// defaulting to 24 hours
+	idempotencyWindow := defaultIdempotencyWindow
+	if IDEMPOTENCYWINDOW := os.Getenv("IDEMPOTENCYWINDOW"); IDEMPOTENCYWINDOW != "" {
+		idempotencyWindow, err = time.ParseDuration(IDEMPOTENCYWINDOW)
+		if err != nil || idempotencyWindow <= 0 {
+			return nil, fmt.Errorf("Invalid IDEMPOTENCYWINDOW %q; must be a positive duration such as \"24h\"", IDEMPOTENCYWINDOW)
+		}
+	}
+
+	// set up how often to check for changes made outside the API
+	// (from environment), defaulting to 10 seconds
+	watchInterval := defaultWatchInterval
+	if WATCHINTERVAL := os.Getenv("WATCHINTERVAL"); WATCHINTERVAL != "" {
+		watchInterval, err = time.ParseDuration(WATCHINTERVAL)
+		if err != nil || watchInterval <= 0 {
+			return nil, fmt.Errorf("Invalid WATCHINTERVAL %q; must be a positive duration such as \"10s\"", WATCHINTERVAL)
+		}
+	}
+
+	// set up how long deleted resources are kept in the trash
+	// (from environment), defaulting to 30 days
+	trashRetention := defaultTrashRetention
+	if TRASHRETENTION := os.Getenv("TRASHRETENTION"); TRASHRETENTION != "" {
+		trashRetention, err = time.ParseDuration(TRASHRETENTION)
+		if err != nil || trashRetention <= 0 {
+			return nil, fmt.Errorf("Invalid TRASHRETENTION %q; must be a positive duration such as \"720h\"", TRASHRETENTION)
+		}
+	}
+
+	// set up how many other resources a deletion may remove or
+	// change before it must be confirmed (from environment),
+	// defaulting to 50
+	deleteConfirmThreshold := defaultDeleteConfirmThreshold
+	if DELETECONFIRMTHRESHOLD := os.Getenv("DELETECONFIRMTHRESHOLD"); DELETECONFIRMTHRESHOLD != "" {
+		deleteConfirmThreshold, err = strconv.Atoi(DELETECONFIRMTHRESHOLD)
+		if err != nil || deleteConfirmThreshold < 0 {
+			return nil, fmt.Errorf("Invalid DELETECONFIRMTHRESHOLD %q; must be a number zero or greater", DELETECONFIRMTHRESHOLD)
+		}
+	}
+
+	// set up directory for saving API server state, such as
+	// webhooks and the trash (from environment); it is created if
+	// needed, so that the state is never kept only in memory
+	APISTATEDIR := os.Getenv("APISTATEDIR")
+	if APISTATEDIR == "" {
+		APISTATEDIR = defaultStateDir
+	}
+	if err := os.MkdirAll(APISTATEDIR, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create APISTATEDIR: %v", err)
+	}
+	webhooks, err := newWebhookStore(APISTATEDIR)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load webhooks from APISTATEDIR: %v", err)
+	}
+	changes, err := newChangeLog(APISTATEDIR)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load changes from APISTATEDIR: %v", err)
+	}
+	tracking, err := newTrackingStore(APISTATEDIR)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load tracking rules from APISTATEDIR: %v", err)
+	}
+	trash, err := newTrashStore(APISTATEDIR, trashRetention)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load trash from APISTATEDIR: %v", err)
+	}
+	labels, err := newLabelStore(APISTATEDIR)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load labels from APISTATEDIR: %v", err)
+	}
+
+	// set up access to the Github API for importing repos (from
+	// environment); both are optional, defaulting to api.github.com
+	// without a token
+	GITHUBAPIURL := os.Getenv("GITHUBAPIURL")
+	GITHUBTOKEN := os.Getenv("GITHUBTOKEN")
+
+	// set up directory that repos with file:/// addresses must be
+	// within to be used from the API server (from environment);
+	// optional, as without it no such repos are
+	LOCALREPOROOT := os.Getenv("LOCALREPOROOT")
+	if LOCALREPOROOT != "" {
+		if !filepath.IsAbs(LOCALREPOROOT) {
+			return nil, fmt.Errorf("Invalid LOCALREPOROOT %q; must be an absolute path", LOCALREPOROOT)
+		}
+		LOCALREPOROOT = filepath.Clean(LOCALREPOROOT)
+	}
+
+	// event sequence numbers carry on from the last saved change
+	events := newEventBus()
+	events.seq = changes.lastSeq()
+
 	oauthConf := &oauth2.Config{
 		ClientID:     GITHUBCLIENTID,
 		ClientSecret: GITHUBCLIENTSECRET,
@@ -62,10 +227,36 @@ func SetupEnv() (*Env, error) {
 	}
 
 	env := &Env{
-		db:           db,
-		jwtSecretKey: JWTSECRETKEY,
-		oauthConf:    oauthConf,
-		oauthState:   OAUTHSTATE,
+		db:             db,
+		batchMu:        &sync.Mutex{},
+		jwtSecretKey:   JWTSECRETKEY,
+		oauthConf:      oauthConf,
+		oauthState:     OAUTHSTATE,
+		idempotency:    newIdempotencyStore(idempotencyWindow),
+		events:         events,
+		watcher:        newWatcher(),
+		watchInterval:  watchInterval,
+		webhooks:       webhooks,
+		changes:        changes,
+		githubAPIURL:   GITHUBAPIURL,
+		githubToken:    GITHUBTOKEN,
+		tracking:       tracking,
+		lsRemote:       lsRemoteBranches,
+		lsRefs:         lsRemoteRefs,
+		commitOnBranch: gitCommitOnBranch,
+		localRepoRoot:  LOCALREPOROOT,
+		trash:          trash,
+		labels:         labels,
+		locks:          newResourceLocks(),
+		cliLogins:      newCLILoginStore(),
+		validateGithub: auth.ValidateGithub,
+
+		deleteConfirmThreshold: deleteConfirmThreshold,
 	}
+	env.events.subscribe(env.webhooks.handleEvent)
+	env.events.subscribe(env.changes.record)
+	env.events.subscribe(env.tracking.handleEvent)
+	env.events.subscribe(env.trash.handleEvent)
+	env.events.subscribe(env.labels.handleEvent)
 	return env, nil
 }
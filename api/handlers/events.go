@@ -0,0 +1,202 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types that are published on the event bus. Every change
+// to a peridot resource is published as an event, named for the
+// resource and what happened to it.
+const (
+	EventProjectCreated = "project.created"
+	EventProjectUpdated = "project.updated"
+	EventProjectDeleted = "project.deleted"
+	// EventProjectTrashed is published when a project is moved to
+	// the trash, and EventProjectRestored when it is restored;
+	// likewise for subprojects and repos.
+	EventProjectTrashed  = "project.trashed"
+	EventProjectRestored = "project.restored"
+
+	EventSubprojectCreated  = "subproject.created"
+	EventSubprojectUpdated  = "subproject.updated"
+	EventSubprojectDeleted  = "subproject.deleted"
+	EventSubprojectTrashed  = "subproject.trashed"
+	EventSubprojectRestored = "subproject.restored"
+
+	EventRepoCreated  = "repo.created"
+	EventRepoUpdated  = "repo.updated"
+	EventRepoDeleted  = "repo.deleted"
+	EventRepoTrashed  = "repo.trashed"
+	EventRepoRestored = "repo.restored"
+
+	EventBranchCreated = "branch.created"
+	EventBranchDeleted = "branch.deleted"
+
+	EventRepoPullCreated = "repopull.created"
+	// EventRepoPullStatusChanged is published when a repo pull's
+	// status or health changes.
+	EventRepoPullStatusChanged = "repopull.status_changed"
+	EventRepoPullDeleted       = "repopull.deleted"
+
+	EventJobCreated = "job.created"
+	// EventJobUpdated is published when a job is changed through
+	// the API, i.e. when it is marked as ready.
+	EventJobUpdated = "job.updated"
+	// EventJobStatusChanged is published when a job's status or
+	// health changes.
+	EventJobStatusChanged = "job.status_changed"
+	EventJobDeleted       = "job.deleted"
+
+	EventAgentCreated = "agent.created"
+	EventAgentUpdated = "agent.updated"
+	// EventAgentInactive is published when an agent goes from
+	// active to inactive.
+	EventAgentInactive = "agent.inactive"
+	EventAgentDeleted  = "agent.deleted"
+
+	EventUserCreated = "user.created"
+	EventUserUpdated = "user.updated"
+
+	// EventDatabaseReset is published when an admin resets the
+	// database, removing everything in it.
+	EventDatabaseReset = "database.reset"
+)
+
+// eventTypes lists the known event types.
+var eventTypes = []string{
+	EventProjectCreated,
+	EventProjectUpdated,
+	EventProjectDeleted,
+	EventProjectTrashed,
+	EventProjectRestored,
+	EventSubprojectCreated,
+	EventSubprojectUpdated,
+	EventSubprojectDeleted,
+	EventSubprojectTrashed,
+	EventSubprojectRestored,
+	EventRepoCreated,
+	EventRepoUpdated,
+	EventRepoDeleted,
+	EventRepoTrashed,
+	EventRepoRestored,
+	EventBranchCreated,
+	EventBranchDeleted,
+	EventRepoPullCreated,
+	EventRepoPullStatusChanged,
+	EventRepoPullDeleted,
+	EventJobCreated,
+	EventJobUpdated,
+	EventJobStatusChanged,
+	EventJobDeleted,
+	EventAgentCreated,
+	EventAgentUpdated,
+	EventAgentInactive,
+	EventAgentDeleted,
+	EventUserCreated,
+	EventUserUpdated,
+	EventDatabaseReset,
+}
+
+// isEventType reports whether s is a known event type.
+func isEventType(s string) bool {
+	for _, t := range eventTypes {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+// event is something that happened to a peridot resource, which
+// is passed along to webhooks and other subscribers.
+type event struct {
+	// Seq is assigned by the event bus, and increases by one
+	// with each event published.
+	Seq  uint64      `json:"seq"`
+	Type string      `json:"event"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// eventHistorySize is how many recent events the event bus
+// keeps, so that subscribers can catch up on what they missed.
+const eventHistorySize = 1000
+
+// eventBus passes events along to its subscribers, in the order
+// they were published.
+type eventBus struct {
+	mu     sync.Mutex
+	seq    uint64
+	nextID int
+	subs   map[int]func(*event)
+	// history holds the most recent events, oldest first
+	history []*event
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: map[int]func(*event){}}
+}
+
+// subscribe registers fn to be called with each event, and returns
+// a function that cancels the subscription. fn is called while the
+// bus is locked, so that events arrive in order; it must not block
+// or publish events itself.
+func (b *eventBus) subscribe(fn func(*event)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subscribeLocked(fn)
+}
+
+// subscribeLocked does the work of subscribe. The caller must hold
+// b.mu.
+func (b *eventBus) subscribeLocked(fn func(*event)) func() {
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = fn
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs, id)
+	}
+}
+
+// publish creates an event with the given type and data, and
+// passes it to each subscriber.
+func (b *eventBus) publish(eventType string, data interface{}) *event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	ev := &event{Seq: b.seq, Type: eventType, Time: time.Now().UTC(), Data: data}
+	b.history = append(b.history, ev)
+	if len(b.history) > eventHistorySize {
+		b.history = b.history[len(b.history)-eventHistorySize:]
+	}
+	for _, fn := range b.subs {
+		fn(ev)
+	}
+	return ev
+}
+
+// subscribeSince is like subscribe, but first calls fn with each
+// event in the history that came after seq. It also reports
+// whether the history went back far enough to include all of them;
+// if not (or if seq is from before the server restarted), some
+// events have been missed.
+func (b *eventBus) subscribeSince(seq uint64, fn func(*event)) (func(), bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	complete := seq == b.seq
+	for _, ev := range b.history {
+		if ev.Seq <= seq {
+			continue
+		}
+		if ev.Seq == seq+1 {
+			complete = true
+		}
+		fn(ev)
+	}
+	return b.subscribeLocked(fn), complete
+}
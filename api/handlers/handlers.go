@@ -6,9 +6,20 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// branchPattern is the route pattern for a branch name within a
+// repo's endpoints. Branch names may contain "/", which must be sent
+// as "%2F"; see extractBranch. Whether a name is a valid branch name
+// is checked by checkBranchName.
+const branchPattern = `[^/]+`
+
 // RegisterHandlers registers the api handler endpoints with the
-// specified router, for the given environment.
+// specified router, for the given environment. Endpoints that
+// accept POST are wrapped so that they honor Idempotency-Key.
+// It also sets the router to match on the encoded path, so that
+// branch names containing "/" can be used.
 func (env *Env) RegisterHandlers(router *mux.Router) {
+	router.UseEncodedPath()
+
 	// /hello -- ping and hello
 	router.HandleFunc("/hello", env.helloHandler).Methods("GET")
 
@@ -17,42 +28,95 @@ func (env *Env) RegisterHandlers(router *mux.Router) {
 	router.HandleFunc("/auth/redirect", env.authGithubCallbackHandler).Methods("GET")
 
 	// /admin -- administrative actions
-	router.HandleFunc("/admin/db", env.validateTokenMiddleware(env.adminDBHandler)).Methods("POST")
+	router.HandleFunc("/admin/db", env.validateTokenMiddleware(env.idempotencyMiddleware(env.adminDBHandler))).Methods("POST")
+	router.HandleFunc("/admin/webhooks", env.validateTokenMiddleware(env.idempotencyMiddleware(env.adminWebhooksHandler))).Methods("GET", "POST")
+	router.HandleFunc("/admin/webhooks/{id:[0-9]+}", env.validateTokenMiddleware(env.adminWebhooksOneHandler)).Methods("GET", "PUT", "DELETE")
+	router.HandleFunc("/admin/webhooks/{id:[0-9]+}/deliveries", env.validateTokenMiddleware(env.adminWebhookDeliveriesHandler)).Methods("GET")
+	router.HandleFunc("/admin/webhooks/{id:[0-9]+}/deliveries/{delivery:[0-9]+}/redeliver", env.validateTokenMiddleware(env.idempotencyMiddleware(env.adminWebhookRedeliverHandler))).Methods("POST")
 
 	// /users -- user data
-	router.HandleFunc("/users", env.validateTokenMiddleware(env.usersHandler)).Methods("GET", "POST")
-	router.HandleFunc("/users/{id:[0-9]+}", env.validateTokenMiddleware(env.usersOneHandler)).Methods("GET", "PUT")
+	router.HandleFunc("/users", env.validateTokenMiddleware(env.idempotencyMiddleware(env.usersHandler))).Methods("GET", "POST")
+	router.HandleFunc("/users/{id:[0-9]+}", env.validateTokenMiddleware(env.usersOneHandler)).Methods("GET", "PUT", "PATCH")
 
 	// /projects -- project data
-	router.HandleFunc("/projects", env.validateTokenMiddleware(env.projectsHandler)).Methods("GET", "POST")
-	router.HandleFunc("/projects/{id:[0-9]+}", env.validateTokenMiddleware(env.projectsOneHandler)).Methods("GET", "PUT", "DELETE")
+	router.HandleFunc("/projects", env.validateTokenMiddleware(env.idempotencyMiddleware(env.projectsHandler))).Methods("GET", "POST")
+	router.HandleFunc("/projects/{id:[0-9]+}", env.validateTokenMiddleware(env.hideTrashed(resourceProject, env.projectsOneHandler))).Methods("GET", "PUT", "PATCH", "DELETE")
 	// and subprojects within a project
-	router.HandleFunc("/projects/{id:[0-9]+}/subprojects", env.validateTokenMiddleware(env.subprojectsSubHandler)).Methods("GET", "POST")
+	router.HandleFunc("/projects/{id:[0-9]+}/subprojects", env.validateTokenMiddleware(env.hideTrashed(resourceProject, env.idempotencyMiddleware(env.subprojectsSubHandler)))).Methods("GET", "POST")
+	// and the whole hierarchy below a project
+	router.HandleFunc("/projects/{id:[0-9]+}/tree", env.validateTokenMiddleware(env.hideTrashed(resourceProject, env.projectTreeHandler))).Methods("GET")
+	// and its manifest
+	router.HandleFunc("/projects/{id:[0-9]+}/manifest", env.validateTokenMiddleware(env.hideTrashed(resourceProject, env.projectManifestHandler))).Methods("GET")
+	// and its labels
+	router.HandleFunc("/projects/{id:[0-9]+}/labels", env.validateTokenMiddleware(env.hideTrashed(resourceProject, env.projectLabelsHandler))).Methods("GET", "PUT", "PATCH")
+	// and restoring it from the trash
+	router.HandleFunc("/projects/{id:[0-9]+}/restore", env.validateTokenMiddleware(env.idempotencyMiddleware(env.projectsRestoreHandler))).Methods("POST")
+
+	// /manifests -- declarative project definitions
+	router.HandleFunc("/manifests/apply", env.validateTokenMiddleware(env.idempotencyMiddleware(env.manifestsApplyHandler))).Methods("POST")
 
 	// /subprojects -- subproject data
-	router.HandleFunc("/subprojects", env.validateTokenMiddleware(env.subprojectsHandler)).Methods("GET", "POST")
-	router.HandleFunc("/subprojects/{id:[0-9]+}", env.validateTokenMiddleware(env.subprojectsOneHandler)).Methods("GET", "PUT", "DELETE")
+	router.HandleFunc("/subprojects", env.validateTokenMiddleware(env.idempotencyMiddleware(env.subprojectsHandler))).Methods("GET", "POST")
+	router.HandleFunc("/subprojects/{id:[0-9]+}", env.validateTokenMiddleware(env.hideTrashed(resourceSubproject, env.subprojectsOneHandler))).Methods("GET", "PUT", "PATCH", "DELETE")
 	// and repos within a subproject
-	router.HandleFunc("/subprojects/{id:[0-9]+}/repos", env.validateTokenMiddleware(env.reposSubHandler)).Methods("GET", "POST")
+	router.HandleFunc("/subprojects/{id:[0-9]+}/repos", env.validateTokenMiddleware(env.hideTrashed(resourceSubproject, env.idempotencyMiddleware(env.reposSubHandler)))).Methods("GET", "POST")
+	// and importing repos from a Github organization or user
+	router.HandleFunc("/subprojects/{id:[0-9]+}/repos/github", env.validateTokenMiddleware(env.hideTrashed(resourceSubproject, env.idempotencyMiddleware(env.reposGithubImportHandler)))).Methods("POST")
+	// and its labels
+	router.HandleFunc("/subprojects/{id:[0-9]+}/labels", env.validateTokenMiddleware(env.hideTrashed(resourceSubproject, env.subprojectLabelsHandler))).Methods("GET", "PUT", "PATCH")
+	// and restoring it from the trash
+	router.HandleFunc("/subprojects/{id:[0-9]+}/restore", env.validateTokenMiddleware(env.idempotencyMiddleware(env.subprojectsRestoreHandler))).Methods("POST")
 
 	// /repos -- repo data
-	router.HandleFunc("/repos", env.validateTokenMiddleware(env.reposHandler)).Methods("GET", "POST")
-	router.HandleFunc("/repos/{id:[0-9]+}", env.validateTokenMiddleware(env.reposOneHandler)).Methods("GET", "PUT", "DELETE")
+	router.HandleFunc("/repos", env.validateTokenMiddleware(env.idempotencyMiddleware(env.reposHandler))).Methods("GET", "POST")
+	router.HandleFunc("/repos/{id:[0-9]+}", env.validateTokenMiddleware(env.hideTrashed(resourceRepo, env.reposOneHandler))).Methods("GET", "PUT", "PATCH", "DELETE")
 	// and a repo's branches
-	router.HandleFunc("/repos/{id:[0-9]+}/branches", env.validateTokenMiddleware(env.repoBranchesSubHandler)).Methods("GET", "POST")
-	// and a specific branch, to POST a new repo pull
-	// FIXME the pattern here does not sync with the various rules for branch naming in git
-	router.HandleFunc(`/repos/{id:[0-9]+}/branches/{branch:[0-9a-zA-Z_\-\.]+}`, env.validateTokenMiddleware(env.repoPullsSubHandler)).Methods("GET", "POST")
+	router.HandleFunc("/repos/{id:[0-9]+}/branches", env.validateTokenMiddleware(env.hideTrashed(resourceRepo, env.idempotencyMiddleware(env.repoBranchesSubHandler)))).Methods("GET", "POST")
+	// and a specific branch, to POST a new repo pull or DELETE it
+	router.HandleFunc("/repos/{id:[0-9]+}/branches/{branch:"+branchPattern+"}", env.validateTokenMiddleware(env.hideTrashed(resourceRepo, env.idempotencyMiddleware(env.repoPullsSubHandler)))).Methods("GET", "POST", "DELETE")
+	// and the latest pull of a branch
+	router.HandleFunc("/repos/{id:[0-9]+}/branches/{branch:"+branchPattern+"}/latest", env.validateTokenMiddleware(env.hideTrashed(resourceRepo, env.repoBranchLatestHandler))).Methods("GET")
+	// and its branch tracking rules
+	router.HandleFunc("/repos/{id:[0-9]+}/tracking", env.validateTokenMiddleware(env.hideTrashed(resourceRepo, env.repoTrackingHandler))).Methods("GET", "PUT", "DELETE")
+	router.HandleFunc("/repos/{id:[0-9]+}/tracking/sync", env.validateTokenMiddleware(env.hideTrashed(resourceRepo, env.idempotencyMiddleware(env.repoTrackingSyncHandler)))).Methods("POST")
+	// and its labels
+	router.HandleFunc("/repos/{id:[0-9]+}/labels", env.validateTokenMiddleware(env.hideTrashed(resourceRepo, env.repoLabelsHandler))).Methods("GET", "PUT", "PATCH")
+	// and restoring it from the trash
+	router.HandleFunc("/repos/{id:[0-9]+}/restore", env.validateTokenMiddleware(env.idempotencyMiddleware(env.reposRestoreHandler))).Methods("POST")
 
 	// /repopulls -- repo pull data
-	router.HandleFunc("/repopulls/{id:[0-9]+}", env.validateTokenMiddleware(env.repoPullsOneHandler)).Methods("GET", "DELETE")
+	router.HandleFunc("/repopulls", env.validateTokenMiddleware(env.repoPullsHandler)).Methods("GET")
+	router.HandleFunc("/repopulls/{id:[0-9]+}", env.validateTokenMiddleware(env.hideTrashed(resourceRepoPull, env.repoPullsOneHandler))).Methods("GET", "DELETE")
 	// and a repopull's jobs
-	router.HandleFunc("/repopulls/{id:[0-9]+}/jobs", env.validateTokenMiddleware(env.jobsSubHandler)).Methods("GET", "POST")
+	router.HandleFunc("/repopulls/{id:[0-9]+}/jobs", env.validateTokenMiddleware(env.hideTrashed(resourceRepoPull, env.idempotencyMiddleware(env.jobsSubHandler)))).Methods("GET", "POST")
+	// and what changed from it to another pull of the same repo
+	router.HandleFunc("/repopulls/{id:[0-9]+}/compare/{other:[0-9]+}", env.validateTokenMiddleware(env.hideTrashed(resourceRepoPull, env.repoPullsCompareHandler))).Methods("GET")
+	// and a stream of events for a repopull and its jobs
+	router.HandleFunc("/repopulls/{id:[0-9]+}/events", env.validateTokenMiddleware(env.hideTrashed(resourceRepoPull, env.repoPullEventsHandler))).Methods("GET")
+
+	// /trash -- deleted projects, subprojects and repos, until they
+	// are purged
+	router.HandleFunc("/trash", env.validateTokenMiddleware(env.trashHandler)).Methods("GET", "DELETE")
+	router.HandleFunc("/trash/{resource:projects|subprojects|repos}/{id:[0-9]+}", env.validateTokenMiddleware(env.trashOneHandler)).Methods("DELETE")
 
 	// /agents -- registered peridot agents
-	router.HandleFunc("/agents", env.validateTokenMiddleware(env.agentsHandler)).Methods("GET", "POST")
-	router.HandleFunc("/agents/{id:[0-9]+}", env.validateTokenMiddleware(env.agentsOneHandler)).Methods("GET", "PUT", "DELETE")
+	router.HandleFunc("/agents", env.validateTokenMiddleware(env.idempotencyMiddleware(env.agentsHandler))).Methods("GET", "POST")
+	router.HandleFunc("/agents/{id:[0-9]+}", env.validateTokenMiddleware(env.agentsOneHandler)).Methods("GET", "PUT", "PATCH", "DELETE")
 
 	// /jobs -- job data
-	router.HandleFunc("/jobs/{id:[0-9]+}", env.validateTokenMiddleware(env.jobsOneHandler)).Methods("GET", "PUT", "DELETE")
+	router.HandleFunc("/jobs/{id:[0-9]+}", env.validateTokenMiddleware(env.hideTrashed(resourceJob, env.jobsOneHandler))).Methods("GET", "PUT", "PATCH", "DELETE")
+	// and a stream of events for a job
+	router.HandleFunc("/jobs/{id:[0-9]+}/events", env.validateTokenMiddleware(env.hideTrashed(resourceJob, env.jobEventsHandler))).Methods("GET")
+
+	// /events -- stream of job and repo pull events
+	router.HandleFunc("/events", env.validateTokenMiddleware(env.eventsHandler)).Methods("GET")
+
+	// /changes -- feed of changes to all resources
+	router.HandleFunc("/changes", env.validateTokenMiddleware(env.changesHandler)).Methods("GET")
+
+	// /search -- find resources of any type by name
+	router.HandleFunc("/search", env.validateTokenMiddleware(env.searchHandler)).Methods("GET")
+
+	// /batch -- several creations in one atomic request
+	router.HandleFunc("/batch", env.validateTokenMiddleware(env.idempotencyMiddleware(env.batchHandler))).Methods("POST")
 }
@@ -49,6 +49,7 @@ func (env *Env) adminDBHandler(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, `{"error": "Unable to reset database"}`)
 			return
 		}
+		env.events.publish(EventDatabaseReset, map[string]interface{}{})
 		w.WriteHeader(http.StatusNoContent)
 	default:
 		w.WriteHeader(http.StatusBadRequest)
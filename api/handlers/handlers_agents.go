@@ -43,9 +43,15 @@ func (env *Env) agentsGetHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(agents))
+	if !ok {
+		return
+	}
+
 	// create map so we return a JSON object
 	agentsMap := map[string][]*datastore.Agent{}
-	agentsMap["agents"] = agents
+	agentsMap["agents"] = agents[start:end]
 	js, err := json.Marshal(agentsMap)
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
@@ -131,6 +137,9 @@ func (env *Env) agentsPostHelper(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"error": "Unable to create agent"}`)
 		return
 	}
+	if agent, err := env.db.GetAgentByID(newID); err == nil {
+		env.events.publish(EventAgentCreated, map[string]interface{}{"agent": agent})
+	}
 
 	// success!
 	w.WriteHeader(http.StatusCreated)
@@ -147,12 +156,12 @@ func (env *Env) agentsOneHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		env.agentsOneGetHelper(w, r)
-	case "PUT":
+	case "PUT", "PATCH":
 		env.agentsOnePutHelper(w, r)
 	case "DELETE":
 		env.agentsOneDeleteHelper(w, r)
 	default:
-		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
@@ -180,6 +189,11 @@ func (env *Env) agentsOneGetHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// set the ETag, and stop here if the client's copy is current
+	if writeETag(w, r, agent) {
+		return
+	}
+
 	// create map so we return a JSON object
 	jsData := struct {
 		Agent *datastore.Agent `json:"agent"`
@@ -208,6 +222,9 @@ func (env *Env) agentsOnePutHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// hold the agent until it has been changed (see resourceLocks)
+	defer env.locks.lock(resourceAgent, agentID)()
+
 	// get existing agent from database
 	agent, err := env.db.GetAgentByID(agentID)
 	if err != nil {
@@ -216,12 +233,15 @@ func (env *Env) agentsOnePutHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// parse JSON request
-	js := map[string]interface{}{}
-	err = json.NewDecoder(r.Body).Decode(&js)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+	// if the request is conditional, make sure the client
+	// is updating the current version
+	if !checkIfMatch(w, r, agent) {
+		return
+	}
+
+	// parse JSON request (or merge patch, for PATCH)
+	js, ok := extractUpdateRequest(w, r, agent)
+	if !ok {
 		return
 	}
 
@@ -301,6 +321,10 @@ func (env *Env) agentsOnePutHelper(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if agent, err := env.db.GetAgentByID(agentID); err == nil {
+		env.events.publish(EventAgentUpdated, map[string]interface{}{"agent": agent})
+	}
+
 	// success!
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -321,6 +345,30 @@ func (env *Env) agentsOneDeleteHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// hold the agent until it has been deleted (see resourceLocks)
+	defer env.locks.lock(resourceAgent, agentID)()
+
+	// if the request is conditional, make sure the client
+	// is deleting the current version
+	if r.Header.Get("If-Match") != "" {
+		var current interface{}
+		if agent, err := env.db.GetAgentByID(agentID); err == nil {
+			current = agent
+		}
+		if !checkIfMatch(w, r, current) {
+			return
+		}
+	}
+
+	// with ?dry_run, only report what deleting it would remove or
+	// change; large deletions must be confirmed
+	if !env.checkDeletion(w, r, resourceAgent, agentID, "") {
+		return
+	}
+
+	// keep the agent's details, for the event
+	agent, _ := env.db.GetAgentByID(agentID)
+
 	// delete the agent
 	err = env.db.DeleteAgent(agentID)
 	if err != nil {
@@ -328,6 +376,9 @@ func (env *Env) agentsOneDeleteHelper(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"error": "Unable to delete agent"}`)
 		return
 	}
+	if agent != nil {
+		env.events.publish(EventAgentDeleted, map[string]interface{}{"agent": agent})
+	}
 
 	// success!
 	w.WriteHeader(http.StatusNoContent)
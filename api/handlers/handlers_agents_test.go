@@ -207,6 +207,96 @@ func TestCannotPutAgentsOneHandlerAsCommenter(t *testing.T) {
 	}
 }
 
+func TestCannotPutAgentsOneHandlerWithStaleIfMatch(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PUT", "/agents/3", `{"is_active":true}`, "operator")
+	agent, err := env.db.GetAgentByID(3)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	etag, err := computeETag(agent)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// someone else changes the agent after we've read it
+	err = env.db.UpdateAgentStatus(3, false, "otherHost", 9003)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	req.Header.Set("If-Match", etag)
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.agentsOneHandler), "/agents/{id}")
+
+	if 412 != rec.Code {
+		t.Errorf("Expected %d, got %d", 412, rec.Code)
+	}
+
+	// and verify our update was not applied
+	agent, err = env.db.GetAgentByID(3)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	if agent.IsActive != false || agent.Address != "otherHost" {
+		t.Errorf("expected other update to remain, got %#v", agent)
+	}
+}
+
+// ===== PATCH /agents/3 =====
+
+func TestCanPatchAgentsOneHandlerAsOperator(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PATCH", "/agents/3", `{"is_active":true, "is_spdxwriter":false}`, "operator")
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.agentsOneHandler), "/agents/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	// and verify state of database now
+	agent, err := env.db.GetAgentByID(3)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	wantedAgent := &datastore.Agent{ID: 3, Name: "broken-agent", IsActive: true, Address: "example.com", Port: 9003, IsCodeReader: true, IsSpdxReader: false, IsCodeWriter: true, IsSpdxWriter: false}
+	if *agent != *wantedAgent {
+		t.Errorf("expected %#v, got %#v", wantedAgent, agent)
+	}
+}
+
+func TestCanPatchAgentsOneHandlerWithNoChanges(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PATCH", "/agents/3", `{"address":"example.com"}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.agentsOneHandler), "/agents/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+}
+
+func TestCannotPatchAgentsOneHandlerRemovingValue(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PATCH", "/agents/3", `{"address":null}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.agentsOneHandler), "/agents/{id}")
+	hu.ConfirmBadRequestResponse(t, rec)
+
+	// and verify state of database has not changed
+	agent, err := env.db.GetAgentByID(3)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	if agent.Address != "example.com" {
+		t.Errorf("expected %s, got %s", "example.com", agent.Address)
+	}
+}
+
+func TestCannotPatchAgentsOneHandlerWithWrongContentType(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PATCH", "/agents/3", `{"is_active":true}`, "operator")
+	req.Header.Set("Content-Type", "text/plain")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.agentsOneHandler), "/agents/{id}")
+
+	if 415 != rec.Code {
+		t.Errorf("Expected %d, got %d", 415, rec.Code)
+	}
+}
+
+func TestCannotPatchAgentsOneHandlerAsCommenter(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PATCH", "/agents/3", `{"is_active":true}`, "commenter")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.agentsOneHandler), "/agents/{id}")
+	hu.ConfirmAccessDenied(t, rec)
+}
+
 // ===== DELETE /agents/3 =====
 
 func TestCanDeleteAgentsOneHandlerAsAdmin(t *testing.T) {
@@ -3,14 +3,92 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
 
 	"golang.org/x/oauth2"
 
 	"github.com/swinslow/peridot-api/internal/auth"
 )
 
+// cliLoginTimeout is how long a command-line login may take, from
+// starting it to GitHub redirecting back to the API.
+const cliLoginTimeout = 10 * time.Minute
+
+// cliNonceRegexp matches the nonce that a command-line client sends
+// to recognize its own login.
+var cliNonceRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{16,128}$`)
+
+// cliLogin is a login started by a command-line client, such as
+// peridotctl, which is waiting for the token on a local port.
+type cliLogin struct {
+	port    int
+	nonce   string
+	expires time.Time
+}
+
+// cliLoginStore holds the command-line logins in progress, by the
+// OAuth state that was sent to GitHub for each.
+type cliLoginStore struct {
+	mu      sync.Mutex
+	pending map[string]*cliLogin
+}
+
+func newCLILoginStore() *cliLoginStore {
+	return &cliLoginStore{pending: map[string]*cliLogin{}}
+}
+
+// add records a new login and returns its OAuth state.
+func (cs *cliLoginStore) add(port int, nonce string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	state := "cli-" + hex.EncodeToString(b)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	now := time.Now()
+	for st, cl := range cs.pending {
+		if now.After(cl.expires) {
+			delete(cs.pending, st)
+		}
+	}
+	cs.pending[state] = &cliLogin{port: port, nonce: nonce, expires: now.Add(cliLoginTimeout)}
+	return state, nil
+}
+
+// take removes and returns the login with the given OAuth state, if
+// it is still in progress. Each can only be used once.
+func (cs *cliLoginStore) take(state string) (*cliLogin, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cl, ok := cs.pending[state]
+	if !ok {
+		return nil, false
+	}
+	delete(cs.pending, state)
+	if time.Now().After(cl.expires) {
+		return nil, false
+	}
+	return cl, true
+}
+
+// callbackURL returns where the browser is sent to hand a login's
+// result to the command-line client. It is always on this machine's
+// loopback address, so the token can't be sent anywhere else.
+func (cl *cliLogin) callbackURL(vals url.Values) string {
+	vals.Set("nonce", cl.nonce)
+	return fmt.Sprintf("http://127.0.0.1:%d/callback?%s", cl.port, vals.Encode())
+}
+
 func (env *Env) authLoginHandler(w http.ResponseWriter, r *http.Request) {
 	// we only take GET requests
 	if r.Method != "GET" {
@@ -18,7 +96,34 @@ func (env *Env) authLoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	url := env.oauthConf.AuthCodeURL(env.oauthState, oauth2.AccessTypeOnline)
+	// a command-line client gives the local port it is waiting on
+	// for the token, and a nonce to recognize it by
+	state := env.oauthState
+	if portStr := r.URL.Query().Get("cli_port"); portStr != "" {
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port < 1 || port > 65535 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'cli_port'"}`)
+			return
+		}
+		nonce := r.URL.Query().Get("cli_nonce")
+		if !cliNonceRegexp.MatchString(nonce) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'cli_nonce'"}`)
+			return
+		}
+		state, err = env.cliLogins.add(port, nonce)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"error": "Unable to start login"}`)
+			return
+		}
+	}
+
+	url := env.oauthConf.AuthCodeURL(state, oauth2.AccessTypeOnline)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
@@ -29,7 +134,14 @@ func (env *Env) authLoginHandler(w http.ResponseWriter, r *http.Request) {
 // would need to obtain the JWT through the webapp and then
 // use it in other peridot API calls as needed.
 func (env *Env) authGithubCallbackHandler(w http.ResponseWriter, r *http.Request) {
-	ghUser, err := auth.ValidateGithub(r, env.oauthConf, env.oauthState)
+	// a command-line login gets its token, or the error, back on its
+	// local port instead
+	if cl, ok := env.cliLogins.take(r.FormValue("state")); ok {
+		env.authCLICallback(w, r, cl)
+		return
+	}
+
+	ghUser, err := env.validateGithub(r, env.oauthConf, env.oauthState)
 	if err != nil {
 		// FIXME return HTML with error message + redirect
 		fmt.Fprintf(w, "<html>\n<body>\n<p>Error: Couldn't validate GitHub credentials</p>\n</body>\n</html>\n")
@@ -46,3 +158,19 @@ func (env *Env) authGithubCallbackHandler(w http.ResponseWriter, r *http.Request
 	// return HTML with JWT + JS for localstorage + redirect
 	fmt.Fprintf(w, "<html>\n<script>\nwindow.localStorage.setItem('apitoken', '%s');\nwindow.location.href = '/';\n</script>\n</html>\n", tkn)
 }
+
+// authCLICallback finishes a command-line login, by sending the
+// browser on to the client's local port with the new token.
+func (env *Env) authCLICallback(w http.ResponseWriter, r *http.Request, cl *cliLogin) {
+	ghUser, err := env.validateGithub(r, env.oauthConf, r.FormValue("state"))
+	if err != nil {
+		http.Redirect(w, r, cl.callbackURL(url.Values{"error": {"Couldn't validate GitHub credentials"}}), http.StatusFound)
+		return
+	}
+	tkn, err := auth.EncodeToken(env.jwtSecretKey, ghUser)
+	if err != nil {
+		http.Redirect(w, r, cl.callbackURL(url.Values{"error": {"Couldn't create token"}}), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, cl.callbackURL(url.Values{"token": {tkn}}), http.StatusFound)
+}
@@ -3,10 +3,16 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
+	"golang.org/x/oauth2"
+
+	"github.com/swinslow/peridot-api/internal/auth"
 	hu "github.com/swinslow/peridot-api/test/handlerutils"
 )
 
@@ -73,3 +79,137 @@ func TestCannotDeleteAuthLoginHandler(t *testing.T) {
 		t.Errorf("Expected %d, got %d", 405, rec.Code)
 	}
 }
+
+const testCLINonce = "abcdefghijklmnop0123"
+
+func TestCannotGetAuthLoginHandlerWithInvalidCLIPort(t *testing.T) {
+	for _, port := range []string{"abc", "0", "65536", "-1"} {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/auth/login?cli_port="+port+"&cli_nonce="+testCLINonce, nil)
+		if err != nil {
+			t.Fatalf("got non-nil error: %v", err)
+		}
+
+		env := getTestEnv()
+		hu.ServeHandler(rec, req, http.HandlerFunc(env.authLoginHandler), "/auth/login")
+
+		// check that we got a 400
+		if 400 != rec.Code {
+			t.Errorf("port %s: expected %d, got %d", port, 400, rec.Code)
+		}
+	}
+}
+
+func TestCannotGetAuthLoginHandlerWithInvalidCLINonce(t *testing.T) {
+	for _, nonce := range []string{"", "short", "abcdefghijklmnop&x=y"} {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/auth/login?cli_port=4321&cli_nonce="+url.QueryEscape(nonce), nil)
+		if err != nil {
+			t.Fatalf("got non-nil error: %v", err)
+		}
+
+		env := getTestEnv()
+		hu.ServeHandler(rec, req, http.HandlerFunc(env.authLoginHandler), "/auth/login")
+
+		// check that we got a 400
+		if 400 != rec.Code {
+			t.Errorf("nonce %q: expected %d, got %d", nonce, 400, rec.Code)
+		}
+	}
+}
+
+// startCLILogin starts a command-line login with the test env, and
+// returns the OAuth state it sent to GitHub.
+func startCLILogin(t *testing.T, env *Env) string {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/auth/login?cli_port=4321&cli_nonce="+testCLINonce, nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.authLoginHandler), "/auth/login")
+
+	// check that we got a 307 (redirect) with a new state
+	if 307 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 307, rec.Code)
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	state := loc.Query().Get("state")
+	if !strings.HasPrefix(state, "cli-") {
+		t.Fatalf("expected state for command-line login, got %q", state)
+	}
+	return state
+}
+
+func TestCanGetAuthCallbackForCLILogin(t *testing.T) {
+	env := getTestEnv()
+	env.validateGithub = func(r *http.Request, oauthConf *oauth2.Config, oauthState string) (string, error) {
+		if r.FormValue("state") != oauthState {
+			return "", fmt.Errorf("invalid oauth state")
+		}
+		return "johndoe", nil
+	}
+	state := startCLILogin(t, env)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/auth/redirect?code=xyz&state="+state, nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.authGithubCallbackHandler), "/auth/redirect")
+
+	// check that we were sent back to the client's local port
+	if 302 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 302, rec.Code)
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if loc.Scheme != "http" || loc.Host != "127.0.0.1:4321" || loc.Path != "/callback" {
+		t.Errorf("expected local callback, got %s", loc)
+	}
+	if loc.Query().Get("nonce") != testCLINonce {
+		t.Errorf("expected nonce %s, got %s", testCLINonce, loc.Query().Get("nonce"))
+	}
+	github, err := auth.DecodeToken(env.jwtSecretKey, loc.Query().Get("token"))
+	if err != nil {
+		t.Fatalf("got non-nil error decoding token: %v", err)
+	}
+	if github != "johndoe" {
+		t.Errorf("expected token for %s, got %s", "johndoe", github)
+	}
+
+	// and that the login can't be finished twice
+	if _, ok := env.cliLogins.take(state); ok {
+		t.Errorf("expected login to be removed once used")
+	}
+}
+
+func TestAuthCallbackForCLILoginSendsErrorToClient(t *testing.T) {
+	env := getTestEnv()
+	env.validateGithub = func(r *http.Request, oauthConf *oauth2.Config, oauthState string) (string, error) {
+		return "", fmt.Errorf("could not access Github API")
+	}
+	state := startCLILogin(t, env)
+
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/auth/redirect?code=xyz&state="+state, nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.authGithubCallbackHandler), "/auth/redirect")
+
+	if 302 != rec.Code {
+		t.Fatalf("Expected %d, got %d", 302, rec.Code)
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if loc.Host != "127.0.0.1:4321" || loc.Query().Get("error") == "" || loc.Query().Get("token") != "" {
+		t.Errorf("expected error sent to local callback, got %s", loc)
+	}
+}
@@ -0,0 +1,545 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// maxBatchOperations is the largest number of operations that
+// will be accepted in a single batch request.
+const maxBatchOperations = 500
+
+// batchOperation is one request within a batch.
+type batchOperation struct {
+	// Ref optionally names this operation, so that later
+	// operations can refer to the ID it creates as "${ref}".
+	Ref string `json:"ref,omitempty"`
+	// Method is the HTTP method; only POST is currently
+	// supported, and it is the default if omitted.
+	Method string `json:"method,omitempty"`
+	// Path is the API endpoint, e.g. "/projects/${prj}/subprojects".
+	Path string `json:"path"`
+	// Body is the JSON request body for the operation.
+	Body interface{} `json:"body,omitempty"`
+}
+
+// batchResult is the outcome of one operation within a batch.
+type batchResult struct {
+	Ref    string          `json:"ref,omitempty"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// batchCreated records a resource created by a batch operation,
+// so that it can be deleted again if a later operation fails.
+type batchCreated struct {
+	kind   string
+	id     uint32
+	repoID uint32
+	branch string
+}
+
+// ========== HANDLER for /batch
+
+func (env *Env) batchHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be at least operator; each operation will
+	// also check access for itself
+	user := extractUser(w, r, datastore.AccessOperator)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; parse JSON request
+	js := struct {
+		Operations []*batchOperation `json:"operations"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&js)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+		return
+	}
+	if len(js.Operations) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing required value for 'operations'"}`)
+		return
+	}
+	if len(js.Operations) > maxBatchOperations {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Too many operations; maximum is %d"}`, maxBatchOperations)
+		return
+	}
+
+	// the datastore has no transactions, so a batch is made
+	// atomic by undoing its creations if any operation fails.
+	// batches are run one at a time so that they cannot
+	// interleave with one another.
+	env.batchMu.Lock()
+	defer env.batchMu.Unlock()
+
+	// the operations' events are held back until the batch succeeds,
+	// so that nothing hears of resources that are rolled back
+	benv, heldEvents := env.batchEnv()
+	router := benv.batchRouter()
+	refs := map[string]interface{}{}
+	results := []*batchResult{}
+	created := []*batchCreated{}
+
+	for i, op := range js.Operations {
+		res, c, failMsg := benv.runBatchOperation(r, router, op, refs)
+		results = append(results, res)
+		if failMsg != "" {
+			kept := benv.rollbackBatch(created)
+			env.publishKeptBatchResources(kept)
+			jsData := struct {
+				Error   string         `json:"error"`
+				Failed  int            `json:"failed"`
+				Results []*batchResult `json:"results"`
+				Kept    []*batchKept   `json:"kept,omitempty"`
+			}{
+				Error:   fmt.Sprintf("Operation %d failed (%s); all operations rolled back", i, failMsg),
+				Failed:  i,
+				Results: results,
+			}
+			if len(kept) > 0 {
+				jsData.Error = fmt.Sprintf("Operation %d failed (%s); operations rolled back, except for resources that others have since added to", i, failMsg)
+				for _, c := range kept {
+					jsData.Kept = append(jsData.Kept, newBatchKept(c))
+				}
+			}
+			rjs, err := json.Marshal(jsData)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+				return
+			}
+			w.WriteHeader(res.Status)
+			w.Write(rjs)
+			return
+		}
+		created = append(created, c)
+	}
+
+	// success! now the batch's events can be published
+	for _, ev := range heldEvents() {
+		env.events.publish(ev.Type, ev.Data)
+	}
+	jsData := struct {
+		Results []*batchResult `json:"results"`
+	}{Results: results}
+	rjs, err := json.Marshal(jsData)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(rjs)
+}
+
+// batchKept is a resource created by a failed batch that was not
+// rolled back, because others have since added to it.
+type batchKept struct {
+	Type   string `json:"type"`
+	ID     uint32 `json:"id,omitempty"`
+	RepoID uint32 `json:"repo_id,omitempty"`
+	Branch string `json:"branch,omitempty"`
+}
+
+// batchKindTypes are the resource types of each kind of batch
+// operation, as named in responses and events.
+var batchKindTypes = map[string]string{
+	"projects":    resourceProject,
+	"subprojects": resourceSubproject,
+	"repos":       resourceRepo,
+	"branches":    resourceBranch,
+	"repopulls":   resourceRepoPull,
+	"jobs":        resourceJob,
+	"agents":      resourceAgent,
+}
+
+func newBatchKept(c *batchCreated) *batchKept {
+	return &batchKept{Type: batchKindTypes[c.kind], ID: c.id, RepoID: c.repoID, Branch: c.branch}
+}
+
+// batchEnv returns a copy of env whose events go to a separate bus,
+// and a function that returns the events published there so far.
+func (env *Env) batchEnv() (*Env, func() []*event) {
+	var mu sync.Mutex
+	held := []*event{}
+	benv := *env
+	benv.events = newEventBus()
+	benv.events.subscribe(func(ev *event) {
+		mu.Lock()
+		defer mu.Unlock()
+		held = append(held, ev)
+	})
+	return &benv, func() []*event {
+		mu.Lock()
+		defer mu.Unlock()
+		return held
+	}
+}
+
+// batchRouter builds a router for the endpoints that can be used
+// within a batch. Requests are dispatched directly to the handlers,
+// without the token middleware, since the batch request's context
+// already carries the authenticated user.
+func (env *Env) batchRouter() *mux.Router {
+	router := mux.NewRouter().UseEncodedPath()
+	router.HandleFunc("/projects", env.projectsHandler).Name("projects")
+	router.HandleFunc("/projects/{id:[0-9]+}/subprojects", env.hideTrashed(resourceProject, env.subprojectsSubHandler)).Name("subprojects")
+	router.HandleFunc("/subprojects", env.subprojectsHandler).Name("subprojects")
+	router.HandleFunc("/subprojects/{id:[0-9]+}/repos", env.hideTrashed(resourceSubproject, env.reposSubHandler)).Name("repos")
+	router.HandleFunc("/repos", env.reposHandler).Name("repos")
+	router.HandleFunc("/repos/{id:[0-9]+}/branches", env.hideTrashed(resourceRepo, env.repoBranchesSubHandler)).Name("branches")
+	router.HandleFunc("/repos/{id:[0-9]+}/branches/{branch:"+branchPattern+"}", env.hideTrashed(resourceRepo, env.repoPullsSubHandler)).Name("repopulls")
+	router.HandleFunc("/repopulls/{id:[0-9]+}/jobs", env.hideTrashed(resourceRepoPull, env.jobsSubHandler)).Name("jobs")
+	router.HandleFunc("/agents", env.agentsHandler).Name("agents")
+	return router
+}
+
+// runBatchOperation runs a single operation from a batch. It
+// returns the operation's result and a record of what it created.
+// If the operation failed, it also returns a non-empty message
+// describing why.
+func (env *Env) runBatchOperation(r *http.Request, router *mux.Router, op *batchOperation, refs map[string]interface{}) (*batchResult, *batchCreated, string) {
+	res := &batchResult{Ref: op.Ref, Status: http.StatusBadRequest}
+
+	if op.Method != "" && op.Method != "POST" {
+		return res, nil, "only POST operations are supported"
+	}
+	if op.Ref != "" {
+		if _, ok := refs[op.Ref]; ok {
+			return res, nil, fmt.Sprintf("duplicate ref '%s'", op.Ref)
+		}
+	}
+
+	// fill in references to earlier operations
+	path, err := substituteBatchRefsInPath(op.Path, refs)
+	if err != nil {
+		return res, nil, err.Error()
+	}
+	var body interface{} = map[string]interface{}{}
+	if op.Body != nil {
+		body, err = substituteBatchRefs(op.Body, refs)
+		if err != nil {
+			return res, nil, err.Error()
+		}
+	}
+	bodyJS, err := json.Marshal(body)
+	if err != nil {
+		return res, nil, "invalid body"
+	}
+
+	// build and dispatch the request for this operation
+	req, err := http.NewRequest("POST", path, bytes.NewReader(bodyJS))
+	if err != nil {
+		return res, nil, "invalid path"
+	}
+	req = req.WithContext(r.Context())
+	req.Header.Set("Content-Type", "application/json")
+
+	var match mux.RouteMatch
+	if !router.Match(req, &match) || match.MatchErr != nil {
+		return res, nil, fmt.Sprintf("unsupported path '%s'", op.Path)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	res.Status = rec.Code
+	if json.Valid(rec.Body.Bytes()) {
+		res.Body = json.RawMessage(rec.Body.Bytes())
+	}
+	if rec.Code != http.StatusCreated {
+		return res, nil, fmt.Sprintf("status %d", rec.Code)
+	}
+
+	// figure out what was created, for references and rollback
+	created := &batchCreated{kind: match.Route.GetName()}
+	respJS := struct {
+		ID     uint32 `json:"id"`
+		Branch string `json:"branch"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &respJS); err != nil {
+		return res, nil, "unreadable response"
+	}
+	if created.kind == "branches" {
+		repoID, _ := strconv.ParseUint(match.Vars["id"], 10, 32)
+		created.repoID = uint32(repoID)
+		created.branch = respJS.Branch
+		if op.Ref != "" {
+			refs[op.Ref] = respJS.Branch
+		}
+	} else {
+		created.id = respJS.ID
+		if op.Ref != "" {
+			refs[op.Ref] = float64(respJS.ID)
+		}
+	}
+
+	return res, created, ""
+}
+
+// rollbackBatch deletes the resources created by a failed batch,
+// in reverse order of creation, and returns those it kept. Others
+// may have added to them meanwhile, since only batches, manifests
+// and imports are kept from running at the same time; a resource
+// that has children left once the batch's own are deleted is kept,
+// rather than deleting the others' along with it.
+func (env *Env) rollbackBatch(created []*batchCreated) []*batchCreated {
+	kept := []*batchCreated{}
+	for i := len(created) - 1; i >= 0; i-- {
+		c := created[i]
+		if env.batchCreatedHasChildren(c) {
+			kept = append(kept, c)
+			continue
+		}
+		switch c.kind {
+		case "projects":
+			project, _ := env.db.GetProjectByID(c.id)
+			if env.db.DeleteProject(c.id) == nil && project != nil {
+				env.events.publish(EventProjectDeleted, map[string]interface{}{"project": project})
+			}
+		case "subprojects":
+			subproject, _ := env.db.GetSubprojectByID(c.id)
+			if env.db.DeleteSubproject(c.id) == nil && subproject != nil {
+				env.events.publish(EventSubprojectDeleted, map[string]interface{}{"subproject": subproject})
+			}
+		case "repos":
+			repo, _ := env.db.GetRepoByID(c.id)
+			if env.db.DeleteRepo(c.id) == nil && repo != nil {
+				env.events.publish(EventRepoDeleted, map[string]interface{}{"repo": repo})
+			}
+		case "branches":
+			if env.db.DeleteRepoBranch(c.repoID, c.branch) == nil {
+				env.events.publish(EventBranchDeleted, map[string]interface{}{
+					"branch": &datastore.RepoBranch{RepoID: c.repoID, Branch: c.branch},
+				})
+			}
+		case "repopulls":
+			rp, _ := env.db.GetRepoPullByID(c.id)
+			if env.db.DeleteRepoPull(c.id) == nil && rp != nil {
+				env.publishRepoPullEvent(EventRepoPullDeleted, rp)
+			}
+		case "jobs":
+			job, _ := env.db.GetJobByID(c.id)
+			if env.db.DeleteJob(c.id) == nil && job != nil {
+				env.publishJobEvent(EventJobDeleted, job)
+			}
+		case "agents":
+			agent, _ := env.db.GetAgentByID(c.id)
+			if env.db.DeleteAgent(c.id) == nil && agent != nil {
+				env.events.publish(EventAgentDeleted, map[string]interface{}{"agent": agent})
+			}
+		}
+	}
+	return kept
+}
+
+// batchCreatedHasChildren reports whether a resource created by a
+// batch has anything below it: subprojects, repos, branches, repo
+// pulls, jobs that must run after it, or for an agent, jobs that
+// run on it. If this can't be found out, it is taken to have some,
+// so that nothing is lost.
+func (env *Env) batchCreatedHasChildren(c *batchCreated) bool {
+	switch c.kind {
+	case "projects":
+		sps, err := env.db.GetAllSubprojectsForProjectID(c.id)
+		return err != nil || len(sps) > 0
+	case "subprojects":
+		repos, err := env.db.GetAllReposForSubprojectID(c.id)
+		return err != nil || len(repos) > 0
+	case "repos":
+		rbs, err := env.db.GetAllRepoBranchesForRepoID(c.id)
+		return err != nil || len(rbs) > 0
+	case "branches":
+		rps, err := env.db.GetAllRepoPullsForRepoBranch(c.repoID, c.branch)
+		return err != nil || len(rps) > 0
+	case "repopulls":
+		jobs, err := env.db.GetAllJobsForRepoPull(c.id)
+		return err != nil || len(jobs) > 0
+	case "jobs":
+		job, err := env.db.GetJobByID(c.id)
+		if err != nil {
+			return true
+		}
+		jobs, err := env.db.GetAllJobsForRepoPull(job.RepoPullID)
+		if err != nil {
+			return true
+		}
+		for _, j := range jobs {
+			for _, prior := range j.PriorJobIDs {
+				if prior == c.id {
+					return true
+				}
+			}
+		}
+	case "agents":
+		// any job can run on an agent, so all of them are scanned,
+		// as impactBuilder.addAgent does
+		rps, err := env.getAllRepoPulls()
+		if err != nil {
+			return true
+		}
+		for _, rp := range rps {
+			jobs, err := env.db.GetAllJobsForRepoPull(rp.ID)
+			if err != nil {
+				return true
+			}
+			for _, j := range jobs {
+				if j.AgentID == c.id {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// publishKeptBatchResources publishes the creation of resources that
+// a failed batch kept, since its held events were dropped.
+func (env *Env) publishKeptBatchResources(kept []*batchCreated) {
+	// in order of creation, so that parents come first
+	for i := len(kept) - 1; i >= 0; i-- {
+		c := kept[i]
+		switch c.kind {
+		case "projects":
+			if project, err := env.db.GetProjectByID(c.id); err == nil {
+				env.events.publish(EventProjectCreated, map[string]interface{}{"project": project})
+			}
+		case "subprojects":
+			if subproject, err := env.db.GetSubprojectByID(c.id); err == nil {
+				env.events.publish(EventSubprojectCreated, map[string]interface{}{"subproject": subproject})
+			}
+		case "repos":
+			if repo, err := env.db.GetRepoByID(c.id); err == nil {
+				env.events.publish(EventRepoCreated, map[string]interface{}{"repo": repo})
+			}
+		case "branches":
+			env.events.publish(EventBranchCreated, map[string]interface{}{
+				"branch": &datastore.RepoBranch{RepoID: c.repoID, Branch: c.branch},
+			})
+		case "repopulls":
+			// the watcher already knows of it, from when it was
+			// created, so this is published directly
+			if rp, err := env.db.GetRepoPullByID(c.id); err == nil {
+				env.events.publish(EventRepoPullCreated, map[string]interface{}{"repopull": rp})
+			}
+		case "jobs":
+			if job, err := env.db.GetJobByID(c.id); err == nil {
+				env.events.publish(EventJobCreated, map[string]interface{}{"job": job})
+			}
+		}
+	}
+}
+
+// batchRefString returns the string form of a reference's value,
+// for use within a larger string.
+func batchRefString(v interface{}) string {
+	switch vv := v.(type) {
+	case float64:
+		return strconv.FormatUint(uint64(vv), 10)
+	case string:
+		return vv
+	}
+	return ""
+}
+
+// substituteBatchRefsInString replaces each "${ref}" in s with the
+// value recorded for ref. If escape is true, the values are
+// escaped for use as a URL path segment.
+func substituteBatchRefsInString(s string, refs map[string]interface{}, escape bool) (string, error) {
+	var out strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			out.WriteString(s)
+			return out.String(), nil
+		}
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated reference in '%s'", s)
+		}
+		name := s[start+2 : start+end]
+		v, ok := refs[name]
+		if !ok {
+			return "", fmt.Errorf("unknown ref '%s'", name)
+		}
+		val := batchRefString(v)
+		if escape {
+			val = url.PathEscape(val)
+		}
+		out.WriteString(s[:start])
+		out.WriteString(val)
+		s = s[start+end+1:]
+	}
+}
+
+// substituteBatchRefsInPath replaces references within an
+// operation's path.
+func substituteBatchRefsInPath(path string, refs map[string]interface{}) (string, error) {
+	return substituteBatchRefsInString(path, refs, true)
+}
+
+// substituteBatchRefs walks a decoded JSON body and replaces
+// references in its string values. A string that consists of
+// exactly one reference is replaced by the referenced value
+// itself, so that e.g. "${prj}" becomes the number 4 rather than
+// the string "4".
+func substituteBatchRefs(body interface{}, refs map[string]interface{}) (interface{}, error) {
+	switch v := body.(type) {
+	case string:
+		if strings.HasPrefix(v, "${") && strings.HasSuffix(v, "}") && strings.Count(v, "${") == 1 {
+			name := v[2 : len(v)-1]
+			val, ok := refs[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown ref '%s'", name)
+			}
+			return val, nil
+		}
+		return substituteBatchRefsInString(v, refs, false)
+	case []interface{}:
+		out := []interface{}{}
+		for _, item := range v {
+			newItem, err := substituteBatchRefs(item, refs)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, newItem)
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for k, item := range v {
+			newItem, err := substituteBatchRefs(item, refs)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = newItem
+		}
+		return out, nil
+	}
+	return body, nil
+}
@@ -0,0 +1,233 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	hu "github.com/swinslow/peridot-api/test/handlerutils"
+)
+
+// ===== POST /batch =====
+
+func TestCanPostBatchHandlerAsOperator(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/batch", `{"operations": [
+		{"ref": "prj", "path": "/projects", "body": {"name": "prj4", "fullname": "project 4"}},
+		{"ref": "sp", "path": "/projects/${prj}/subprojects", "body": {"name": "subprj5", "fullname": "subproject 5"}},
+		{"ref": "repo", "path": "/subprojects/${sp}/repos", "body": {"name": "repo5", "address": "https://example.com/repo5.git"}},
+		{"ref": "br", "path": "/repos/${repo}/branches", "body": {"branch": "master"}},
+		{"ref": "pull", "path": "/repos/${repo}/branches/${br}", "body": {"commit": "abcdef012345abcdef012345abcdef0123451234"}},
+		{"ref": "job1", "path": "/repopulls/${pull}/jobs", "body": {"agent_id": 4, "config": {}}},
+		{"path": "/repopulls/${pull}/jobs", "body": {"agent_id": 1, "priorjob_ids": ["${job1}"], "config": {}}}
+	]}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.batchHandler), "/batch")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"results": [
+		{"ref": "prj", "status": 201, "body": {"id": 4}},
+		{"ref": "sp", "status": 201, "body": {"id": 5}},
+		{"ref": "repo", "status": 201, "body": {"id": 5}},
+		{"ref": "br", "status": 201, "body": {"branch": "master"}},
+		{"ref": "pull", "status": 201, "body": {"id": 5}},
+		{"ref": "job1", "status": 201, "body": {"id": 9}},
+		{"status": 201, "body": {"id": 10}}
+	]}`
+	hu.CheckResponse(t, rec, wanted)
+
+	// and verify state of database now
+	sp, err := env.db.GetSubprojectByID(5)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if sp.ProjectID != 4 {
+		t.Errorf("expected %d, got %d", 4, sp.ProjectID)
+	}
+	job, err := env.db.GetJobByID(10)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if job.RepoPullID != 5 || len(job.PriorJobIDs) != 1 || job.PriorJobIDs[0] != 9 {
+		t.Errorf("expected job for repo pull 5 with prior job 9, got %#v", job)
+	}
+}
+
+func TestBatchHandlerRollsBackOnFailure(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/batch", `{"operations": [
+		{"ref": "prj", "path": "/projects", "body": {"name": "prj4", "fullname": "project 4"}},
+		{"ref": "sp", "path": "/projects/${prj}/subprojects", "body": {"name": "subprj5", "fullname": "subproject 5"}},
+		{"path": "/subprojects/${sp}/repos", "body": {"name": "repo5"}}
+	]}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.batchHandler), "/batch")
+	hu.ConfirmBadRequestResponse(t, rec)
+
+	wanted := `{"error": "Operation 2 failed (status 400); all operations rolled back", "failed": 2, "results": [
+		{"ref": "prj", "status": 201, "body": {"id": 4}},
+		{"ref": "sp", "status": 201, "body": {"id": 5}},
+		{"status": 400, "body": {"error": "Missing required value for 'address'"}}
+	]}`
+	hu.CheckResponse(t, rec, wanted)
+
+	// and verify state of database has not changed
+	projects, err := env.db.GetAllProjects()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(projects) != 3 {
+		t.Errorf("expected %d, got %d", 3, len(projects))
+	}
+	subprojects, err := env.db.GetAllSubprojects()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(subprojects) != 4 {
+		t.Errorf("expected %d, got %d", 4, len(subprojects))
+	}
+}
+
+func TestBatchHandlerPublishesEventsOnlyOnSuccess(t *testing.T) {
+	env := getTestEnv()
+	types := []string{}
+	env.events.subscribe(func(ev *event) { types = append(types, ev.Type) })
+
+	// a batch that is rolled back publishes nothing
+	rec := serveTestRequest(t, env, "POST", "/batch", `{"operations": [
+		{"ref": "prj", "path": "/projects", "body": {"name": "prj4", "fullname": "project 4"}},
+		{"path": "/projects/${prj}/subprojects", "body": {"fullname": "no name"}}
+	]}`, "operator", env.batchHandler, "/batch")
+	hu.ConfirmBadRequestResponse(t, rec)
+	if len(types) != 0 {
+		t.Errorf("expected no events, got %v", types)
+	}
+
+	// one that succeeds publishes its events once it is done
+	rec = serveTestRequest(t, env, "POST", "/batch", `{"operations": [
+		{"ref": "prj", "path": "/projects", "body": {"name": "prj4", "fullname": "project 4"}},
+		{"path": "/projects/${prj}/subprojects", "body": {"name": "subprj5", "fullname": "subproject 5"}}
+	]}`, "operator", env.batchHandler, "/batch")
+	hu.ConfirmOKResponse(t, rec)
+	wanted := []string{EventProjectCreated, EventSubprojectCreated}
+	if !reflect.DeepEqual(types, wanted) {
+		t.Errorf("expected %v, got %v", wanted, types)
+	}
+}
+
+func TestBatchRollbackKeepsResourcesThatOthersAddedTo(t *testing.T) {
+	env := getTestEnv()
+	types := []string{}
+	env.events.subscribe(func(ev *event) { types = append(types, ev.Type) })
+
+	// a batch created project 4 and subproject 5, and meanwhile
+	// someone else added subproject 6 to the project
+	prjID, err := env.db.AddProject("prj4", "project 4")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	spID, err := env.db.AddSubproject(prjID, "subprj5", "subproject 5")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if _, err := env.db.AddSubproject(prjID, "subprj6", "subproject 6"); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	created := []*batchCreated{{kind: "projects", id: prjID}, {kind: "subprojects", id: spID}}
+
+	benv, held := env.batchEnv()
+	kept := benv.rollbackBatch(created)
+	if len(kept) != 1 || kept[0].kind != "projects" || kept[0].id != prjID {
+		t.Fatalf("expected project %d to be kept, got %#v", prjID, kept)
+	}
+	if _, err := env.db.GetSubprojectByID(spID); err == nil {
+		t.Errorf("expected subproject %d to be rolled back", spID)
+	}
+	if sps, _ := env.db.GetAllSubprojectsForProjectID(prjID); len(sps) != 1 {
+		t.Errorf("expected the other subproject to be left alone, got %d", len(sps))
+	}
+	if len(held()) != 1 || len(types) != 0 {
+		t.Errorf("expected the rollback's event to be held back, got %d held and %v", len(held()), types)
+	}
+
+	// the kept project's creation is published after all
+	env.publishKeptBatchResources(kept)
+	if wanted := []string{EventProjectCreated}; !reflect.DeepEqual(types, wanted) {
+		t.Errorf("expected %v, got %v", wanted, types)
+	}
+}
+
+func TestBatchRollbackKeepsAgentsThatOtherJobsRunOn(t *testing.T) {
+	env := getTestEnv()
+
+	// a batch created agent 7, and meanwhile someone else created a
+	// job on it in repo pull 3, which isn't part of the batch
+	agentID, err := env.db.AddAgent("agent7", true, "localhost", 9007, true, false, false, false)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	unusedID, err := env.db.AddAgent("agent8", true, "localhost", 9008, true, false, false, false)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if _, err := env.db.AddJob(3, agentID, []uint32{}); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	created := []*batchCreated{{kind: "agents", id: agentID}, {kind: "agents", id: unusedID}}
+
+	benv, _ := env.batchEnv()
+	kept := benv.rollbackBatch(created)
+	if len(kept) != 1 || kept[0].kind != "agents" || kept[0].id != agentID {
+		t.Fatalf("expected agent %d to be kept, got %#v", agentID, kept)
+	}
+	if _, err := env.db.GetAgentByID(agentID); err != nil {
+		t.Errorf("expected agent %d to be kept, got %v", agentID, err)
+	}
+	if _, err := env.db.GetAgentByID(unusedID); err == nil {
+		t.Errorf("expected agent %d to be rolled back", unusedID)
+	}
+}
+
+func TestCannotPostBatchHandlerWithUnknownRef(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/batch", `{"operations": [
+		{"ref": "prj", "path": "/projects", "body": {"name": "prj4", "fullname": "project 4"}},
+		{"path": "/projects/${nope}/subprojects", "body": {"name": "subprj5", "fullname": "subproject 5"}}
+	]}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.batchHandler), "/batch")
+	hu.ConfirmBadRequestResponse(t, rec)
+
+	// and verify the project was rolled back
+	projects, err := env.db.GetAllProjects()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(projects) != 3 {
+		t.Errorf("expected %d, got %d", 3, len(projects))
+	}
+}
+
+func TestCannotPostBatchHandlerWithNonCreateOperation(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/batch", `{"operations": [
+		{"method": "DELETE", "path": "/projects/1"}
+	]}`, "admin")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.batchHandler), "/batch")
+	hu.ConfirmBadRequestResponse(t, rec)
+
+	// and verify the project was not deleted
+	_, err := env.db.GetProjectByID(1)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+}
+
+func TestCannotPostBatchHandlerAsOtherUser(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/batch", `{"operations": [
+		{"path": "/projects", "body": {"name": "prj4", "fullname": "project 4"}}
+	]}`, "commenter")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.batchHandler), "/batch")
+	hu.ConfirmAccessDenied(t, rec)
+
+	rec, req, env = setupTestEnv(t, "POST", "/batch", `{"operations": [
+		{"path": "/projects", "body": {"name": "prj4", "fullname": "project 4"}}
+	]}`, "invalid")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.batchHandler), "/batch")
+	hu.ConfirmInvalidAuth(t, rec, ErrAuthGithub)
+}
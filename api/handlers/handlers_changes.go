@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// maxChangesLimit is the most changes returned by one request to
+// /changes, and the default if no limit is given.
+const maxChangesLimit = 1000
+
+// ========== HANDLER for /changes
+
+func (env *Env) changesHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be at least viewer
+	user := extractUser(w, r, datastore.AccessViewer)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; check what is requested
+	q := r.URL.Query()
+	var since uint64
+	if s := q.Get("since"); s != "" {
+		var err error
+		since, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'since'"}`)
+			return
+		}
+	}
+	limit := maxChangesLimit
+	if s := q.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxChangesLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'limit'; must be between 1 and %d"}`, maxChangesLimit)
+			return
+		}
+	}
+
+	changes, latest, ok := env.changes.since(since, limit)
+	if !ok {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprintf(w, `{"error": "Changes since %d are no longer available; reload all data, then continue from 'latest'", "latest": %d}`, since, latest)
+		return
+	}
+
+	// non-admin users only get to see users' IDs and Github names,
+	// as with /users
+	if user.AccessLevel != datastore.AccessAdmin {
+		for i, c := range changes {
+			if c.Resource != "user" || c.Data == nil {
+				continue
+			}
+			u := &datastore.User{}
+			if err := json.Unmarshal(c.Data, u); err != nil {
+				continue
+			}
+			ltd, _ := json.Marshal(&limitedUser{ID: u.ID, Github: u.Github})
+			cp := *c
+			cp.Data = ltd
+			changes[i] = &cp
+		}
+	}
+
+	next := since
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Seq
+	}
+
+	// create map so we return a JSON object
+	jsData := struct {
+		Changes []*change `json:"changes"`
+		Next    uint64    `json:"next"`
+		Latest  uint64    `json:"latest"`
+	}{Changes: changes, Next: next, Latest: latest}
+	js, err := json.Marshal(jsData)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
+}
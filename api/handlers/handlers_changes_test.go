@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+
+	hu "github.com/swinslow/peridot-api/test/handlerutils"
+)
+
+// changesResponse is the body of a /changes response.
+type changesResponse struct {
+	Changes []*change `json:"changes"`
+	Next    uint64    `json:"next"`
+	Latest  uint64    `json:"latest"`
+}
+
+func getChanges(t *testing.T, env *Env, query string, ghUsername string) *changesResponse {
+	rec := serveTestRequest(t, env, "GET", "/changes"+query, ``, ghUsername, env.changesHandler, "/changes")
+	hu.ConfirmOKResponse(t, rec)
+	got := &changesResponse{}
+	if err := json.Unmarshal(hu.GetBody(t, rec), got); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return got
+}
+
+func TestChangesListsMutationsInOrder(t *testing.T) {
+	env := getTestEnv()
+
+	rec := serveTestRequest(t, env, "POST", "/projects", `{"name": "prj4", "fullname": "project 4"}`, "operator", env.projectsHandler, "/projects")
+	hu.ConfirmCreatedResponse(t, rec)
+	rec = serveTestRequest(t, env, "PUT", "/projects/4", `{"fullname": "project four"}`, "operator", env.projectsOneHandler, "/projects/{id:[0-9]+}")
+	hu.ConfirmNoContentResponse(t, rec)
+	rec = serveTestRequest(t, env, "DELETE", "/projects/4", ``, "admin", env.projectsOneHandler, "/projects/{id:[0-9]+}")
+	hu.ConfirmNoContentResponse(t, rec)
+	rec = serveTestRequest(t, env, "POST", "/users", `{"name": "Steve", "github": "steve", "access": "operator"}`, "admin", env.usersHandler, "/users")
+	hu.ConfirmCreatedResponse(t, rec)
+
+	got := getChanges(t, env, "", "viewer")
+	if len(got.Changes) != 4 || got.Next != 4 || got.Latest != 4 {
+		t.Fatalf("unexpected response: %#v", got)
+	}
+	wanted := []struct {
+		resource string
+		action   string
+		data     string
+	}{
+		{"project", "created", `{"id": 4, "name": "prj4", "fullname": "project 4"}`},
+		{"project", "updated", `{"id": 4, "name": "prj4", "fullname": "project four"}`},
+		{"project", "trashed", `{"id": 4, "name": "prj4", "fullname": "project four"}`},
+		// users' full details are only shown to admins
+		{"user", "created", `{"id": 11, "github": "steve"}`},
+	}
+	for i, w := range wanted {
+		c := got.Changes[i]
+		if c.Seq != uint64(i+1) || c.Resource != w.resource || c.Action != w.action {
+			t.Errorf("change %d: expected %s %s, got %d %s %s", i, w.resource, w.action, c.Seq, c.Resource, c.Action)
+		}
+		hu.CheckMatch(t, w.data, c.Data, false)
+	}
+
+	got = getChanges(t, env, "?since=3", "admin")
+	if len(got.Changes) != 1 {
+		t.Fatalf("expected %d, got %d", 1, len(got.Changes))
+	}
+	hu.CheckMatch(t, `{"id": 11, "name": "Steve", "github": "steve", "access": "operator"}`, got.Changes[0].Data, false)
+}
+
+func TestChangesCanBeReadInPages(t *testing.T) {
+	env := getTestEnv()
+	for i := 0; i < 5; i++ {
+		env.events.publish(EventRepoUpdated, map[string]interface{}{"repo": &datastore.Repo{ID: 1}})
+	}
+
+	got := getChanges(t, env, "?since=1&limit=2", "viewer")
+	if len(got.Changes) != 2 || got.Changes[0].Seq != 2 || got.Next != 3 || got.Latest != 5 {
+		t.Errorf("unexpected response: %#v", got)
+	}
+
+	// nothing new is an empty list, not an error
+	got = getChanges(t, env, "?since=5", "viewer")
+	if len(got.Changes) != 0 || got.Next != 5 || got.Latest != 5 {
+		t.Errorf("unexpected response: %#v", got)
+	}
+}
+
+func TestChangesAreGoneWhenNoLongerKept(t *testing.T) {
+	env := getTestEnv()
+	for i := 0; i < 5; i++ {
+		env.events.publish(EventRepoUpdated, map[string]interface{}{"repo": &datastore.Repo{ID: 1}})
+	}
+	env.changes.changes = env.changes.changes[2:]
+
+	rec := serveTestRequest(t, env, "GET", "/changes?since=1", ``, "viewer", env.changesHandler, "/changes")
+	if rec.Code != http.StatusGone {
+		t.Errorf("expected %d, got %d", http.StatusGone, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Changes since 1 are no longer available; reload all data, then continue from 'latest'", "latest": 5}`)
+
+	// a sequence number from the future is gone too, e.g. after
+	// the server's state was lost
+	rec = serveTestRequest(t, env, "GET", "/changes?since=9", ``, "viewer", env.changesHandler, "/changes")
+	if rec.Code != http.StatusGone {
+		t.Errorf("expected %d, got %d", http.StatusGone, rec.Code)
+	}
+
+	// but the oldest change kept can still be reached
+	got := getChanges(t, env, "?since=2", "viewer")
+	if len(got.Changes) != 3 {
+		t.Errorf("expected %d, got %d", 3, len(got.Changes))
+	}
+}
+
+func TestCannotGetChangesWithInvalidValues(t *testing.T) {
+	env := getTestEnv()
+
+	rec := serveTestRequest(t, env, "GET", "/changes?since=-1", ``, "viewer", env.changesHandler, "/changes")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'since'"}`)
+
+	rec = serveTestRequest(t, env, "GET", "/changes?limit=5000", ``, "viewer", env.changesHandler, "/changes")
+	hu.ConfirmBadRequestResponse(t, rec)
+
+	rec = serveTestRequest(t, env, "GET", "/changes", ``, "disabled", env.changesHandler, "/changes")
+	hu.ConfirmAccessDenied(t, rec)
+}
+
+func TestChangeLogIsSavedAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peridot-changes")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cl, err := newChangeLog(dir)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	events := newEventBus()
+	events.subscribe(cl.record)
+	events.publish(EventProjectCreated, map[string]interface{}{"project": &datastore.Project{ID: 4, Name: "prj4"}})
+	events.publish(EventDatabaseReset, map[string]interface{}{})
+
+	cl, err = newChangeLog(dir)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if cl.lastSeq() != 2 {
+		t.Fatalf("expected %d, got %d", 2, cl.lastSeq())
+	}
+	changes, _, ok := cl.since(0, 10)
+	if !ok || len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %v %#v", ok, changes)
+	}
+	if changes[1].Resource != "database" || changes[1].Action != "reset" || changes[1].Data != nil {
+		t.Errorf("unexpected change: %#v", changes[1])
+	}
+	hu.CheckMatch(t, `{"id": 4, "name": "prj4", "fullname": ""}`, changes[0].Data, false)
+}
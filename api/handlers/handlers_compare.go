@@ -0,0 +1,366 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// Kinds of change between the jobs of two repo pulls.
+const (
+	jobChangeAdded   = "added"
+	jobChangeRemoved = "removed"
+	jobChangeChanged = "changed"
+)
+
+// Kinds of change between the files of two repo pulls.
+const (
+	fileChangeAdded    = "added"
+	fileChangeRemoved  = "removed"
+	fileChangeModified = "modified"
+)
+
+// fileInstanceLister is a datastore that can list the file instances
+// of a repo pull. peridot-db's Datastore can't do this yet (see
+// tickler.txt), so files can only be compared with one that can.
+type fileInstanceLister interface {
+	GetAllFileInstancesForRepoPull(rpID uint32) ([]*datastore.FileInstance, error)
+}
+
+// compareFile is one version of a file, for a comparison.
+type compareFile struct {
+	ID         uint64 `json:"id"`
+	FileHashID uint64 `json:"file_hash_id"`
+	SHA256     string `json:"sha256"`
+}
+
+// fileChange is a difference between the files of two repo pulls,
+// for one path. From is left out for an added file, and To for a
+// removed one.
+type fileChange struct {
+	Path   string       `json:"path"`
+	Change string       `json:"change"`
+	From   *compareFile `json:"from,omitempty"`
+	To     *compareFile `json:"to,omitempty"`
+}
+
+// compareFileCounts counts the files of two repo pulls by how they
+// differ.
+type compareFileCounts struct {
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Modified  int `json:"modified"`
+	Unchanged int `json:"unchanged"`
+}
+
+// compareJob is how one job turned out, for a comparison.
+type compareJob struct {
+	ID     uint32           `json:"id"`
+	Status datastore.Status `json:"status"`
+	Health datastore.Health `json:"health"`
+}
+
+// jobChange is a difference between the jobs of two repo pulls, for
+// one agent. From is left out for an added job, and To for a removed
+// one.
+type jobChange struct {
+	AgentID uint32      `json:"agent_id"`
+	Change  string      `json:"change"`
+	From    *compareJob `json:"from,omitempty"`
+	To      *compareJob `json:"to,omitempty"`
+}
+
+// compareCounts counts the jobs of two repo pulls by how they
+// differ.
+type compareCounts struct {
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Changed   int `json:"changed"`
+	Unchanged int `json:"unchanged"`
+}
+
+// compareRepoPull is the part of each compared repo pull that is
+// shown with the comparison.
+type compareRepoPull struct {
+	ID     uint32           `json:"id"`
+	Branch string           `json:"branch"`
+	Commit string           `json:"commit"`
+	Tag    string           `json:"tag,omitempty"`
+	Status datastore.Status `json:"status"`
+	Health datastore.Health `json:"health"`
+}
+
+func newCompareRepoPull(rp *datastore.RepoPull) *compareRepoPull {
+	return &compareRepoPull{
+		ID:     rp.ID,
+		Branch: rp.Branch,
+		Commit: rp.Commit,
+		Tag:    rp.Tag,
+		Status: rp.Status,
+		Health: rp.Health,
+	}
+}
+
+// compareJobs pairs up the jobs of two repo pulls by agent, and
+// returns how the pairs differ, with counts of each kind of change.
+// An agent's jobs are paired in ID order; any left over were added
+// to, or removed from, the second repo pull. Pairs whose status and
+// health are the same are only counted.
+func compareJobs(fromJobs []*datastore.Job, toJobs []*datastore.Job) ([]*jobChange, *compareCounts) {
+	byAgent := func(jobs []*datastore.Job) map[uint32][]*datastore.Job {
+		m := map[uint32][]*datastore.Job{}
+		for _, j := range jobs {
+			m[j.AgentID] = append(m[j.AgentID], j)
+		}
+		for _, js := range m {
+			sort.Slice(js, func(i, k int) bool { return js[i].ID < js[k].ID })
+		}
+		return m
+	}
+	from, to := byAgent(fromJobs), byAgent(toJobs)
+
+	agentIDs := []uint32{}
+	for id := range from {
+		agentIDs = append(agentIDs, id)
+	}
+	for id := range to {
+		if _, ok := from[id]; !ok {
+			agentIDs = append(agentIDs, id)
+		}
+	}
+	sortIDs(agentIDs)
+
+	changes := []*jobChange{}
+	counts := &compareCounts{}
+	for _, agentID := range agentIDs {
+		fjs, tjs := from[agentID], to[agentID]
+		for i := 0; i < len(fjs) || i < len(tjs); i++ {
+			jc := &jobChange{AgentID: agentID}
+			if i < len(fjs) {
+				jc.From = &compareJob{ID: fjs[i].ID, Status: fjs[i].Status, Health: fjs[i].Health}
+			}
+			if i < len(tjs) {
+				jc.To = &compareJob{ID: tjs[i].ID, Status: tjs[i].Status, Health: tjs[i].Health}
+			}
+			switch {
+			case jc.From == nil:
+				jc.Change = jobChangeAdded
+				counts.Added++
+			case jc.To == nil:
+				jc.Change = jobChangeRemoved
+				counts.Removed++
+			case jc.From.Status != jc.To.Status || jc.From.Health != jc.To.Health:
+				jc.Change = jobChangeChanged
+				counts.Changed++
+			default:
+				counts.Unchanged++
+				continue
+			}
+			changes = append(changes, jc)
+		}
+	}
+	return changes, counts
+}
+
+// compareFiles pairs up the file instances of two repo pulls by
+// path, and returns how the pairs differ, in path order, with counts
+// of each kind of change. A pair is modified if its file hashes
+// differ; pairs with the same hash are only counted. A file that
+// was moved is removed from its old path and added at its new one.
+// The hashes' SHA256 values are not filled in.
+func compareFiles(fromFiles []*datastore.FileInstance, toFiles []*datastore.FileInstance) ([]*fileChange, *compareFileCounts) {
+	byPath := func(fis []*datastore.FileInstance) map[string]*datastore.FileInstance {
+		m := map[string]*datastore.FileInstance{}
+		for _, fi := range fis {
+			m[fi.Path] = fi
+		}
+		return m
+	}
+	from, to := byPath(fromFiles), byPath(toFiles)
+
+	paths := []string{}
+	for p := range from {
+		paths = append(paths, p)
+	}
+	for p := range to {
+		if _, ok := from[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	changes := []*fileChange{}
+	counts := &compareFileCounts{}
+	for _, p := range paths {
+		fc := &fileChange{Path: p}
+		if fi, ok := from[p]; ok {
+			fc.From = &compareFile{ID: fi.ID, FileHashID: fi.FileHashID}
+		}
+		if fi, ok := to[p]; ok {
+			fc.To = &compareFile{ID: fi.ID, FileHashID: fi.FileHashID}
+		}
+		switch {
+		case fc.From == nil:
+			fc.Change = fileChangeAdded
+			counts.Added++
+		case fc.To == nil:
+			fc.Change = fileChangeRemoved
+			counts.Removed++
+		case fc.From.FileHashID != fc.To.FileHashID:
+			fc.Change = fileChangeModified
+			counts.Modified++
+		default:
+			counts.Unchanged++
+			continue
+		}
+		changes = append(changes, fc)
+	}
+	return changes, counts
+}
+
+// ========== HANDLER for /repopulls/{id}/compare/{other}
+
+func (env *Env) repoPullsCompareHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be at least viewer
+	user := extractUser(w, r, datastore.AccessViewer)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get both repo pull IDs from vars
+	fromID, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid ID"}`)
+		return
+	}
+	toID64, err := strconv.ParseUint(mux.Vars(r)["other"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid ID to compare with"}`)
+		return
+	}
+	toID := uint32(toID64)
+
+	// the route hides a first repo pull in the trash; the second
+	// is checked here
+	from, err := env.db.GetRepoPullByID(fromID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown repopull ID"}`)
+		return
+	}
+	to, err := env.db.GetRepoPullByID(toID)
+	if err != nil || env.resourceHidden(resourceRepoPull, toID) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown repopull ID to compare with"}`)
+		return
+	}
+	if from.RepoID != to.RepoID {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Repo pulls %d and %d are of different repos; only pulls of the same repo can be compared"}`, fromID, toID)
+		return
+	}
+
+	// files can't be compared without a way to list them
+	lister, ok := env.db.(fileInstanceLister)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, `{"error": "Comparing files needs a datastore that can list the file instances of a repo pull"}`)
+		return
+	}
+	fromFiles, err := lister.GetAllFileInstancesForRepoPull(fromID)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+	toFiles, err := lister.GetAllFileInstancesForRepoPull(toID)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+	fileChanges, fileCounts := compareFiles(fromFiles, toFiles)
+
+	fromJobs, err := env.db.GetAllJobsForRepoPull(fromID)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+	toJobs, err := env.db.GetAllJobsForRepoPull(toID)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+	jobChanges, jobCounts := compareJobs(fromJobs, toJobs)
+	from, _ = rollUpRepoPull(from, fromJobs)
+	to, _ = rollUpRepoPull(to, toJobs)
+
+	// limit the files to the requested page, if any; the counts are
+	// always for all of them. A repo pull has few jobs, so they are
+	// all listed
+	start, end, ok := extractPage(w, r, len(fileChanges))
+	if !ok {
+		return
+	}
+	filesPage := fileChanges[start:end]
+
+	// and look up the hashes of just the files on the page
+	for _, fc := range filesPage {
+		for _, cf := range []*compareFile{fc.From, fc.To} {
+			if cf == nil {
+				continue
+			}
+			fh, err := env.db.GetFileHashByID(cf.FileHashID)
+			if err != nil {
+				fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+				return
+			}
+			cf.SHA256 = fh.HashSHA256
+		}
+	}
+
+	jsData := struct {
+		RepoID  uint32           `json:"repo_id"`
+		From    *compareRepoPull `json:"from"`
+		To      *compareRepoPull `json:"to"`
+		Summary struct {
+			Files *compareFileCounts `json:"files"`
+			Jobs  *compareCounts     `json:"jobs"`
+		} `json:"summary"`
+		Files []*fileChange `json:"files"`
+		Jobs  []*jobChange  `json:"jobs"`
+	}{
+		RepoID: from.RepoID,
+		From:   newCompareRepoPull(from),
+		To:     newCompareRepoPull(to),
+		Files:  filesPage,
+		Jobs:   jobChanges,
+	}
+	jsData.Summary.Files = fileCounts
+	jsData.Summary.Jobs = jobCounts
+	js, err := json.Marshal(jsData)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
+}
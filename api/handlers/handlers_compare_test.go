@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+
+	hu "github.com/swinslow/peridot-api/test/handlerutils"
+)
+
+// ===== GET /repopulls/1/compare/2 =====
+
+func TestCanCompareRepoPulls(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repopulls/1/compare/2", ``, "viewer", env.repoPullsCompareHandler, "/repopulls/{id}/compare/{other}")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"repo_id": 2,
+		"from": {"id": 1, "branch": "master", "commit": "abcdef012345abcdef012345abcdef0123451234", "tag": "v1.1", "status": "stopped", "health": "error"},
+		"to": {"id": 2, "branch": "master", "commit": "abcdef012345abcdef012345abcdef0123455678", "tag": "v1.2", "status": "running", "health": "degraded"},
+		"summary": {"files": {"added": 1, "removed": 1, "modified": 1, "unchanged": 2}, "jobs": {"added": 4, "removed": 0, "changed": 1, "unchanged": 0}},
+		"files": [
+			{"path": "src/main.go", "change": "modified", "from": {"id": 3, "file_hash_id": 3, "sha256": "3333333333333333333333333333333333333333333333333333333333333333"}, "to": {"id": 7, "file_hash_id": 5, "sha256": "5555555555555555555555555555555555555555555555555555555555555555"}},
+			{"path": "src/new.go", "change": "added", "to": {"id": 8, "file_hash_id": 4, "sha256": "4444444444444444444444444444444444444444444444444444444444444444"}},
+			{"path": "src/old.go", "change": "removed", "from": {"id": 4, "file_hash_id": 4, "sha256": "4444444444444444444444444444444444444444444444444444444444444444"}}
+		],
+		"jobs": [
+			{"agent_id": 1, "change": "added", "to": {"id": 5, "status": "stopped", "health": "ok"}},
+			{"agent_id": 1, "change": "added", "to": {"id": 6, "status": "stopped", "health": "ok"}},
+			{"agent_id": 4, "change": "changed", "from": {"id": 1, "status": "stopped", "health": "error"}, "to": {"id": 2, "status": "stopped", "health": "ok"}},
+			{"agent_id": 5, "change": "added", "to": {"id": 7, "status": "running", "health": "degraded"}},
+			{"agent_id": 6, "change": "added", "to": {"id": 8, "status": "startup", "health": "ok"}}
+		]}`
+	hu.CheckResponse(t, rec, wanted)
+}
+
+func TestCanCompareRepoPullsBackwardsByPage(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repopulls/2/compare/1?offset=1&limit=1", ``, "viewer", env.repoPullsCompareHandler, "/repopulls/{id}/compare/{other}")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"repo_id": 2,
+		"from": {"id": 2, "branch": "master", "commit": "abcdef012345abcdef012345abcdef0123455678", "tag": "v1.2", "status": "running", "health": "degraded"},
+		"to": {"id": 1, "branch": "master", "commit": "abcdef012345abcdef012345abcdef0123451234", "tag": "v1.1", "status": "stopped", "health": "error"},
+		"summary": {"files": {"added": 1, "removed": 1, "modified": 1, "unchanged": 2}, "jobs": {"added": 0, "removed": 4, "changed": 1, "unchanged": 0}},
+		"files": [
+			{"path": "src/new.go", "change": "removed", "from": {"id": 8, "file_hash_id": 4, "sha256": "4444444444444444444444444444444444444444444444444444444444444444"}}
+		],
+		"jobs": [
+			{"agent_id": 1, "change": "removed", "from": {"id": 5, "status": "stopped", "health": "ok"}},
+			{"agent_id": 1, "change": "removed", "from": {"id": 6, "status": "stopped", "health": "ok"}},
+			{"agent_id": 4, "change": "changed", "from": {"id": 2, "status": "stopped", "health": "ok"}, "to": {"id": 1, "status": "stopped", "health": "error"}},
+			{"agent_id": 5, "change": "removed", "from": {"id": 7, "status": "running", "health": "degraded"}},
+			{"agent_id": 6, "change": "removed", "from": {"id": 8, "status": "startup", "health": "ok"}}
+		]}`
+	hu.CheckResponse(t, rec, wanted)
+	if got := rec.Header().Get("X-Total-Count"); got != "3" {
+		t.Errorf("expected X-Total-Count 3, got %q", got)
+	}
+}
+
+func TestComparingRepoPullWithItselfHasNoChanges(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repopulls/2/compare/2", ``, "viewer", env.repoPullsCompareHandler, "/repopulls/{id}/compare/{other}")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"repo_id": 2,
+		"from": {"id": 2, "branch": "master", "commit": "abcdef012345abcdef012345abcdef0123455678", "tag": "v1.2", "status": "running", "health": "degraded"},
+		"to": {"id": 2, "branch": "master", "commit": "abcdef012345abcdef012345abcdef0123455678", "tag": "v1.2", "status": "running", "health": "degraded"},
+		"summary": {"files": {"added": 0, "removed": 0, "modified": 0, "unchanged": 4}, "jobs": {"added": 0, "removed": 0, "changed": 0, "unchanged": 5}},
+		"files": [],
+		"jobs": []}`
+	hu.CheckResponse(t, rec, wanted)
+}
+
+func TestCannotCompareRepoPullsOfDifferentRepos(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repopulls/1/compare/3", ``, "viewer", env.repoPullsCompareHandler, "/repopulls/{id}/compare/{other}")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Repo pulls 1 and 3 are of different repos; only pulls of the same repo can be compared"}`)
+}
+
+func TestCannotCompareWithUnknownOrTrashedRepoPull(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repopulls/1/compare/413", ``, "viewer", env.repoPullsCompareHandler, "/repopulls/{id}/compare/{other}")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unknown repopull ID to compare with"}`)
+
+	rec = serveTestRequest(t, env, "DELETE", "/repos/4", ``, "admin", env.reposOneHandler, "/repos/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+	rec = serveTestRequest(t, env, "GET", "/repopulls/1/compare/3", ``, "viewer", env.repoPullsCompareHandler, "/repopulls/{id}/compare/{other}")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unknown repopull ID to compare with"}`)
+}
+
+func TestCannotCompareRepoPullsAsBadUser(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repopulls/1/compare/2", ``, "disabled", env.repoPullsCompareHandler, "/repopulls/{id}/compare/{other}")
+	hu.ConfirmAccessDenied(t, rec)
+}
+
+// jobsOnlyDB is a datastore that can't list a repo pull's file
+// instances, like peridot-db's for now.
+type jobsOnlyDB struct {
+	datastore.Datastore
+}
+
+func TestCannotCompareRepoPullsWithoutFileInstances(t *testing.T) {
+	env := getTestEnv()
+	env.db = jobsOnlyDB{env.db}
+	rec := serveTestRequest(t, env, "GET", "/repopulls/1/compare/2", ``, "viewer", env.repoPullsCompareHandler, "/repopulls/{id}/compare/{other}")
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("expected %d, got %d", http.StatusNotImplemented, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Comparing files needs a datastore that can list the file instances of a repo pull"}`)
+}
@@ -0,0 +1,239 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+const (
+	// sseKeepAlive is how often a comment is sent on an idle event
+	// stream, so that proxies do not close the connection.
+	sseKeepAlive = 30 * time.Second
+	// sseBufferSize is how many events can be waiting to be sent to
+	// one client. If a client falls further behind than this, its
+	// stream is closed, and it can resume with Last-Event-ID.
+	sseBufferSize = 256
+)
+
+// streamEventTypes are the event types that are sent on event
+// streams.
+var streamEventTypes = map[string]bool{
+	EventRepoPullCreated:       true,
+	EventRepoPullStatusChanged: true,
+	EventRepoPullDeleted:       true,
+	EventJobCreated:            true,
+	EventJobStatusChanged:      true,
+	EventJobDeleted:            true,
+}
+
+// eventSubject returns the IDs of the job and repo pull that an
+// event is about. The job ID is 0 for repo pull events.
+func eventSubject(ev *event) (uint32, uint32) {
+	data, ok := ev.Data.(map[string]interface{})
+	if !ok {
+		return 0, 0
+	}
+	if job, ok := data["job"].(*datastore.Job); ok {
+		return job.ID, job.RepoPullID
+	}
+	if rp, ok := data["repopull"].(*datastore.RepoPull); ok {
+		return 0, rp.ID
+	}
+	return 0, 0
+}
+
+// streamEvents sends matching events to the client as Server-Sent
+// Events, until the client goes away. If the request has a
+// Last-Event-ID header, events since then are sent first; if some
+// of them are no longer available, a "reset" event is sent so that
+// the client knows to reload its data.
+func (env *Env) streamEvents(w http.ResponseWriter, r *http.Request, match func(*event) bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Streaming is not supported"}`)
+		return
+	}
+
+	var lastID uint64
+	lastIDStr := r.Header.Get("Last-Event-ID")
+	if lastIDStr != "" {
+		var err error
+		lastID, err = strconv.ParseUint(lastIDStr, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'Last-Event-ID'"}`)
+			return
+		}
+	}
+
+	// the event bus calls send while it is locked, so it must not
+	// block; if the buffer is full, give up on this client
+	ch := make(chan *event, sseBufferSize)
+	overflow := make(chan struct{})
+	overflowed := false
+	send := func(ev *event) {
+		if overflowed || !streamEventTypes[ev.Type] || !match(ev) {
+			return
+		}
+		select {
+		case ch <- ev:
+		default:
+			overflowed = true
+			close(overflow)
+		}
+	}
+	var cancel func()
+	complete := true
+	if lastIDStr != "" {
+		cancel, complete = env.events.subscribeSince(lastID, send)
+	} else {
+		cancel = env.events.subscribe(send)
+	}
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if complete {
+		fmt.Fprintf(w, ": connected\n\n")
+	} else {
+		fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-overflow:
+			return
+		case ev := <-ch:
+			js, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, js)
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// ========== HANDLER for /events
+
+func (env *Env) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	// error responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be at least viewer
+	user := extractUser(w, r, datastore.AccessViewer)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; stream all events
+	env.streamEvents(w, r, func(ev *event) bool { return true })
+}
+
+// ========== HANDLER for /repopulls/{id}/events
+
+func (env *Env) repoPullEventsHandler(w http.ResponseWriter, r *http.Request) {
+	// error responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be at least viewer
+	user := extractUser(w, r, datastore.AccessViewer)
+	if user == nil {
+		return
+	}
+
+	// sufficient access
+	// extract ID for request
+	rpID, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid ID"}`)
+		return
+	}
+	if _, err := env.db.GetRepoPullByID(rpID); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown repo pull ID"}`)
+		return
+	}
+
+	// stream events for this repo pull and its jobs
+	env.streamEvents(w, r, func(ev *event) bool {
+		_, evRepoPullID := eventSubject(ev)
+		return evRepoPullID == rpID
+	})
+}
+
+// ========== HANDLER for /jobs/{id}/events
+
+func (env *Env) jobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	// error responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be at least viewer
+	user := extractUser(w, r, datastore.AccessViewer)
+	if user == nil {
+		return
+	}
+
+	// sufficient access
+	// extract ID for request
+	jobID, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid ID"}`)
+		return
+	}
+	if _, err := env.db.GetJobByID(jobID); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown job ID"}`)
+		return
+	}
+
+	// stream events for this job
+	env.streamEvents(w, r, func(ev *event) bool {
+		evJobID, _ := eventSubject(ev)
+		return evJobID == jobID
+	})
+}
@@ -0,0 +1,274 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/swinslow/peridot-db/pkg/datastore"
+
+	"github.com/swinslow/peridot-api/internal/auth"
+	hu "github.com/swinslow/peridot-api/test/handlerutils"
+)
+
+// sseMessage is one message read from an event stream; comments
+// are returned with Event set to ":".
+type sseMessage struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// openEventStream starts a test server and opens an event stream
+// on it as the given user, returning a channel of the messages
+// received and a function to close everything down.
+func openEventStream(t *testing.T, env *Env, path string, lastEventID string, ghUsername string) (<-chan sseMessage, func()) {
+	router := mux.NewRouter()
+	env.RegisterHandlers(router)
+	srv := httptest.NewServer(router)
+
+	token, err := auth.EncodeToken(env.jwtSecretKey, ghUsername)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	req, err := http.NewRequest("GET", srv.URL+path, nil)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %s", ct)
+	}
+
+	msgs := make(chan sseMessage, 100)
+	go func() {
+		defer close(msgs)
+		scanner := bufio.NewScanner(resp.Body)
+		msg := sseMessage{}
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				msgs <- msg
+				msg = sseMessage{}
+			case strings.HasPrefix(line, ":"):
+				msg.Event = ":"
+			case strings.HasPrefix(line, "id: "):
+				msg.ID = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				msg.Event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				msg.Data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+
+	return msgs, func() {
+		resp.Body.Close()
+		srv.Close()
+	}
+}
+
+// nextMessage waits for the next message on an event stream.
+func nextMessage(t *testing.T, msgs <-chan sseMessage) sseMessage {
+	select {
+	case msg, ok := <-msgs:
+		if !ok {
+			t.Fatalf("event stream closed unexpectedly")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for event")
+	}
+	return sseMessage{}
+}
+
+func TestEventStreamSendsRepoPullJobChanges(t *testing.T) {
+	env := getTestEnv()
+	if err := env.pollChanges(); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	msgs, done := openEventStream(t, env, "/repopulls/2/events", "", "viewer")
+	defer done()
+	if msg := nextMessage(t, msgs); msg.Event != ":" {
+		t.Fatalf("expected initial comment, got %#v", msg)
+	}
+
+	// job 1 is in a different repo pull, so only job 7 is sent
+	for _, id := range []uint32{1, 7} {
+		err := env.db.UpdateJobStatus(id, time.Time{}, time.Time{}, datastore.StatusStopped, datastore.HealthOK, "")
+		if err != nil {
+			t.Fatalf("got non-nil error: %v", err)
+		}
+	}
+	if err := env.pollChanges(); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	msg := nextMessage(t, msgs)
+	if msg.Event != EventJobStatusChanged {
+		t.Fatalf("expected %s, got %#v", EventJobStatusChanged, msg)
+	}
+	var got struct {
+		Seq  uint64 `json:"seq"`
+		Data struct {
+			Job            *datastore.Job   `json:"job"`
+			PreviousStatus datastore.Status `json:"previous_status"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(msg.Data), &got); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if got.Data.Job.ID != 7 || got.Data.Job.Status != datastore.StatusStopped || got.Data.PreviousStatus != datastore.StatusRunning {
+		t.Errorf("unexpected event data: %s", msg.Data)
+	}
+	if msg.ID != "2" {
+		t.Errorf("expected id %s, got %s", "2", msg.ID)
+	}
+
+	// then the repo pull (after repo pull 1, which isn't sent), whose
+	// health is derived from its jobs and so is no longer degraded
+	msg = nextMessage(t, msgs)
+	if msg.Event != EventRepoPullStatusChanged || msg.ID != "4" {
+		t.Errorf("expected %s with id 4, got %#v", EventRepoPullStatusChanged, msg)
+	}
+
+	// and a job deleted through the API is sent once, followed by
+	// the repo pull stopping, as its other jobs have all stopped
+	rec := serveTestRequest(t, env, "DELETE", "/jobs/8", ``, "admin", env.jobsOneHandler, "/jobs/{id:[0-9]+}")
+	hu.ConfirmNoContentResponse(t, rec)
+	if err := env.pollChanges(); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	msg = nextMessage(t, msgs)
+	if msg.Event != EventJobDeleted || msg.ID != "5" {
+		t.Errorf("expected %s with id 5, got %#v", EventJobDeleted, msg)
+	}
+	msg = nextMessage(t, msgs)
+	if msg.Event != EventRepoPullStatusChanged || msg.ID != "6" {
+		t.Errorf("expected %s with id 6, got %#v", EventRepoPullStatusChanged, msg)
+	}
+	env.events.publish(EventRepoPullCreated, map[string]interface{}{"repopull": &datastore.RepoPull{ID: 2}})
+	msg = nextMessage(t, msgs)
+	if msg.ID != "7" {
+		t.Errorf("expected only one job.deleted event, got %#v", msg)
+	}
+}
+
+func TestWatcherLeavesChangesMadeWhileReadingToTheAPI(t *testing.T) {
+	env := getTestEnv()
+	if err := env.pollChanges(); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	// read the datastore as pollChanges does, before the lock is
+	// taken again to compare
+	env.watcher.mu.Lock()
+	env.watcher.touchedRepoPulls = map[uint32]bool{}
+	env.watcher.touchedJobs = map[uint32]bool{}
+	env.watcher.mu.Unlock()
+	rps, err := env.getAllRepoPulls()
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	jobs, err := env.getJobsForRepoPulls(rps)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	agents, err := env.db.GetAllAgents()
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	// meanwhile, a job is created and another deleted through the API
+	rec := serveTestRequest(t, env, "POST", "/repopulls/3/jobs", `{"agent_id": 5, "priorjob_ids": [3], "is_ready": false, "config": {}}`, "operator", env.jobsSubHandler, "/repopulls/{id}/jobs")
+	hu.ConfirmCreatedResponse(t, rec)
+	rec = serveTestRequest(t, env, "DELETE", "/jobs/1", ``, "admin", env.jobsOneHandler, "/jobs/{id:[0-9]+}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	// so comparing what was read publishes nothing more about them
+	got := []string{}
+	unsubscribe := env.events.subscribe(func(ev *event) { got = append(got, ev.Type) })
+	defer unsubscribe()
+	env.watcher.mu.Lock()
+	env.compareChanges(rps, jobs, agents)
+	env.watcher.mu.Unlock()
+	if len(got) != 0 {
+		t.Errorf("expected no events, got %v", got)
+	}
+	if _, ok := env.watcher.jobs[9]; !ok {
+		t.Errorf("expected created job to still be known")
+	}
+	if _, ok := env.watcher.jobs[1]; ok {
+		t.Errorf("expected deleted job to stay forgotten")
+	}
+
+	// and the next poll doesn't either, apart from repo pull 1's
+	// status, which is derived from its remaining jobs
+	if err := env.pollChanges(); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	for _, typ := range got {
+		if typ != EventRepoPullStatusChanged {
+			t.Errorf("expected only %s, got %v", EventRepoPullStatusChanged, got)
+		}
+	}
+}
+
+func TestEventStreamResumesFromLastEventID(t *testing.T) {
+	env := getTestEnv()
+	for i := uint32(1); i <= 3; i++ {
+		env.events.publish(EventJobCreated, map[string]interface{}{"job": &datastore.Job{ID: 10 + i, RepoPullID: 2}})
+	}
+
+	msgs, done := openEventStream(t, env, "/events", "1", "viewer")
+	defer done()
+	if msg := nextMessage(t, msgs); msg.Event != ":" {
+		t.Fatalf("expected initial comment, got %#v", msg)
+	}
+	for _, wanted := range []string{"2", "3"} {
+		msg := nextMessage(t, msgs)
+		if msg.ID != wanted || msg.Event != EventJobCreated {
+			t.Errorf("expected %s with id %s, got %#v", EventJobCreated, wanted, msg)
+		}
+	}
+
+	// an ID from before a restart can't be resumed from
+	msgs2, done2 := openEventStream(t, env, "/events", "17", "viewer")
+	defer done2()
+	if msg := nextMessage(t, msgs2); msg.Event != "reset" {
+		t.Errorf("expected reset, got %#v", msg)
+	}
+}
+
+func TestCannotGetEventStreamUnlessViewer(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/events", "", "disabled")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.eventsHandler), "/events")
+	hu.ConfirmAccessDenied(t, rec)
+}
+
+func TestCannotGetEventStreamWithInvalidLastEventID(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/events", "", "viewer")
+	req.Header.Set("Last-Event-ID", "abc")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.eventsHandler), "/events")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'Last-Event-ID'"}`)
+}
@@ -0,0 +1,238 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/swinslow/peridot-api/internal/auth"
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// githubImported is a repo created by a Github import.
+type githubImported struct {
+	ID      uint32 `json:"id,omitempty"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	// Branch is the repo's default branch, if it was registered.
+	Branch string `json:"branch,omitempty"`
+}
+
+// githubSkipped is a Github repository that was not imported.
+type githubSkipped struct {
+	Name string `json:"name"`
+	// Reason is "excluded", "archived", "fork" or "exists".
+	Reason string `json:"reason"`
+}
+
+// ========== HANDLER for /subprojects/{id}/repos/github
+
+func (env *Env) reposGithubImportHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be at least operator
+	user := extractUser(w, r, datastore.AccessOperator)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get subproject id from vars
+	subprojectID, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid subproject ID"}`)
+		return
+	}
+	dryRun := false
+	if s := r.URL.Query().Get("dry_run"); s != "" {
+		dryRun, err = strconv.ParseBool(s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'dry_run'"}`)
+			return
+		}
+	}
+
+	// parse JSON request
+	js := struct {
+		Org          string   `json:"org"`
+		User         string   `json:"user"`
+		Include      []string `json:"include"`
+		Exclude      []string `json:"exclude"`
+		SkipArchived bool     `json:"skip_archived"`
+		SkipForks    bool     `json:"skip_forks"`
+	}{}
+	err = json.NewDecoder(r.Body).Decode(&js)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+		return
+	}
+	if (js.Org == "") == (js.User == "") {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Exactly one of 'org' or 'user' is required"}`)
+		return
+	}
+	for _, p := range append(js.Include, js.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": %q}`, fmt.Sprintf("Invalid pattern %q", p))
+			return
+		}
+	}
+
+	if _, err := env.db.GetSubprojectByID(subprojectID); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown subproject ID"}`)
+		return
+	}
+
+	// list the repositories on Github
+	owner, isUser := js.Org, false
+	if js.User != "" {
+		owner, isUser = js.User, true
+	}
+	ghRepos, err := auth.ListGithubRepos(r.Context(), env.githubAPIURL, env.githubToken, owner, isUser)
+	if err == auth.ErrGithubOwnerNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown Github organization or user"}`)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, `{"error": "Unable to list Github repositories"}`)
+		return
+	}
+
+	// creating many repos is a sequence of separate changes, so
+	// it must not interleave with batches or manifests
+	env.batchMu.Lock()
+	defer env.batchMu.Unlock()
+
+	// repos that are already registered anywhere are skipped
+	existing, err := env.db.GetAllRepos()
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+	registered := map[string]bool{}
+	for _, repo := range existing {
+		registered[repoAddressKey(repo.Address)] = true
+	}
+
+	imported := []*githubImported{}
+	skipped := []*githubSkipped{}
+	for _, ghr := range ghRepos {
+		address := ghr.CloneURL
+		if ra, err := parseRepoAddress(address); err == nil {
+			address = ra.String()
+		}
+		reason := ""
+		switch {
+		case !matchesAnyPattern(ghr.Name, js.Include, true) || matchesAnyPattern(ghr.Name, js.Exclude, false):
+			reason = "excluded"
+		case js.SkipArchived && ghr.Archived:
+			reason = "archived"
+		case js.SkipForks && ghr.Fork:
+			reason = "fork"
+		case registered[repoAddressKey(address)]:
+			reason = "exists"
+		}
+		if reason != "" {
+			skipped = append(skipped, &githubSkipped{Name: ghr.Name, Reason: reason})
+			continue
+		}
+
+		imp := &githubImported{Name: ghr.Name, Address: address}
+		// an empty repository has no default branch
+		if checkBranchName(ghr.DefaultBranch) == nil {
+			imp.Branch = ghr.DefaultBranch
+		}
+		if dryRun {
+			imported = append(imported, imp)
+			continue
+		}
+
+		// a repo only counts as imported once its branch is
+		// registered too
+		newID, err := env.db.AddRepo(subprojectID, imp.Name, imp.Address)
+		if err != nil {
+			githubImportFailed(w, fmt.Sprintf("Unable to import repo %s; earlier repos were imported", imp.Name), imported, nil)
+			return
+		}
+		imp.ID = newID
+		env.events.publish(EventRepoCreated, map[string]interface{}{
+			"repo": &datastore.Repo{ID: newID, SubprojectID: subprojectID, Name: imp.Name, Address: imp.Address},
+		})
+		if imp.Branch != "" {
+			if err := env.db.AddRepoBranch(newID, imp.Branch); err != nil {
+				githubImportFailed(w, fmt.Sprintf("Repo %s was created, but unable to register its branch %s; earlier repos were imported", imp.Name, imp.Branch), imported, imp)
+				return
+			}
+			env.events.publish(EventBranchCreated, map[string]interface{}{
+				"branch": &datastore.RepoBranch{RepoID: newID, Branch: imp.Branch},
+			})
+		}
+		imported = append(imported, imp)
+		registered[repoAddressKey(imp.Address)] = true
+	}
+
+	// create map so we return a JSON object
+	jsData := struct {
+		DryRun   bool              `json:"dry_run"`
+		Imported []*githubImported `json:"imported"`
+		Skipped  []*githubSkipped  `json:"skipped"`
+	}{DryRun: dryRun, Imported: imported, Skipped: skipped}
+	rjs, err := json.Marshal(jsData)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(rjs)
+}
+
+// githubImportFailed writes the response for an import that failed
+// part way through: the repos imported before it, and partial, a
+// repo that was created without its branch, if any.
+func githubImportFailed(w http.ResponseWriter, msg string, imported []*githubImported, partial *githubImported) {
+	jsData := struct {
+		Error    string            `json:"error"`
+		Imported []*githubImported `json:"imported"`
+		Partial  *githubImported   `json:"partial,omitempty"`
+	}{Error: msg, Imported: imported, Partial: partial}
+	rjs, err := json.Marshal(jsData)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(rjs)
+}
+
+// matchesAnyPattern returns whether name matches any of the glob
+// patterns, or ifEmpty if there are none.
+func matchesAnyPattern(name string, patterns []string, ifEmpty bool) bool {
+	if len(patterns) == 0 {
+		return ifEmpty
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
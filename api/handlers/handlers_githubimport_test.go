@@ -0,0 +1,183 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	hu "github.com/swinslow/peridot-api/test/handlerutils"
+)
+
+// fakeGithub serves the parts of the Github API used to list an
+// organization's or user's repositories. The "peridot-org"
+// organization's repositories are split over two pages.
+func fakeGithub(t *testing.T) *httptest.Server {
+	pages := map[string][]string{
+		"/orgs/peridot-org/repos": {
+			`[{"name": "peridot-api", "clone_url": "https://github.com/peridot-org/peridot-api.git", "default_branch": "master"},
+			  {"name": "peridot-db", "clone_url": "https://example.com/repo1.git", "default_branch": "master"},
+			  {"name": "old-tool", "clone_url": "https://github.com/peridot-org/old-tool.git", "default_branch": "master", "archived": true}]`,
+			`[{"name": "forked-lib", "clone_url": "https://github.com/peridot-org/forked-lib.git", "default_branch": "main", "fork": true},
+			  {"name": "peridot-empty", "clone_url": "https://github.com/peridot-org/peridot-empty.git"},
+			  {"name": "docs", "clone_url": "https://github.com/peridot-org/docs.git", "default_branch": "gh-pages"}]`,
+		},
+		"/users/someone/repos": {
+			`[{"name": "dotfiles", "clone_url": "https://github.com/someone/dotfiles.git", "default_branch": "main"}]`,
+		},
+	}
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ghtoken" {
+			t.Errorf("expected Github token, got %q", r.Header.Get("Authorization"))
+		}
+		ps, ok := pages[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"message": "Not Found"}`)
+			return
+		}
+		page := 1
+		fmt.Sscanf(r.URL.Query().Get("page"), "%d", &page)
+		if page < len(ps) {
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=%d>; rel="next"`, srv.URL, r.URL.Path, page+1))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, ps[page-1])
+	}))
+	return srv
+}
+
+// ===== POST /subprojects/{id}/repos/github =====
+
+func TestCanImportGithubReposHandler(t *testing.T) {
+	srv := fakeGithub(t)
+	defer srv.Close()
+
+	rec, req, env := setupTestEnv(t, "POST", "/subprojects/3/repos/github", `{"org": "peridot-org", "exclude": ["docs"], "skip_archived": true, "skip_forks": true}`, "operator")
+	env.githubAPIURL, env.githubToken = srv.URL, "ghtoken"
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.reposGithubImportHandler), "/subprojects/{id:[0-9]+}/repos/github")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"dry_run": false,
+		"imported": [
+			{"id": 5, "name": "peridot-api", "address": "https://github.com/peridot-org/peridot-api.git", "branch": "master"},
+			{"id": 6, "name": "peridot-empty", "address": "https://github.com/peridot-org/peridot-empty.git"}
+		],
+		"skipped": [
+			{"name": "peridot-db", "reason": "exists"},
+			{"name": "old-tool", "reason": "archived"},
+			{"name": "forked-lib", "reason": "fork"},
+			{"name": "docs", "reason": "excluded"}
+		]}`
+	hu.CheckResponse(t, rec, wanted)
+
+	repos, _ := env.db.GetAllReposForSubprojectID(3)
+	if len(repos) != 2 {
+		t.Fatalf("expected %d repos, got %d", 2, len(repos))
+	}
+	branches, _ := env.db.GetAllRepoBranchesForRepoID(5)
+	if len(branches) != 1 || branches[0].Branch != "master" {
+		t.Errorf("unexpected branches: %#v", branches)
+	}
+	// repo and branch created events, then another repo created
+	if env.events.seq != 3 {
+		t.Errorf("expected %d events, got %d", 3, env.events.seq)
+	}
+}
+
+func TestCanImportGithubReposHandlerDryRun(t *testing.T) {
+	srv := fakeGithub(t)
+	defer srv.Close()
+
+	rec, req, env := setupTestEnv(t, "POST", "/subprojects/3/repos/github?dry_run=true", `{"user": "someone", "include": ["dot*"]}`, "operator")
+	env.githubAPIURL, env.githubToken = srv.URL, "ghtoken"
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.reposGithubImportHandler), "/subprojects/{id:[0-9]+}/repos/github")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"dry_run": true, "imported": [{"name": "dotfiles", "address": "https://github.com/someone/dotfiles.git", "branch": "main"}], "skipped": []}`)
+
+	repos, _ := env.db.GetAllReposForSubprojectID(3)
+	if len(repos) != 0 {
+		t.Errorf("expected %d repos, got %d", 0, len(repos))
+	}
+}
+
+func TestCannotImportGithubReposForUnknownOwner(t *testing.T) {
+	srv := fakeGithub(t)
+	defer srv.Close()
+
+	rec, req, env := setupTestEnv(t, "POST", "/subprojects/3/repos/github", `{"org": "nobody"}`, "operator")
+	env.githubAPIURL, env.githubToken = srv.URL, "ghtoken"
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.reposGithubImportHandler), "/subprojects/{id:[0-9]+}/repos/github")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unknown Github organization or user"}`)
+}
+
+func TestCannotImportGithubReposWithInvalidValues(t *testing.T) {
+	tests := []struct {
+		body  string
+		error string
+	}{
+		{`{}`, `Exactly one of 'org' or 'user' is required`},
+		{`{"org": "peridot-org", "user": "someone"}`, `Exactly one of 'org' or 'user' is required`},
+		{`{"org": "peridot-org", "include": ["[a-"]}`, `Invalid pattern \"[a-\"`},
+	}
+	for _, tc := range tests {
+		rec, req, env := setupTestEnv(t, "POST", "/subprojects/3/repos/github", tc.body, "operator")
+		hu.ServeHandler(rec, req, http.HandlerFunc(env.reposGithubImportHandler), "/subprojects/{id:[0-9]+}/repos/github")
+		hu.ConfirmBadRequestResponse(t, rec)
+		hu.CheckResponse(t, rec, `{"error": "`+tc.error+`"}`)
+	}
+
+	rec, req, env := setupTestEnv(t, "POST", "/subprojects/17/repos/github", `{"org": "peridot-org"}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.reposGithubImportHandler), "/subprojects/{id:[0-9]+}/repos/github")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestCannotImportGithubReposAsBadUser(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/subprojects/3/repos/github", `{"org": "peridot-org"}`, "commenter")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.reposGithubImportHandler), "/subprojects/{id:[0-9]+}/repos/github")
+	hu.ConfirmAccessDenied(t, rec)
+}
+
+func TestImportGithubReposReportsRepoCreatedWithoutBranch(t *testing.T) {
+	srv := fakeGithub(t)
+	defer srv.Close()
+
+	// the mock datastore keeps the branches of a deleted repo, so a
+	// new repo given repo 4's ID can't register its master branch
+	env := getTestEnv()
+	env.githubAPIURL, env.githubToken = srv.URL, "ghtoken"
+	if err := env.db.DeleteRepo(4); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	rec := serveTestRequest(t, env, "POST", "/subprojects/3/repos/github", `{"org": "peridot-org", "include": ["peridot-api", "peridot-empty"]}`, "operator", env.reposGithubImportHandler, "/subprojects/{id:[0-9]+}/repos/github")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Repo peridot-api was created, but unable to register its branch master; earlier repos were imported",
+		"imported": [],
+		"partial": {"id": 4, "name": "peridot-api", "address": "https://github.com/peridot-org/peridot-api.git", "branch": "master"}}`)
+
+	// and an import that fails to create a repo lists only the
+	// repos that were fully imported
+	env = getTestEnv()
+	env.githubAPIURL, env.githubToken = srv.URL, "ghtoken"
+	if _, err := env.db.AddRepo(3, "peridot-empty", "https://example.com/other.git"); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	rec = serveTestRequest(t, env, "POST", "/subprojects/3/repos/github", `{"org": "peridot-org", "include": ["peridot-api", "peridot-empty"]}`, "operator", env.reposGithubImportHandler, "/subprojects/{id:[0-9]+}/repos/github")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unable to import repo peridot-empty; earlier repos were imported",
+		"imported": [{"id": 6, "name": "peridot-api", "address": "https://github.com/peridot-org/peridot-api.git", "branch": "master"}]}`)
+}
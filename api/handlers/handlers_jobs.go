@@ -51,9 +51,15 @@ func (env *Env) jobsSubGetHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(jobs))
+	if !ok {
+		return
+	}
+
 	// create map so we return a JSON object
 	jobsMap := map[string][]*datastore.Job{}
-	jobsMap["jobs"] = jobs
+	jobsMap["jobs"] = jobs[start:end]
 	js, err := json.Marshal(jobsMap)
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
@@ -152,6 +158,9 @@ func (env *Env) jobsSubPostHelper(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if job, err := env.db.GetJobByID(newID); err == nil {
+		env.publishJobEvent(EventJobCreated, job)
+	}
 
 	// success!
 	w.WriteHeader(http.StatusCreated)
@@ -168,12 +177,12 @@ func (env *Env) jobsOneHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		env.jobsOneGetHelper(w, r)
-	case "PUT":
+	case "PUT", "PATCH":
 		env.jobsOnePutHelper(w, r)
 	case "DELETE":
 		env.jobsOneDeleteHelper(w, r)
 	default:
-		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
@@ -201,6 +210,11 @@ func (env *Env) jobsOneGetHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// set the ETag, and stop here if the client's copy is current
+	if writeETag(w, r, job) {
+		return
+	}
+
 	// create map so we return a JSON object
 	jsData := struct {
 		Job *datastore.Job `json:"job"`
@@ -229,20 +243,26 @@ func (env *Env) jobsOnePutHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// hold the job until it has been changed (see resourceLocks)
+	defer env.locks.lock(resourceJob, jobID)()
+
 	// check job exists in database
-	_, err = env.db.GetJobByID(jobID)
+	job, err := env.db.GetJobByID(jobID)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, `{"error": "Unknown job ID"}`)
 		return
 	}
 
-	// parse JSON request
-	js := map[string]interface{}{}
-	err = json.NewDecoder(r.Body).Decode(&js)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+	// if the request is conditional, make sure the client
+	// is updating the current version
+	if !checkIfMatch(w, r, job) {
+		return
+	}
+
+	// parse JSON request (or merge patch, for PATCH)
+	js, ok := extractUpdateRequest(w, r, job)
+	if !ok {
 		return
 	}
 
@@ -253,7 +273,12 @@ func (env *Env) jobsOnePutHelper(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"error": "No new value specified for is_ready"}`)
 		return
 	}
-	newIsReady := newIsReadyStr.(bool)
+	newIsReady, ok := newIsReadyStr.(bool)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid value for 'is_ready'"}`)
+		return
+	}
 
 	// modify the job data
 	err = env.db.UpdateJobIsReady(jobID, newIsReady)
@@ -262,6 +287,9 @@ func (env *Env) jobsOnePutHelper(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"error": "Unable to update job"}`)
 		return
 	}
+	if job, err := env.db.GetJobByID(jobID); err == nil {
+		env.events.publish(EventJobUpdated, map[string]interface{}{"job": job})
+	}
 
 	// success!
 	w.WriteHeader(http.StatusNoContent)
@@ -283,6 +311,30 @@ func (env *Env) jobsOneDeleteHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// hold the job until it has been deleted (see resourceLocks)
+	defer env.locks.lock(resourceJob, jobID)()
+
+	// if the request is conditional, make sure the client
+	// is deleting the current version
+	if r.Header.Get("If-Match") != "" {
+		var current interface{}
+		if job, err := env.db.GetJobByID(jobID); err == nil {
+			current = job
+		}
+		if !checkIfMatch(w, r, current) {
+			return
+		}
+	}
+
+	// with ?dry_run, only report what deleting it would remove or
+	// change; large deletions must be confirmed
+	if !env.checkDeletion(w, r, resourceJob, jobID, "") {
+		return
+	}
+
+	// keep the job's details, for the event
+	job, _ := env.db.GetJobByID(jobID)
+
 	// delete the job
 	err = env.db.DeleteJob(jobID)
 	if err != nil {
@@ -290,6 +342,9 @@ func (env *Env) jobsOneDeleteHelper(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"error": "Unable to delete job"}`)
 		return
 	}
+	if job != nil {
+		env.publishJobEvent(EventJobDeleted, job)
+	}
 
 	// success!
 	w.WriteHeader(http.StatusNoContent)
@@ -181,6 +181,29 @@ func TestCannotPutJobsOneHandlerAsCommenter(t *testing.T) {
 	helperCompareJobs(t, wantedJob, gotJob)
 }
 
+// ===== PATCH /jobs/3 =====
+
+func TestCanPatchJobsOneHandlerAsOperator(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PATCH", "/jobs/4", `{"is_ready": true}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.jobsOneHandler), "/jobs/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	// and verify state of database now
+	job, err := env.db.GetJobByID(4)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if job.IsReady != true {
+		t.Errorf("expected %v, got %v", true, job.IsReady)
+	}
+}
+
+func TestCannotPatchJobsOneHandlerWithNonUpdateableValue(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PATCH", "/jobs/4", `{"agent_id": 2}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.jobsOneHandler), "/jobs/{id}")
+	hu.ConfirmBadRequestResponse(t, rec)
+}
+
 // ===== DELETE /jobs/3 =====
 
 func TestCanDeleteJobsOneHandlerAsAdmin(t *testing.T) {
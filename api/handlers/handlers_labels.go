@@ -0,0 +1,160 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// ========== HANDLERS for /{projects,subprojects,repos}/{id}/labels
+
+func (env *Env) projectLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	env.labelsHandler(w, r, resourceProject)
+}
+
+func (env *Env) subprojectLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	env.labelsHandler(w, r, resourceSubproject)
+}
+
+func (env *Env) repoLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	env.labelsHandler(w, r, resourceRepo)
+}
+
+// labelsHandler handles the labels of the resource of the given
+// type, whose ID is in the endpoint.
+func (env *Env) labelsHandler(w http.ResponseWriter, r *http.Request, resource string) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// check valid request types
+	switch r.Method {
+	case "GET":
+		env.labelsGetHelper(w, r, resource)
+	case "PUT", "PATCH":
+		env.labelsPutHelper(w, r, resource)
+	default:
+		w.Header().Set("Allow", "GET, PUT, PATCH")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// extractLabelsID gets the ID of the resource from the endpoint. If
+// it is missing or unknown, it writes an error response and returns
+// false.
+func (env *Env) extractLabelsID(w http.ResponseWriter, r *http.Request, resource string) (uint32, bool) {
+	id, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid %s ID"}`, resource)
+		return 0, false
+	}
+	switch resource {
+	case resourceProject:
+		_, err = env.db.GetProjectByID(id)
+	case resourceSubproject:
+		_, err = env.db.GetSubprojectByID(id)
+	case resourceRepo:
+		_, err = env.db.GetRepoByID(id)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown %s ID"}`, resource)
+		return 0, false
+	}
+	return id, true
+}
+
+// writeLabels writes a resource's labels as the response.
+func writeLabels(w http.ResponseWriter, labels map[string]string) {
+	js, err := json.Marshal(map[string]map[string]string{"labels": labels})
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
+}
+
+func (env *Env) labelsGetHelper(w http.ResponseWriter, r *http.Request, resource string) {
+	// get user and check access level
+	// must be at least viewer
+	user := extractUser(w, r, datastore.AccessViewer)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get the resource from vars
+	id, ok := env.extractLabelsID(w, r, resource)
+	if !ok {
+		return
+	}
+
+	writeLabels(w, env.labels.get(resource, id))
+}
+
+// labelsPutHelper replaces the labels for PUT, or changes some of
+// them for PATCH, where a null value removes a label.
+func (env *Env) labelsPutHelper(w http.ResponseWriter, r *http.Request, resource string) {
+	// get user and check access level
+	// must be at least operator
+	user := extractUser(w, r, datastore.AccessOperator)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get the resource from vars
+	id, ok := env.extractLabelsID(w, r, resource)
+	if !ok {
+		return
+	}
+	if r.Method == "PATCH" && !checkMergePatchType(w, r) {
+		return
+	}
+
+	// parse JSON request
+	js := struct {
+		Labels map[string]*string `json:"labels"`
+	}{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&js); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+		return
+	}
+	if js.Labels == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing required value for 'labels'"}`)
+		return
+	}
+
+	labels := map[string]string{}
+	if r.Method == "PATCH" {
+		labels = env.labels.get(resource, id)
+	}
+	for key, value := range js.Labels {
+		if value == nil {
+			if r.Method != "PATCH" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, `{"error": %q}`, fmt.Sprintf("Invalid value for 'labels'; label %q must be a string", key))
+				return
+			}
+			delete(labels, key)
+			continue
+		}
+		labels[key] = *value
+	}
+	if err := checkLabels(labels); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": %q}`, fmt.Sprintf("Invalid value for 'labels'; %v", err))
+		return
+	}
+
+	env.labels.set(resource, id, labels)
+
+	// return the labels as they now are
+	writeLabels(w, labels)
+}
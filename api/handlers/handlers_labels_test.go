@@ -0,0 +1,150 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	hu "github.com/swinslow/peridot-api/test/handlerutils"
+)
+
+// ===== GET, PUT, PATCH /{projects,subprojects,repos}/{id}/labels =====
+
+func TestCanGetLabelsAsViewer(t *testing.T) {
+	env := getTestEnv()
+	env.labels.set(resourceRepo, 2, map[string]string{"team": "infra"})
+
+	rec := serveTestRequest(t, env, "GET", "/repos/2/labels", ``, "viewer", env.repoLabelsHandler, "/repos/{id}/labels")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"labels": {"team": "infra"}}`)
+
+	// a resource without labels has an empty set
+	rec = serveTestRequest(t, env, "GET", "/projects/1/labels", ``, "viewer", env.projectLabelsHandler, "/projects/{id}/labels")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"labels": {}}`)
+}
+
+func TestCannotGetLabelsForUnknownResource(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/subprojects/413/labels", ``, "viewer", env.subprojectLabelsHandler, "/subprojects/{id}/labels")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unknown subproject ID"}`)
+}
+
+func TestCanPutLabelsAsOperator(t *testing.T) {
+	env := getTestEnv()
+	env.labels.set(resourceProject, 1, map[string]string{"old": "yes"})
+
+	rec := serveTestRequest(t, env, "PUT", "/projects/1/labels", `{"labels": {"team": "infra", "example.com/tier": "high"}}`, "operator", env.projectLabelsHandler, "/projects/{id}/labels")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"labels": {"team": "infra", "example.com/tier": "high"}}`)
+
+	rec = serveTestRequest(t, env, "GET", "/projects/1/labels", ``, "viewer", env.projectLabelsHandler, "/projects/{id}/labels")
+	hu.CheckResponse(t, rec, `{"labels": {"team": "infra", "example.com/tier": "high"}}`)
+}
+
+func TestCanPatchLabelsAsOperator(t *testing.T) {
+	env := getTestEnv()
+	env.labels.set(resourceSubproject, 4, map[string]string{"team": "infra", "tier": "low"})
+
+	rec := serveTestRequest(t, env, "PATCH", "/subprojects/4/labels", `{"labels": {"tier": null, "train": "2019-12"}}`, "operator", env.subprojectLabelsHandler, "/subprojects/{id}/labels")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"labels": {"team": "infra", "train": "2019-12"}}`)
+}
+
+func TestCannotPutLabelsAsCommenter(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "PUT", "/repos/2/labels", `{"labels": {"team": "infra"}}`, "commenter", env.repoLabelsHandler, "/repos/{id}/labels")
+	hu.ConfirmAccessDenied(t, rec)
+}
+
+func TestCannotPutInvalidLabels(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "PUT", "/repos/2/labels", `{"labels": {"team name": "infra"}}`, "operator", env.repoLabelsHandler, "/repos/{id}/labels")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'labels'; invalid label key \"team name\""}`)
+
+	rec = serveTestRequest(t, env, "PUT", "/repos/2/labels", `{"labels": {"team": "-infra"}}`, "operator", env.repoLabelsHandler, "/repos/{id}/labels")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'labels'; invalid value \"-infra\" for label \"team\""}`)
+
+	rec = serveTestRequest(t, env, "PUT", "/repos/2/labels", `{"labels": {"team": null}}`, "operator", env.repoLabelsHandler, "/repos/{id}/labels")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'labels'; label \"team\" must be a string"}`)
+
+	rec = serveTestRequest(t, env, "PUT", "/repos/2/labels", `{"team": "infra"}`, "operator", env.repoLabelsHandler, "/repos/{id}/labels")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid JSON request"}`)
+}
+
+func TestLabelsAreRemovedWithRepo(t *testing.T) {
+	env := getTestEnv()
+	env.labels.set(resourceRepo, 3, map[string]string{"team": "infra"})
+
+	rec := serveTestRequest(t, env, "DELETE", "/repos/3", ``, "admin", env.reposOneHandler, "/repos/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+	// kept while the repo is in the trash
+	if labels := env.labels.get(resourceRepo, 3); len(labels) != 1 {
+		t.Errorf("expected labels to be kept, got %v", labels)
+	}
+
+	rec = serveTestRequest(t, env, "DELETE", "/trash/repos/3", ``, "admin", env.trashOneHandler, "/trash/{resource}/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+	if labels := env.labels.get(resourceRepo, 3); len(labels) != 0 {
+		t.Errorf("expected no labels, got %v", labels)
+	}
+}
+
+func TestLabelsAreRemovedWithProjectBelowIt(t *testing.T) {
+	env := getTestEnv()
+	env.labels.set(resourceSubproject, 1, map[string]string{"team": "infra"})
+	trashProject3(t, env)
+
+	rec := serveTestRequest(t, env, "DELETE", "/trash/projects/3", ``, "admin", env.trashOneHandler, "/trash/{resource}/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+	if labels := env.labels.get(resourceSubproject, 1); len(labels) != 0 {
+		t.Errorf("expected no labels, got %v", labels)
+	}
+}
+
+// ===== label selectors on lists =====
+
+func TestCanListReposWithLabelSelector(t *testing.T) {
+	env := getTestEnv()
+	env.labels.set(resourceRepo, 1, map[string]string{"team": "infra", "tier": "low"})
+	env.labels.set(resourceRepo, 2, map[string]string{"team": "infra", "tier": "high"})
+	env.labels.set(resourceRepo, 3, map[string]string{"team": "web"})
+
+	rec := serveTestRequest(t, env, "GET", "/repos?label=team=infra,tier!=low", ``, "viewer", env.reposHandler, "/repos")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"repos": [{"id": 2, "subproject_id": 4, "name": "repo2", "address": "https://example.com/repo2.git"}]}`)
+
+	// several label parameters are combined
+	rec = serveTestRequest(t, env, "GET", "/subprojects/4/repos?label=!tier&label=team", ``, "viewer", env.reposSubHandler, "/subprojects/{id}/repos")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"repos": [{"id": 3, "subproject_id": 4, "name": "repo3", "address": "https://example.com/repo3.git"}]}`)
+}
+
+func TestCanListProjectsAndSubprojectsWithLabelSelector(t *testing.T) {
+	env := getTestEnv()
+	env.labels.set(resourceProject, 2, map[string]string{"unit": "devices"})
+	env.labels.set(resourceSubproject, 3, map[string]string{"unit": "devices"})
+
+	rec := serveTestRequest(t, env, "GET", "/projects?label=unit==devices", ``, "viewer", env.projectsHandler, "/projects")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"projects": [{"id": 2, "name": "prj2", "fullname": "project 2"}]}`)
+
+	rec = serveTestRequest(t, env, "GET", "/subprojects?label=unit=devices", ``, "viewer", env.subprojectsHandler, "/subprojects")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"subprojects": [{"id": 3, "project_id": 1, "name": "subprj3", "fullname": "subproject 3"}]}`)
+}
+
+func TestCannotListWithInvalidLabelSelector(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/projects?label=team=in+fra", ``, "viewer", env.projectsHandler, "/projects")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'label'; invalid value \"in fra\" for label \"team\""}`)
+}
@@ -0,0 +1,253 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// isYAML returns whether a media type, e.g. from a Content-Type or
+// Accept header, is YAML.
+func isYAML(mediaType string) bool {
+	return strings.Contains(mediaType, "yaml")
+}
+
+// ========== HANDLER for /projects/{id}/manifest
+
+func (env *Env) projectManifestHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format unless YAML is requested
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be at least viewer
+	user := extractUser(w, r, datastore.AccessViewer)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get project id from vars
+	projectID, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid project ID"}`)
+		return
+	}
+
+	// check which format is requested
+	asYAML := isYAML(r.Header.Get("Accept"))
+	switch r.URL.Query().Get("format") {
+	case "":
+	case "json":
+		asYAML = false
+	case "yaml":
+		asYAML = true
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid value for 'format'; must be 'json' or 'yaml'"}`)
+		return
+	}
+
+	// get project from database
+	project, err := env.db.GetProjectByID(projectID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown project ID"}`)
+		return
+	}
+
+	m, err := env.exportManifest(project)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+
+	if asYAML {
+		y, err := yaml.Marshal(m)
+		if err != nil {
+			fmt.Fprintf(w, `{"error": "YAML marshalling error"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(y)
+		return
+	}
+	js, err := json.Marshal(m)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
+}
+
+// ========== HANDLER for /manifests/apply
+
+func (env *Env) manifestsApplyHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be at least operator; deleting anything
+	// requires admin, checked below
+	user := extractUser(w, r, datastore.AccessOperator)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; check what is requested
+	dryRun := false
+	if s := r.URL.Query().Get("dry_run"); s != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'dry_run'"}`)
+			return
+		}
+	}
+
+	// parse the manifest, as YAML or JSON
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Unable to read request"}`)
+		return
+	}
+	m := &manifest{}
+	if isYAML(r.Header.Get("Content-Type")) {
+		if err := yaml.UnmarshalStrict(body, m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid YAML request"}`)
+			return
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+			return
+		}
+	}
+	if err := m.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": %q}`, "Invalid manifest: "+err.Error())
+		return
+	}
+
+	// a manifest is applied as a sequence of separate changes, so
+	// it must not interleave with batches or other manifests
+	env.batchMu.Lock()
+	defer env.batchMu.Unlock()
+
+	actions, projectID, err := env.planManifest(m, user)
+	if c, ok := err.(*repoAddressConflict); ok {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": %q, "repo_id": %d}`, "Repo "+c.path+" has the same address as repo "+fmt.Sprint(c.repoID), c.repoID)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+
+	if !dryRun && user.AccessLevel < datastore.AccessAdmin {
+		for _, a := range actions {
+			if a.Action == "delete" || a.Action == "restore" {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, `{"error": %q}`, fmt.Sprintf("Applying this manifest would %s %s %s, which requires admin access", a.Action, a.Resource, a.Path))
+				return
+			}
+		}
+	}
+
+	// deleting branches removes their repo pulls for good, so it
+	// must be confirmed in the same way as deleting them one by one
+	branches := []*datastore.RepoBranch{}
+	for _, a := range actions {
+		if a.branch != nil {
+			branches = append(branches, a.branch)
+		}
+	}
+	var impact *deletionImpact
+	if len(branches) > 0 {
+		impact, err = env.branchesDeletionImpact(branches)
+		if err != nil {
+			fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+			return
+		}
+		env.setDeletionConfirm(impact, dryRun)
+		if !dryRun && !env.confirmDeletion(w, r, impact) {
+			return
+		}
+	}
+
+	if !dryRun {
+		for i, a := range actions {
+			err := func() error {
+				// an existing resource is held while it is changed,
+				// as for PUT, PATCH and DELETE
+				if a.ID != 0 {
+					defer env.locks.lock(a.Resource, a.ID)()
+				}
+				return a.run()
+			}()
+			if err != nil {
+				jsData := struct {
+					Error   string            `json:"error"`
+					Failed  int               `json:"failed"`
+					Actions []*manifestAction `json:"actions"`
+				}{
+					Error:   fmt.Sprintf("Unable to %s %s %s; earlier actions were applied", a.Action, a.Resource, a.Path),
+					Failed:  i,
+					Actions: actions,
+				}
+				js, err := json.Marshal(jsData)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write(js)
+				return
+			}
+		}
+	}
+
+	// create map so we return a JSON object
+	jsData := struct {
+		DryRun    bool              `json:"dry_run"`
+		ProjectID uint32            `json:"project_id,omitempty"`
+		Actions   []*manifestAction `json:"actions"`
+		Deletion  *deletionImpact   `json:"deletion,omitempty"`
+	}{DryRun: dryRun, ProjectID: projectID(), Actions: actions, Deletion: impact}
+	js, err := json.Marshal(jsData)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
+}
@@ -0,0 +1,359 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+
+	hu "github.com/swinslow/peridot-api/test/handlerutils"
+)
+
+// prj1Manifest is a manifest that changes mock project 1: it
+// renames subproject 2, moves repo 3 into it, adds branches and
+// leaves out branch beta of repo 2, adds subproject 5 and removes
+// subproject 3.
+const prj1Manifest = `{"version": 1, "project": {"name": "prj1", "fullname": "project 1", "subprojects": [
+	{"name": "subprj2", "fullname": "subproject two", "repos": [
+		{"name": "repo1", "address": "https://example.com/repo1.git", "branches": ["master", "dev"]},
+		{"name": "repo3", "address": "https://example.com/repo3.git"}
+	]},
+	{"name": "subprj4", "fullname": "subproject 4", "repos": [
+		{"name": "repo2", "address": "https://example.com/repo2.git", "branches": ["master", "alpha"]},
+		{"name": "repo4", "address": "https://example.com/repo4.git", "branches": ["master", "dev"]}
+	]},
+	{"name": "subprj5", "fullname": "subproject 5", "repos": [
+		{"name": "repo5", "address": "https://example.com/repo5.git", "branches": ["master"]}
+	]}
+]}}`
+
+// ===== GET /projects/{id}/manifest =====
+
+func TestCanGetProjectManifestHandler(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/projects/3/manifest", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectManifestHandler), "/projects/{id:[0-9]+}/manifest")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"version": 1, "project": {"name": "prj3", "fullname": "project 3", "subprojects": [{"name": "subprj1", "fullname": "subproject 1"}]}, "agents": [
+		{"name": "idsearcher", "address": "localhost", "port": 9001, "is_codereader": true, "is_spdxreader": false, "is_codewriter": false, "is_spdxwriter": true},
+		{"name": "attributer", "address": "localhost", "port": 9002, "is_codereader": false, "is_spdxreader": true, "is_codewriter": true, "is_spdxwriter": false},
+		{"name": "broken-agent", "address": "example.com", "port": 9003, "is_codereader": true, "is_spdxreader": false, "is_codewriter": true, "is_spdxwriter": true},
+		{"name": "getter-github", "address": "localhost", "port": 9004, "is_codereader": false, "is_spdxreader": false, "is_codewriter": true, "is_spdxwriter": false},
+		{"name": "analyze-godeps", "address": "localhost", "port": 9005, "is_codereader": true, "is_spdxreader": true, "is_codewriter": true, "is_spdxwriter": true},
+		{"name": "decider", "address": "localhost", "port": 9006, "is_codereader": false, "is_spdxreader": true, "is_codewriter": false, "is_spdxwriter": true}
+	]}`
+	hu.CheckResponse(t, rec, wanted)
+}
+
+func TestCanGetProjectManifestHandlerAsYAML(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/projects/1/manifest?format=yaml", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectManifestHandler), "/projects/{id:[0-9]+}/manifest")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rec.Code)
+	}
+	if rec.Header().Get("Content-Type") != "application/yaml" {
+		t.Errorf("expected %s, got %s", "application/yaml", rec.Header().Get("Content-Type"))
+	}
+
+	m := &manifest{}
+	if err := yaml.UnmarshalStrict(rec.Body.Bytes(), m); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if err := m.validate(); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if len(m.Project.Subprojects) != 3 || len(m.Project.Subprojects[2].Repos) != 3 {
+		t.Fatalf("unexpected manifest: %#v", m.Project)
+	}
+	r2 := m.Project.Subprojects[2].Repos[0]
+	if r2.Name != "repo2" || len(r2.Branches) != 3 {
+		t.Errorf("unexpected repo: %#v", r2)
+	}
+}
+
+func TestCannotGetProjectManifestHandlerWithInvalidValues(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/projects/1/manifest?format=xml", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectManifestHandler), "/projects/{id:[0-9]+}/manifest")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'format'; must be 'json' or 'yaml'"}`)
+
+	rec, req, env = setupTestEnv(t, "GET", "/projects/17/manifest", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectManifestHandler), "/projects/{id:[0-9]+}/manifest")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+// ===== POST /manifests/apply =====
+
+func TestCanApplyManifestDryRun(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/manifests/apply?dry_run=true", prj1Manifest, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.manifestsApplyHandler), "/manifests/apply")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"dry_run": true, "project_id": 1, "actions": [
+		{"action": "update", "resource": "subproject", "path": "prj1/subprj2", "id": 2, "fields": ["fullname"]},
+		{"action": "create", "resource": "branch", "path": "prj1/subprj2/repo1/dev"},
+		{"action": "update", "resource": "repo", "path": "prj1/subprj2/repo3", "id": 3, "fields": ["subproject"]},
+		{"action": "create", "resource": "subproject", "path": "prj1/subprj5"},
+		{"action": "create", "resource": "repo", "path": "prj1/subprj5/repo5"},
+		{"action": "create", "resource": "branch", "path": "prj1/subprj5/repo5/master"},
+		{"action": "delete", "resource": "subproject", "path": "prj1/subprj3", "id": 3}
+	]}`
+	hu.CheckResponse(t, rec, wanted)
+
+	// and nothing was changed
+	sps, _ := env.db.GetAllSubprojectsForProjectID(1)
+	if len(sps) != 3 || sps[0].Fullname != "subproject 2" {
+		t.Errorf("expected no changes, got %#v", sps)
+	}
+	if env.events.seq != 0 {
+		t.Errorf("expected no events, got %d", env.events.seq)
+	}
+}
+
+func TestCanApplyManifest(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/manifests/apply", prj1Manifest, "admin")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.manifestsApplyHandler), "/manifests/apply")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"dry_run": false, "project_id": 1, "actions": [
+		{"action": "update", "resource": "subproject", "path": "prj1/subprj2", "id": 2, "fields": ["fullname"]},
+		{"action": "create", "resource": "branch", "path": "prj1/subprj2/repo1/dev"},
+		{"action": "update", "resource": "repo", "path": "prj1/subprj2/repo3", "id": 3, "fields": ["subproject"]},
+		{"action": "create", "resource": "subproject", "path": "prj1/subprj5", "id": 5},
+		{"action": "create", "resource": "repo", "path": "prj1/subprj5/repo5", "id": 5},
+		{"action": "create", "resource": "branch", "path": "prj1/subprj5/repo5/master"},
+		{"action": "delete", "resource": "subproject", "path": "prj1/subprj3", "id": 3}
+	]}`
+	hu.CheckResponse(t, rec, wanted)
+	if env.events.seq != 7 {
+		t.Errorf("expected %d events, got %d", 7, env.events.seq)
+	}
+
+	// the project now matches the manifest, so applying it
+	// again does nothing
+	rec, req, _ = setupTestEnv(t, "POST", "/manifests/apply", prj1Manifest, "admin")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.manifestsApplyHandler), "/manifests/apply")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"dry_run": false, "project_id": 1, "actions": []}`)
+
+	repo3, _ := env.db.GetRepoByID(3)
+	if repo3.SubprojectID != 2 {
+		t.Errorf("expected %d, got %d", 2, repo3.SubprojectID)
+	}
+
+	// deleted subprojects are moved to the trash
+	if !env.trash.has(resourceSubproject, 3) {
+		t.Errorf("expected subproject 3 to be in the trash")
+	}
+
+	// and branches that aren't listed are left alone
+	rbs, _ := env.db.GetAllRepoBranchesForRepoID(2)
+	if len(rbs) != 3 {
+		t.Errorf("expected %d, got %d", 3, len(rbs))
+	}
+}
+
+func TestCanApplyManifestPruningBranches(t *testing.T) {
+	pruning := strings.TrimSuffix(prj1Manifest, "}") + `, "prune": true}`
+	rec, req, env := setupTestEnv(t, "POST", "/manifests/apply?dry_run=true", pruning, "admin")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.manifestsApplyHandler), "/manifests/apply")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"dry_run": true, "project_id": 1, "actions": [
+		{"action": "update", "resource": "subproject", "path": "prj1/subprj2", "id": 2, "fields": ["fullname"]},
+		{"action": "create", "resource": "branch", "path": "prj1/subprj2/repo1/dev"},
+		{"action": "update", "resource": "repo", "path": "prj1/subprj2/repo3", "id": 3, "fields": ["subproject"]},
+		{"action": "create", "resource": "subproject", "path": "prj1/subprj5"},
+		{"action": "create", "resource": "repo", "path": "prj1/subprj5/repo5"},
+		{"action": "create", "resource": "branch", "path": "prj1/subprj5/repo5/master"},
+		{"action": "delete", "resource": "branch", "path": "prj1/subprj4/repo2/beta"},
+		{"action": "delete", "resource": "subproject", "path": "prj1/subprj3", "id": 3}
+	], "deletion": {"dry_run": true, "resource": "branches", "removed": {
+		"branches": {"count": 1, "branches": [{"repo_id": 2, "branch": "beta"}]}
+	}, "altered": {}, "total": 1, "confirm_required": false}}`
+	hu.CheckResponse(t, rec, wanted)
+
+	rec, req, _ = setupTestEnv(t, "POST", "/manifests/apply", pruning, "admin")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.manifestsApplyHandler), "/manifests/apply")
+	hu.ConfirmOKResponse(t, rec)
+	rbs, _ := env.db.GetAllRepoBranchesForRepoID(2)
+	if len(rbs) != 2 {
+		t.Errorf("expected %d, got %d", 2, len(rbs))
+	}
+}
+
+func TestApplyingManifestPruningBranchesNeedsConfirmOverThreshold(t *testing.T) {
+	// leaving out repo 2's master branch would delete repo pulls 1
+	// and 2 and their jobs
+	pruning := `{"version": 1, "prune": true, "project": {"name": "prj1", "fullname": "project 1", "subprojects": [
+		{"name": "subprj2", "fullname": "subproject 2", "repos": [
+			{"name": "repo1", "address": "https://example.com/repo1.git", "branches": ["master"]}
+		]},
+		{"name": "subprj3", "fullname": "subproject 3"},
+		{"name": "subprj4", "fullname": "subproject 4", "repos": [
+			{"name": "repo2", "address": "https://example.com/repo2.git", "branches": ["alpha", "beta"]},
+			{"name": "repo3", "address": "https://example.com/repo3.git"},
+			{"name": "repo4", "address": "https://example.com/repo4.git", "branches": ["master", "dev"]}
+		]}
+	]}}`
+	env := getTestEnv()
+	env.deleteConfirmThreshold = 5
+
+	rec := serveTestRequest(t, env, "POST", "/manifests/apply", pruning, "admin", env.manifestsApplyHandler, "/manifests/apply")
+	if rec.Code != http.StatusPreconditionRequired {
+		t.Errorf("expected %d, got %d", http.StatusPreconditionRequired, rec.Code)
+	}
+	if env.events.seq != 0 {
+		t.Errorf("expected no events, got %d", env.events.seq)
+	}
+
+	// the dry run gives the token to confirm with
+	rec = serveTestRequest(t, env, "POST", "/manifests/apply?dry_run=true", pruning, "admin", env.manifestsApplyHandler, "/manifests/apply")
+	hu.ConfirmOKResponse(t, rec)
+	var got struct {
+		Deletion *deletionImpact `json:"deletion"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if got.Deletion == nil || !got.Deletion.ConfirmRequired || got.Deletion.Confirm == "" {
+		t.Fatalf("expected confirm token, got %#v", got.Deletion)
+	}
+
+	rec = serveTestRequest(t, env, "POST", "/manifests/apply?confirm="+got.Deletion.Confirm, pruning, "admin", env.manifestsApplyHandler, "/manifests/apply")
+	hu.ConfirmOKResponse(t, rec)
+	rbs, _ := env.db.GetAllRepoBranchesForRepoID(2)
+	if len(rbs) != 2 || rbs[0].Branch == "master" || rbs[1].Branch == "master" {
+		t.Errorf("expected master branch to be deleted, got %#v", rbs)
+	}
+}
+
+func TestCanApplyManifestRestoringFromTrash(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "POST", "/manifests/apply", prj1Manifest, "admin", env.manifestsApplyHandler, "/manifests/apply")
+	hu.ConfirmOKResponse(t, rec)
+
+	// listing subproject 3 again restores it, and only an admin
+	// may do that
+	body := strings.Replace(prj1Manifest, `{"name": "subprj5"`, `{"name": "subprj3", "fullname": "subproject 3"},
+	{"name": "subprj5"`, 1)
+	rec = serveTestRequest(t, env, "POST", "/manifests/apply", body, "operator", env.manifestsApplyHandler, "/manifests/apply")
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected %d, got %d", http.StatusForbidden, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Applying this manifest would restore subproject prj1/subprj3, which requires admin access"}`)
+
+	rec = serveTestRequest(t, env, "POST", "/manifests/apply", body, "admin", env.manifestsApplyHandler, "/manifests/apply")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"dry_run": false, "project_id": 1, "actions": [
+		{"action": "restore", "resource": "subproject", "path": "prj1/subprj3", "id": 3}
+	]}`)
+	if env.trash.has(resourceSubproject, 3) {
+		t.Errorf("expected subproject 3 to be restored")
+	}
+
+	// and resources left in the trash are not deleted again
+	rec = serveTestRequest(t, env, "DELETE", "/subprojects/3", ``, "admin", env.subprojectsOneHandler, "/subprojects/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+	rec = serveTestRequest(t, env, "POST", "/manifests/apply", prj1Manifest, "operator", env.manifestsApplyHandler, "/manifests/apply")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"dry_run": false, "project_id": 1, "actions": []}`)
+}
+
+func TestCanApplyManifestForNewProjectAsYAML(t *testing.T) {
+	body := `version: 1
+project:
+  name: prj4
+  fullname: project 4
+  subprojects:
+  - name: core
+    fullname: core
+    repos:
+    - name: core-repo
+      address: https://example.com/core.git
+      branches: [main]
+agents:
+- name: decider
+  address: localhost
+  port: 9016
+  is_spdxreader: true
+  is_spdxwriter: true
+- name: scanner
+  address: localhost
+  port: 9017
+  is_codereader: true
+  is_spdxwriter: true
+`
+	rec, req, env := setupTestEnv(t, "POST", "/manifests/apply", body, "operator")
+	req.Header.Set("Content-Type", "application/yaml")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.manifestsApplyHandler), "/manifests/apply")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"dry_run": false, "project_id": 4, "actions": [
+		{"action": "create", "resource": "project", "path": "prj4", "id": 4},
+		{"action": "create", "resource": "subproject", "path": "prj4/core", "id": 5},
+		{"action": "create", "resource": "repo", "path": "prj4/core/core-repo", "id": 5},
+		{"action": "create", "resource": "branch", "path": "prj4/core/core-repo/main"},
+		{"action": "update", "resource": "agent", "path": "decider", "id": 6, "fields": ["port"]},
+		{"action": "create", "resource": "agent", "path": "scanner", "id": 7}
+	]}`
+	hu.CheckResponse(t, rec, wanted)
+
+	agent, _ := env.db.GetAgentByID(6)
+	if agent.Port != 9016 || !agent.IsActive {
+		t.Errorf("unexpected agent: %#v", agent)
+	}
+}
+
+func TestCannotApplyManifestWithDeletesAsOperator(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/manifests/apply", prj1Manifest, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.manifestsApplyHandler), "/manifests/apply")
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected %d, got %d", http.StatusForbidden, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Applying this manifest would delete subproject prj1/subprj3, which requires admin access"}`)
+
+	rec, req, env = setupTestEnv(t, "POST", "/manifests/apply?dry_run=true", prj1Manifest, "commenter")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.manifestsApplyHandler), "/manifests/apply")
+	hu.ConfirmAccessDenied(t, rec)
+}
+
+func TestCannotApplyInvalidManifest(t *testing.T) {
+	tests := []struct {
+		body  string
+		error string
+	}{
+		{`{"version": 2, "project": {"name": "prj1"}}`, `Invalid manifest: unsupported version 2; must be 1`},
+		{`{"version": 1}`, `Invalid manifest: missing project name`},
+		{`{"version": 1, "project": {"name": "prj1", "subprojects": [{"name": "a", "repos": [{"name": "r", "address": "https://example.com/x"}]}, {"name": "b", "repos": [{"name": "r", "address": "https://example.com/y"}]}]}}`, `Invalid manifest: duplicate repo name \"r\"`},
+		{`{"version": 1, "project": {"name": "prj1", "subprojects": [{"name": "a", "repos": [{"name": "r", "address": "https://example.com/x", "branches": ["release/1.2.lock"]}]}]}}`, `Invalid manifest: invalid branch name \"release/1.2.lock\" for repo \"r\": no part may end with \".lock\"`},
+		{`{"version": 1, "project": {"name": "prj1", "subprojects": [{"name": "a", "repos": [{"name": "r", "address": "ftp://example.com/x"}]}]}}`, `Invalid manifest: invalid address for repo \"r\": unsupported scheme \"ftp\"; must be https, http, ssh, git or file`},
+		{`{"version": 1, "project": {"name": "prj1", "subprojects": [{"name": "a", "repos": [{"name": "r", "address": "https://github.com/x/y"}, {"name": "s", "address": "git@github.com:x/y.git"}]}]}}`, `Invalid manifest: repos \"r\" and \"s\" have the same address`},
+		{`{"version": 1, "project": {"name": "prj1"}, "agents": [{"name": "x", "port": 70000}]}`, `Invalid manifest: invalid port for agent \"x\"`},
+		{`{"version": 1, "project": {"name": "prj1", "owner": "me"}}`, `Invalid JSON request`},
+	}
+	for _, tc := range tests {
+		rec, req, env := setupTestEnv(t, "POST", "/manifests/apply", tc.body, "admin")
+		hu.ServeHandler(rec, req, http.HandlerFunc(env.manifestsApplyHandler), "/manifests/apply")
+		hu.ConfirmBadRequestResponse(t, rec)
+		hu.CheckResponse(t, rec, `{"error": "`+tc.error+`"}`)
+	}
+}
+
+func TestCannotApplyManifestWithAddressOfAnotherProject(t *testing.T) {
+	body := `{"version": 1, "project": {"name": "prj3", "fullname": "project 3", "subprojects": [
+		{"name": "subprj1", "fullname": "subproject 1", "repos": [{"name": "copy", "address": "HTTPS://Example.com/repo2/"}]}
+	]}}`
+	rec, req, env := setupTestEnv(t, "POST", "/manifests/apply", body, "admin")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.manifestsApplyHandler), "/manifests/apply")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected %d, got %d", http.StatusConflict, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Repo prj3/subprj1/copy has the same address as repo 2", "repo_id": 2}`)
+}
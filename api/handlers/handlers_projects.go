@@ -34,16 +34,32 @@ func (env *Env) projectsGetHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// sufficient access; get projects from database
+	// sufficient access; get the label selector, if any
+	sel, ok := extractLabelSelector(w, r)
+	if !ok {
+		return
+	}
+
+	// get projects from database
 	projects, err := env.db.GetAllProjects()
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
 		return
 	}
+	// leave out anything in the trash
+	projects = env.visibleProjects(projects)
+	// and anything that doesn't match the label selector
+	projects = env.labelledProjects(projects, sel)
+
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(projects))
+	if !ok {
+		return
+	}
 
 	// create map so we return a JSON object
 	projectsMap := map[string][]*datastore.Project{}
-	projectsMap["projects"] = projects
+	projectsMap["projects"] = projects[start:end]
 	js, err := json.Marshal(projectsMap)
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
@@ -90,6 +106,9 @@ func (env *Env) projectsPostHelper(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"error": "Unable to create project"}`)
 		return
 	}
+	env.events.publish(EventProjectCreated, map[string]interface{}{
+		"project": &datastore.Project{ID: newID, Name: name, Fullname: fullname},
+	})
 
 	// success!
 	w.WriteHeader(http.StatusCreated)
@@ -104,12 +123,12 @@ func (env *Env) projectsOneHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		env.projectsOneGetHelper(w, r)
-	case "PUT":
+	case "PUT", "PATCH":
 		env.projectsOnePutHelper(w, r)
 	case "DELETE":
 		env.projectsOneDeleteHelper(w, r)
 	default:
-		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
@@ -137,6 +156,11 @@ func (env *Env) projectsOneGetHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// set the ETag, and stop here if the client's copy is current
+	if writeETag(w, r, argProject) {
+		return
+	}
+
 	// create map so we return a JSON object
 	jsData := struct {
 		Project *datastore.Project `json:"project"`
@@ -165,6 +189,9 @@ func (env *Env) projectsOnePutHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// hold the project until it has been changed (see resourceLocks)
+	defer env.locks.lock(resourceProject, projectID)()
+
 	// get existing project from database
 	project, err := env.db.GetProjectByID(projectID)
 	if err != nil {
@@ -173,23 +200,30 @@ func (env *Env) projectsOnePutHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// parse JSON request
-	js := map[string]string{}
-	err = json.NewDecoder(r.Body).Decode(&js)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+	// if the request is conditional, make sure the client
+	// is updating the current version
+	if !checkIfMatch(w, r, project) {
 		return
 	}
 
-	// and extract data; if absent, use existing data
-	newName, ok := js["name"]
+	// parse JSON request (or merge patch, for PATCH)
+	js, ok := extractUpdateRequest(w, r, project)
 	if !ok {
-		newName = project.Name
+		return
 	}
-	newFullname, ok := js["fullname"]
-	if !ok {
-		newFullname = project.Fullname
+
+	// and extract data; if absent, use existing data
+	newName, err := optionalString(js, "name", project.Name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "%v"}`, err)
+		return
+	}
+	newFullname, err := optionalString(js, "fullname", project.Fullname)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "%v"}`, err)
+		return
 	}
 
 	// modify the project data
@@ -199,6 +233,9 @@ func (env *Env) projectsOnePutHelper(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"error": "Unable to update project"}`)
 		return
 	}
+	env.events.publish(EventProjectUpdated, map[string]interface{}{
+		"project": &datastore.Project{ID: projectID, Name: newName, Fullname: newFullname},
+	})
 
 	// success!
 	w.WriteHeader(http.StatusNoContent)
@@ -220,14 +257,38 @@ func (env *Env) projectsOneDeleteHelper(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// delete the project
-	err = env.db.DeleteProject(projectID)
+	// hold the project until it has been deleted (see resourceLocks)
+	defer env.locks.lock(resourceProject, projectID)()
+
+	// if the request is conditional, make sure the client
+	// is deleting the current version
+	if r.Header.Get("If-Match") != "" {
+		var current interface{}
+		if project, err := env.db.GetProjectByID(projectID); err == nil {
+			current = project
+		}
+		if !checkIfMatch(w, r, current) {
+			return
+		}
+	}
+
+	// with ?dry_run, only report what deleting it would remove or
+	// change; large deletions must be confirmed
+	if !env.checkDeletion(w, r, resourceProject, projectID, "") {
+		return
+	}
+
+	project, err := env.db.GetProjectByID(projectID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"error": "Unable to delete project"}`)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown project ID"}`)
 		return
 	}
 
+	// move the project to the trash; it is only deleted from the
+	// database once it is purged
+	env.trashResource(resourceProject, projectID, project.Name, user, project)
+
 	// success!
 	w.WriteHeader(http.StatusNoContent)
 }
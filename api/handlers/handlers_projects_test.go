@@ -4,7 +4,9 @@ package handlers
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/swinslow/peridot-db/pkg/datastore"
 	hu "github.com/swinslow/peridot-api/test/handlerutils"
@@ -21,6 +23,37 @@ func TestCanGetProjectsHandler(t *testing.T) {
 	hu.CheckResponse(t, rec, wanted)
 }
 
+func TestCanGetProjectsHandlerWithPage(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/projects?offset=1&limit=1", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsHandler), "/projects")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"projects": [{"id": 2, "name": "prj2", "fullname": "project 2"}]}`
+	hu.CheckResponse(t, rec, wanted)
+	if rec.Header().Get("X-Total-Count") != "3" {
+		t.Errorf("expected %s, got %s", "3", rec.Header().Get("X-Total-Count"))
+	}
+
+	// offset past the end is an empty page
+	rec, req, env = setupTestEnv(t, "GET", "/projects?offset=7", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsHandler), "/projects")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"projects": []}`)
+
+	// a huge limit is the rest of the list
+	rec, req, env = setupTestEnv(t, "GET", "/projects?offset=1&limit=9223372036854775807", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsHandler), "/projects")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"projects": [{"id": 2, "name": "prj2", "fullname": "project 2"}, {"id": 3, "name": "prj3", "fullname": "project 3"}]}`)
+}
+
+func TestCannotGetProjectsHandlerWithInvalidPage(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/projects?limit=-1", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsHandler), "/projects")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'limit'"}`)
+}
+
 func TestCannotGetProjectsHandlerAsBadUser(t *testing.T) {
 	rec, req, env := setupTestEnv(t, "GET", "/projects", ``, "disabled")
 	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsHandler), "/projects")
@@ -102,6 +135,57 @@ func TestCannotGetProjectsOneHandlerAsBadUser(t *testing.T) {
 	hu.ConfirmInvalidAuth(t, rec, ErrAuthGithub)
 }
 
+func TestGetProjectsOneHandlerSetsETag(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/projects/3", "", "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsOneHandler), "/projects/{id}")
+	hu.ConfirmOKResponse(t, rec)
+
+	p, err := env.db.GetProjectByID(3)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	wantedETag, err := computeETag(p)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	gotETag := rec.Result().Header.Get("ETag")
+	if gotETag != wantedETag {
+		t.Errorf("expected %s, got %s", wantedETag, gotETag)
+	}
+}
+
+func TestGetProjectsOneHandlerWithMatchingIfNoneMatchIsNotModified(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/projects/3", "", "viewer")
+	p, err := env.db.GetProjectByID(3)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	etag, err := computeETag(p)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsOneHandler), "/projects/{id}")
+
+	if 304 != rec.Code {
+		t.Errorf("Expected %d, got %d", 304, rec.Code)
+	}
+	got := hu.GetBody(t, rec)
+	if len(got) > 0 {
+		t.Errorf("expected no content for 304 response, got %v", string(got))
+	}
+}
+
+func TestGetProjectsOneHandlerWithStaleIfNoneMatchIsOK(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/projects/3", "", "viewer")
+	req.Header.Set("If-None-Match", `"0123456789abcdef"`)
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsOneHandler), "/projects/{id}")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"project": {"id": 3, "name": "prj3", "fullname": "project 3"}}`
+	hu.CheckResponse(t, rec, wanted)
+}
+
 // ===== PUT /projects/3 =====
 
 func TestCanPutProjectsOneHandlerAsOperator(t *testing.T) {
@@ -168,6 +252,75 @@ func TestCannotPutProjectsOneHandlerAsCommenter(t *testing.T) {
 	}
 }
 
+func TestCanPutProjectsOneHandlerWithMatchingIfMatch(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PUT", "/projects/3", `{"name": "new-name"}`, "operator")
+	p, err := env.db.GetProjectByID(3)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	etag, err := computeETag(p)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	req.Header.Set("If-Match", etag)
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsOneHandler), "/projects/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	// and verify state of database now
+	p, err = env.db.GetProjectByID(3)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	if p.Name != "new-name" {
+		t.Errorf("expected %s, got %s", "new-name", p.Name)
+	}
+}
+
+func TestCannotPutProjectsOneHandlerWithStaleIfMatch(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PUT", "/projects/3", `{"name": "new-name"}`, "operator")
+	req.Header.Set("If-Match", `"0123456789abcdef"`)
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsOneHandler), "/projects/{id}")
+
+	if 412 != rec.Code {
+		t.Errorf("Expected %d, got %d", 412, rec.Code)
+	}
+
+	// and verify state of database has not changed
+	p, err := env.db.GetProjectByID(3)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	if p.Name != "prj3" {
+		t.Errorf("expected %s, got %s", "prj3", p.Name)
+	}
+}
+
+// ===== PATCH /projects/3 =====
+
+func TestCanPatchProjectsOneHandlerAsOperator(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PATCH", "/projects/3", `{"fullname": "new-fullname"}`, "operator")
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsOneHandler), "/projects/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	// and verify state of database now
+	p, err := env.db.GetProjectByID(3)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	wantedProject := &datastore.Project{ID: 3, Name: "prj3", Fullname: "new-fullname"}
+	if *p != *wantedProject {
+		t.Errorf("expected %#v, got %#v", wantedProject, p)
+	}
+}
+
+func TestCannotPatchProjectsOneHandlerWithInvalidValue(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PATCH", "/projects/3", `{"name": 17}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsOneHandler), "/projects/{id}")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'name'"}`)
+}
+
 // ===== DELETE /projects/3 =====
 
 func TestCanDeleteProjectsOneHandlerAsAdmin(t *testing.T) {
@@ -175,18 +328,22 @@ func TestCanDeleteProjectsOneHandlerAsAdmin(t *testing.T) {
 	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsOneHandler), "/projects/{id}")
 	hu.ConfirmNoContentResponse(t, rec)
 
-	// and verify state of database now
-	projects, err := env.db.GetAllProjects()
-	if err != nil {
+	// and verify that the project is in the trash, not deleted
+	if _, err := env.db.GetProjectByID(3); err != nil {
 		t.Errorf("expected nil error, got %v", err)
 	}
-	if len(projects) != 2 {
-		t.Errorf("expected %d, got %d", 2, len(projects))
+	e, ok := env.trash.get(resourceProject, 3)
+	if !ok {
+		t.Fatalf("expected project 3 to be in the trash")
 	}
-	p, err := env.db.GetProjectByID(3)
-	if err == nil {
-		t.Fatalf("expected non-nil error, got nil and %#v", p)
+	if e.Name != "prj3" || e.DeletedBy != 1 {
+		t.Errorf("unexpected trash entry: %#v", e)
 	}
+
+	// and that it is no longer listed
+	rec = serveTestRequest(t, env, "GET", "/projects", ``, "viewer", env.projectsHandler, "/projects")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"projects": [{"id": 1, "name": "prj1", "fullname": "project 1"}, {"id": 2, "name": "prj2", "fullname": "project 2"}]}`)
 }
 
 func TestCannotDeleteProjectsOneHandlerAsOperator(t *testing.T) {
@@ -211,3 +368,77 @@ func TestCannotDeleteProjectsOneHandlerAsOperator(t *testing.T) {
 		t.Errorf("expected %#v, got %#v", wantedProject, p)
 	}
 }
+
+func TestConcurrentPutsProjectsOneHandlerWithSameIfMatchOnlyOneSucceeds(t *testing.T) {
+	env := getTestEnv()
+	p, _ := env.db.GetProjectByID(3)
+	etag, err := computeETag(p)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// the first request holds the project while it changes it, and
+	// the second, sent with the same ETag, waits for it
+	unlock := env.locks.lock(resourceProject, 3)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec, req, _ := setupTestEnv(t, "PUT", "/projects/3", `{"name": "second-name"}`, "operator")
+		req.Header.Set("If-Match", etag)
+		hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsOneHandler), "/projects/{id}")
+		done <- rec
+	}()
+	key := resourceLockKey{resourceProject, 3}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		env.locks.mu.Lock()
+		waiting := env.locks.locks[key].refs == 2
+		env.locks.mu.Unlock()
+		if waiting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the second request to wait for the lock")
+		}
+	}
+	if err := env.db.UpdateProject(3, "first-name", ""); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	unlock()
+
+	// so it sees the first change, and fails
+	rec := <-done
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected %d, got %d", http.StatusPreconditionFailed, rec.Code)
+	}
+	p, _ = env.db.GetProjectByID(3)
+	if p.Name != "first-name" {
+		t.Errorf("expected %s, got %s", "first-name", p.Name)
+	}
+}
+
+func TestCanDeleteProjectsOneHandlerWithWildcardIfMatch(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "DELETE", "/projects/3", ``, "admin")
+	req.Header.Set("If-Match", "*")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsOneHandler), "/projects/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	// and verify that the project is in the trash
+	if !env.trash.has(resourceProject, 3) {
+		t.Errorf("expected project 3 to be in the trash")
+	}
+}
+
+func TestCannotDeleteProjectsOneHandlerWithStaleIfMatch(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "DELETE", "/projects/3", ``, "admin")
+	req.Header.Set("If-Match", `"0123456789abcdef"`)
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectsOneHandler), "/projects/{id}")
+
+	if 412 != rec.Code {
+		t.Errorf("Expected %d, got %d", 412, rec.Code)
+	}
+
+	// and verify state of database has not changed
+	_, err := env.db.GetProjectByID(3)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+}
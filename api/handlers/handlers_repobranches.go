@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"sort"
+	"time"
 
 	"github.com/swinslow/peridot-db/pkg/datastore"
 )
@@ -52,6 +53,16 @@ func (env *Env) repoBranchesSubGetHelper(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// with ?summary=true, return each branch with its latest pull
+	summary, ok := extractBoolParam(w, r, "summary")
+	if !ok {
+		return
+	}
+	if summary {
+		env.repoBranchesSummaryHelper(w, r, repoID, branches)
+		return
+	}
+
 	// want to return as a sorted array of strings with just
 	// the branch names
 	branchesArr := []string{}
@@ -60,9 +71,15 @@ func (env *Env) repoBranchesSubGetHelper(w http.ResponseWriter, r *http.Request)
 	}
 	sort.Strings(branchesArr)
 
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(branchesArr))
+	if !ok {
+		return
+	}
+
 	// create map so we return a JSON object
 	branchesMap := map[string][]string{}
-	branchesMap["branches"] = branchesArr
+	branchesMap["branches"] = branchesArr[start:end]
 	js, err := json.Marshal(branchesMap)
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
@@ -71,6 +88,101 @@ func (env *Env) repoBranchesSubGetHelper(w http.ResponseWriter, r *http.Request)
 	w.Write(js)
 }
 
+// latestPull is the part of a branch's latest repo pull that is
+// shown in its summary.
+type latestPull struct {
+	ID         uint32           `json:"id"`
+	Status     datastore.Status `json:"status"`
+	Health     datastore.Health `json:"health"`
+	Commit     string           `json:"commit"`
+	Tag        string           `json:"tag,omitempty"`
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt time.Time        `json:"finished_at"`
+}
+
+// branchSummary is a branch, with how many times it has been pulled
+// and how its latest pull went.
+type branchSummary struct {
+	Branch string `json:"branch"`
+	Pulls  int    `json:"pulls"`
+	// Latest is left out for a branch that has not been pulled.
+	Latest *latestPull `json:"latest,omitempty"`
+	// LatestSuccessfulID is the ID of the latest pull that stopped
+	// without error, if any.
+	LatestSuccessfulID uint32 `json:"latest_successful_id,omitempty"`
+}
+
+// repoPullSucceeded reports whether a repo pull has stopped without
+// error.
+func repoPullSucceeded(rp *datastore.RepoPull) bool {
+	return rp.Status == datastore.StatusStopped &&
+		(rp.Health == datastore.HealthOK || rp.Health == datastore.HealthDegraded)
+}
+
+// latestRepoPull returns the most recently created of a branch's
+// repo pulls, or if successful is true, the most recently created
+// one that succeeded; or nil if there is none.
+func latestRepoPull(rps []*datastore.RepoPull, successful bool) *datastore.RepoPull {
+	var latest *datastore.RepoPull
+	for _, rp := range rps {
+		if successful && !repoPullSucceeded(rp) {
+			continue
+		}
+		if latest == nil || rp.ID > latest.ID {
+			latest = rp
+		}
+	}
+	return latest
+}
+
+func (env *Env) repoBranchesSummaryHelper(w http.ResponseWriter, r *http.Request, repoID uint32, branches []*datastore.RepoBranch) {
+	sort.Slice(branches, func(i, j int) bool { return branches[i].Branch < branches[j].Branch })
+
+	// limit to the requested page, if any, before looking up pulls
+	start, end, ok := extractPage(w, r, len(branches))
+	if !ok {
+		return
+	}
+
+	summaries := []*branchSummary{}
+	for _, rb := range branches[start:end] {
+		rps, err := env.db.GetAllRepoPullsForRepoBranch(repoID, rb.Branch)
+		if err == nil {
+			rps, err = env.rolledUpRepoPulls(rps)
+		}
+		if err != nil {
+			fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+			return
+		}
+		bs := &branchSummary{Branch: rb.Branch, Pulls: len(rps)}
+		if rp := latestRepoPull(rps, false); rp != nil {
+			bs.Latest = &latestPull{
+				ID:         rp.ID,
+				Status:     rp.Status,
+				Health:     rp.Health,
+				Commit:     rp.Commit,
+				Tag:        rp.Tag,
+				StartedAt:  rp.StartedAt,
+				FinishedAt: rp.FinishedAt,
+			}
+		}
+		if rp := latestRepoPull(rps, true); rp != nil {
+			bs.LatestSuccessfulID = rp.ID
+		}
+		summaries = append(summaries, bs)
+	}
+
+	// create map so we return a JSON object
+	summariesMap := map[string][]*branchSummary{}
+	summariesMap["branches"] = summaries
+	js, err := json.Marshal(summariesMap)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
+}
+
 func (env *Env) repoBranchesSubPostHelper(w http.ResponseWriter, r *http.Request) {
 	// get user and check access level
 	// must be at least operator
@@ -97,22 +209,189 @@ func (env *Env) repoBranchesSubPostHelper(w http.ResponseWriter, r *http.Request
 	}
 
 	// and extract data
-	branch, ok := js["branch"]
+	v, ok := js["branch"]
 	if !ok {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, `{"error": "Missing required value for 'branch'"}`)
 		return
 	}
+	branch, ok := v.(string)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid value for 'branch'"}`)
+		return
+	}
+	if err = checkBranchName(branch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": %q}`, "Invalid value for 'branch': "+err.Error())
+		return
+	}
 
 	// add the new repo branch
-	err = env.db.AddRepoBranch(repoID, branch.(string))
+	err = env.db.AddRepoBranch(repoID, branch)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, `{"error": "Unable to create repo branch"}`)
 		return
 	}
+	env.events.publish(EventBranchCreated, map[string]interface{}{
+		"branch": &datastore.RepoBranch{RepoID: repoID, Branch: branch},
+	})
 
 	// success!
 	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, `{"branch": "%s"}`, branch.(string))
+	fmt.Fprintf(w, `{"branch": %q}`, branch)
+}
+
+// ========== HANDLER for DELETE /repos/{id}/branches/{branch}
+// (routed through repoPullsSubHandler)
+
+func (env *Env) repoBranchDeleteHelper(w http.ResponseWriter, r *http.Request) {
+	// get user and check access level
+	user := extractUser(w, r, datastore.AccessAdmin)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get repo id and branch from vars
+	repoID, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid repo ID"}`)
+		return
+	}
+	branch, err := extractBranch(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid branch"}`)
+		return
+	}
+
+	// make sure the branch exists
+	rbs, err := env.db.GetAllRepoBranchesForRepoID(repoID)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+	found := false
+	for _, rb := range rbs {
+		if rb.Branch == branch {
+			found = true
+			break
+		}
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown branch"}`)
+		return
+	}
+
+	// with ?dry_run, only report what deleting it would remove or
+	// change; large deletions must be confirmed
+	if !env.checkDeletion(w, r, resourceBranch, repoID, branch) {
+		return
+	}
+
+	// delete the branch, along with its repo pulls
+	err = env.db.DeleteRepoBranch(repoID, branch)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Unable to delete repo branch"}`)
+		return
+	}
+	env.events.publish(EventBranchDeleted, map[string]interface{}{
+		"branch": &datastore.RepoBranch{RepoID: repoID, Branch: branch},
+	})
+
+	// success!
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ========== HANDLER for /repos/{id}/branches/{branch}/latest
+
+func (env *Env) repoBranchLatestHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be at least viewer
+	user := extractUser(w, r, datastore.AccessViewer)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get repo id and branch from vars
+	repoID, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid repo ID"}`)
+		return
+	}
+	branch, err := extractBranch(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid branch"}`)
+		return
+	}
+	// with ?successful=true, skip pulls that haven't succeeded
+	successful, ok := extractBoolParam(w, r, "successful")
+	if !ok {
+		return
+	}
+
+	// make sure the branch exists
+	rbs, err := env.db.GetAllRepoBranchesForRepoID(repoID)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+	found := false
+	for _, rb := range rbs {
+		if rb.Branch == branch {
+			found = true
+			break
+		}
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown branch"}`)
+		return
+	}
+
+	rps, err := env.db.GetAllRepoPullsForRepoBranch(repoID, branch)
+	if err == nil {
+		rps, err = env.rolledUpRepoPulls(rps)
+	}
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+	rp := latestRepoPull(rps, successful)
+	if rp == nil {
+		w.WriteHeader(http.StatusNotFound)
+		if successful {
+			fmt.Fprintf(w, `{"error": "No successful repo pulls for this branch"}`)
+		} else {
+			fmt.Fprintf(w, `{"error": "No repo pulls for this branch"}`)
+		}
+		return
+	}
+
+	// create map so we return a JSON object
+	jsData := struct {
+		RepoPull *datastore.RepoPull `json:"repopull"`
+	}{RepoPull: rp}
+	js, err := json.Marshal(jsData)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
 }
@@ -5,6 +5,9 @@ package handlers
 import (
 	"net/http"
 	"testing"
+	"time"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
 
 	hu "github.com/swinslow/peridot-api/test/handlerutils"
 )
@@ -31,6 +34,100 @@ func TestCannotGetRepoBranchesSubHandlerAsBadUser(t *testing.T) {
 	hu.ConfirmInvalidAuth(t, rec, ErrAuthGithub)
 }
 
+func TestCanGetRepoBranchesSummary(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repos/2/branches?summary=true", ``, "viewer", env.repoBranchesSubHandler, "/repos/{id}/branches")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"branches": [
+		{"branch": "alpha", "pulls": 0},
+		{"branch": "beta", "pulls": 0},
+		{"branch": "master", "pulls": 2, "latest": {"id": 2, "status": "running", "health": "degraded", "commit": "abcdef012345abcdef012345abcdef0123455678", "tag": "v1.2", "started_at": "2019-05-02T14:07:00Z", "finished_at": "0001-01-01T00:00:00Z"}}
+	]}`
+	hu.CheckResponse(t, rec, wanted)
+}
+
+func TestCanGetRepoBranchesSummaryPage(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repos/4/branches?summary=true&limit=1", ``, "viewer", env.repoBranchesSubHandler, "/repos/{id}/branches")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"branches": [
+		{"branch": "dev", "pulls": 1, "latest": {"id": 3, "status": "running", "health": "degraded", "commit": "abcdef012345abcdef012345abcdef01234590ab", "started_at": "2019-05-03T01:00:00Z", "finished_at": "0001-01-01T00:00:00Z"}}
+	]}`
+	hu.CheckResponse(t, rec, wanted)
+	if got := rec.Header().Get("X-Total-Count"); got != "2" {
+		t.Errorf("expected X-Total-Count 2, got %q", got)
+	}
+}
+
+func TestCannotGetRepoBranchesSummaryWithInvalidValue(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repos/2/branches?summary=yes-please", ``, "viewer", env.repoBranchesSubHandler, "/repos/{id}/branches")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'summary'"}`)
+}
+
+// ===== GET /repos/2/branches/master/latest =====
+
+func TestCanGetLatestRepoPullForBranch(t *testing.T) {
+	env := getTestEnv()
+	stopRepoPull2Jobs(t, env)
+
+	// a newer pull that hasn't finished yet
+	rec := serveTestRequest(t, env, "POST", "/repos/2/branches/master", `{"commit": "123490ab56123490ab56123490ab56123490ab56"}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	hu.ConfirmCreatedResponse(t, rec)
+
+	rec = serveTestRequest(t, env, "GET", "/repos/2/branches/master/latest", ``, "viewer", env.repoBranchLatestHandler, "/repos/{id}/branches/{branch}/latest")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"repopull": {"id":5,"repo_id":2,"branch":"master","started_at":"0001-01-01T00:00:00Z","finished_at":"0001-01-01T00:00:00Z","status":"startup","health":"ok","commit":"123490ab56123490ab56123490ab56123490ab56","spdx_id":""}}`)
+
+	// only the latest that succeeded
+	rec = serveTestRequest(t, env, "GET", "/repos/2/branches/master/latest?successful=true", ``, "viewer", env.repoBranchLatestHandler, "/repos/{id}/branches/{branch}/latest")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"repopull": {"id":2,"repo_id":2,"branch":"master","started_at":"2019-05-02T14:07:00Z","finished_at":"2019-05-02T14:20:00Z","status":"stopped","health":"ok","commit":"abcdef012345abcdef012345abcdef0123455678","tag":"v1.2","spdx_id":""}}`)
+}
+
+func TestCannotGetLatestRepoPullWhileItsJobsAreRunning(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repos/2/branches/master/latest?successful=true", ``, "viewer", env.repoBranchLatestHandler, "/repos/{id}/branches/{branch}/latest")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "No successful repo pulls for this branch"}`)
+}
+
+func TestCannotGetLatestRepoPullWhenThereIsNone(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repos/2/branches/alpha/latest", ``, "viewer", env.repoBranchLatestHandler, "/repos/{id}/branches/{branch}/latest")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "No repo pulls for this branch"}`)
+
+	// repo 4's dev branch has a pull, but it is still running
+	rec = serveTestRequest(t, env, "GET", "/repos/4/branches/dev/latest?successful=true", ``, "viewer", env.repoBranchLatestHandler, "/repos/{id}/branches/{branch}/latest")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "No successful repo pulls for this branch"}`)
+}
+
+func TestCannotGetLatestRepoPullForUnknownBranch(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repos/2/branches/nope/latest", ``, "viewer", env.repoBranchLatestHandler, "/repos/{id}/branches/{branch}/latest")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unknown branch"}`)
+}
+
+func TestCannotGetLatestRepoPullAsBadUser(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repos/2/branches/master/latest", ``, "disabled", env.repoBranchLatestHandler, "/repos/{id}/branches/{branch}/latest")
+	hu.ConfirmAccessDenied(t, rec)
+}
+
 // ===== POST /repos/2/branches =====
 
 func TestCanPostRepoBranchesSubHandlerAsOperator(t *testing.T) {
@@ -51,6 +148,36 @@ func TestCanPostRepoBranchesSubHandlerAsOperator(t *testing.T) {
 	}
 }
 
+func TestCanPostRepoBranchesSubHandlerWithSlash(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/repos/2/branches", `{"branch": "release/1.2"}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.repoBranchesSubHandler), "/repos/{id}/branches")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"branch": "release/1.2"}`)
+}
+
+func TestCannotPostRepoBranchesSubHandlerWithInvalidName(t *testing.T) {
+	tests := []struct {
+		body  string
+		error string
+	}{
+		{`{"branch": 17}`, `Invalid value for 'branch'`},
+		{`{"branch": "foo..bar"}`, `Invalid value for 'branch': must not contain \"..\"`},
+		{`{"branch": "foo.lock"}`, `Invalid value for 'branch': no part may end with \".lock\"`},
+		{`{"branch": "feature//foo"}`, `Invalid value for 'branch': must not contain \"//\"`},
+	}
+	for _, tc := range tests {
+		rec, req, env := setupTestEnv(t, "POST", "/repos/2/branches", tc.body, "operator")
+		hu.ServeHandler(rec, req, http.HandlerFunc(env.repoBranchesSubHandler), "/repos/{id}/branches")
+		hu.ConfirmBadRequestResponse(t, rec)
+		hu.CheckResponse(t, rec, `{"error": "`+tc.error+`"}`)
+
+		rbs, _ := env.db.GetAllRepoBranchesForRepoID(2)
+		if len(rbs) != 3 {
+			t.Errorf("expected %d, got %d", 3, len(rbs))
+		}
+	}
+}
+
 func TestCannotPostRepoBranchesSubHandlerAsOtherUser(t *testing.T) {
 	// as commenter
 	rec, req, env := setupTestEnv(t, "POST", "/repos/2/branches", `{"branch": "new-branch"}`, "commenter")
@@ -72,3 +199,69 @@ func TestCannotPostRepoBranchesSubHandlerAsBadUser(t *testing.T) {
 	hu.ServeHandler(rec, req, http.HandlerFunc(env.repoBranchesSubHandler), "/repos/{id}/branches")
 	hu.ConfirmInvalidAuth(t, rec, ErrAuthGithub)
 }
+
+// ===== DELETE /repos/2/branches/beta =====
+
+func TestCanDeleteRepoBranchHandlerAsAdmin(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "DELETE", "/repos/2/branches/beta", ``, "admin")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.repoPullsSubHandler), "/repos/{id}/branches/{branch}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	// and verify state of database now
+	rbs, err := env.db.GetAllRepoBranchesForRepoID(2)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	if len(rbs) != 2 {
+		t.Errorf("expected %d, got %d", 2, len(rbs))
+	}
+	if env.events.seq != 1 {
+		t.Errorf("expected %d events, got %d", 1, env.events.seq)
+	}
+}
+
+func TestCanDeleteRepoBranchHandlerWithSlash(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "DELETE", "/repos/2/branches/release%2F1.2", ``, "admin")
+	if err := env.db.AddRepoBranch(2, "release/1.2"); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.repoPullsSubHandler), "/repos/{id}/branches/{branch}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	rbs, _ := env.db.GetAllRepoBranchesForRepoID(2)
+	if len(rbs) != 3 {
+		t.Errorf("expected %d, got %d", 3, len(rbs))
+	}
+}
+
+func TestCannotDeleteUnknownRepoBranchHandler(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "DELETE", "/repos/2/branches/gamma", ``, "admin")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.repoPullsSubHandler), "/repos/{id}/branches/{branch}")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unknown branch"}`)
+}
+
+func TestCannotDeleteRepoBranchHandlerAsOperator(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "DELETE", "/repos/2/branches/beta", ``, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.repoPullsSubHandler), "/repos/{id}/branches/{branch}")
+	hu.ConfirmAccessDenied(t, rec)
+
+	rbs, _ := env.db.GetAllRepoBranchesForRepoID(2)
+	if len(rbs) != 3 {
+		t.Errorf("expected %d, got %d", 3, len(rbs))
+	}
+}
+
+// stopRepoPull2Jobs stops repo pull 2's running and starting jobs at
+// 14:20, so that the pull itself has stopped successfully.
+func stopRepoPull2Jobs(t *testing.T, env *Env) {
+	finished := time.Date(2019, 5, 2, 14, 20, 0, 0, time.UTC)
+	for _, id := range []uint32{7, 8} {
+		err := env.db.UpdateJobStatus(id, time.Time{}, finished, datastore.StatusStopped, datastore.HealthOK, "")
+		if err != nil {
+			t.Fatalf("got non-nil error: %v", err)
+		}
+	}
+}
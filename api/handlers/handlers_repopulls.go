@@ -6,25 +6,77 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 
-	"github.com/gorilla/mux"
 	"github.com/swinslow/peridot-db/pkg/datastore"
 )
 
+// ========== HANDLER for /repopulls
+
+func (env *Env) repoPullsHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests; repo pulls are created on a branch
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be at least viewer
+	user := extractUser(w, r, datastore.AccessViewer)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get what to select and how to order it
+	f, ok := extractRepoPullFilter(w, r)
+	if !ok {
+		return
+	}
+
+	pulls, err := env.findRepoPulls(f)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(pulls))
+	if !ok {
+		return
+	}
+
+	// create map so we return a JSON object
+	pullsMap := map[string][]*datastore.RepoPull{}
+	pullsMap["repopulls"] = pulls[start:end]
+	js, err := json.Marshal(pullsMap)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
+}
+
 // ========== HANDLER for /repos/{id}/branches/{branch}
 
 func (env *Env) repoPullsSubHandler(w http.ResponseWriter, r *http.Request) {
 	// responses will be JSON format
 	w.Header().Set("Content-Type", "application/json")
 
-	// we only take GET or POST requests
+	// we only take GET, POST or DELETE requests; DELETE removes
+	// the branch itself
 	switch r.Method {
 	case "GET":
 		env.repoPullsSubGetHelper(w, r)
 	case "POST":
 		env.repoPullsSubPostHelper(w, r)
+	case "DELETE":
+		env.repoBranchDeleteHelper(w, r)
 	default:
-		w.Header().Set("Allow", "GET, POST")
+		w.Header().Set("Allow", "GET, POST, DELETE")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
@@ -44,9 +96,8 @@ func (env *Env) repoPullsSubGetHelper(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"error": "Missing or invalid repo ID"}`)
 		return
 	}
-	vars := mux.Vars(r)
-	branch, ok := vars["branch"]
-	if !ok {
+	branch, err := extractBranch(r)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, `{"error": "Missing or invalid branch"}`)
 		return
@@ -59,9 +110,22 @@ func (env *Env) repoPullsSubGetHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(pulls))
+	if !ok {
+		return
+	}
+
+	// with their status, health and times derived from their jobs
+	page, err := env.rolledUpRepoPulls(pulls[start:end])
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+
 	// create map so we return a JSON object
 	pullsMap := map[string][]*datastore.RepoPull{}
-	pullsMap["pulls"] = pulls
+	pullsMap["pulls"] = page
 	js, err := json.Marshal(pullsMap)
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
@@ -85,9 +149,8 @@ func (env *Env) repoPullsSubPostHelper(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"error": "Missing or invalid repo ID"}`)
 		return
 	}
-	vars := mux.Vars(r)
-	branch, ok := vars["branch"]
-	if !ok {
+	branch, err := extractBranch(r)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, `{"error": "Missing or invalid branch"}`)
 		return
@@ -102,28 +165,146 @@ func (env *Env) repoPullsSubPostHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// and extract data
-	commit, ok := js["commit"]
-	if !ok {
+	// and extract data; all are strings, and only "commit" is
+	// required, unless it is to be resolved
+	vals := map[string]string{}
+	for _, name := range []string{"commit", "tag", "spdx_id"} {
+		v, ok := js[name]
+		if !ok {
+			continue
+		}
+		str, ok := v.(string)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for '%s'; must be a string"}`, name)
+			return
+		}
+		vals[name] = str
+	}
+	commit := strings.ToLower(vals["commit"])
+	tag := vals["tag"]
+	spdxID := vals["spdx_id"]
+
+	// and whether to resolve the commit from the repo, in place of
+	// giving it
+	resolve := false
+	if v, ok := js["resolve"]; ok {
+		resolve, ok = v.(bool)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'resolve'; must be a boolean"}`)
+			return
+		}
+	}
+	if commit == "" && !resolve {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, `{"error": "Missing required value for 'commit'"}`)
 		return
 	}
+	if commit != "" && resolve {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Cannot both give a 'commit' and 'resolve' one"}`)
+		return
+	}
+	if commit != "" {
+		if err := checkCommitID(commit); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": %q}`, "Invalid value for 'commit': "+err.Error())
+			return
+		}
+	}
+	if tag != "" {
+		// tag names follow the same rules as branch names
+		if err := checkBranchName(tag); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": %q}`, "Invalid value for 'tag': "+err.Error())
+			return
+		}
+	}
 
-	// for now, ignore tag and spdxID if they're present
-	tag := ""
-	spdxID := ""
+	repo, err := env.db.GetRepoByID(repoID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown repo ID"}`)
+		return
+	}
+
+	// this server only reads repositories on its own file system
+	// that are within the configured root
+	dir, local := localRepoPath(env.localRepoRoot, repo.Address)
+
+	// if asked to, pull the tag, or else the head of the branch, as
+	// the remote repository has them now
+	if resolve {
+		if !local && strings.HasPrefix(repo.Address, "file://") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Unable to resolve a commit in a file:/// repo outside the local repo root"}`)
+			return
+		}
+		refs, err := env.lsRefs(r.Context(), repo.Address)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(w, `{"error": "Unable to list the repo's remote branches and tags"}`)
+			return
+		}
+		if tag != "" {
+			commit = refs["refs/tags/"+tag]
+		} else {
+			commit = refs["refs/heads/"+branch]
+		}
+		if commit == "" && tag != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": %q}`, fmt.Sprintf("Tag %q is not in the repo", tag))
+			return
+		}
+		if commit == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": %q}`, fmt.Sprintf("Branch %q is not in the repo", branch))
+			return
+		}
+	}
+
+	// a repository on this server's file system can be checked
+	// before any work is queued for it
+	if local {
+		var msg string
+		switch err := env.commitOnBranch(r.Context(), dir, branch, commit); err {
+		case nil:
+		case errUnknownBranch:
+			msg = fmt.Sprintf("Branch %q is not in the repo", branch)
+		case errUnknownCommit:
+			msg = fmt.Sprintf("Commit %s is not in the repo", commit)
+		case errCommitNotOnBranch:
+			msg = fmt.Sprintf("Commit %s is not on branch %q", commit, branch)
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(w, `{"error": "Unable to check the commit in the repo"}`)
+			return
+		}
+		if msg != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": %q}`, msg)
+			return
+		}
+	}
 
 	// add the new repo pull
-	id, err := env.db.AddRepoPull(repoID, branch, commit.(string), tag, spdxID)
+	id, err := env.db.AddRepoPull(repoID, branch, commit, tag, spdxID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, `{"error": "Unable to create repo pull"}`)
 		return
 	}
+	if rp, err := env.db.GetRepoPullByID(id); err == nil {
+		env.publishRepoPullEvent(EventRepoPullCreated, rp)
+	}
 
-	// success!
+	// success! a resolved commit is returned too
 	w.WriteHeader(http.StatusCreated)
+	if resolve {
+		fmt.Fprintf(w, `{"id": %d, "commit": %q}`, id, commit)
+		return
+	}
 	fmt.Fprintf(w, `{"id": %d}`, id)
 }
 
@@ -167,11 +348,18 @@ func (env *Env) repoPullsOneGetHelper(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
 		return
 	}
+	// with its status, health and times derived from its jobs
+	rp, rollup, err := env.rolledUpRepoPull(rp)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
 
 	// create map so we return a JSON object
 	jsData := struct {
 		RepoPull *datastore.RepoPull `json:"repopull"`
-	}{RepoPull: rp}
+		Rollup   *repoPullRollup     `json:"rollup"`
+	}{RepoPull: rp, Rollup: rollup}
 	js, err := json.Marshal(jsData)
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
@@ -196,6 +384,15 @@ func (env *Env) repoPullsOneDeleteHelper(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// with ?dry_run, only report what deleting it would remove or
+	// change; large deletions must be confirmed
+	if !env.checkDeletion(w, r, resourceRepoPull, rpID, "") {
+		return
+	}
+
+	// keep the repo pull's details, for the event
+	rp, _ := env.db.GetRepoPullByID(rpID)
+
 	// delete the repo
 	err = env.db.DeleteRepoPull(rpID)
 	if err != nil {
@@ -203,6 +400,9 @@ func (env *Env) repoPullsOneDeleteHelper(w http.ResponseWriter, r *http.Request)
 		fmt.Fprintf(w, `{"error": "Unable to delete repo pull"}`)
 		return
 	}
+	if rp != nil {
+		env.publishRepoPullEvent(EventRepoPullDeleted, rp)
+	}
 
 	// success!
 	w.WriteHeader(http.StatusNoContent)
@@ -3,8 +3,16 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/swinslow/peridot-db/pkg/datastore"
 	hu "github.com/swinslow/peridot-api/test/handlerutils"
@@ -18,8 +26,8 @@ func TestCanGetRepoPullsSubHandler(t *testing.T) {
 	hu.ConfirmOKResponse(t, rec)
 
 	wanted := `{"pulls": [
-		{"id":1,"repo_id":2,"branch":"master","started_at":"0001-01-01T00:00:00Z","finished_at":"0001-01-01T00:00:00Z","status":"stopped","health":"error","commit":"abcdef012345abcdef012345abcdef0123451234","tag":"v1.1","spdx_id":""},
-		{"id":2,"repo_id":2,"branch":"master","started_at":"0001-01-01T00:00:00Z","finished_at":"0001-01-01T00:00:00Z","status":"stopped","health":"ok","commit":"abcdef012345abcdef012345abcdef0123455678","tag":"v1.2","spdx_id":""}
+		{"id":1,"repo_id":2,"branch":"master","started_at":"2019-05-02T13:53:41Z","finished_at":"2019-05-02T13:55:00Z","status":"stopped","health":"error","commit":"abcdef012345abcdef012345abcdef0123451234","tag":"v1.1","spdx_id":""},
+		{"id":2,"repo_id":2,"branch":"master","started_at":"2019-05-02T14:07:00Z","finished_at":"0001-01-01T00:00:00Z","status":"running","health":"degraded","commit":"abcdef012345abcdef012345abcdef0123455678","tag":"v1.2","spdx_id":""}
 	]}`
 	hu.CheckResponse(t, rec, wanted)
 }
@@ -62,6 +70,206 @@ func TestCanPostRepoPullsSubHandlerWithCommitAsOperator(t *testing.T) {
 	}
 }
 
+func TestCanPostRepoPullsSubHandlerForBranchWithSlash(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/repos/2/branches/release%2F1.2", `{"commit": "123490ab56123490ab56123490ab56123490ab56"}`, "operator")
+	if err := env.db.AddRepoBranch(2, "release/1.2"); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.repoPullsSubHandler), "/repos/{id}/branches/{branch:"+branchPattern+"}")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 5}`)
+
+	rp, err := env.db.GetRepoPullByID(5)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if rp.Branch != "release/1.2" {
+		t.Errorf("expected %s, got %s", "release/1.2", rp.Branch)
+	}
+}
+
+func TestCanPostRepoPullsSubHandlerWithTagAndUpperCaseSHA256(t *testing.T) {
+	env := getTestEnv()
+	commit := "123490AB56123490AB56123490AB56123490AB56123490AB56123490AB561234"
+	rec := serveTestRequest(t, env, "POST", "/repos/2/branches/alpha", `{"commit": "`+commit+`", "tag": "v2.0", "spdx_id": "SPDXRef-pull"}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 5}`)
+
+	rp, err := env.db.GetRepoPullByID(5)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if rp.Commit != "123490ab56123490ab56123490ab56123490ab56123490ab56123490ab561234" || rp.Tag != "v2.0" || rp.SPDXID != "SPDXRef-pull" {
+		t.Errorf("expected lower-case commit, tag and SPDX ID, got %#v", rp)
+	}
+}
+
+func TestCannotPostRepoPullsSubHandlerWithInvalidCommitOrTag(t *testing.T) {
+	env := getTestEnv()
+	cases := []struct {
+		body   string
+		wanted string
+	}{
+		{`{"commit": "123490ab"}`, `{"error": "Invalid value for 'commit': must be a full 40- or 64-character hex commit ID"}`},
+		{`{"commit": "master"}`, `{"error": "Invalid value for 'commit': must be a full 40- or 64-character hex commit ID"}`},
+		{`{"commit": "g23490ab56123490ab56123490ab56123490ab56"}`, `{"error": "Invalid value for 'commit': must be a full 40- or 64-character hex commit ID"}`},
+		{`{"commit": 123490}`, `{"error": "Invalid value for 'commit'; must be a string"}`},
+		{`{"commit": "123490ab56123490ab56123490ab56123490ab56", "tag": "v1..2"}`, `{"error": "Invalid value for 'tag': must not contain \"..\""}`},
+		{`{"commit": "123490ab56123490ab56123490ab56123490ab56", "tag": ["v1"]}`, `{"error": "Invalid value for 'tag'; must be a string"}`},
+		{`{}`, `{"error": "Missing required value for 'commit'"}`},
+		{`{"commit": "", "tag": "v1.0"}`, `{"error": "Missing required value for 'commit'"}`},
+		{`{"resolve": false}`, `{"error": "Missing required value for 'commit'"}`},
+		{`{"resolve": "true"}`, `{"error": "Invalid value for 'resolve'; must be a boolean"}`},
+		{`{"commit": "123490ab56123490ab56123490ab56123490ab56", "resolve": true}`, `{"error": "Cannot both give a 'commit' and 'resolve' one"}`},
+	}
+	for _, tc := range cases {
+		rec := serveTestRequest(t, env, "POST", "/repos/2/branches/alpha", tc.body, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+		hu.ConfirmBadRequestResponse(t, rec)
+		hu.CheckResponse(t, rec, tc.wanted)
+	}
+	if rps, _ := env.db.GetAllRepoPullsForRepoBranch(2, "alpha"); len(rps) != 0 {
+		t.Errorf("expected no repo pulls, got %d", len(rps))
+	}
+}
+
+func TestCannotPostRepoPullsSubHandlerForUnknownRepo(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "POST", "/repos/17/branches/alpha", `{"commit": "123490ab56123490ab56123490ab56123490ab56"}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unknown repo ID"}`)
+}
+
+func TestCanPostRepoPullsSubHandlerResolvingBranchOrTag(t *testing.T) {
+	env := getTestEnv()
+	env.lsRefs = func(ctx context.Context, address string) (map[string]string, error) {
+		if address != "https://example.com/repo2.git" {
+			t.Errorf("expected %s, got %s", "https://example.com/repo2.git", address)
+		}
+		return map[string]string{
+			"refs/heads/alpha": "1111111111111111111111111111111111111111",
+			"refs/tags/v2.0":   "2222222222222222222222222222222222222222",
+		}, nil
+	}
+
+	// the head of the branch, with or without an empty commit
+	rec := serveTestRequest(t, env, "POST", "/repos/2/branches/alpha", `{"resolve": true}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 5, "commit": "1111111111111111111111111111111111111111"}`)
+	rec = serveTestRequest(t, env, "POST", "/repos/2/branches/alpha", `{"commit": "", "resolve": true}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 6, "commit": "1111111111111111111111111111111111111111"}`)
+
+	// or a tag
+	rec = serveTestRequest(t, env, "POST", "/repos/2/branches/alpha", `{"tag": "v2.0", "resolve": true}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 7, "commit": "2222222222222222222222222222222222222222"}`)
+	rp, err := env.db.GetRepoPullByID(7)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if rp.Commit != "2222222222222222222222222222222222222222" || rp.Tag != "v2.0" {
+		t.Errorf("expected tag v2.0's commit, got %#v", rp)
+	}
+
+	// but not ones that aren't there
+	rec = serveTestRequest(t, env, "POST", "/repos/2/branches/alpha", `{"tag": "v3.0", "resolve": true}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Tag \"v3.0\" is not in the repo"}`)
+	rec = serveTestRequest(t, env, "POST", "/repos/2/branches/beta", `{"resolve": true}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Branch \"beta\" is not in the repo"}`)
+}
+
+func TestCannotPostRepoPullsSubHandlerResolvingWithoutRemote(t *testing.T) {
+	env := getTestEnv()
+	env.lsRefs = func(ctx context.Context, address string) (map[string]string, error) {
+		return nil, fmt.Errorf("unreachable")
+	}
+	rec := serveTestRequest(t, env, "POST", "/repos/2/branches/alpha", `{"resolve": true}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected %d, got %d", http.StatusBadGateway, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unable to list the repo's remote branches and tags"}`)
+}
+
+func TestCanPostRepoPullsSubHandlerCheckedInLocalRepo(t *testing.T) {
+	dir, mainCommit, topicCommit := makeTestGitRepo(t)
+	defer os.RemoveAll(dir)
+	env := getTestEnv()
+	env.localRepoRoot = filepath.Dir(dir)
+	if err := env.db.UpdateRepo(2, "", "file://"+dir); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	for _, branch := range []string{"main", "topic"} {
+		if err := env.db.AddRepoBranch(2, branch); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+	}
+
+	// a commit on the branch, given or resolved from the remote
+	rec := serveTestRequest(t, env, "POST", "/repos/2/branches/main", `{"commit": "`+mainCommit+`"}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 5}`)
+	rec = serveTestRequest(t, env, "POST", "/repos/2/branches/topic", `{"resolve": true}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 6, "commit": "`+topicCommit+`"}`)
+
+	// a tag's commit must be on the branch too
+	rec = serveTestRequest(t, env, "POST", "/repos/2/branches/topic", `{"tag": "v1.0", "resolve": true}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 7, "commit": "`+mainCommit+`"}`)
+
+	cases := []struct {
+		branch string
+		commit string
+		wanted string
+	}{
+		{"main", topicCommit, `{"error": "Commit ` + topicCommit + ` is not on branch \"main\""}`},
+		{"main", "123490ab56123490ab56123490ab56123490ab56", `{"error": "Commit 123490ab56123490ab56123490ab56123490ab56 is not in the repo"}`},
+		{"alpha", mainCommit, `{"error": "Branch \"alpha\" is not in the repo"}`},
+	}
+	for _, tc := range cases {
+		rec = serveTestRequest(t, env, "POST", "/repos/2/branches/"+tc.branch, `{"commit": "`+tc.commit+`"}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+		hu.ConfirmBadRequestResponse(t, rec)
+		hu.CheckResponse(t, rec, tc.wanted)
+	}
+	if rp, err := env.db.GetRepoPullByID(8); err == nil {
+		t.Errorf("expected no more repo pulls, got %#v", rp)
+	}
+}
+
+func TestLocalRepoOutsideRootIsNotRead(t *testing.T) {
+	dir, mainCommit, _ := makeTestGitRepo(t)
+	defer os.RemoveAll(dir)
+	env := getTestEnv()
+	env.lsRefs = func(ctx context.Context, address string) (map[string]string, error) {
+		t.Errorf("expected repo not to be listed, got %s", address)
+		return nil, fmt.Errorf("not listed")
+	}
+	env.commitOnBranch = func(ctx context.Context, dir string, branch string, commit string) error {
+		t.Errorf("expected repo not to be checked, got %s", dir)
+		return nil
+	}
+	if err := env.db.UpdateRepo(2, "", "file://"+dir); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	// a given commit is left unchecked, as for other remotes
+	rec := serveTestRequest(t, env, "POST", "/repos/2/branches/alpha", `{"commit": "`+mainCommit+`"}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 5}`)
+
+	// but one can't be resolved, without a root or outside it
+	for _, root := range []string{"", filepath.Join(filepath.Dir(dir), "other")} {
+		env.localRepoRoot = root
+		rec = serveTestRequest(t, env, "POST", "/repos/2/branches/alpha", `{"resolve": true}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+		hu.ConfirmBadRequestResponse(t, rec)
+		hu.CheckResponse(t, rec, `{"error": "Unable to resolve a commit in a file:/// repo outside the local repo root"}`)
+	}
+}
+
 // ===== GET /repopulls/3 =====
 
 func TestCanGetRepoPullsOneHandlerAsViewer(t *testing.T) {
@@ -69,7 +277,13 @@ func TestCanGetRepoPullsOneHandlerAsViewer(t *testing.T) {
 	hu.ServeHandler(rec, req, http.HandlerFunc(env.repoPullsOneHandler), "/repopulls/{id}")
 	hu.ConfirmOKResponse(t, rec)
 
-	wanted := `{"repopull": {"id":3,"repo_id":4,"branch":"dev","started_at":"0001-01-01T00:00:00Z","finished_at":"0001-01-01T00:00:00Z","status":"running","health":"degraded","commit":"abcdef012345abcdef012345abcdef01234590ab","spdx_id":""}}`
+	wanted := `{"repopull": {"id":3,"repo_id":4,"branch":"dev","started_at":"2019-05-03T01:00:00Z","finished_at":"0001-01-01T00:00:00Z","status":"running","health":"degraded","commit":"abcdef012345abcdef012345abcdef01234590ab","spdx_id":""},
+		"rollup": {"jobs":1,"statuses":{"running":1},"healths":{"degraded":1},"rules":{
+			"status":"stopped if all jobs have stopped; startup if none have started; otherwise running",
+			"health":"the worst of the jobs' health: error, then degraded, then ok",
+			"started_at":"when the pull itself started, or else when its first job started",
+			"finished_at":"once stopped, when the last of the pull and its jobs finished",
+			"no_jobs":"a pull without jobs keeps its own status, health and times"}}}`
 	hu.CheckResponse(t, rec, wanted)
 }
 
@@ -127,3 +341,162 @@ func TestCannotDeleteRepoPullsOneHandlerAsOperator(t *testing.T) {
 	}
 
 }
+
+// ===== GET /repopulls =====
+
+// repoPullIDs returns the IDs of the repo pulls in a GET /repopulls
+// response.
+func repoPullIDs(t *testing.T, rec *httptest.ResponseRecorder) []uint32 {
+	js := struct {
+		RepoPulls []*datastore.RepoPull `json:"repopulls"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &js); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	ids := []uint32{}
+	for _, rp := range js.RepoPulls {
+		ids = append(ids, rp.ID)
+	}
+	return ids
+}
+
+// setRepoPullTimes sets when the mock repo pulls started and
+// finished: repo pull 1 on June 1, 2 on June 3 and 3 (still running)
+// on June 5.
+func setRepoPullTimes(t *testing.T, env *Env) {
+	times := []struct {
+		id       uint32
+		started  string
+		finished string
+	}{
+		{1, "2019-06-01T10:00:00Z", "2019-06-01T10:05:00Z"},
+		{2, "2019-06-03T10:00:00Z", "2019-06-03T10:05:00Z"},
+		{3, "2019-06-05T10:00:00Z", ""},
+	}
+	for _, rt := range times {
+		rp, err := env.db.GetRepoPullByID(rt.id)
+		if err != nil {
+			t.Fatalf("got non-nil error: %v", err)
+		}
+		rp.StartedAt, _ = time.Parse(time.RFC3339, rt.started)
+		if rt.finished != "" {
+			rp.FinishedAt, _ = time.Parse(time.RFC3339, rt.finished)
+		}
+	}
+}
+
+func TestCanGetAllRepoPullsAsViewer(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repopulls", ``, "viewer", env.repoPullsHandler, "/repopulls")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"repopulls": [
+		{"id":1,"repo_id":2,"branch":"master","started_at":"2019-05-02T13:53:41Z","finished_at":"2019-05-02T13:55:00Z","status":"stopped","health":"error","commit":"abcdef012345abcdef012345abcdef0123451234","tag":"v1.1","spdx_id":""},
+		{"id":2,"repo_id":2,"branch":"master","started_at":"2019-05-02T14:07:00Z","finished_at":"0001-01-01T00:00:00Z","status":"running","health":"degraded","commit":"abcdef012345abcdef012345abcdef0123455678","tag":"v1.2","spdx_id":""},
+		{"id":3,"repo_id":4,"branch":"dev","started_at":"2019-05-03T01:00:00Z","finished_at":"0001-01-01T00:00:00Z","status":"running","health":"degraded","commit":"abcdef012345abcdef012345abcdef01234590ab","spdx_id":""}
+	]}`
+	hu.CheckResponse(t, rec, wanted)
+	if got := rec.Header().Get("X-Total-Count"); got != "3" {
+		t.Errorf("expected X-Total-Count 3, got %q", got)
+	}
+}
+
+func TestCanFilterAllRepoPulls(t *testing.T) {
+	env := getTestEnv()
+	setRepoPullTimes(t, env)
+
+	tests := []struct {
+		query  string
+		wanted []uint32
+	}{
+		{"repo_id=2", []uint32{1, 2}},
+		{"subproject_id=4", []uint32{1, 2, 3}},
+		{"subproject_id=2", []uint32{}},
+		{"project_id=1", []uint32{1, 2, 3}},
+		{"project_id=3", []uint32{}},
+		{"branch=dev", []uint32{3}},
+		// repo pull 2 is still running, since two of its jobs are
+		{"status=stopped", []uint32{1}},
+		{"status=running", []uint32{2, 3}},
+		{"health=error,degraded", []uint32{1, 2, 3}},
+		{"health=ok", []uint32{}},
+		{"status=stopped&health=error", []uint32{1}},
+		{"commit=ABCDEF012345ABCDEF012345ABCDEF0123455", []uint32{2}},
+		{"tag=v1", []uint32{1, 2}},
+		{"tag=v1.2", []uint32{2}},
+		{"started_after=2019-06-02T00:00:00Z", []uint32{2, 3}},
+		{"started_after=2019-06-02T00:00:00Z&started_before=2019-06-04T00:00:00Z", []uint32{2}},
+		{"finished_before=2019-06-04T00:00:00Z", []uint32{1}},
+		{"finished_after=2019-06-02T00:00:00Z", []uint32{}},
+		{"health=error&finished_after=2019-06-01T00:00:00Z&finished_before=2019-06-08T00:00:00Z", []uint32{1}},
+	}
+	for _, tc := range tests {
+		rec := serveTestRequest(t, env, "GET", "/repopulls?"+tc.query, ``, "viewer", env.repoPullsHandler, "/repopulls")
+		hu.ConfirmOKResponse(t, rec)
+		if got := repoPullIDs(t, rec); !reflect.DeepEqual(got, tc.wanted) {
+			t.Errorf("%s: expected %v, got %v", tc.query, tc.wanted, got)
+		}
+	}
+}
+
+func TestCanSortAllRepoPullsByRecency(t *testing.T) {
+	env := getTestEnv()
+	setRepoPullTimes(t, env)
+
+	// a new repo pull, not yet started, comes first
+	rec := serveTestRequest(t, env, "POST", "/repos/2/branches/alpha", `{"commit": "123490ab56123490ab56123490ab56123490ab56"}`, "operator", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	hu.ConfirmCreatedResponse(t, rec)
+
+	rec = serveTestRequest(t, env, "GET", "/repopulls?sort=recent", ``, "viewer", env.repoPullsHandler, "/repopulls")
+	hu.ConfirmOKResponse(t, rec)
+	if got, wanted := repoPullIDs(t, rec), []uint32{5, 3, 2, 1}; !reflect.DeepEqual(got, wanted) {
+		t.Errorf("expected %v, got %v", wanted, got)
+	}
+
+	// and it is paged after sorting
+	rec = serveTestRequest(t, env, "GET", "/repopulls?sort=recent&offset=1&limit=2", ``, "viewer", env.repoPullsHandler, "/repopulls")
+	hu.ConfirmOKResponse(t, rec)
+	if got, wanted := repoPullIDs(t, rec), []uint32{3, 2}; !reflect.DeepEqual(got, wanted) {
+		t.Errorf("expected %v, got %v", wanted, got)
+	}
+	if got := rec.Header().Get("X-Total-Count"); got != "4" {
+		t.Errorf("expected X-Total-Count 4, got %q", got)
+	}
+}
+
+func TestAllRepoPullsLeavesOutTrashedRepos(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "DELETE", "/repos/4", ``, "admin", env.reposOneHandler, "/repos/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	rec = serveTestRequest(t, env, "GET", "/repopulls", ``, "admin", env.repoPullsHandler, "/repopulls")
+	hu.ConfirmOKResponse(t, rec)
+	if got, wanted := repoPullIDs(t, rec), []uint32{1, 2}; !reflect.DeepEqual(got, wanted) {
+		t.Errorf("expected %v, got %v", wanted, got)
+	}
+}
+
+func TestCannotGetAllRepoPullsWithInvalidFilter(t *testing.T) {
+	env := getTestEnv()
+	tests := []struct {
+		query  string
+		wanted string
+	}{
+		{"repo_id=x", `{"error": "Invalid value for 'repo_id'"}`},
+		{"status=done", `{"error": "Invalid value for 'status'; must be one of startup, running, stopped"}`},
+		{"health=fine", `{"error": "Invalid value for 'health'; must be one of ok, degraded, error"}`},
+		{"started_after=2019-06-01", `{"error": "Invalid value for 'started_after'; must be an RFC 3339 time, e.g. 2019-06-01T00:00:00Z"}`},
+		{"sort=oldest", `{"error": "Invalid value for 'sort'; must be one of id, recent"}`},
+	}
+	for _, tc := range tests {
+		rec := serveTestRequest(t, env, "GET", "/repopulls?"+tc.query, ``, "viewer", env.repoPullsHandler, "/repopulls")
+		hu.ConfirmBadRequestResponse(t, rec)
+		hu.CheckResponse(t, rec, tc.wanted)
+	}
+}
+
+func TestCannotGetAllRepoPullsAsBadUser(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/repopulls", ``, "disabled", env.repoPullsHandler, "/repopulls")
+	hu.ConfirmAccessDenied(t, rec)
+}
@@ -36,16 +36,32 @@ func (env *Env) reposGetHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// sufficient access; get repos from database
+	// sufficient access; get the label selector, if any
+	sel, ok := extractLabelSelector(w, r)
+	if !ok {
+		return
+	}
+
+	// get repos from database
 	repos, err := env.db.GetAllRepos()
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
 		return
 	}
+	// leave out anything in the trash
+	repos = env.visibleRepos(repos)
+	// and anything that doesn't match the label selector
+	repos = env.labelledRepos(repos, sel)
+
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(repos))
+	if !ok {
+		return
+	}
 
 	// create map so we return a JSON object
 	reposMap := map[string][]*datastore.Repo{}
-	reposMap["repos"] = repos
+	reposMap["repos"] = repos[start:end]
 	js, err := json.Marshal(reposMap)
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
@@ -93,14 +109,28 @@ func (env *Env) reposPostHelper(w http.ResponseWriter, r *http.Request) {
 
 	// convert subprojectID float64 to uint32
 	subprojectID := uint32(subprojectIDf.(float64))
+	if env.resourceHidden(resourceSubproject, subprojectID) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid value for 'subproject_id'; unknown subproject"}`)
+		return
+	}
+
+	// normalize the address, and check it isn't already used
+	normAddress, ok := env.checkRepoAddress(w, address.(string), 0)
+	if !ok {
+		return
+	}
 
 	// add the new repo
-	newID, err := env.db.AddRepo(subprojectID, name.(string), address.(string))
+	newID, err := env.db.AddRepo(subprojectID, name.(string), normAddress)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, `{"error": "Unable to create repo"}`)
 		return
 	}
+	env.events.publish(EventRepoCreated, map[string]interface{}{
+		"repo": &datastore.Repo{ID: newID, SubprojectID: subprojectID, Name: name.(string), Address: normAddress},
+	})
 
 	// success!
 	w.WriteHeader(http.StatusCreated)
@@ -141,16 +171,32 @@ func (env *Env) reposSubGetHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// get the label selector, if any
+	sel, ok := extractLabelSelector(w, r)
+	if !ok {
+		return
+	}
+
 	// get repos from database
 	repos, err := env.db.GetAllReposForSubprojectID(subprojectID)
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
 		return
 	}
+	// leave out anything in the trash
+	repos = env.visibleRepos(repos)
+	// and anything that doesn't match the label selector
+	repos = env.labelledRepos(repos, sel)
+
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(repos))
+	if !ok {
+		return
+	}
 
 	// create map so we return a JSON object
 	reposMap := map[string][]*datastore.Repo{}
-	reposMap["repos"] = repos
+	reposMap["repos"] = repos[start:end]
 	js, err := json.Marshal(reposMap)
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
@@ -198,13 +244,22 @@ func (env *Env) reposSubPostHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// normalize the address, and check it isn't already used
+	normAddress, ok := env.checkRepoAddress(w, address.(string), 0)
+	if !ok {
+		return
+	}
+
 	// add the new repo
-	newID, err := env.db.AddRepo(subprojectID, name.(string), address.(string))
+	newID, err := env.db.AddRepo(subprojectID, name.(string), normAddress)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, `{"error": "Unable to create repo"}`)
 		return
 	}
+	env.events.publish(EventRepoCreated, map[string]interface{}{
+		"repo": &datastore.Repo{ID: newID, SubprojectID: subprojectID, Name: name.(string), Address: normAddress},
+	})
 
 	// success!
 	w.WriteHeader(http.StatusCreated)
@@ -221,12 +276,12 @@ func (env *Env) reposOneHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		env.reposOneGetHelper(w, r)
-	case "PUT":
+	case "PUT", "PATCH":
 		env.reposOnePutHelper(w, r)
 	case "DELETE":
 		env.reposOneDeleteHelper(w, r)
 	default:
-		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
@@ -254,6 +309,11 @@ func (env *Env) reposOneGetHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// set the ETag, and stop here if the client's copy is current
+	if writeETag(w, r, repo) {
+		return
+	}
+
 	// create map so we return a JSON object
 	jsData := struct {
 		Repo *datastore.Repo `json:"repo"`
@@ -282,6 +342,9 @@ func (env *Env) reposOnePutHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// hold the repo until it has been changed (see resourceLocks)
+	defer env.locks.lock(resourceRepo, repoID)()
+
 	// get existing repo from database
 	repo, err := env.db.GetRepoByID(repoID)
 	if err != nil {
@@ -290,34 +353,103 @@ func (env *Env) reposOnePutHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// parse JSON request
-	js := map[string]string{}
-	err = json.NewDecoder(r.Body).Decode(&js)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+	// if the request is conditional, make sure the client
+	// is updating the current version
+	if !checkIfMatch(w, r, repo) {
 		return
 	}
 
-	// and extract data; if absent, use existing data
-	newName, ok := js["name"]
+	// parse JSON request (or merge patch, for PATCH)
+	js, ok := extractUpdateRequest(w, r, repo)
 	if !ok {
-		newName = repo.Name
-	}
-	newAddress, ok := js["address"]
-	if !ok {
-		newAddress = repo.Address
+		return
 	}
-	// NOTE: currently, cannot update the repo's project ID
-	// using this API call.
 
-	// modify the repo data
+	// and extract data; if absent, use existing data
+	newName, err := optionalString(js, "name", repo.Name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "%v"}`, err)
+		return
+	}
+	newAddress, err := optionalString(js, "address", repo.Address)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "%v"}`, err)
+		return
+	}
+	newSubprojectID, err := optionalID(js, "subproject_id", repo.SubprojectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "%v"}`, err)
+		return
+	}
+	// if the address is changing, normalize it, and check it
+	// isn't already used
+	if newAddress != repo.Address {
+		newAddress, ok = env.checkRepoAddress(w, newAddress, repoID)
+		if !ok {
+			return
+		}
+	}
+	// if the repo is moving, the new subproject must exist, and the
+	// user must be able to change the projects of both subprojects
+	if newSubprojectID != repo.SubprojectID {
+		newSp, err := env.db.GetSubprojectByID(newSubprojectID)
+		if err != nil || env.resourceHidden(resourceSubproject, newSubprojectID) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'subproject_id'; unknown subproject"}`)
+			return
+		}
+		oldSp, err := env.db.GetSubprojectByID(repo.SubprojectID)
+		if err != nil {
+			fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+			return
+		}
+		if !canModifyProject(user, oldSp.ProjectID) || !canModifyProject(user, newSp.ProjectID) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"error": "%s"}`, ErrAuthAccess)
+			return
+		}
+	}
+	// and no other repo in the subproject may have the same name
+	if newSubprojectID != repo.SubprojectID || newName != repo.Name {
+		repos, err := env.db.GetAllReposForSubprojectID(newSubprojectID)
+		if err != nil {
+			fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+			return
+		}
+		for _, other := range repos {
+			if other.ID != repoID && other.Name == newName {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintf(w, `{"error": "Repo %d in subproject %d already has this name", "repo_id": %d}`, other.ID, newSubprojectID, other.ID)
+				return
+			}
+		}
+	}
+
+	// modify the repo data, and move it if needed; the datastore
+	// can't do both at once, so if the move fails, the repo data is
+	// changed back
+	oldName, oldAddress, oldSubprojectID := repo.Name, repo.Address, repo.SubprojectID
 	err = env.db.UpdateRepo(repoID, newName, newAddress)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, `{"error": "Unable to update repo"}`)
 		return
 	}
+	if newSubprojectID != oldSubprojectID {
+		err = env.db.UpdateRepoSubprojectID(repoID, newSubprojectID)
+		if err != nil {
+			env.db.UpdateRepo(repoID, oldName, oldAddress)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"error": "Unable to move repo"}`)
+			return
+		}
+	}
+	if repo, err := env.db.GetRepoByID(repoID); err == nil {
+		env.events.publish(EventRepoUpdated, map[string]interface{}{"repo": repo})
+	}
 
 	// success!
 	w.WriteHeader(http.StatusNoContent)
@@ -339,14 +471,38 @@ func (env *Env) reposOneDeleteHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// delete the repo
-	err = env.db.DeleteRepo(repoID)
+	// hold the repo until it has been deleted (see resourceLocks)
+	defer env.locks.lock(resourceRepo, repoID)()
+
+	// if the request is conditional, make sure the client
+	// is deleting the current version
+	if r.Header.Get("If-Match") != "" {
+		var current interface{}
+		if repo, err := env.db.GetRepoByID(repoID); err == nil {
+			current = repo
+		}
+		if !checkIfMatch(w, r, current) {
+			return
+		}
+	}
+
+	// with ?dry_run, only report what deleting it would remove or
+	// change; large deletions must be confirmed
+	if !env.checkDeletion(w, r, resourceRepo, repoID, "") {
+		return
+	}
+
+	repo, err := env.db.GetRepoByID(repoID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"error": "Unable to delete repo"}`)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown repo ID"}`)
 		return
 	}
 
+	// move the repo to the trash; it is only deleted from the
+	// database once it is purged
+	env.trashResource(resourceRepo, repoID, repo.Name, user, repo)
+
 	// success!
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -3,6 +3,7 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
 	"testing"
 
@@ -59,6 +60,45 @@ func TestCanPostReposHandlerAsOperator(t *testing.T) {
 	}
 }
 
+func TestCanPostReposHandlerWithNormalizedAddress(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/repos", `{"subproject_id": 2, "name": "repo5", "address": "HTTPS://Example.com/newrepo5/"}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.reposHandler), "/repos")
+	hu.ConfirmCreatedResponse(t, rec)
+
+	newRepo, err := env.db.GetRepoByID(5)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if newRepo.Address != "https://example.com/newrepo5.git" {
+		t.Errorf("expected %s, got %s", "https://example.com/newrepo5.git", newRepo.Address)
+	}
+}
+
+func TestCannotPostReposHandlerWithInvalidAddress(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/repos", `{"subproject_id": 2, "name": "repo5", "address": "ftp://example.com/newrepo5.git"}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.reposHandler), "/repos")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'address': unsupported scheme \"ftp\"; must be https, http, ssh, git or file"}`)
+}
+
+func TestCannotPostReposHandlerWithExistingAddress(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/repos", `{"subproject_id": 2, "name": "repo5", "address": "git@example.com:repo1.git"}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.reposHandler), "/repos")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected %d, got %d", http.StatusConflict, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Repo 1 already has this address", "repo_id": 1}`)
+
+	// and verify state of database now
+	repos, err := env.db.GetAllRepos()
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	if len(repos) != 4 {
+		t.Errorf("expected %d, got %d", 4, len(repos))
+	}
+}
+
 func TestCannotPostReposHandlerAsOtherUser(t *testing.T) {
 	// as commenter
 	rec, req, env := setupTestEnv(t, "POST", "/repos", `{"subproject_id": 2, "name": "repo5", "address": "https://example.com/newrepo5.git"}`, "commenter")
@@ -223,6 +263,101 @@ func TestCanPutReposOneHandlerAsOperatorWithJustFullname(t *testing.T) {
 	}
 }
 
+func TestCannotPutReposOneHandlerWithExistingAddress(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PUT", "/repos/3", `{"address": "https://example.com/repo2"}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.reposOneHandler), "/repos/{id}")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected %d, got %d", http.StatusConflict, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Repo 2 already has this address", "repo_id": 2}`)
+
+	// but a repo can keep its own address
+	rec, req, env = setupTestEnv(t, "PUT", "/repos/3", `{"name": "new-name", "address": "https://example.com/repo3"}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.reposOneHandler), "/repos/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+}
+
+func TestCanMoveReposOneHandlerToOtherSubproject(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PATCH", "/repos/2", `{"subproject_id": 1}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.reposOneHandler), "/repos/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	// and verify state of database now; its pulls move with it
+	repo, err := env.db.GetRepoByID(2)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	wantedRepo := &datastore.Repo{ID: 2, SubprojectID: 1, Name: "repo2", Address: "https://example.com/repo2.git"}
+	if repo.ID != wantedRepo.ID || repo.SubprojectID != wantedRepo.SubprojectID || repo.Name != wantedRepo.Name || repo.Address != wantedRepo.Address {
+		t.Errorf("expected %#v, got %#v", wantedRepo, repo)
+	}
+	rps, _ := env.db.GetAllRepoPullsForRepoBranch(2, "master")
+	if len(rps) != 2 {
+		t.Errorf("expected %d, got %d", 2, len(rps))
+	}
+	if env.events.seq != 1 {
+		t.Errorf("expected %d events, got %d", 1, env.events.seq)
+	}
+}
+
+func TestCannotMoveReposOneHandlerWithInvalidValues(t *testing.T) {
+	tests := []struct {
+		body  string
+		code  int
+		error string
+	}{
+		{`{"subproject_id": -2}`, http.StatusBadRequest, `{"error": "Invalid value for 'subproject_id'"}`},
+		{`{"subproject_id": 17}`, http.StatusBadRequest, `{"error": "Invalid value for 'subproject_id'; unknown subproject"}`},
+		{`{"subproject_id": 2, "name": "repo1"}`, http.StatusConflict, `{"error": "Repo 1 in subproject 2 already has this name", "repo_id": 1}`},
+		{`{"name": "repo4"}`, http.StatusConflict, `{"error": "Repo 4 in subproject 4 already has this name", "repo_id": 4}`},
+	}
+	for _, tc := range tests {
+		rec, req, env := setupTestEnv(t, "PUT", "/repos/3", tc.body, "operator")
+		hu.ServeHandler(rec, req, http.HandlerFunc(env.reposOneHandler), "/repos/{id}")
+		if rec.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.body, tc.code, rec.Code)
+		}
+		hu.CheckResponse(t, rec, tc.error)
+
+		repo, _ := env.db.GetRepoByID(3)
+		if repo.SubprojectID != 4 || repo.Name != "repo3" {
+			t.Errorf("%s: unexpected repo: %#v", tc.body, repo)
+		}
+	}
+}
+
+// failingMoveDB is a datastore whose moves of repos and subprojects
+// always fail.
+type failingMoveDB struct {
+	datastore.Datastore
+}
+
+func (db *failingMoveDB) UpdateRepoSubprojectID(id uint32, subprojectID uint32) error {
+	return fmt.Errorf("unable to move repo")
+}
+
+func (db *failingMoveDB) UpdateSubprojectProjectID(id uint32, projectID uint32) error {
+	return fmt.Errorf("unable to move subproject")
+}
+
+func TestFailedMoveOfReposOneHandlerLeavesRepoUnchanged(t *testing.T) {
+	env := getTestEnv()
+	env.db = &failingMoveDB{env.db}
+	rec := serveTestRequest(t, env, "PUT", "/repos/3", `{"name": "new-name", "subproject_id": 1}`, "operator", env.reposOneHandler, "/repos/{id}")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unable to move repo"}`)
+
+	repo, _ := env.db.GetRepoByID(3)
+	if repo.SubprojectID != 4 || repo.Name != "repo3" {
+		t.Errorf("expected repo to be left unchanged, got %#v", repo)
+	}
+	if env.events.seq != 0 {
+		t.Errorf("expected no events, got %d", env.events.seq)
+	}
+}
+
 func TestCannotPutReposOneHandlerAsCommenter(t *testing.T) {
 	rec, req, env := setupTestEnv(t, "PUT", "/repos/3", `{"name": "new-name", "address": "https://example.com/new-name.git"}`, "commenter")
 	hu.ServeHandler(rec, req, http.HandlerFunc(env.reposOneHandler), "/repos/{id}")
@@ -246,18 +381,18 @@ func TestCanDeleteReposOneHandlerAsAdmin(t *testing.T) {
 	hu.ServeHandler(rec, req, http.HandlerFunc(env.reposOneHandler), "/repos/{id}")
 	hu.ConfirmNoContentResponse(t, rec)
 
-	// and verify state of database now
-	repos, err := env.db.GetAllRepos()
-	if err != nil {
+	// and verify that the repo is in the trash, not deleted
+	if _, err := env.db.GetRepoByID(3); err != nil {
 		t.Errorf("expected nil error, got %v", err)
 	}
-	if len(repos) != 3 {
-		t.Errorf("expected %d, got %d", 3, len(repos))
-	}
-	repo, err := env.db.GetRepoByID(3)
-	if err == nil {
-		t.Fatalf("expected non-nil error, got nil and %#v", repo)
+	if !env.trash.has(resourceRepo, 3) {
+		t.Errorf("expected repo 3 to be in the trash")
 	}
+
+	// and that it is no longer listed
+	rec = serveTestRequest(t, env, "GET", "/subprojects/4/repos", ``, "viewer", env.reposSubHandler, "/subprojects/{id}/repos")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"repos": [{"id": 2, "subproject_id": 4, "name": "repo2", "address": "https://example.com/repo2.git"}, {"id": 4, "subproject_id": 4, "name": "repo4", "address": "https://example.com/repo4.git"}]}`)
 }
 
 func TestCannotDeleteReposOneHandlerAsOperator(t *testing.T) {
@@ -0,0 +1,389 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// Types of search result, in the order they are listed when their
+// scores are the same.
+var searchTypes = []string{resourceProject, resourceSubproject, resourceRepo, resourceBranch, resourceRepoPull, resourceAgent, resourceUser}
+
+// isSearchType reports whether s is a known type of search result.
+func isSearchType(s string) bool {
+	for _, t := range searchTypes {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Scores for how well a value matches a search.
+const (
+	searchScoreExact     = 100
+	searchScorePrefix    = 75
+	searchScoreWordStart = 50
+	searchScoreContains  = 25
+	// searchSecondaryPenalty is taken off matches in secondary
+	// values, such as a project's fullname or a repo pull's tag, so
+	// that a match in a name ranks above the same match elsewhere.
+	searchSecondaryPenalty = 5
+)
+
+// searchResult is one resource that matches a search.
+type searchResult struct {
+	Type string `json:"type"`
+	ID   uint32 `json:"id,omitempty"`
+	// Name is the resource's name, or for a repo pull, its commit.
+	Name string `json:"name"`
+	// Field is the value that matched, and Match is what it is.
+	Field string `json:"field"`
+	Match string `json:"match"`
+	Score int    `json:"score"`
+	// where the resource is, so that e.g. the project that owns a
+	// repo can be found
+	ProjectID    uint32 `json:"project_id,omitempty"`
+	SubprojectID uint32 `json:"subproject_id,omitempty"`
+	RepoID       uint32 `json:"repo_id,omitempty"`
+	Branch       string `json:"branch,omitempty"`
+	// InTrash is only ever set for admins, as only they see
+	// resources in the trash.
+	InTrash bool `json:"in_trash,omitempty"`
+}
+
+// searchField is a value of a resource to match against.
+type searchField struct {
+	name      string
+	value     string
+	secondary bool
+	// exact means that the value matches exactly, even if it is not
+	// written the same as the query
+	exact bool
+}
+
+// searchScore returns how well value matches the lowercased query
+// q, or 0 if it does not.
+func searchScore(value string, q string) int {
+	v := strings.ToLower(value)
+	switch {
+	case v == q:
+		return searchScoreExact
+	case strings.HasPrefix(v, q):
+		return searchScorePrefix
+	}
+	i := strings.Index(v, q)
+	if i < 0 {
+		return 0
+	}
+	// does the match start a word anywhere in the value?
+	for ; i >= 0; i = nextIndex(v, q, i) {
+		c := v[i-1]
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') {
+			return searchScoreWordStart
+		}
+	}
+	return searchScoreContains
+}
+
+// nextIndex returns the index of the next q in v after index i, or
+// -1 if there is none.
+func nextIndex(v string, q string, i int) int {
+	j := strings.Index(v[i+1:], q)
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+// searchBest returns the best matching field, and its score, or 0
+// if none match.
+func searchBest(fields []searchField, q string) (*searchField, int) {
+	var best *searchField
+	bestScore := 0
+	for i := range fields {
+		if fields[i].value == "" {
+			continue
+		}
+		score := searchScore(fields[i].value, q)
+		if fields[i].exact {
+			score = searchScoreExact
+		}
+		if score == 0 {
+			continue
+		}
+		if fields[i].secondary {
+			score -= searchSecondaryPenalty
+		}
+		if score > bestScore {
+			best, bestScore = &fields[i], score
+		}
+	}
+	return best, bestScore
+}
+
+// searchAddressKey returns the repo address key for a query, if it
+// refers to a repository, even without a scheme (such as
+// "github.com/foo/bar"); or "" if it does not.
+func searchAddressKey(q string) string {
+	ra, err := parseRepoAddress(q)
+	if err != nil {
+		ra, err = parseRepoAddress("https://" + q)
+		if err != nil {
+			return ""
+		}
+	}
+	return ra.key()
+}
+
+// searcher collects the results of one search.
+type searcher struct {
+	env     *Env
+	q       string
+	addrKey string
+	admin   bool
+	types   map[string]bool
+	results []*searchResult
+}
+
+// wants reports whether results of the given type were asked for.
+func (s *searcher) wants(typ string) bool {
+	return len(s.types) == 0 || s.types[typ]
+}
+
+// add adds a result for a resource, if one of its fields matches,
+// unless it is hidden by the trash from a user who isn't admin.
+func (s *searcher) add(sr *searchResult, hidden bool, fields ...searchField) {
+	if hidden && !s.admin {
+		return
+	}
+	best, score := searchBest(fields, s.q)
+	if best == nil {
+		return
+	}
+	sr.Field, sr.Match, sr.Score, sr.InTrash = best.name, best.value, score, hidden
+	s.results = append(s.results, sr)
+}
+
+// run searches every type of resource that was asked for.
+func (s *searcher) run() error {
+	env := s.env
+	projects, err := env.db.GetAllProjects()
+	if err != nil {
+		return err
+	}
+	subprojects, err := env.db.GetAllSubprojects()
+	if err != nil {
+		return err
+	}
+	repos, err := env.db.GetAllRepos()
+	if err != nil {
+		return err
+	}
+
+	// which project each subproject is in
+	spProject := map[uint32]uint32{}
+	for _, sp := range subprojects {
+		spProject[sp.ID] = sp.ProjectID
+	}
+
+	if s.wants(resourceProject) {
+		for _, p := range projects {
+			s.add(&searchResult{Type: resourceProject, ID: p.ID, Name: p.Name},
+				env.trash.has(resourceProject, p.ID),
+				searchField{name: "name", value: p.Name},
+				searchField{name: "fullname", value: p.Fullname, secondary: true})
+		}
+	}
+	if s.wants(resourceSubproject) {
+		for _, sp := range subprojects {
+			s.add(&searchResult{Type: resourceSubproject, ID: sp.ID, Name: sp.Name, ProjectID: sp.ProjectID},
+				env.subprojectHidden(sp),
+				searchField{name: "name", value: sp.Name},
+				searchField{name: "fullname", value: sp.Fullname, secondary: true})
+		}
+	}
+	if s.wants(resourceRepo) {
+		for _, repo := range repos {
+			// an address that refers to the same repository as the
+			// query is an exact match, however it is written
+			sameAddress := s.addrKey != "" && repoAddressKey(repo.Address) == s.addrKey
+			s.add(&searchResult{Type: resourceRepo, ID: repo.ID, Name: repo.Name, ProjectID: spProject[repo.SubprojectID], SubprojectID: repo.SubprojectID},
+				env.repoHidden(repo),
+				searchField{name: "name", value: repo.Name},
+				searchField{name: "address", value: repo.Address, secondary: !sameAddress, exact: sameAddress})
+		}
+	}
+	if s.wants(resourceBranch) || s.wants(resourceRepoPull) {
+		for _, repo := range repos {
+			if err := s.runBranches(repo, spProject[repo.SubprojectID]); err != nil {
+				return err
+			}
+		}
+	}
+	return s.runOthers()
+}
+
+// runBranches searches a repo's branches and repo pulls.
+func (s *searcher) runBranches(repo *datastore.Repo, projectID uint32) error {
+	hidden := s.env.repoHidden(repo)
+	if hidden && !s.admin {
+		return nil
+	}
+	rbs, err := s.env.db.GetAllRepoBranchesForRepoID(repo.ID)
+	if err != nil {
+		return err
+	}
+	for _, rb := range rbs {
+		if s.wants(resourceBranch) {
+			s.add(&searchResult{Type: resourceBranch, Name: rb.Branch, ProjectID: projectID, SubprojectID: repo.SubprojectID, RepoID: repo.ID, Branch: rb.Branch},
+				hidden,
+				searchField{name: "branch", value: rb.Branch})
+		}
+		if !s.wants(resourceRepoPull) {
+			continue
+		}
+		rps, err := s.env.db.GetAllRepoPullsForRepoBranch(repo.ID, rb.Branch)
+		if err != nil {
+			return err
+		}
+		for _, rp := range rps {
+			s.add(&searchResult{Type: resourceRepoPull, ID: rp.ID, Name: rp.Commit, ProjectID: projectID, SubprojectID: repo.SubprojectID, RepoID: repo.ID, Branch: rp.Branch},
+				hidden,
+				searchField{name: "commit", value: rp.Commit},
+				searchField{name: "tag", value: rp.Tag, secondary: true})
+		}
+	}
+	return nil
+}
+
+// runOthers searches the resources that are not part of a project.
+func (s *searcher) runOthers() error {
+	if s.wants(resourceAgent) {
+		agents, err := s.env.db.GetAllAgents()
+		if err != nil {
+			return err
+		}
+		for _, a := range agents {
+			s.add(&searchResult{Type: resourceAgent, ID: a.ID, Name: a.Name}, false,
+				searchField{name: "name", value: a.Name})
+		}
+	}
+	if s.wants(resourceUser) {
+		users, err := s.env.db.GetAllUsers()
+		if err != nil {
+			return err
+		}
+		// only the Github name is matched, as that is all that
+		// users who aren't admin can see of other users
+		for _, u := range users {
+			s.add(&searchResult{Type: resourceUser, ID: u.ID, Name: u.Github}, false,
+				searchField{name: "github", value: u.Github})
+		}
+	}
+	return nil
+}
+
+// sort orders the results by score, then type, then ID.
+func (s *searcher) sort() {
+	typeOrder := map[string]int{}
+	for i, typ := range searchTypes {
+		typeOrder[typ] = i
+	}
+	sort.SliceStable(s.results, func(i, j int) bool {
+		a, b := s.results[i], s.results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Type != b.Type {
+			return typeOrder[a.Type] < typeOrder[b.Type]
+		}
+		if a.RepoID != b.RepoID {
+			return a.RepoID < b.RepoID
+		}
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return a.Branch < b.Branch
+	})
+}
+
+// ========== HANDLER for /search
+
+func (env *Env) searchHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be at least viewer
+	user := extractUser(w, r, datastore.AccessViewer)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get the query
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing required value for 'q'"}`)
+		return
+	}
+
+	// and the types of result wanted, if limited
+	types := map[string]bool{}
+	if s := r.URL.Query().Get("type"); s != "" {
+		for _, typ := range strings.Split(s, ",") {
+			typ = strings.TrimSpace(typ)
+			if !isSearchType(typ) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, `{"error": "Invalid value for 'type'; must be one of %s"}`, strings.Join(searchTypes, ", "))
+				return
+			}
+			types[typ] = true
+		}
+	}
+
+	s := &searcher{
+		env:     env,
+		q:       strings.ToLower(q),
+		addrKey: searchAddressKey(q),
+		admin:   user.AccessLevel == datastore.AccessAdmin,
+		types:   types,
+		results: []*searchResult{},
+	}
+	if err := s.run(); err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+	s.sort()
+
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(s.results))
+	if !ok {
+		return
+	}
+
+	// create map so we return a JSON object
+	resultsMap := map[string][]*searchResult{}
+	resultsMap["results"] = s.results[start:end]
+	js, err := json.Marshal(resultsMap)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
+}
@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	hu "github.com/swinslow/peridot-api/test/handlerutils"
+)
+
+// ===== GET /search =====
+
+func TestCanSearchForRepoByAddressAsViewer(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/search?q=example.com/repo2", ``, "viewer", env.searchHandler, "/search")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"results": [
+		{"type": "repo", "id": 2, "name": "repo2", "field": "address", "match": "https://example.com/repo2.git", "score": 100, "project_id": 1, "subproject_id": 4}
+	]}`)
+}
+
+func TestSearchRanksNameMatchesFirst(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/search?q=PRJ&limit=4", ``, "viewer", env.searchHandler, "/search")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"results": [
+		{"type": "project", "id": 1, "name": "prj1", "field": "name", "match": "prj1", "score": 75},
+		{"type": "project", "id": 2, "name": "prj2", "field": "name", "match": "prj2", "score": 75},
+		{"type": "project", "id": 3, "name": "prj3", "field": "name", "match": "prj3", "score": 75},
+		{"type": "subproject", "id": 1, "name": "subprj1", "field": "name", "match": "subprj1", "score": 25, "project_id": 3}
+	]}`)
+	if got := rec.Header().Get("X-Total-Count"); got != "7" {
+		t.Errorf("expected X-Total-Count 7, got %q", got)
+	}
+}
+
+func TestCanSearchForBranchesAndRepoPulls(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/search?q=master&type=branch", ``, "viewer", env.searchHandler, "/search")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"results": [
+		{"type": "branch", "name": "master", "field": "branch", "match": "master", "score": 100, "project_id": 1, "subproject_id": 2, "repo_id": 1, "branch": "master"},
+		{"type": "branch", "name": "master", "field": "branch", "match": "master", "score": 100, "project_id": 1, "subproject_id": 4, "repo_id": 2, "branch": "master"},
+		{"type": "branch", "name": "master", "field": "branch", "match": "master", "score": 100, "project_id": 1, "subproject_id": 4, "repo_id": 4, "branch": "master"}
+	]}`)
+
+	rec = serveTestRequest(t, env, "GET", "/search?q=abcdef012345&type=repopull,agent", ``, "viewer", env.searchHandler, "/search")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"results": [
+		{"type": "repopull", "id": 1, "name": "abcdef012345abcdef012345abcdef0123451234", "field": "commit", "match": "abcdef012345abcdef012345abcdef0123451234", "score": 75, "project_id": 1, "subproject_id": 4, "repo_id": 2, "branch": "master"},
+		{"type": "repopull", "id": 2, "name": "abcdef012345abcdef012345abcdef0123455678", "field": "commit", "match": "abcdef012345abcdef012345abcdef0123455678", "score": 75, "project_id": 1, "subproject_id": 4, "repo_id": 2, "branch": "master"},
+		{"type": "repopull", "id": 3, "name": "abcdef012345abcdef012345abcdef01234590ab", "field": "commit", "match": "abcdef012345abcdef012345abcdef01234590ab", "score": 75, "project_id": 1, "subproject_id": 4, "repo_id": 4, "branch": "dev"}
+	]}`)
+}
+
+func TestCanSearchForUsersAndAgents(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/search?q=godeps", ``, "viewer", env.searchHandler, "/search")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"results": [{"type": "agent", "id": 5, "name": "analyze-godeps", "field": "name", "match": "analyze-godeps", "score": 50}]}`)
+
+	rec = serveTestRequest(t, env, "GET", "/search?q=admin", ``, "viewer", env.searchHandler, "/search")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"results": [{"type": "user", "id": 1, "name": "admin", "field": "github", "match": "admin", "score": 100}]}`)
+}
+
+func TestSearchOnlyShowsTrashToAdmin(t *testing.T) {
+	env := getTestEnv()
+	trashProject3(t, env)
+
+	rec := serveTestRequest(t, env, "GET", "/search?q=prj3&type=project", ``, "viewer", env.searchHandler, "/search")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"results": []}`)
+
+	rec = serveTestRequest(t, env, "GET", "/search?q=prj3&type=project", ``, "admin", env.searchHandler, "/search")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"results": [{"type": "project", "id": 3, "name": "prj3", "field": "name", "match": "prj3", "score": 100, "in_trash": true}]}`)
+}
+
+func TestCannotSearchWithoutQuery(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/search?q=%20", ``, "viewer", env.searchHandler, "/search")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Missing required value for 'q'"}`)
+}
+
+func TestCannotSearchForUnknownType(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/search?q=repo&type=repos", ``, "viewer", env.searchHandler, "/search")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'type'; must be one of project, subproject, repo, branch, repopull, agent, user"}`)
+}
+
+func TestCannotSearchAsBadUser(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/search?q=repo", ``, "disabled", env.searchHandler, "/search")
+	hu.ConfirmAccessDenied(t, rec)
+}
+
+func TestCannotPostSearch(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "POST", "/search?q=repo", ``, "viewer", env.searchHandler, "/search")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
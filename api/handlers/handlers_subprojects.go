@@ -36,16 +36,32 @@ func (env *Env) subprojectsGetHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// sufficient access; get subprojects from database
+	// sufficient access; get the label selector, if any
+	sel, ok := extractLabelSelector(w, r)
+	if !ok {
+		return
+	}
+
+	// get subprojects from database
 	subprojects, err := env.db.GetAllSubprojects()
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
 		return
 	}
+	// leave out anything in the trash
+	subprojects = env.visibleSubprojects(subprojects)
+	// and anything that doesn't match the label selector
+	subprojects = env.labelledSubprojects(subprojects, sel)
+
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(subprojects))
+	if !ok {
+		return
+	}
 
 	// create map so we return a JSON object
 	subprojectsMap := map[string][]*datastore.Subproject{}
-	subprojectsMap["subprojects"] = subprojects
+	subprojectsMap["subprojects"] = subprojects[start:end]
 	js, err := json.Marshal(subprojectsMap)
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
@@ -93,6 +109,11 @@ func (env *Env) subprojectsPostHelper(w http.ResponseWriter, r *http.Request) {
 
 	// convert projectID float64 to uint32
 	projectID := uint32(projectIDf.(float64))
+	if env.resourceHidden(resourceProject, projectID) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid value for 'project_id'; unknown project"}`)
+		return
+	}
 
 	// add the new subproject
 	newID, err := env.db.AddSubproject(projectID, name.(string), fullname.(string))
@@ -101,6 +122,9 @@ func (env *Env) subprojectsPostHelper(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"error": "Unable to create subproject"}`)
 		return
 	}
+	env.events.publish(EventSubprojectCreated, map[string]interface{}{
+		"subproject": &datastore.Subproject{ID: newID, ProjectID: projectID, Name: name.(string), Fullname: fullname.(string)},
+	})
 
 	// success!
 	w.WriteHeader(http.StatusCreated)
@@ -141,16 +165,32 @@ func (env *Env) subprojectsSubGetHelper(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// get the label selector, if any
+	sel, ok := extractLabelSelector(w, r)
+	if !ok {
+		return
+	}
+
 	// get subprojects from database
 	subprojects, err := env.db.GetAllSubprojectsForProjectID(projectID)
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
 		return
 	}
+	// leave out anything in the trash
+	subprojects = env.visibleSubprojects(subprojects)
+	// and anything that doesn't match the label selector
+	subprojects = env.labelledSubprojects(subprojects, sel)
+
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(subprojects))
+	if !ok {
+		return
+	}
 
 	// create map so we return a JSON object
 	subprojectsMap := map[string][]*datastore.Subproject{}
-	subprojectsMap["subprojects"] = subprojects
+	subprojectsMap["subprojects"] = subprojects[start:end]
 	js, err := json.Marshal(subprojectsMap)
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
@@ -205,6 +245,9 @@ func (env *Env) subprojectsSubPostHelper(w http.ResponseWriter, r *http.Request)
 		fmt.Fprintf(w, `{"error": "Unable to create subproject"}`)
 		return
 	}
+	env.events.publish(EventSubprojectCreated, map[string]interface{}{
+		"subproject": &datastore.Subproject{ID: newID, ProjectID: projectID, Name: name.(string), Fullname: fullname.(string)},
+	})
 
 	// success!
 	w.WriteHeader(http.StatusCreated)
@@ -221,12 +264,12 @@ func (env *Env) subprojectsOneHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		env.subprojectsOneGetHelper(w, r)
-	case "PUT":
+	case "PUT", "PATCH":
 		env.subprojectsOnePutHelper(w, r)
 	case "DELETE":
 		env.subprojectsOneDeleteHelper(w, r)
 	default:
-		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
@@ -254,6 +297,11 @@ func (env *Env) subprojectsOneGetHelper(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// set the ETag, and stop here if the client's copy is current
+	if writeETag(w, r, sp) {
+		return
+	}
+
 	// create map so we return a JSON object
 	jsData := struct {
 		Subproject *datastore.Subproject `json:"subproject"`
@@ -282,6 +330,9 @@ func (env *Env) subprojectsOnePutHelper(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// hold the subproject until it has been changed (see resourceLocks)
+	defer env.locks.lock(resourceSubproject, subprojectID)()
+
 	// get existing subproject from database
 	sp, err := env.db.GetSubprojectByID(subprojectID)
 	if err != nil {
@@ -290,34 +341,89 @@ func (env *Env) subprojectsOnePutHelper(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// parse JSON request
-	js := map[string]string{}
-	err = json.NewDecoder(r.Body).Decode(&js)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+	// if the request is conditional, make sure the client
+	// is updating the current version
+	if !checkIfMatch(w, r, sp) {
 		return
 	}
 
-	// and extract data; if absent, use existing data
-	newName, ok := js["name"]
-	if !ok {
-		newName = sp.Name
-	}
-	newFullname, ok := js["fullname"]
+	// parse JSON request (or merge patch, for PATCH)
+	js, ok := extractUpdateRequest(w, r, sp)
 	if !ok {
-		newFullname = sp.Fullname
+		return
 	}
-	// NOTE: currently, cannot update the subproject's project ID
-	// using this API call.
 
-	// modify the subproject data
+	// and extract data; if absent, use existing data
+	newName, err := optionalString(js, "name", sp.Name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "%v"}`, err)
+		return
+	}
+	newFullname, err := optionalString(js, "fullname", sp.Fullname)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "%v"}`, err)
+		return
+	}
+	newProjectID, err := optionalID(js, "project_id", sp.ProjectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "%v"}`, err)
+		return
+	}
+	// if the subproject is moving, the new project must exist, and
+	// the user must be able to change both projects
+	if newProjectID != sp.ProjectID {
+		if _, err := env.db.GetProjectByID(newProjectID); err != nil || env.resourceHidden(resourceProject, newProjectID) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'project_id'; unknown project"}`)
+			return
+		}
+		if !canModifyProject(user, sp.ProjectID) || !canModifyProject(user, newProjectID) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"error": "%s"}`, ErrAuthAccess)
+			return
+		}
+	}
+	// and no other subproject in the project may have the same name
+	if newProjectID != sp.ProjectID || newName != sp.Name {
+		sps, err := env.db.GetAllSubprojectsForProjectID(newProjectID)
+		if err != nil {
+			fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+			return
+		}
+		for _, other := range sps {
+			if other.ID != subprojectID && other.Name == newName {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintf(w, `{"error": "Subproject %d in project %d already has this name", "subproject_id": %d}`, other.ID, newProjectID, other.ID)
+				return
+			}
+		}
+	}
+
+	// modify the subproject data, and move it if needed; the
+	// datastore can't do both at once, so if the move fails, the
+	// subproject data is changed back
+	oldName, oldFullname, oldProjectID := sp.Name, sp.Fullname, sp.ProjectID
 	err = env.db.UpdateSubproject(subprojectID, newName, newFullname)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, `{"error": "Unable to update subproject"}`)
 		return
 	}
+	if newProjectID != oldProjectID {
+		err = env.db.UpdateSubprojectProjectID(subprojectID, newProjectID)
+		if err != nil {
+			env.db.UpdateSubproject(subprojectID, oldName, oldFullname)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"error": "Unable to move subproject"}`)
+			return
+		}
+	}
+	if subproject, err := env.db.GetSubprojectByID(subprojectID); err == nil {
+		env.events.publish(EventSubprojectUpdated, map[string]interface{}{"subproject": subproject})
+	}
 
 	// success!
 	w.WriteHeader(http.StatusNoContent)
@@ -339,14 +445,38 @@ func (env *Env) subprojectsOneDeleteHelper(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// delete the subproject
-	err = env.db.DeleteSubproject(subprojectID)
+	// hold the subproject until it has been deleted (see resourceLocks)
+	defer env.locks.lock(resourceSubproject, subprojectID)()
+
+	// if the request is conditional, make sure the client
+	// is deleting the current version
+	if r.Header.Get("If-Match") != "" {
+		var current interface{}
+		if subproject, err := env.db.GetSubprojectByID(subprojectID); err == nil {
+			current = subproject
+		}
+		if !checkIfMatch(w, r, current) {
+			return
+		}
+	}
+
+	// with ?dry_run, only report what deleting it would remove or
+	// change; large deletions must be confirmed
+	if !env.checkDeletion(w, r, resourceSubproject, subprojectID, "") {
+		return
+	}
+
+	subproject, err := env.db.GetSubprojectByID(subprojectID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"error": "Unable to delete subproject"}`)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown subproject ID"}`)
 		return
 	}
 
+	// move the subproject to the trash; it is only deleted from the
+	// database once it is purged
+	env.trashResource(resourceSubproject, subprojectID, subproject.Name, user, subproject)
+
 	// success!
 	w.WriteHeader(http.StatusNoContent)
 }
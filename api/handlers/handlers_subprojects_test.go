@@ -223,6 +223,70 @@ func TestCanPutSubprojectsOneHandlerAsOperatorWithJustFullname(t *testing.T) {
 	}
 }
 
+func TestCanMoveSubprojectsOneHandlerToOtherProject(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PUT", "/subprojects/4", `{"project_id": 3}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.subprojectsOneHandler), "/subprojects/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	// and verify state of database now; its repos move with it
+	sp, err := env.db.GetSubprojectByID(4)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if sp.ProjectID != 3 || sp.Name != "subprj4" {
+		t.Errorf("unexpected subproject: %#v", sp)
+	}
+	repos, _ := env.db.GetAllReposForSubprojectID(4)
+	if len(repos) != 3 {
+		t.Errorf("expected %d, got %d", 3, len(repos))
+	}
+	if env.events.seq != 1 {
+		t.Errorf("expected %d events, got %d", 1, env.events.seq)
+	}
+}
+
+func TestFailedMoveOfSubprojectsOneHandlerLeavesSubprojectUnchanged(t *testing.T) {
+	env := getTestEnv()
+	env.db = &failingMoveDB{env.db}
+	rec := serveTestRequest(t, env, "PUT", "/subprojects/4", `{"name": "new-name", "project_id": 3}`, "operator", env.subprojectsOneHandler, "/subprojects/{id}")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unable to move subproject"}`)
+
+	sp, _ := env.db.GetSubprojectByID(4)
+	if sp.ProjectID != 1 || sp.Name != "subprj4" {
+		t.Errorf("expected subproject to be left unchanged, got %#v", sp)
+	}
+}
+
+func TestCannotMoveSubprojectsOneHandlerWithInvalidValues(t *testing.T) {
+	tests := []struct {
+		body  string
+		code  int
+		error string
+	}{
+		{`{"project_id": "3"}`, http.StatusBadRequest, `{"error": "Invalid value for 'project_id'"}`},
+		{`{"project_id": 1.5}`, http.StatusBadRequest, `{"error": "Invalid value for 'project_id'"}`},
+		{`{"project_id": 17}`, http.StatusBadRequest, `{"error": "Invalid value for 'project_id'; unknown project"}`},
+		{`{"project_id": 3, "name": "subprj1"}`, http.StatusConflict, `{"error": "Subproject 1 in project 3 already has this name", "subproject_id": 1}`},
+		{`{"name": "subprj2"}`, http.StatusConflict, `{"error": "Subproject 2 in project 1 already has this name", "subproject_id": 2}`},
+	}
+	for _, tc := range tests {
+		rec, req, env := setupTestEnv(t, "PUT", "/subprojects/4", tc.body, "operator")
+		hu.ServeHandler(rec, req, http.HandlerFunc(env.subprojectsOneHandler), "/subprojects/{id}")
+		if rec.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.body, tc.code, rec.Code)
+		}
+		hu.CheckResponse(t, rec, tc.error)
+
+		sp, _ := env.db.GetSubprojectByID(4)
+		if sp.ProjectID != 1 || sp.Name != "subprj4" {
+			t.Errorf("%s: unexpected subproject: %#v", tc.body, sp)
+		}
+	}
+}
+
 func TestCannotSubputProjectsOneHandlerAsCommenter(t *testing.T) {
 	rec, req, env := setupTestEnv(t, "PUT", "/subprojects/3", `{"name": "new-name", "fullname": "new-fullname"}`, "commenter")
 	hu.ServeHandler(rec, req, http.HandlerFunc(env.subprojectsOneHandler), "/subprojects/{id}")
@@ -246,18 +310,18 @@ func TestCanDeleteSubprojectsOneHandlerAsAdmin(t *testing.T) {
 	hu.ServeHandler(rec, req, http.HandlerFunc(env.subprojectsOneHandler), "/subprojects/{id}")
 	hu.ConfirmNoContentResponse(t, rec)
 
-	// and verify state of database now
-	subprojects, err := env.db.GetAllSubprojects()
-	if err != nil {
+	// and verify that the subproject is in the trash, not deleted
+	if _, err := env.db.GetSubprojectByID(3); err != nil {
 		t.Errorf("expected nil error, got %v", err)
 	}
-	if len(subprojects) != 3 {
-		t.Errorf("expected %d, got %d", 3, len(subprojects))
-	}
-	sp, err := env.db.GetSubprojectByID(3)
-	if err == nil {
-		t.Fatalf("expected non-nil error, got nil and %#v", sp)
+	if !env.trash.has(resourceSubproject, 3) {
+		t.Errorf("expected subproject 3 to be in the trash")
 	}
+
+	// and that it is no longer listed
+	rec = serveTestRequest(t, env, "GET", "/projects/1/subprojects", ``, "viewer", env.subprojectsSubHandler, "/projects/{id}/subprojects")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"subprojects": [{"id": 2, "project_id": 1, "name": "subprj2", "fullname": "subproject 2"}, {"id": 4, "project_id": 1, "name": "subprj4", "fullname": "subproject 4"}]}`)
 }
 
 func TestCannotDeleteSubprojectsOneHandlerAsOperator(t *testing.T) {
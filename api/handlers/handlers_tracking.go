@@ -0,0 +1,314 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// ========== HANDLER for /repos/{id}/tracking
+
+func (env *Env) repoTrackingHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// check valid request types
+	switch r.Method {
+	case "GET":
+		env.repoTrackingGetHelper(w, r)
+	case "PUT":
+		env.repoTrackingPutHelper(w, r)
+	case "DELETE":
+		env.repoTrackingDeleteHelper(w, r)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// extractTrackingRepo gets the repo from the endpoint. If it is
+// missing or unknown, it writes an error response and returns nil.
+func (env *Env) extractTrackingRepo(w http.ResponseWriter, r *http.Request) *datastore.Repo {
+	repoID, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid repo ID"}`)
+		return nil
+	}
+	repo, err := env.db.GetRepoByID(repoID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown repo ID"}`)
+		return nil
+	}
+	return repo
+}
+
+func (env *Env) repoTrackingGetHelper(w http.ResponseWriter, r *http.Request) {
+	// get user and check access level
+	// must be at least viewer
+	user := extractUser(w, r, datastore.AccessViewer)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get repo from vars
+	repo := env.extractTrackingRepo(w, r)
+	if repo == nil {
+		return
+	}
+
+	// a repo without rules tracks nothing
+	tr := env.tracking.get(repo.ID)
+	if tr == nil {
+		tr = &trackingRules{Include: []string{}, Exclude: []string{}}
+	}
+	js, err := json.Marshal(tr)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
+}
+
+func (env *Env) repoTrackingPutHelper(w http.ResponseWriter, r *http.Request) {
+	// get user and check access level
+	// must be at least operator
+	user := extractUser(w, r, datastore.AccessOperator)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get repo from vars
+	repo := env.extractTrackingRepo(w, r)
+	if repo == nil {
+		return
+	}
+
+	// parse JSON request
+	tr := &trackingRules{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(tr); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+		return
+	}
+	if len(tr.Include) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing required value for 'include'"}`)
+		return
+	}
+	if tr.Exclude == nil {
+		tr.Exclude = []string{}
+	}
+	for _, p := range append(tr.Include, tr.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": %q}`, fmt.Sprintf("Invalid pattern %q", p))
+			return
+		}
+	}
+
+	env.tracking.set(repo.ID, tr)
+
+	// success!
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (env *Env) repoTrackingDeleteHelper(w http.ResponseWriter, r *http.Request) {
+	// get user and check access level
+	// must be at least operator
+	user := extractUser(w, r, datastore.AccessOperator)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get repo from vars
+	repo := env.extractTrackingRepo(w, r)
+	if repo == nil {
+		return
+	}
+
+	env.tracking.remove(repo.ID)
+
+	// success!
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ========== HANDLER for /repos/{id}/tracking/sync
+
+func (env *Env) repoTrackingSyncHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be at least operator
+	user := extractUser(w, r, datastore.AccessOperator)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get repo from vars
+	repo := env.extractTrackingRepo(w, r)
+	if repo == nil {
+		return
+	}
+	dryRun := false
+	if s := r.URL.Query().Get("dry_run"); s != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'dry_run'"}`)
+			return
+		}
+	}
+
+	// parse JSON request; an empty body discovers the remote
+	// branches without pruning
+	js := struct {
+		Refs  []string `json:"refs"`
+		Prune bool     `json:"prune"`
+	}{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&js); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+		return
+	}
+
+	tr := env.tracking.get(repo.ID)
+	if tr == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "No tracking rules are set for this repo"}`)
+		return
+	}
+
+	// if no refs were supplied, ask the remote repository
+	refs := js.Refs
+	if refs == nil {
+		var err error
+		refs, err = env.lsRemote(r.Context(), repo.Address)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(w, `{"error": "Unable to list the repo's remote branches"}`)
+			return
+		}
+	}
+	remote := map[string]bool{}
+	for _, ref := range refs {
+		if branch, ok := branchFromRef(ref); ok && checkBranchName(branch) == nil {
+			remote[branch] = true
+		}
+	}
+
+	// syncing is a sequence of separate changes, so it must not
+	// interleave with batches or manifests
+	env.batchMu.Lock()
+	defer env.batchMu.Unlock()
+
+	rbs, err := env.db.GetAllRepoBranchesForRepoID(repo.ID)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+	existing := map[string]bool{}
+	for _, rb := range rbs {
+		existing[rb.Branch] = true
+	}
+
+	// tracked remote branches that are missing are created; with
+	// prune, tracked branches that are no longer on the remote are
+	// deleted. Branches that the rules do not track are left alone.
+	created := []string{}
+	for branch := range remote {
+		if tr.tracks(branch) && !existing[branch] {
+			created = append(created, branch)
+		}
+	}
+	sort.Strings(created)
+	deleted := []string{}
+	if js.Prune {
+		for branch := range existing {
+			if tr.tracks(branch) && !remote[branch] {
+				deleted = append(deleted, branch)
+			}
+		}
+	}
+	sort.Strings(deleted)
+
+	if !dryRun && len(deleted) > 0 && user.AccessLevel < datastore.AccessAdmin {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"error": %q}`, fmt.Sprintf("Syncing would delete branch %q, which requires admin access", deleted[0]))
+		return
+	}
+
+	if !dryRun {
+		for i, branch := range created {
+			if err := env.db.AddRepoBranch(repo.ID, branch); err != nil {
+				env.writeSyncFailure(w, fmt.Sprintf("Unable to create branch %s; earlier changes were made", branch), created[:i], []string{})
+				return
+			}
+			env.events.publish(EventBranchCreated, map[string]interface{}{
+				"branch": &datastore.RepoBranch{RepoID: repo.ID, Branch: branch},
+			})
+		}
+		for i, branch := range deleted {
+			if err := env.db.DeleteRepoBranch(repo.ID, branch); err != nil {
+				env.writeSyncFailure(w, fmt.Sprintf("Unable to delete branch %s; earlier changes were made", branch), created, deleted[:i])
+				return
+			}
+			env.events.publish(EventBranchDeleted, map[string]interface{}{
+				"branch": &datastore.RepoBranch{RepoID: repo.ID, Branch: branch},
+			})
+		}
+	}
+
+	// create map so we return a JSON object
+	jsData := struct {
+		DryRun  bool     `json:"dry_run"`
+		Created []string `json:"created"`
+		Deleted []string `json:"deleted"`
+	}{DryRun: dryRun, Created: created, Deleted: deleted}
+	rjs, err := json.Marshal(jsData)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(rjs)
+}
+
+// writeSyncFailure writes the response for a sync that failed part
+// way through, listing the changes that were made.
+func (env *Env) writeSyncFailure(w http.ResponseWriter, msg string, created []string, deleted []string) {
+	jsData := struct {
+		Error   string   `json:"error"`
+		Created []string `json:"created"`
+		Deleted []string `json:"deleted"`
+	}{Error: msg, Created: created, Deleted: deleted}
+	rjs, err := json.Marshal(jsData)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(rjs)
+}
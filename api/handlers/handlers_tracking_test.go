@@ -0,0 +1,198 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	hu "github.com/swinslow/peridot-api/test/handlerutils"
+)
+
+// trackingTestRules track every branch with at most one "/" in its
+// name, except those made by dependabot.
+const trackingTestRules = `{"include": ["*", "*/*"], "exclude": ["dependabot/*"]}`
+
+// trackingTestRefs are the remote refs for mock repo 2, which has
+// branches master, alpha and beta.
+var trackingTestRefs = []string{
+	"refs/heads/master",
+	"refs/heads/alpha",
+	"refs/heads/release/1.2",
+	"refs/heads/dependabot/lodash",
+	"refs/tags/v1.0",
+}
+
+// setupTrackingTestEnv returns a test Env in which mock repo 2 has
+// trackingTestRules set.
+func setupTrackingTestEnv(t *testing.T) *Env {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "PUT", "/repos/2/tracking", trackingTestRules, "operator", env.repoTrackingHandler, "/repos/{id}/tracking")
+	hu.ConfirmNoContentResponse(t, rec)
+	return env
+}
+
+// ===== GET, PUT, DELETE /repos/2/tracking =====
+
+func TestCanSetAndGetRepoTrackingHandler(t *testing.T) {
+	env := setupTrackingTestEnv(t)
+
+	rec := serveTestRequest(t, env, "GET", "/repos/2/tracking", ``, "viewer", env.repoTrackingHandler, "/repos/{id}/tracking")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, trackingTestRules)
+
+	// a repo without rules tracks nothing
+	rec = serveTestRequest(t, env, "GET", "/repos/3/tracking", ``, "viewer", env.repoTrackingHandler, "/repos/{id}/tracking")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"include": [], "exclude": []}`)
+
+	rec = serveTestRequest(t, env, "DELETE", "/repos/2/tracking", ``, "operator", env.repoTrackingHandler, "/repos/{id}/tracking")
+	hu.ConfirmNoContentResponse(t, rec)
+	if tr := env.tracking.get(2); tr != nil {
+		t.Errorf("expected nil, got %#v", tr)
+	}
+}
+
+func TestCannotPutRepoTrackingHandlerWithInvalidValues(t *testing.T) {
+	tests := []struct {
+		body  string
+		error string
+	}{
+		{`{}`, `Missing required value for 'include'`},
+		{`{"include": ["*"], "other": true}`, `Invalid JSON request`},
+		{`{"include": ["[a-"]}`, `Invalid pattern \"[a-\"`},
+		{`{"include": ["*"], "exclude": [""]}`, `Invalid pattern \"\"`},
+	}
+	for _, tc := range tests {
+		rec, req, env := setupTestEnv(t, "PUT", "/repos/2/tracking", tc.body, "operator")
+		hu.ServeHandler(rec, req, http.HandlerFunc(env.repoTrackingHandler), "/repos/{id}/tracking")
+		hu.ConfirmBadRequestResponse(t, rec)
+		hu.CheckResponse(t, rec, `{"error": "`+tc.error+`"}`)
+	}
+
+	rec, req, env := setupTestEnv(t, "PUT", "/repos/17/tracking", trackingTestRules, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.repoTrackingHandler), "/repos/{id}/tracking")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestCannotPutRepoTrackingHandlerAsCommenter(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PUT", "/repos/2/tracking", trackingTestRules, "commenter")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.repoTrackingHandler), "/repos/{id}/tracking")
+	hu.ConfirmAccessDenied(t, rec)
+}
+
+func TestRepoTrackingIsRemovedWithRepo(t *testing.T) {
+	env := setupTrackingTestEnv(t)
+	rec := serveTestRequest(t, env, "DELETE", "/repos/2", ``, "admin", env.reposOneHandler, "/repos/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	// the rules are kept while the repo is in the trash, in case it
+	// is restored
+	if tr := env.tracking.get(2); tr == nil {
+		t.Fatalf("expected rules, got nil")
+	}
+	rec = serveTestRequest(t, env, "DELETE", "/trash/repos/2", ``, "admin", env.trashOneHandler, "/trash/{resource}/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+	if tr := env.tracking.get(2); tr != nil {
+		t.Errorf("expected nil, got %#v", tr)
+	}
+}
+
+// ===== POST /repos/2/tracking/sync =====
+
+func TestCanSyncRepoTrackingWithSuppliedRefs(t *testing.T) {
+	env := setupTrackingTestEnv(t)
+	body := `{"refs": ["refs/heads/master", "refs/heads/alpha", "refs/heads/release/1.2", "refs/heads/dependabot/lodash", "refs/tags/v1.0"], "prune": true}`
+	rec := serveTestRequest(t, env, "POST", "/repos/2/tracking/sync", body, "admin", env.repoTrackingSyncHandler, "/repos/{id}/tracking/sync")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"dry_run": false, "created": ["release/1.2"], "deleted": ["beta"]}`)
+
+	rbs, _ := env.db.GetAllRepoBranchesForRepoID(2)
+	got := map[string]bool{}
+	for _, rb := range rbs {
+		got[rb.Branch] = true
+	}
+	if len(got) != 3 || !got["master"] || !got["alpha"] || !got["release/1.2"] {
+		t.Errorf("unexpected branches: %v", got)
+	}
+	if env.events.seq != 2 {
+		t.Errorf("expected %d events, got %d", 2, env.events.seq)
+	}
+
+	// syncing again changes nothing
+	rec = serveTestRequest(t, env, "POST", "/repos/2/tracking/sync", body, "admin", env.repoTrackingSyncHandler, "/repos/{id}/tracking/sync")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"dry_run": false, "created": [], "deleted": []}`)
+}
+
+func TestCanSyncRepoTrackingWithDiscoveredRefs(t *testing.T) {
+	env := setupTrackingTestEnv(t)
+	env.lsRemote = func(ctx context.Context, address string) ([]string, error) {
+		if address != "https://example.com/repo2.git" {
+			t.Errorf("expected %s, got %s", "https://example.com/repo2.git", address)
+		}
+		return trackingTestRefs, nil
+	}
+
+	// without prune, branches missing from the remote are kept
+	rec := serveTestRequest(t, env, "POST", "/repos/2/tracking/sync", ``, "operator", env.repoTrackingSyncHandler, "/repos/{id}/tracking/sync")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"dry_run": false, "created": ["release/1.2"], "deleted": []}`)
+
+	rbs, _ := env.db.GetAllRepoBranchesForRepoID(2)
+	if len(rbs) != 4 {
+		t.Errorf("expected %d, got %d", 4, len(rbs))
+	}
+}
+
+func TestCanSyncRepoTrackingDryRunAsOperator(t *testing.T) {
+	env := setupTrackingTestEnv(t)
+	env.lsRemote = func(ctx context.Context, address string) ([]string, error) {
+		return trackingTestRefs, nil
+	}
+	rec := serveTestRequest(t, env, "POST", "/repos/2/tracking/sync?dry_run=true", `{"prune": true}`, "operator", env.repoTrackingSyncHandler, "/repos/{id}/tracking/sync")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"dry_run": true, "created": ["release/1.2"], "deleted": ["beta"]}`)
+
+	rbs, _ := env.db.GetAllRepoBranchesForRepoID(2)
+	if len(rbs) != 3 {
+		t.Errorf("expected %d, got %d", 3, len(rbs))
+	}
+	if env.events.seq != 0 {
+		t.Errorf("expected no events, got %d", env.events.seq)
+	}
+
+	// but pruning for real needs admin access
+	rec = serveTestRequest(t, env, "POST", "/repos/2/tracking/sync", `{"prune": true}`, "operator", env.repoTrackingSyncHandler, "/repos/{id}/tracking/sync")
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected %d, got %d", http.StatusForbidden, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Syncing would delete branch \"beta\", which requires admin access"}`)
+}
+
+func TestCannotSyncRepoTrackingWithoutRulesOrRemote(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/repos/2/tracking/sync", `{"refs": ["master"]}`, "operator")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.repoTrackingSyncHandler), "/repos/{id}/tracking/sync")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "No tracking rules are set for this repo"}`)
+
+	env = setupTrackingTestEnv(t)
+	env.lsRemote = func(ctx context.Context, address string) ([]string, error) {
+		return nil, fmt.Errorf("unreachable")
+	}
+	rec = serveTestRequest(t, env, "POST", "/repos/2/tracking/sync", ``, "operator", env.repoTrackingSyncHandler, "/repos/{id}/tracking/sync")
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected %d, got %d", http.StatusBadGateway, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unable to list the repo's remote branches"}`)
+}
+
+func TestCannotSyncRepoTrackingAsCommenter(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "POST", "/repos/2/tracking/sync", `{"refs": []}`, "commenter")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.repoTrackingSyncHandler), "/repos/{id}/tracking/sync")
+	hu.ConfirmAccessDenied(t, rec)
+}
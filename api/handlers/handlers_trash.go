@@ -0,0 +1,240 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// ========== HANDLERS for /{projects,subprojects,repos}/{id}/restore
+
+func (env *Env) projectsRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	env.restoreHelper(w, r, resourceProject)
+}
+
+func (env *Env) subprojectsRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	env.restoreHelper(w, r, resourceSubproject)
+}
+
+func (env *Env) reposRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	env.restoreHelper(w, r, resourceRepo)
+}
+
+// restoreHelper takes the resource of the given type, whose ID is in
+// the endpoint, back out of the trash.
+func (env *Env) restoreHelper(w http.ResponseWriter, r *http.Request, resource string) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be admin, as for deleting
+	user := extractUser(w, r, datastore.AccessAdmin)
+	if user == nil {
+		return
+	}
+
+	// sufficient access
+	// extract ID for request
+	id, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid ID"}`)
+		return
+	}
+
+	// restoring must not interleave with purging
+	env.batchMu.Lock()
+	defer env.batchMu.Unlock()
+
+	// find the resource, and whatever it is below
+	var obj interface{}
+	var parent string
+	var parentID uint32
+	switch resource {
+	case resourceProject:
+		obj, err = env.db.GetProjectByID(id)
+	case resourceSubproject:
+		var sp *datastore.Subproject
+		sp, err = env.db.GetSubprojectByID(id)
+		if err == nil {
+			obj, parent, parentID = sp, resourceProject, sp.ProjectID
+		}
+	case resourceRepo:
+		var repo *datastore.Repo
+		repo, err = env.db.GetRepoByID(id)
+		if err == nil {
+			obj, parent, parentID = repo, resourceSubproject, repo.SubprojectID
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown %s ID"}`, resource)
+		return
+	}
+	if !env.trash.has(resource, id) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": "%s is not in the trash"}`, strings.Title(resource))
+		return
+	}
+
+	// a resource can't be restored into something that is still in
+	// the trash
+	if parent != "" && env.resourceHidden(parent, parentID) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": "%s %d is in the trash; restore it first", "%s_id": %d}`, strings.Title(parent), parentID, parent, parentID)
+		return
+	}
+
+	env.trash.remove(resource, id)
+	env.events.publish(resource+".restored", map[string]interface{}{resource: obj})
+
+	// success!
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ========== HANDLER for /trash
+
+func (env *Env) trashHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// check valid request types
+	switch r.Method {
+	case "GET":
+		env.trashGetHelper(w, r)
+	case "DELETE":
+		env.trashDeleteHelper(w, r)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (env *Env) trashGetHelper(w http.ResponseWriter, r *http.Request) {
+	// get user and check access level
+	// must be admin
+	user := extractUser(w, r, datastore.AccessAdmin)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get entries, oldest first
+	entries := env.trash.list()
+
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(entries))
+	if !ok {
+		return
+	}
+
+	// create map so we return a JSON object
+	trashMap := map[string][]*trashEntry{}
+	trashMap["trash"] = entries[start:end]
+	js, err := json.Marshal(trashMap)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
+}
+
+func (env *Env) trashDeleteHelper(w http.ResponseWriter, r *http.Request) {
+	// get user and check access level
+	// must be admin
+	user := extractUser(w, r, datastore.AccessAdmin)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; purge everything in the trash
+	env.batchMu.Lock()
+	defer env.batchMu.Unlock()
+	// with ?dry_run, only report what deleting it would remove or
+	// change; large deletions must be confirmed
+	if !env.checkPurge(w, r, "trash", 0) {
+		return
+	}
+
+	for _, e := range env.trash.list() {
+		// an earlier purge may have removed it already
+		if !env.trash.has(e.Resource, e.ID) {
+			continue
+		}
+		if err := env.purgeTrashEntry(e); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"error": "Unable to purge %s %d; earlier resources were purged"}`, e.Resource, e.ID)
+			return
+		}
+	}
+
+	// success!
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ========== HANDLER for /trash/{resource}/{id}
+
+func (env *Env) trashOneHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take DELETE requests
+	if r.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be admin
+	user := extractUser(w, r, datastore.AccessAdmin)
+	if user == nil {
+		return
+	}
+
+	// sufficient access
+	// extract resource and ID for request; the route gives the
+	// resource in the plural
+	resource := strings.TrimSuffix(mux.Vars(r)["resource"], "s")
+	id, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid ID"}`)
+		return
+	}
+
+	env.batchMu.Lock()
+	defer env.batchMu.Unlock()
+	e, ok := env.trash.get(resource, id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "%s is not in the trash"}`, strings.Title(resource))
+		return
+	}
+	// with ?dry_run, only report what deleting it would remove or
+	// change; large deletions must be confirmed
+	if !env.checkPurge(w, r, resource, id) {
+		return
+	}
+
+	if err := env.purgeTrashEntry(e); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "Unable to purge %s"}`, resource)
+		return
+	}
+
+	// success!
+	w.WriteHeader(http.StatusNoContent)
+}
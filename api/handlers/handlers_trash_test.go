@@ -0,0 +1,248 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	hu "github.com/swinslow/peridot-api/test/handlerutils"
+)
+
+// trashProject3 moves mock project 3, with subproject 1, to the
+// trash.
+func trashProject3(t *testing.T, env *Env) {
+	rec := serveTestRequest(t, env, "DELETE", "/projects/3", ``, "admin", env.projectsOneHandler, "/projects/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+}
+
+// ===== hiding resources in the trash =====
+
+func TestTrashedResourcesAreHidden(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "DELETE", "/subprojects/4", ``, "admin", env.subprojectsOneHandler, "/subprojects/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	// the subproject and everything below it respond as unknown
+	rec = serveTestRequest(t, env, "GET", "/subprojects/4", ``, "viewer", env.hideTrashed(resourceSubproject, env.subprojectsOneHandler), "/subprojects/{id}")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unknown subproject ID"}`)
+	rec = serveTestRequest(t, env, "GET", "/repos/2", ``, "viewer", env.hideTrashed(resourceRepo, env.reposOneHandler), "/repos/{id}")
+	hu.CheckResponse(t, rec, `{"error": "Unknown repo ID"}`)
+	rec = serveTestRequest(t, env, "GET", "/repopulls/1", ``, "viewer", env.hideTrashed(resourceRepoPull, env.repoPullsOneHandler), "/repopulls/{id}")
+	hu.CheckResponse(t, rec, `{"error": "Unknown repopull ID"}`)
+
+	// and is left out of listings
+	rec = serveTestRequest(t, env, "GET", "/repos", ``, "viewer", env.reposHandler, "/repos")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"repos": [{"id": 1, "subproject_id": 2, "name": "repo1", "address": "https://example.com/repo1.git"}]}`)
+	rec = serveTestRequest(t, env, "GET", "/projects/1/tree?depth=1", ``, "viewer", env.projectTreeHandler, "/projects/{id}/tree")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"project": {"id": 1, "name": "prj1", "fullname": "project 1", "subprojects": [
+		{"id": 2, "project_id": 1, "name": "subprj2", "fullname": "subproject 2", "repos": null},
+		{"id": 3, "project_id": 1, "name": "subprj3", "fullname": "subproject 3", "repos": null}
+	]}}`)
+
+	// other resources are unaffected
+	rec = serveTestRequest(t, env, "GET", "/repos/1", ``, "viewer", env.hideTrashed(resourceRepo, env.reposOneHandler), "/repos/{id}")
+	hu.ConfirmOKResponse(t, rec)
+}
+
+func TestCannotCreateInTrashedParent(t *testing.T) {
+	env := getTestEnv()
+	trashProject3(t, env)
+
+	rec := serveTestRequest(t, env, "POST", "/repos", `{"subproject_id": 1, "name": "repo5", "address": "https://example.com/repo5.git"}`, "operator", env.reposHandler, "/repos")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'subproject_id'; unknown subproject"}`)
+
+	rec = serveTestRequest(t, env, "PUT", "/subprojects/2", `{"project_id": 3}`, "operator", env.subprojectsOneHandler, "/subprojects/{id}")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'project_id'; unknown project"}`)
+}
+
+func TestTrashedRepoKeepsItsAddress(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "DELETE", "/repos/3", ``, "admin", env.reposOneHandler, "/repos/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	rec = serveTestRequest(t, env, "POST", "/repos", `{"subproject_id": 2, "name": "repo5", "address": "https://example.com/repo3.git"}`, "operator", env.reposHandler, "/repos")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected %d, got %d", http.StatusConflict, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Repo 3 in the trash already has this address", "repo_id": 3}`)
+}
+
+// ===== POST /{resource}/{id}/restore =====
+
+func TestCanRestoreProject(t *testing.T) {
+	env := getTestEnv()
+	trashProject3(t, env)
+
+	rec := serveTestRequest(t, env, "POST", "/projects/3/restore", ``, "admin", env.projectsRestoreHandler, "/projects/{id}/restore")
+	hu.ConfirmNoContentResponse(t, rec)
+	if env.trash.has(resourceProject, 3) {
+		t.Errorf("expected project 3 to be restored")
+	}
+	rec = serveTestRequest(t, env, "GET", "/subprojects/1", ``, "viewer", env.hideTrashed(resourceSubproject, env.subprojectsOneHandler), "/subprojects/{id}")
+	hu.ConfirmOKResponse(t, rec)
+
+	got := getChanges(t, env, "", "viewer")
+	if len(got.Changes) != 2 || got.Changes[0].Action != "trashed" || got.Changes[1].Action != "restored" {
+		t.Errorf("unexpected changes: %#v", got)
+	}
+}
+
+func TestCannotRestoreIntoTrashedParent(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "DELETE", "/repos/3", ``, "admin", env.reposOneHandler, "/repos/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+	rec = serveTestRequest(t, env, "DELETE", "/subprojects/4", ``, "admin", env.subprojectsOneHandler, "/subprojects/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	rec = serveTestRequest(t, env, "POST", "/repos/3/restore", ``, "admin", env.reposRestoreHandler, "/repos/{id}/restore")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected %d, got %d", http.StatusConflict, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Subproject 4 is in the trash; restore it first", "subproject_id": 4}`)
+
+	// restoring the subproject first works
+	rec = serveTestRequest(t, env, "POST", "/subprojects/4/restore", ``, "admin", env.subprojectsRestoreHandler, "/subprojects/{id}/restore")
+	hu.ConfirmNoContentResponse(t, rec)
+	rec = serveTestRequest(t, env, "POST", "/repos/3/restore", ``, "admin", env.reposRestoreHandler, "/repos/{id}/restore")
+	hu.ConfirmNoContentResponse(t, rec)
+}
+
+func TestCannotRestoreWithInvalidValues(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "POST", "/repos/3/restore", ``, "admin", env.reposRestoreHandler, "/repos/{id}/restore")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected %d, got %d", http.StatusConflict, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Repo is not in the trash"}`)
+
+	rec = serveTestRequest(t, env, "POST", "/repos/17/restore", ``, "admin", env.reposRestoreHandler, "/repos/{id}/restore")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unknown repo ID"}`)
+}
+
+func TestCannotRestoreAsOperator(t *testing.T) {
+	env := getTestEnv()
+	trashProject3(t, env)
+	rec := serveTestRequest(t, env, "POST", "/projects/3/restore", ``, "operator", env.projectsRestoreHandler, "/projects/{id}/restore")
+	hu.ConfirmAccessDenied(t, rec)
+	if !env.trash.has(resourceProject, 3) {
+		t.Errorf("expected project 3 to still be in the trash")
+	}
+}
+
+// ===== GET /trash =====
+
+func TestCanGetTrashHandlerAsAdmin(t *testing.T) {
+	env := getTestEnv()
+	trashProject3(t, env)
+
+	rec := serveTestRequest(t, env, "GET", "/trash", ``, "admin", env.trashHandler, "/trash")
+	hu.ConfirmOKResponse(t, rec)
+	e, _ := env.trash.get(resourceProject, 3)
+	hu.CheckResponse(t, rec, `{"trash": [{"resource": "project", "id": 3, "name": "prj3", "deleted_at": "`+e.DeletedAt.Format(time.RFC3339Nano)+`", "deleted_by": 1, "purge_at": "`+e.PurgeAt.Format(time.RFC3339Nano)+`"}]}`)
+	if !e.PurgeAt.Equal(e.DeletedAt.Add(defaultTrashRetention)) {
+		t.Errorf("expected purge at %v, got %v", e.DeletedAt.Add(defaultTrashRetention), e.PurgeAt)
+	}
+}
+
+func TestCannotGetTrashHandlerAsOperator(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "GET", "/trash", ``, "operator", env.trashHandler, "/trash")
+	hu.ConfirmAccessDenied(t, rec)
+}
+
+// ===== purging the trash =====
+
+func TestCanPurgeOneFromTrash(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "DELETE", "/subprojects/1", ``, "admin", env.subprojectsOneHandler, "/subprojects/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+	trashProject3(t, env)
+
+	rec = serveTestRequest(t, env, "DELETE", "/trash/projects/3", ``, "admin", env.trashOneHandler, "/trash/{resource}/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	// the project and everything below it are gone, including
+	// what was in the trash separately
+	if p, err := env.db.GetProjectByID(3); err == nil {
+		t.Errorf("expected non-nil error, got nil and %#v", p)
+	}
+	if sp, err := env.db.GetSubprojectByID(1); err == nil {
+		t.Errorf("expected non-nil error, got nil and %#v", sp)
+	}
+	if !env.trash.empty() {
+		t.Errorf("expected empty trash, got %#v", env.trash.list())
+	}
+
+	rec = serveTestRequest(t, env, "DELETE", "/trash/projects/3", ``, "admin", env.trashOneHandler, "/trash/{resource}/{id}")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Project is not in the trash"}`)
+}
+
+func TestCanPurgeAllFromTrash(t *testing.T) {
+	env := getTestEnv()
+	trashProject3(t, env)
+	rec := serveTestRequest(t, env, "DELETE", "/repos/1", ``, "admin", env.reposOneHandler, "/repos/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	rec = serveTestRequest(t, env, "DELETE", "/trash", ``, "admin", env.trashHandler, "/trash")
+	hu.ConfirmNoContentResponse(t, rec)
+	if _, err := env.db.GetProjectByID(3); err == nil {
+		t.Errorf("expected project 3 to be deleted")
+	}
+	if _, err := env.db.GetRepoByID(1); err == nil {
+		t.Errorf("expected repo 1 to be deleted")
+	}
+	if !env.trash.empty() {
+		t.Errorf("expected empty trash, got %#v", env.trash.list())
+	}
+}
+
+func TestCannotPurgeTrashAsOperator(t *testing.T) {
+	env := getTestEnv()
+	trashProject3(t, env)
+	rec := serveTestRequest(t, env, "DELETE", "/trash", ``, "operator", env.trashHandler, "/trash")
+	hu.ConfirmAccessDenied(t, rec)
+	rec = serveTestRequest(t, env, "DELETE", "/trash/projects/3", ``, "operator", env.trashOneHandler, "/trash/{resource}/{id}")
+	hu.ConfirmAccessDenied(t, rec)
+	if _, err := env.db.GetProjectByID(3); err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+}
+
+func TestExpiredTrashIsPurged(t *testing.T) {
+	env := getTestEnv()
+	trashProject3(t, env)
+
+	// nothing is purged before the retention period has passed
+	env.purgeExpiredTrash(time.Now().Add(time.Hour))
+	if _, err := env.db.GetProjectByID(3); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	env.purgeExpiredTrash(time.Now().Add(defaultTrashRetention + time.Hour))
+	if _, err := env.db.GetProjectByID(3); err == nil {
+		t.Errorf("expected project 3 to be purged")
+	}
+	if !env.trash.empty() {
+		t.Errorf("expected empty trash, got %#v", env.trash.list())
+	}
+
+	got := getChanges(t, env, "", "viewer")
+	if len(got.Changes) != 2 || got.Changes[1].Action != "deleted" {
+		t.Errorf("unexpected changes: %#v", got)
+	}
+}
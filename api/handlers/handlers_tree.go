@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// Tree depths: how many levels below the project are included.
+const (
+	treeDepthProject = iota
+	treeDepthSubprojects
+	treeDepthRepos
+	treeDepthBranches
+)
+
+// treeProject is a project with its subprojects, as returned by
+// /projects/{id}/tree.
+type treeProject struct {
+	*datastore.Project
+	Subprojects []*treeSubproject `json:"subprojects"`
+}
+
+// treeSubproject is a subproject with its repos.
+type treeSubproject struct {
+	*datastore.Subproject
+	Repos []*treeRepo `json:"repos"`
+}
+
+// treeRepo is a repo with its branches.
+type treeRepo struct {
+	*datastore.Repo
+	Branches []*treeBranch `json:"branches"`
+}
+
+// treeBranch is a branch, with its most recent repo pull if that
+// was requested.
+type treeBranch struct {
+	Branch     string        `json:"branch"`
+	LatestPull *treeRepoPull `json:"latest_pull,omitempty"`
+}
+
+// treeRepoPull is the summary of a repo pull shown for a branch.
+type treeRepoPull struct {
+	ID     uint32           `json:"id"`
+	Status datastore.Status `json:"status"`
+	Health datastore.Health `json:"health"`
+	Commit string           `json:"commit"`
+	Tag    string           `json:"tag,omitempty"`
+}
+
+// ========== HANDLER for /projects/{id}/tree
+
+func (env *Env) projectTreeHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	// must be at least viewer
+	user := extractUser(w, r, datastore.AccessViewer)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get project id from vars
+	projectID, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid project ID"}`)
+		return
+	}
+
+	// check what is requested
+	q := r.URL.Query()
+	depth := treeDepthBranches
+	if s := q.Get("depth"); s != "" {
+		depth, err = strconv.Atoi(s)
+		if err != nil || depth < treeDepthProject || depth > treeDepthBranches {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'depth'; must be between %d and %d"}`, treeDepthProject, treeDepthBranches)
+			return
+		}
+	}
+	latestPull, ok := extractBoolParam(w, r, "latest_pull")
+	if !ok {
+		return
+	}
+	if latestPull && depth < treeDepthBranches {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "'latest_pull' requires 'depth' of %d"}`, treeDepthBranches)
+		return
+	}
+
+	// get project from database
+	project, err := env.db.GetProjectByID(projectID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown project ID"}`)
+		return
+	}
+
+	tree, err := env.getProjectTree(project, depth, latestPull)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return
+	}
+
+	// create map so we return a JSON object
+	jsData := struct {
+		Project *treeProject `json:"project"`
+	}{Project: tree}
+	js, err := json.Marshal(jsData)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
+}
+
+// getProjectTree builds the tree for a project down to the given
+// depth, optionally including each branch's most recent repo pull.
+func (env *Env) getProjectTree(project *datastore.Project, depth int, latestPull bool) (*treeProject, error) {
+	tp := &treeProject{Project: project}
+	if depth < treeDepthSubprojects {
+		return tp, nil
+	}
+
+	// subprojects and repos in the trash are left out
+	subprojects, err := env.db.GetAllSubprojectsForProjectID(project.ID)
+	if err != nil {
+		return nil, err
+	}
+	subprojects = env.visibleSubprojects(subprojects)
+	tp.Subprojects = []*treeSubproject{}
+	for _, sp := range subprojects {
+		tsp := &treeSubproject{Subproject: sp}
+		tp.Subprojects = append(tp.Subprojects, tsp)
+		if depth < treeDepthRepos {
+			continue
+		}
+
+		repos, err := env.db.GetAllReposForSubprojectID(sp.ID)
+		if err != nil {
+			return nil, err
+		}
+		repos = env.visibleRepos(repos)
+		tsp.Repos = []*treeRepo{}
+		for _, repo := range repos {
+			tr := &treeRepo{Repo: repo}
+			tsp.Repos = append(tsp.Repos, tr)
+			if depth < treeDepthBranches {
+				continue
+			}
+
+			branches, err := env.db.GetAllRepoBranchesForRepoID(repo.ID)
+			if err != nil {
+				return nil, err
+			}
+			tr.Branches = []*treeBranch{}
+			for _, branch := range branches {
+				tb := &treeBranch{Branch: branch.Branch}
+				tr.Branches = append(tr.Branches, tb)
+				if !latestPull {
+					continue
+				}
+
+				rps, err := env.db.GetAllRepoPullsForRepoBranch(repo.ID, branch.Branch)
+				if err != nil {
+					return nil, err
+				}
+				if rp := latestRepoPull(rps, false); rp != nil {
+					rp, _, err := env.rolledUpRepoPull(rp)
+					if err != nil {
+						return nil, err
+					}
+					tb.LatestPull = &treeRepoPull{ID: rp.ID, Status: rp.Status, Health: rp.Health, Commit: rp.Commit, Tag: rp.Tag}
+				}
+			}
+		}
+	}
+	return tp, nil
+}
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	hu "github.com/swinslow/peridot-api/test/handlerutils"
+)
+
+// ===== GET /projects/{id}/tree =====
+
+func TestCanGetProjectTreeHandler(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/projects/1/tree", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectTreeHandler), "/projects/{id:[0-9]+}/tree")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"project": {"id": 1, "name": "prj1", "fullname": "project 1", "subprojects": [
+		{"id": 2, "project_id": 1, "name": "subprj2", "fullname": "subproject 2", "repos": [
+			{"id": 1, "subproject_id": 2, "name": "repo1", "address": "https://example.com/repo1.git", "branches": [{"branch": "master"}]}
+		]},
+		{"id": 3, "project_id": 1, "name": "subprj3", "fullname": "subproject 3", "repos": []},
+		{"id": 4, "project_id": 1, "name": "subprj4", "fullname": "subproject 4", "repos": [
+			{"id": 2, "subproject_id": 4, "name": "repo2", "address": "https://example.com/repo2.git", "branches": [{"branch": "master"}, {"branch": "alpha"}, {"branch": "beta"}]},
+			{"id": 3, "subproject_id": 4, "name": "repo3", "address": "https://example.com/repo3.git", "branches": []},
+			{"id": 4, "subproject_id": 4, "name": "repo4", "address": "https://example.com/repo4.git", "branches": [{"branch": "master"}, {"branch": "dev"}]}
+		]}
+	]}}`
+	hu.CheckResponse(t, rec, wanted)
+}
+
+func TestCanGetProjectTreeHandlerWithDepth(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/projects/3/tree?depth=1", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectTreeHandler), "/projects/{id:[0-9]+}/tree")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"project": {"id": 3, "name": "prj3", "fullname": "project 3", "subprojects": [{"id": 1, "project_id": 3, "name": "subprj1", "fullname": "subproject 1", "repos": null}]}}`)
+
+	rec, req, env = setupTestEnv(t, "GET", "/projects/3/tree?depth=0", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectTreeHandler), "/projects/{id:[0-9]+}/tree")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"project": {"id": 3, "name": "prj3", "fullname": "project 3", "subprojects": null}}`)
+}
+
+func TestCanGetProjectTreeHandlerWithLatestPull(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/projects/1/tree?latest_pull=true", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectTreeHandler), "/projects/{id:[0-9]+}/tree")
+	hu.ConfirmOKResponse(t, rec)
+
+	wanted := `{"project": {"id": 1, "name": "prj1", "fullname": "project 1", "subprojects": [
+		{"id": 2, "project_id": 1, "name": "subprj2", "fullname": "subproject 2", "repos": [
+			{"id": 1, "subproject_id": 2, "name": "repo1", "address": "https://example.com/repo1.git", "branches": [{"branch": "master"}]}
+		]},
+		{"id": 3, "project_id": 1, "name": "subprj3", "fullname": "subproject 3", "repos": []},
+		{"id": 4, "project_id": 1, "name": "subprj4", "fullname": "subproject 4", "repos": [
+			{"id": 2, "subproject_id": 4, "name": "repo2", "address": "https://example.com/repo2.git", "branches": [
+				{"branch": "master", "latest_pull": {"id": 2, "status": "running", "health": "degraded", "commit": "abcdef012345abcdef012345abcdef0123455678", "tag": "v1.2"}},
+				{"branch": "alpha"},
+				{"branch": "beta"}
+			]},
+			{"id": 3, "subproject_id": 4, "name": "repo3", "address": "https://example.com/repo3.git", "branches": []},
+			{"id": 4, "subproject_id": 4, "name": "repo4", "address": "https://example.com/repo4.git", "branches": [
+				{"branch": "master"},
+				{"branch": "dev", "latest_pull": {"id": 3, "status": "running", "health": "degraded", "commit": "abcdef012345abcdef012345abcdef01234590ab"}}
+			]}
+		]}
+	]}}`
+	hu.CheckResponse(t, rec, wanted)
+}
+
+func TestCannotGetProjectTreeHandlerWithInvalidValues(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/projects/1/tree?depth=4", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectTreeHandler), "/projects/{id:[0-9]+}/tree")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'depth'; must be between 0 and 3"}`)
+
+	rec, req, env = setupTestEnv(t, "GET", "/projects/1/tree?latest_pull=maybe", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectTreeHandler), "/projects/{id:[0-9]+}/tree")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'latest_pull'"}`)
+
+	rec, req, env = setupTestEnv(t, "GET", "/projects/1/tree?depth=2&latest_pull=1", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectTreeHandler), "/projects/{id:[0-9]+}/tree")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "'latest_pull' requires 'depth' of 3"}`)
+}
+
+func TestCannotGetProjectTreeHandlerForUnknownProject(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/projects/17/tree", ``, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectTreeHandler), "/projects/{id:[0-9]+}/tree")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unknown project ID"}`)
+}
+
+func TestCannotGetProjectTreeHandlerAsBadUser(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/projects/1/tree", ``, "disabled")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectTreeHandler), "/projects/{id:[0-9]+}/tree")
+	hu.ConfirmAccessDenied(t, rec)
+
+	rec, req, env = setupTestEnv(t, "GET", "/projects/1/tree", ``, "invalid")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.projectTreeHandler), "/projects/{id:[0-9]+}/tree")
+	hu.ConfirmInvalidAuth(t, rec, ErrAuthGithub)
+}
@@ -47,6 +47,13 @@ func (env *Env) usersGetHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(users))
+	if !ok {
+		return
+	}
+	users = users[start:end]
+
 	// return different message depending whether the
 	// logged-in user is admin or lesser
 	if user.AccessLevel == datastore.AccessAdmin {
@@ -153,6 +160,9 @@ func (env *Env) usersPostHelper(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"error": "Unable to create user"}`)
 		return
 	}
+	if u, err := env.db.GetUserByID(newID); err == nil {
+		env.events.publish(EventUserCreated, map[string]interface{}{"user": u})
+	}
 
 	// success!
 	w.WriteHeader(http.StatusCreated)
@@ -167,10 +177,10 @@ func (env *Env) usersOneHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		env.usersOneGetHelper(w, r)
-	case "PUT":
+	case "PUT", "PATCH":
 		env.usersOnePutHelper(w, r)
 	default:
-		w.Header().Set("Allow", "GET, PUT")
+		w.Header().Set("Allow", "GET, PUT, PATCH")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
@@ -201,6 +211,11 @@ func (env *Env) usersOneGetHelper(w http.ResponseWriter, r *http.Request) {
 	// return different message depending whether the
 	// logged-in user is admin / self or other
 	if user.AccessLevel == datastore.AccessAdmin || user.ID == argUser.ID {
+		// set the ETag, and stop here if the client's copy is current
+		if writeETag(w, r, argUser) {
+			return
+		}
+
 		// admin user just does full JSON marshalling
 		// create map so we return a JSON object
 		jsData := struct {
@@ -216,10 +231,14 @@ func (env *Env) usersOneGetHelper(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// for non-admin, non-self recipient, need to return just id
-	// and Github username
+	// and Github username; the ETag only covers what they can see
+	ltdUser := &limitedUser{ID: argUser.ID, Github: argUser.Github}
+	if writeETag(w, r, ltdUser) {
+		return
+	}
 	jsData := struct {
 		LtdUser *limitedUser `json:"user"`
-	}{LtdUser: &limitedUser{ID: argUser.ID, Github: argUser.Github}}
+	}{LtdUser: ltdUser}
 	js, err := json.Marshal(jsData)
 	if err != nil {
 		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
@@ -244,6 +263,9 @@ func (env *Env) usersOnePutHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// hold the user until it has been changed (see resourceLocks)
+	defer env.locks.lock(resourceUser, userID)()
+
 	// if not admin and not self, access will be denied
 	if user.AccessLevel != datastore.AccessAdmin && user.ID != userID {
 		w.WriteHeader(http.StatusForbidden)
@@ -259,21 +281,26 @@ func (env *Env) usersOnePutHelper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// parse JSON request
-	js := map[string]string{}
-	err = json.NewDecoder(r.Body).Decode(&js)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+	// if the request is conditional, make sure the client
+	// is updating the current version
+	if !checkIfMatch(w, r, existingUser) {
 		return
 	}
 
-	// and extract data; if absent, use existing data
-	newName, ok := js["name"]
+	// parse JSON request (or merge patch, for PATCH)
+	js, ok := extractUpdateRequest(w, r, existingUser)
 	if !ok {
-		newName = existingUser.Name
+		return
+	}
+
+	// and extract data; if absent, use existing data
+	newName, err := optionalString(js, "name", existingUser.Name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "%v"}`, err)
+		return
 	}
-	newGithub, ok := js["github"]
+	_, ok = js["github"]
 	if ok {
 		// unless we're admin, access will be denied
 		if user.AccessLevel != datastore.AccessAdmin {
@@ -281,11 +308,15 @@ func (env *Env) usersOnePutHelper(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, `{"error": "Access denied"}`)
 			return
 		}
-	} else {
-		newGithub = existingUser.Github
+	}
+	newGithub, err := optionalString(js, "github", existingUser.Github)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "%v"}`, err)
+		return
 	}
 	var newUal datastore.UserAccessLevel
-	newAccess, ok := js["access"]
+	_, ok = js["access"]
 	if ok {
 		// unless we're admin, access will be denied
 		if user.AccessLevel != datastore.AccessAdmin {
@@ -293,7 +324,10 @@ func (env *Env) usersOnePutHelper(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, `{"error": "Access denied"}`)
 			return
 		}
-		newUal, err = datastore.UserAccessLevelFromString(newAccess)
+		newAccess, err := optionalString(js, "access", "")
+		if err == nil {
+			newUal, err = datastore.UserAccessLevelFromString(newAccess)
+		}
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			fmt.Fprintf(w, `{"error": "Invalid value for 'access'"}`)
@@ -314,6 +348,9 @@ func (env *Env) usersOnePutHelper(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, `{"error": "Unable to update user"}`)
 		return
 	}
+	if u, err := env.db.GetUserByID(userID); err == nil {
+		env.events.publish(EventUserUpdated, map[string]interface{}{"user": u})
+	}
 
 	// success!
 	w.WriteHeader(http.StatusNoContent)
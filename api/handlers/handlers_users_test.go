@@ -156,6 +156,21 @@ func TestCannotGetUsersOneHandlerAsBadUser(t *testing.T) {
 	hu.ConfirmInvalidAuth(t, rec, ErrAuthGithub)
 }
 
+func TestGetUsersOneHandlerETagCoversLimitedView(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "GET", "/users/1", "", "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.usersOneHandler), "/users/{id}")
+	hu.ConfirmOKResponse(t, rec)
+
+	wantedETag, err := computeETag(&limitedUser{ID: 1, Github: "admin"})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	gotETag := rec.Result().Header.Get("ETag")
+	if gotETag != wantedETag {
+		t.Errorf("expected %s, got %s", wantedETag, gotETag)
+	}
+}
+
 // ===== PUT /users/3 =====
 
 func TestCanPutUsersOneHandlerAsAdmin(t *testing.T) {
@@ -364,3 +379,28 @@ func TestCannotPutUsersOneHandlerAsBadUser(t *testing.T) {
 	hu.ServeHandler(rec, req, http.HandlerFunc(env.usersOneHandler), "/users/{id}")
 	hu.ConfirmInvalidAuth(t, rec, ErrAuthGithub)
 }
+
+// ===== PATCH /users/3 =====
+
+func TestCanPatchUsersOneHandlerAsViewerSelfWithUnchangedGithub(t *testing.T) {
+	// github is not changed by the patch, so a non-admin may send it
+	rec, req, env := setupTestEnv(t, "PATCH", "/users/4", `{"name": "new-name", "github": "viewer"}`, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.usersOneHandler), "/users/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	// and verify state of database now
+	u, err := env.db.GetUserByID(4)
+	if err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+	wantedUser := &datastore.User{ID: 4, Name: "new-name", Github: "viewer", AccessLevel: datastore.AccessViewer}
+	if *u != *wantedUser {
+		t.Errorf("expected %#v, got %#v", wantedUser, u)
+	}
+}
+
+func TestCannotPatchUsersOneHandlerAsViewerSelfChangingAccess(t *testing.T) {
+	rec, req, env := setupTestEnv(t, "PATCH", "/users/4", `{"access": "admin"}`, "viewer")
+	hu.ServeHandler(rec, req, http.HandlerFunc(env.usersOneHandler), "/users/{id}")
+	hu.ConfirmAccessDenied(t, rec)
+}
@@ -0,0 +1,412 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// validWebhookURL reports whether s is an absolute http or https URL.
+func validWebhookURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// extractEventTypes converts a JSON list of event types, writing
+// an error and returning false if it is empty or has unknown types.
+func extractEventTypes(w http.ResponseWriter, v interface{}) ([]string, bool) {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid value for 'events'; must be a non-empty list"}`)
+		return nil, false
+	}
+	events := []string{}
+	for _, e := range list {
+		s, ok := e.(string)
+		if !ok || !isEventType(s) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Unknown event type '%v'"}`, e)
+			return nil, false
+		}
+		events = append(events, s)
+	}
+	return events, true
+}
+
+// ========== HANDLER for /admin/webhooks
+
+func (env *Env) adminWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET or POST requests
+	switch r.Method {
+	case "GET":
+		env.adminWebhooksGetHelper(w, r)
+	case "POST":
+		env.adminWebhooksPostHelper(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (env *Env) adminWebhooksGetHelper(w http.ResponseWriter, r *http.Request) {
+	// get user and check access level
+	// must be admin
+	user := extractUser(w, r, datastore.AccessAdmin)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; get webhooks
+	hooks := env.webhooks.list()
+
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(hooks))
+	if !ok {
+		return
+	}
+
+	// create map so we return a JSON object
+	views := []*webhookView{}
+	for _, wh := range hooks[start:end] {
+		views = append(views, wh.view())
+	}
+	hooksMap := map[string][]*webhookView{}
+	hooksMap["webhooks"] = views
+	js, err := json.Marshal(hooksMap)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
+}
+
+func (env *Env) adminWebhooksPostHelper(w http.ResponseWriter, r *http.Request) {
+	// get user and check access level
+	// must be admin
+	user := extractUser(w, r, datastore.AccessAdmin)
+	if user == nil {
+		return
+	}
+
+	// sufficient access; parse JSON request
+	js := map[string]interface{}{}
+	err := json.NewDecoder(r.Body).Decode(&js)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+		return
+	}
+
+	// and extract data
+	target, ok := js["url"].(string)
+	if !ok || !validWebhookURL(target) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid value for 'url'"}`)
+		return
+	}
+	secret, ok := js["secret"].(string)
+	if !ok || secret == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing required value for 'secret'"}`)
+		return
+	}
+	events, ok := extractEventTypes(w, js["events"])
+	if !ok {
+		return
+	}
+	// webhooks are active unless specified otherwise
+	isActive, ok := js["is_active"].(bool)
+	if !ok {
+		isActive = true
+	}
+
+	// add the new webhook
+	newID := env.webhooks.add(&webhook{URL: target, Secret: secret, Events: events, IsActive: isActive})
+
+	// success!
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"id": %d}`, newID)
+}
+
+// ========== HANDLER for /admin/webhooks/{id}
+
+func (env *Env) adminWebhooksOneHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET, PUT or DELETE requests
+	switch r.Method {
+	case "GET":
+		env.adminWebhooksOneGetHelper(w, r)
+	case "PUT":
+		env.adminWebhooksOnePutHelper(w, r)
+	case "DELETE":
+		env.adminWebhooksOneDeleteHelper(w, r)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (env *Env) adminWebhooksOneGetHelper(w http.ResponseWriter, r *http.Request) {
+	// get user and check access level
+	user := extractUser(w, r, datastore.AccessAdmin)
+	if user == nil {
+		return
+	}
+
+	// sufficient access
+	// extract ID for request
+	hookID, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid ID"}`)
+		return
+	}
+
+	wh, ok := env.webhooks.get(hookID)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown webhook ID"}`)
+		return
+	}
+
+	// create map so we return a JSON object
+	jsData := struct {
+		Webhook *webhookView `json:"webhook"`
+	}{Webhook: wh.view()}
+	js, err := json.Marshal(jsData)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
+}
+
+func (env *Env) adminWebhooksOnePutHelper(w http.ResponseWriter, r *http.Request) {
+	// get user and check access level
+	user := extractUser(w, r, datastore.AccessAdmin)
+	if user == nil {
+		return
+	}
+
+	// sufficient access
+	// extract ID for request
+	hookID, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid ID"}`)
+		return
+	}
+
+	wh, ok := env.webhooks.get(hookID)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown webhook ID"}`)
+		return
+	}
+
+	// parse JSON request
+	js := map[string]interface{}{}
+	err = json.NewDecoder(r.Body).Decode(&js)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+		return
+	}
+
+	// and extract data; if absent, use existing data
+	updated := false
+	if v, ok := js["url"]; ok {
+		target, ok := v.(string)
+		if !ok || !validWebhookURL(target) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'url'"}`)
+			return
+		}
+		wh.URL = target
+		updated = true
+	}
+	if v, ok := js["secret"]; ok {
+		secret, ok := v.(string)
+		if !ok || secret == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'secret'"}`)
+			return
+		}
+		wh.Secret = secret
+		updated = true
+	}
+	if v, ok := js["events"]; ok {
+		events, ok := extractEventTypes(w, v)
+		if !ok {
+			return
+		}
+		wh.Events = events
+		updated = true
+	}
+	if v, ok := js["is_active"]; ok {
+		isActive, ok := v.(bool)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'is_active'"}`)
+			return
+		}
+		wh.IsActive = isActive
+		updated = true
+	}
+
+	if !updated {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "No updateable values found in request"}`)
+		return
+	}
+
+	if !env.webhooks.update(wh) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown webhook ID"}`)
+		return
+	}
+
+	// success!
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (env *Env) adminWebhooksOneDeleteHelper(w http.ResponseWriter, r *http.Request) {
+	// get user and check access level
+	user := extractUser(w, r, datastore.AccessAdmin)
+	if user == nil {
+		return
+	}
+
+	// sufficient access
+	// extract ID for request
+	hookID, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid ID"}`)
+		return
+	}
+
+	if !env.webhooks.remove(hookID) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown webhook ID"}`)
+		return
+	}
+
+	// success!
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ========== HANDLER for /admin/webhooks/{id}/deliveries
+
+func (env *Env) adminWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take GET requests
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	user := extractUser(w, r, datastore.AccessAdmin)
+	if user == nil {
+		return
+	}
+
+	// sufficient access
+	// extract ID for request
+	hookID, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid ID"}`)
+		return
+	}
+
+	if _, ok := env.webhooks.get(hookID); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown webhook ID"}`)
+		return
+	}
+	deliveries := env.webhooks.listDeliveries(hookID)
+
+	// limit to the requested page, if any
+	start, end, ok := extractPage(w, r, len(deliveries))
+	if !ok {
+		return
+	}
+
+	// create map so we return a JSON object
+	deliveriesMap := map[string][]*webhookDelivery{}
+	deliveriesMap["deliveries"] = deliveries[start:end]
+	js, err := json.Marshal(deliveriesMap)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return
+	}
+	w.Write(js)
+}
+
+// ========== HANDLER for /admin/webhooks/{id}/deliveries/{delivery}/redeliver
+
+func (env *Env) adminWebhookRedeliverHandler(w http.ResponseWriter, r *http.Request) {
+	// responses will be JSON format
+	w.Header().Set("Content-Type", "application/json")
+
+	// we only take POST requests
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// get user and check access level
+	user := extractUser(w, r, datastore.AccessAdmin)
+	if user == nil {
+		return
+	}
+
+	// sufficient access
+	// extract IDs for request
+	hookID, err := extractIDasU32(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid ID"}`)
+		return
+	}
+	deliveryID, err := strconv.ParseUint(mux.Vars(r)["delivery"], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Missing or invalid delivery ID"}`)
+		return
+	}
+
+	newID, ok := env.webhooks.redeliver(hookID, uint32(deliveryID))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown webhook or delivery ID"}`)
+		return
+	}
+
+	// accepted; the new delivery is sent in the background
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, `{"id": %d}`, newID)
+}
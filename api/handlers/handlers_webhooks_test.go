@@ -0,0 +1,340 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+
+	hu "github.com/swinslow/peridot-api/test/handlerutils"
+)
+
+// serveTestRequest sends a request as the given mock user to a
+// handler with an existing test Env, so that a test can make
+// several requests against the same data.
+func serveTestRequest(t *testing.T, env *Env, method string, endpoint string, bodystr string, ghUsername string, hf http.HandlerFunc, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest(method, endpoint, strings.NewReader(bodystr))
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	req = loginWithTestUser(t, req, env, ghUsername)
+	hu.ServeHandler(rec, req, hf, path)
+	return rec
+}
+
+// webhookReceiver is a test server that records the deliveries
+// it receives, and fails the first few of them.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookReceiver(failures int) *webhookReceiver {
+	wr := &webhookReceiver{failures: failures}
+	wr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		wr.mu.Lock()
+		defer wr.mu.Unlock()
+		wr.requests = append(wr.requests, r)
+		wr.bodies = append(wr.bodies, body)
+		if wr.failures > 0 {
+			wr.failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return wr
+}
+
+// waitForDelivery waits until the most recent delivery for the
+// given webhook is no longer pending, and returns it.
+func waitForDelivery(t *testing.T, env *Env, hookID uint32) *webhookDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ds := env.webhooks.listDeliveries(hookID)
+		if len(ds) > 0 && ds[0].Status != deliveryPending {
+			return ds[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for delivery to webhook %d", hookID)
+	return nil
+}
+
+func TestCanCreateAndGetWebhooksAsAdmin(t *testing.T) {
+	env := getTestEnv()
+
+	rec := serveTestRequest(t, env, "POST", "/admin/webhooks", `{"url": "https://example.com/hook", "secret": "s3cret", "events": ["project.created", "agent.inactive"]}`, "admin", env.adminWebhooksHandler, "/admin/webhooks")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 1}`)
+
+	// the secret is not shown
+	rec = serveTestRequest(t, env, "GET", "/admin/webhooks", ``, "admin", env.adminWebhooksHandler, "/admin/webhooks")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"webhooks": [{"id": 1, "url": "https://example.com/hook", "events": ["project.created", "agent.inactive"], "is_active": true}]}`)
+
+	rec = serveTestRequest(t, env, "PUT", "/admin/webhooks/1", `{"is_active": false}`, "admin", env.adminWebhooksOneHandler, "/admin/webhooks/{id:[0-9]+}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	rec = serveTestRequest(t, env, "GET", "/admin/webhooks/1", ``, "admin", env.adminWebhooksOneHandler, "/admin/webhooks/{id:[0-9]+}")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"webhook": {"id": 1, "url": "https://example.com/hook", "events": ["project.created", "agent.inactive"], "is_active": false}}`)
+
+	rec = serveTestRequest(t, env, "DELETE", "/admin/webhooks/1", ``, "admin", env.adminWebhooksOneHandler, "/admin/webhooks/{id:[0-9]+}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	rec = serveTestRequest(t, env, "GET", "/admin/webhooks/1", ``, "admin", env.adminWebhooksOneHandler, "/admin/webhooks/{id:[0-9]+}")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestCannotManageWebhooksUnlessAdmin(t *testing.T) {
+	env := getTestEnv()
+
+	rec := serveTestRequest(t, env, "POST", "/admin/webhooks", `{"url": "https://example.com/hook", "secret": "s3cret", "events": ["project.created"]}`, "operator", env.adminWebhooksHandler, "/admin/webhooks")
+	hu.ConfirmAccessDenied(t, rec)
+
+	rec = serveTestRequest(t, env, "GET", "/admin/webhooks", ``, "operator", env.adminWebhooksHandler, "/admin/webhooks")
+	hu.ConfirmAccessDenied(t, rec)
+}
+
+func TestCannotCreateWebhookWithInvalidValues(t *testing.T) {
+	env := getTestEnv()
+
+	rec := serveTestRequest(t, env, "POST", "/admin/webhooks", `{"url": "example.com/hook", "secret": "s3cret", "events": ["project.created"]}`, "admin", env.adminWebhooksHandler, "/admin/webhooks")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Missing or invalid value for 'url'"}`)
+
+	rec = serveTestRequest(t, env, "POST", "/admin/webhooks", `{"url": "https://example.com/hook", "events": ["project.created"]}`, "admin", env.adminWebhooksHandler, "/admin/webhooks")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Missing required value for 'secret'"}`)
+
+	rec = serveTestRequest(t, env, "POST", "/admin/webhooks", `{"url": "https://example.com/hook", "secret": "s3cret", "events": ["project.archived"]}`, "admin", env.adminWebhooksHandler, "/admin/webhooks")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Unknown event type 'project.archived'"}`)
+}
+
+func TestWebhookReceivesSignedEvent(t *testing.T) {
+	env := getTestEnv()
+	wr := newWebhookReceiver(0)
+	defer wr.Close()
+
+	rec := serveTestRequest(t, env, "POST", "/admin/webhooks", `{"url": "`+wr.URL+`", "secret": "s3cret", "events": ["project.created"]}`, "admin", env.adminWebhooksHandler, "/admin/webhooks")
+	hu.ConfirmCreatedResponse(t, rec)
+
+	rec = serveTestRequest(t, env, "POST", "/projects", `{"name": "prj4", "fullname": "project 4"}`, "operator", env.projectsHandler, "/projects")
+	hu.ConfirmCreatedResponse(t, rec)
+
+	d := waitForDelivery(t, env, 1)
+	if d.Status != deliverySucceeded || len(d.Attempts) != 1 {
+		t.Fatalf("expected one successful attempt, got %#v", d)
+	}
+
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	if len(wr.requests) != 1 {
+		t.Fatalf("expected %d, got %d", 1, len(wr.requests))
+	}
+	req, body := wr.requests[0], wr.bodies[0]
+	if got := req.Header.Get("X-Peridot-Event"); got != EventProjectCreated {
+		t.Errorf("expected %s, got %s", EventProjectCreated, got)
+	}
+	if got := req.Header.Get("X-Peridot-Signature-256"); got != signPayload("s3cret", body) {
+		t.Errorf("signature %s does not match body", got)
+	}
+	var ev struct {
+		Event string `json:"event"`
+		Data  struct {
+			Project *datastore.Project `json:"project"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &ev); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if ev.Event != EventProjectCreated || ev.Data.Project == nil || ev.Data.Project.ID != 4 || ev.Data.Project.Name != "prj4" {
+		t.Errorf("unexpected payload: %s", body)
+	}
+}
+
+func TestWebhookRetriesAndCanRedeliver(t *testing.T) {
+	env := getTestEnv()
+	env.webhooks.backoff = time.Millisecond
+	wr := newWebhookReceiver(2)
+	defer wr.Close()
+
+	env.webhooks.add(&webhook{URL: wr.URL, Secret: "s3cret", Events: []string{EventProjectCreated}, IsActive: true})
+	env.events.publish(EventProjectCreated, map[string]interface{}{"project": &datastore.Project{ID: 9}})
+
+	d := waitForDelivery(t, env, 1)
+	if d.Status != deliverySucceeded || len(d.Attempts) != 3 {
+		t.Fatalf("expected success on third attempt, got %#v", d)
+	}
+	if d.Attempts[0].StatusCode != http.StatusInternalServerError || d.Attempts[2].StatusCode != http.StatusOK {
+		t.Errorf("unexpected attempts: %#v", d.Attempts)
+	}
+
+	rec := serveTestRequest(t, env, "POST", "/admin/webhooks/1/deliveries/1/redeliver", ``, "admin", env.adminWebhookRedeliverHandler, "/admin/webhooks/{id:[0-9]+}/deliveries/{delivery:[0-9]+}/redeliver")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected %d, got %d", http.StatusAccepted, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"id": 2}`)
+
+	d = waitForDelivery(t, env, 1)
+	if d.ID != 2 || d.RedeliveryOf != 1 || d.Status != deliverySucceeded {
+		t.Errorf("unexpected redelivery: %#v", d)
+	}
+
+	rec = serveTestRequest(t, env, "GET", "/admin/webhooks/1/deliveries", ``, "admin", env.adminWebhookDeliveriesHandler, "/admin/webhooks/{id:[0-9]+}/deliveries")
+	hu.ConfirmOKResponse(t, rec)
+	var got map[string][]*webhookDelivery
+	if err := json.Unmarshal(hu.GetBody(t, rec), &got); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if len(got["deliveries"]) != 2 || got["deliveries"][0].ID != 2 {
+		t.Errorf("unexpected delivery log: %#v", got)
+	}
+
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	if string(wr.bodies[0]) != string(wr.bodies[3]) {
+		t.Errorf("expected redelivery to resend the same payload")
+	}
+}
+
+func TestWebhookGivesUpAfterMaxAttempts(t *testing.T) {
+	env := getTestEnv()
+	env.webhooks.backoff = time.Millisecond
+	wr := newWebhookReceiver(100)
+	defer wr.Close()
+
+	env.webhooks.add(&webhook{URL: wr.URL, Secret: "s3cret", Events: []string{EventProjectCreated}, IsActive: true})
+	env.events.publish(EventProjectCreated, map[string]interface{}{})
+
+	d := waitForDelivery(t, env, 1)
+	if d.Status != deliveryFailed || len(d.Attempts) != webhookMaxAttempts {
+		t.Errorf("expected failure after %d attempts, got %#v", webhookMaxAttempts, d)
+	}
+}
+
+func TestWebhookDeliveriesAreSavedInTheBackground(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peridot-api-test")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ws, err := newWebhookStore(dir)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	ws.saveDelay = time.Millisecond
+	wr := newWebhookReceiver(0)
+	defer wr.Close()
+	ws.add(&webhook{URL: wr.URL, Secret: "s3cret", Events: []string{EventProjectCreated}, IsActive: true})
+
+	// an event doesn't wait for the store to be saved
+	ws.saveMu.Lock()
+	done := make(chan bool)
+	go func() {
+		ws.handleEvent(&event{Seq: 1, Type: EventProjectCreated, Data: map[string]interface{}{}})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for event to be handled")
+	}
+	ws.saveMu.Unlock()
+
+	// but its delivery is saved soon after
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		loaded, err := newWebhookStore(dir)
+		if err != nil {
+			t.Fatalf("got non-nil error: %v", err)
+		}
+		if len(loaded.listDeliveries(1)) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for delivery to be saved")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatcherPublishesJobAndAgentChanges(t *testing.T) {
+	env := getTestEnv()
+	var got []*event
+	env.events.subscribe(func(ev *event) { got = append(got, ev) })
+
+	// the first poll only records the current state
+	if err := env.pollChanges(); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected no events, got %d", len(got))
+	}
+
+	job, err := env.db.GetJobByID(1)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	oldStatus := job.Status
+	err = env.db.UpdateJobStatus(1, time.Now(), time.Time{}, datastore.StatusRunning, datastore.HealthDegraded, "")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	agent, err := env.db.GetAgentByID(1)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if !agent.IsActive {
+		t.Fatalf("expected mock agent 1 to be active")
+	}
+	err = env.db.UpdateAgentStatus(1, false, agent.Address, agent.Port)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+
+	if err := env.pollChanges(); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	// job 1's repo pull is derived from it, so it changes too
+	if len(got) != 3 {
+		t.Fatalf("expected %d events, got %d", 3, len(got))
+	}
+	if got[0].Type != EventJobStatusChanged || got[1].Type != EventRepoPullStatusChanged || got[2].Type != EventAgentInactive {
+		t.Errorf("unexpected events: %s, %s, %s", got[0].Type, got[1].Type, got[2].Type)
+	}
+	data := got[0].Data.(map[string]interface{})
+	if data["previous_status"] != oldStatus {
+		t.Errorf("expected %v, got %v", oldStatus, data["previous_status"])
+	}
+	data = got[1].Data.(map[string]interface{})
+	if rp := data["repopull"].(*datastore.RepoPull); rp.ID != 1 || rp.Status != datastore.StatusRunning || rp.Health != datastore.HealthDegraded {
+		t.Errorf("expected repo pull 1 to be running and degraded, got %#v", rp)
+	}
+
+	// nothing has changed since the last poll
+	if err := env.pollChanges(); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if len(got) != 3 {
+		t.Errorf("expected %d events, got %d", 3, len(got))
+	}
+}
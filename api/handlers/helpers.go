@@ -5,9 +5,25 @@ package handlers
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 
 	"github.com/gorilla/mux"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// Resource names, as used in deletion impacts, the trash, labels,
+// manifests and search results.
+const (
+	resourceProject    = "project"
+	resourceSubproject = "subproject"
+	resourceRepo       = "repo"
+	resourceBranch     = "branch"
+	resourceRepoPull   = "repopull"
+	resourceJob        = "job"
+	resourceAgent      = "agent"
+	resourceUser       = "user"
 )
 
 func extractIDasU32(r *http.Request) (uint32, error) {
@@ -23,3 +39,114 @@ func extractIDasU32(r *http.Request) (uint32, error) {
 
 	return uint32(p), nil
 }
+
+// extractBranch returns the branch name from the endpoint. The
+// router matches on the encoded path, so that a branch name with a
+// "/" can be sent as "%2F"; the name is unescaped here.
+func extractBranch(r *http.Request) (string, error) {
+	vars := mux.Vars(r)
+	branch, ok := vars["branch"]
+	if !ok {
+		return "", fmt.Errorf("Missing branch in endpoint")
+	}
+	branch, err := url.PathUnescape(branch)
+	if err != nil {
+		return "", fmt.Errorf("Invalid branch in endpoint")
+	}
+	return branch, nil
+}
+
+// extractPage reads the optional "offset" and "limit" query
+// parameters for a list request with total items, and returns the
+// bounds of the requested page within the list. If neither is
+// given, the page is the whole list. It also sets the X-Total-Count
+// header, so that clients can tell when they have seen every item.
+// On invalid values it writes a 400 response and returns false.
+func extractPage(w http.ResponseWriter, r *http.Request, total int) (int, int, bool) {
+	q := r.URL.Query()
+	start := 0
+	end := total
+
+	if s := q.Get("offset"); s != "" {
+		offset, err := strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'offset'"}`)
+			return 0, 0, false
+		}
+		start = offset
+		if start > total {
+			start = total
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'limit'"}`)
+			return 0, 0, false
+		}
+		// compared this way so that a huge limit can't overflow
+		if limit < end-start {
+			end = start + limit
+		}
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	return start, end, true
+}
+
+// extractBoolParam reads an optional true/false query parameter,
+// which is false if absent. On an invalid value it writes a 400
+// response and returns false as its second value.
+func extractBoolParam(w http.ResponseWriter, r *http.Request, name string) (bool, bool) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return false, true
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid value for '%s'"}`, name)
+		return false, false
+	}
+	return b, true
+}
+
+// getAllRepoPulls returns every repo pull on every registered
+// branch of every repo. The datastore has no way to list them
+// directly, so this walks repos, then branches, then pulls.
+func (env *Env) getAllRepoPulls() ([]*datastore.RepoPull, error) {
+	repos, err := env.db.GetAllRepos()
+	if err != nil {
+		return nil, err
+	}
+	rps := []*datastore.RepoPull{}
+	for _, repo := range repos {
+		branches, err := env.db.GetAllRepoBranchesForRepoID(repo.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, branch := range branches {
+			pulls, err := env.db.GetAllRepoPullsForRepoBranch(repo.ID, branch.Branch)
+			if err != nil {
+				return nil, err
+			}
+			rps = append(rps, pulls...)
+		}
+	}
+	return rps, nil
+}
+
+// getJobsForRepoPulls returns every job for the given repo pulls.
+func (env *Env) getJobsForRepoPulls(rps []*datastore.RepoPull) ([]*datastore.Job, error) {
+	jobs := []*datastore.Job{}
+	for _, rp := range rps {
+		rpJobs, err := env.db.GetAllJobsForRepoPull(rp.ID)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, rpJobs...)
+	}
+	return jobs, nil
+}
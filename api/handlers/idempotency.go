@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// defaultIdempotencyWindow is how long a POST response is kept
+// for replay, if IDEMPOTENCYWINDOW is not set.
+const defaultIdempotencyWindow = 24 * time.Hour
+
+// maxIdempotencyKeyLength is the longest Idempotency-Key header
+// value that will be accepted.
+const maxIdempotencyKeyLength = 255
+
+// idempotencyRecord is the stored outcome of a POST request that
+// was sent with an Idempotency-Key header.
+type idempotencyRecord struct {
+	// fingerprint identifies the request's method, path and body.
+	fingerprint [sha256.Size]byte
+	// done is false while the first request is still running.
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyStore holds the responses to recent POST requests,
+// keyed by user and Idempotency-Key. It is kept in memory only, so
+// keys are forgotten if the API server restarts.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	window  time.Duration
+	records map[string]*idempotencyRecord
+}
+
+// newIdempotencyStore creates an idempotencyStore that keeps
+// responses for the given length of time.
+func newIdempotencyStore(window time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		window:  window,
+		records: map[string]*idempotencyRecord{},
+	}
+}
+
+// purgeExpired removes records whose window has passed. The
+// caller must hold the store's lock.
+func (s *idempotencyStore) purgeExpired(now time.Time) {
+	for k, rec := range s.records {
+		if rec.done && !now.Before(rec.expires) {
+			delete(s.records, k)
+		}
+	}
+}
+
+// recordingWriter passes a response through to the client while
+// keeping a copy of its status and body.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// idempotencyMiddleware makes POST requests safe to retry. If a
+// POST includes an Idempotency-Key header, the first response for
+// that user and key is stored, and an identical retry within the
+// store's window gets the same status and body back without the
+// request being run again. Reusing a key for a different request
+// is rejected with 422. Server errors (5xx) are not stored, so
+// that the request can be retried for real. It must run after
+// validateTokenMiddleware, so that the user is known.
+func (env *Env) idempotencyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != "POST" || key == "" {
+			next(w, r)
+			return
+		}
+
+		// keys are scoped to a user; if there isn't a valid one,
+		// let the handler reject the request as usual
+		user, ok := r.Context().Value(userContextKey(0)).(*datastore.User)
+		if !ok || user.ID == 0 {
+			next(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Idempotency-Key must be at most %d characters"}`, maxIdempotencyKeyLength)
+			return
+		}
+
+		// read the body so that we can fingerprint it, and then
+		// put it back for the handler
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Unable to read request body"}`)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.Sum256([]byte(r.Method + " " + r.URL.Path + "\n" + string(body)))
+
+		storeKey := fmt.Sprintf("%d:%s", user.ID, key)
+		store := env.idempotency
+		now := time.Now()
+
+		store.mu.Lock()
+		store.purgeExpired(now)
+		rec, ok := store.records[storeKey]
+		if ok {
+			store.mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case rec.fingerprint != fingerprint:
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				fmt.Fprintf(w, `{"error": "Idempotency-Key has already been used for a different request"}`)
+			case !rec.done:
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintf(w, `{"error": "A request with this Idempotency-Key is still in progress"}`)
+			default:
+				if rec.contentType != "" {
+					w.Header().Set("Content-Type", rec.contentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(rec.status)
+				w.Write(rec.body)
+			}
+			return
+		}
+		rec = &idempotencyRecord{fingerprint: fingerprint}
+		store.records[storeKey] = rec
+		store.mu.Unlock()
+
+		// first time for this key; run the request for real. If the
+		// handler panics (which net/http recovers from), forget the
+		// key, so that retries aren't told it is still in progress
+		defer func() {
+			if p := recover(); p != nil {
+				store.mu.Lock()
+				delete(store.records, storeKey)
+				store.mu.Unlock()
+				panic(p)
+			}
+		}()
+		rw := &recordingWriter{ResponseWriter: w}
+		next(rw, r)
+
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		if rw.status >= 500 {
+			delete(store.records, storeKey)
+			return
+		}
+		rec.done = true
+		rec.status = rw.status
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		rec.contentType = w.Header().Get("Content-Type")
+		rec.body = rw.body.Bytes()
+		rec.expires = time.Now().Add(store.window)
+	})
+}
@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	hu "github.com/swinslow/peridot-api/test/handlerutils"
+)
+
+// postWithIdempotencyKey sends a POST to /projects through the
+// idempotency middleware, for an existing test Env.
+func postWithIdempotencyKey(t *testing.T, env *Env, key string, bodystr string, ghUsername string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/projects", strings.NewReader(bodystr))
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	req = loginWithTestUser(t, req, env, ghUsername)
+	hu.ServeHandler(rec, req, env.idempotencyMiddleware(env.projectsHandler), "/projects")
+	return rec
+}
+
+func TestIdempotencyKeyReplaysFirstResponse(t *testing.T) {
+	env := getTestEnv()
+	body := `{"name": "prj4", "fullname": "project 4"}`
+
+	rec := postWithIdempotencyKey(t, env, "abc123", body, "operator")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 4}`)
+
+	rec = postWithIdempotencyKey(t, env, "abc123", body, "operator")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 4}`)
+	if rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected replayed header, got %q", rec.Header().Get("Idempotent-Replayed"))
+	}
+
+	// and verify only one project was created
+	projects, err := env.db.GetAllProjects()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(projects) != 4 {
+		t.Errorf("expected %d, got %d", 4, len(projects))
+	}
+}
+
+func TestIdempotencyKeyRejectsDifferentBody(t *testing.T) {
+	env := getTestEnv()
+
+	rec := postWithIdempotencyKey(t, env, "abc123", `{"name": "prj4", "fullname": "project 4"}`, "operator")
+	hu.ConfirmCreatedResponse(t, rec)
+
+	rec = postWithIdempotencyKey(t, env, "abc123", `{"name": "prj5", "fullname": "project 5"}`, "operator")
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected %d, got %d", http.StatusUnprocessableEntity, rec.Code)
+	}
+
+	// and verify the second project was not created
+	projects, err := env.db.GetAllProjects()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(projects) != 4 {
+		t.Errorf("expected %d, got %d", 4, len(projects))
+	}
+}
+
+func TestIdempotencyKeyIsScopedToUser(t *testing.T) {
+	env := getTestEnv()
+
+	rec := postWithIdempotencyKey(t, env, "abc123", `{"name": "prj4", "fullname": "project 4"}`, "operator")
+	hu.ConfirmCreatedResponse(t, rec)
+
+	// the same key from another user is a separate request
+	rec = postWithIdempotencyKey(t, env, "abc123", `{"name": "prj5", "fullname": "project 5"}`, "admin")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 5}`)
+}
+
+func TestIdempotencyKeyDoesNotReplayWithoutKey(t *testing.T) {
+	env := getTestEnv()
+	body := `{"name": "prj4", "fullname": "project 4"}`
+
+	rec := postWithIdempotencyKey(t, env, "", body, "operator")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 4}`)
+
+	// without a key, the request is run again and fails as a
+	// duplicate project name
+	rec = postWithIdempotencyKey(t, env, "", body, "operator")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+}
+
+func TestIdempotencyKeyExpiresAfterWindow(t *testing.T) {
+	env := getTestEnv()
+	env.idempotency = newIdempotencyStore(0)
+	body := `{"name": "prj4", "fullname": "project 4"}`
+
+	rec := postWithIdempotencyKey(t, env, "abc123", body, "operator")
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 4}`)
+
+	// once expired, the request is run again and fails as a
+	// duplicate project name
+	rec = postWithIdempotencyKey(t, env, "abc123", body, "operator")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+	if rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected no replayed header, got %q", rec.Header().Get("Idempotent-Replayed"))
+	}
+}
+
+func TestIdempotencyKeyIsForgottenWhenHandlerPanics(t *testing.T) {
+	env := getTestEnv()
+	panics := true
+	handler := env.idempotencyMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if panics {
+			panic("handler failed")
+		}
+		env.projectsHandler(w, r)
+	})
+	post := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/projects", strings.NewReader(`{"name": "prj4", "fullname": "project 4"}`))
+		if err != nil {
+			t.Fatalf("got non-nil error: %v", err)
+		}
+		req.Header.Set("Idempotency-Key", "abc123")
+		req = loginWithTestUser(t, req, env, "operator")
+		hu.ServeHandler(rec, req, handler, "/projects")
+		return rec
+	}
+
+	func() {
+		defer func() {
+			if p := recover(); p == nil {
+				t.Errorf("expected the handler's panic to be passed on")
+			}
+		}()
+		post()
+	}()
+
+	// a retry runs the request, rather than finding it in progress
+	panics = false
+	rec := post()
+	hu.ConfirmCreatedResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"id": 4}`)
+}
@@ -0,0 +1,498 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// defaultDeleteConfirmThreshold is how many other resources a
+// deletion may remove or change before it must be confirmed, if
+// DELETECONFIRMTHRESHOLD is not set.
+const defaultDeleteConfirmThreshold = 50
+
+// impactIDs lists resources of one type, by ID.
+type impactIDs struct {
+	Count int      `json:"count"`
+	IDs   []uint32 `json:"ids"`
+}
+
+// impactBranches lists branches, which have no ID of their own.
+type impactBranches struct {
+	Count    int                     `json:"count"`
+	Branches []*datastore.RepoBranch `json:"branches"`
+}
+
+// impactRemoved lists the resources that a deletion would remove,
+// or move to the trash, along with the resource being deleted. Types
+// with none are left out.
+type impactRemoved struct {
+	// Projects is only used when purging the whole trash.
+	Projects    *impactIDs      `json:"projects,omitempty"`
+	Subprojects *impactIDs      `json:"subprojects,omitempty"`
+	Repos       *impactIDs      `json:"repos,omitempty"`
+	Branches    *impactBranches `json:"branches,omitempty"`
+	RepoPulls   *impactIDs      `json:"repopulls,omitempty"`
+	Jobs        *impactIDs      `json:"jobs,omitempty"`
+}
+
+// impactAltered lists the resources that a deletion would change
+// without removing them: jobs that would silently lose a prior job,
+// or a config that refers to one, because the datastore cascades
+// deleted jobs out of them.
+type impactAltered struct {
+	Jobs *impactIDs `json:"jobs,omitempty"`
+}
+
+// deletionImpact describes what deleting a resource would remove or
+// change along with it.
+type deletionImpact struct {
+	DryRun   bool   `json:"dry_run"`
+	Resource string `json:"resource"`
+	ID       uint32 `json:"id,omitempty"`
+	// RepoID and Branch identify a branch being deleted.
+	RepoID uint32 `json:"repo_id,omitempty"`
+	Branch string `json:"branch,omitempty"`
+	// Trashed is set instead of Removed for a project, subproject
+	// or repo that would be moved to the trash, since what is below
+	// it is only removed if it is purged.
+	Trashed *impactRemoved `json:"trashed,omitempty"`
+	Removed impactRemoved  `json:"removed"`
+	Altered impactAltered  `json:"altered"`
+	// Total counts everything in Trashed, Removed and Altered.
+	Total int `json:"total"`
+	// ConfirmRequired says whether the deletion must be sent with
+	// ?confirm=<Confirm>, because Total is over the threshold.
+	ConfirmRequired bool   `json:"confirm_required"`
+	Confirm         string `json:"confirm,omitempty"`
+}
+
+// impactBuilder collects the resources that a deletion would reach.
+type impactBuilder struct {
+	env         *Env
+	projects    map[uint32]bool
+	subprojects map[uint32]bool
+	repos       map[uint32]bool
+	branches    map[datastore.RepoBranch]bool
+	repoPulls   map[uint32]bool
+	jobs        map[uint32]bool
+
+	// scanned are the jobs looked at, to find those that refer to
+	// removed jobs: the jobs of each repo pull reached
+	scanned []*datastore.Job
+}
+
+func newImpactBuilder(env *Env) *impactBuilder {
+	return &impactBuilder{
+		env:         env,
+		projects:    map[uint32]bool{},
+		subprojects: map[uint32]bool{},
+		repos:       map[uint32]bool{},
+		branches:    map[datastore.RepoBranch]bool{},
+		repoPulls:   map[uint32]bool{},
+		jobs:        map[uint32]bool{},
+	}
+}
+
+// addProject adds everything below a project.
+func (ib *impactBuilder) addProject(id uint32) error {
+	sps, err := ib.env.db.GetAllSubprojectsForProjectID(id)
+	if err != nil {
+		return err
+	}
+	for _, sp := range sps {
+		ib.subprojects[sp.ID] = true
+		if err := ib.addSubproject(sp.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addSubproject adds everything below a subproject.
+func (ib *impactBuilder) addSubproject(id uint32) error {
+	repos, err := ib.env.db.GetAllReposForSubprojectID(id)
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		ib.repos[repo.ID] = true
+		if err := ib.addRepo(repo.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addRepo adds everything below a repo.
+func (ib *impactBuilder) addRepo(id uint32) error {
+	rbs, err := ib.env.db.GetAllRepoBranchesForRepoID(id)
+	if err != nil {
+		return err
+	}
+	for _, rb := range rbs {
+		ib.branches[*rb] = true
+		if err := ib.addBranch(id, rb.Branch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addAgent adds the jobs run by an agent. The datastore can't list
+// them directly, so this is the one case that looks through every
+// repo pull.
+func (ib *impactBuilder) addAgent(id uint32) error {
+	rps, err := ib.env.getAllRepoPulls()
+	if err != nil {
+		return err
+	}
+	for _, rp := range rps {
+		jobs, err := ib.env.db.GetAllJobsForRepoPull(rp.ID)
+		if err != nil {
+			return err
+		}
+		mine := false
+		for _, job := range jobs {
+			if job.AgentID == id {
+				ib.jobs[job.ID] = true
+				mine = true
+			}
+		}
+		// only the agent's own repo pulls can have jobs that refer
+		// to its jobs
+		if mine {
+			ib.scanned = append(ib.scanned, jobs...)
+		}
+	}
+	return nil
+}
+
+// addBranch adds everything below a branch.
+func (ib *impactBuilder) addBranch(repoID uint32, branch string) error {
+	rps, err := ib.env.db.GetAllRepoPullsForRepoBranch(repoID, branch)
+	if err != nil {
+		return err
+	}
+	for _, rp := range rps {
+		ib.repoPulls[rp.ID] = true
+		if err := ib.addRepoPull(rp.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addRepoPull adds everything below a repo pull.
+func (ib *impactBuilder) addRepoPull(id uint32) error {
+	jobs, err := ib.scanRepoPull(id)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		ib.jobs[job.ID] = true
+	}
+	return nil
+}
+
+// scanRepoPull reads a repo pull's jobs, so that those that refer
+// to removed jobs are found, without adding them.
+func (ib *impactBuilder) scanRepoPull(id uint32) ([]*datastore.Job, error) {
+	jobs, err := ib.env.db.GetAllJobsForRepoPull(id)
+	if err != nil {
+		return nil, err
+	}
+	ib.scanned = append(ib.scanned, jobs...)
+	return jobs, nil
+}
+
+// build works out which of the scanned jobs refer to the removed
+// jobs, and returns the impact of deleting the given resource.
+// deleted is the job being deleted, if any, which is not itself
+// listed.
+func (ib *impactBuilder) build(resource string, id uint32, deleted uint32) *deletionImpact {
+	di := &deletionImpact{Resource: resource, ID: id}
+
+	altered := []uint32{}
+	gone := func(jobID uint32) bool {
+		return jobID == deleted || ib.jobs[jobID]
+	}
+	seen := map[uint32]bool{}
+	for _, job := range ib.scanned {
+		if gone(job.ID) || seen[job.ID] {
+			continue
+		}
+		seen[job.ID] = true
+		if refersToJob(job, gone) {
+			altered = append(altered, job.ID)
+		}
+	}
+
+	di.Removed.Projects = impactIDsFromSet(ib.projects)
+	di.Removed.Subprojects = impactIDsFromSet(ib.subprojects)
+	di.Removed.Repos = impactIDsFromSet(ib.repos)
+	di.Removed.RepoPulls = impactIDsFromSet(ib.repoPulls)
+	di.Removed.Jobs = impactIDsFromSet(ib.jobs)
+	if len(ib.branches) > 0 {
+		ibr := &impactBranches{Branches: []*datastore.RepoBranch{}}
+		for rb := range ib.branches {
+			rb := rb
+			ibr.Branches = append(ibr.Branches, &rb)
+		}
+		sort.Slice(ibr.Branches, func(i, j int) bool {
+			if ibr.Branches[i].RepoID != ibr.Branches[j].RepoID {
+				return ibr.Branches[i].RepoID < ibr.Branches[j].RepoID
+			}
+			return ibr.Branches[i].Branch < ibr.Branches[j].Branch
+		})
+		ibr.Count = len(ibr.Branches)
+		di.Removed.Branches = ibr
+	}
+	if len(altered) > 0 {
+		sortIDs(altered)
+		di.Altered.Jobs = &impactIDs{Count: len(altered), IDs: altered}
+	}
+
+	di.Total = len(ib.projects) + len(ib.subprojects) + len(ib.repos) + len(ib.branches) + len(ib.repoPulls) + len(ib.jobs) + len(altered)
+	return di
+}
+
+// impactIDsFromSet returns the sorted IDs in set, or nil if there
+// are none.
+func impactIDsFromSet(set map[uint32]bool) *impactIDs {
+	if len(set) == 0 {
+		return nil
+	}
+	ids := []uint32{}
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+	return &impactIDs{Count: len(ids), IDs: ids}
+}
+
+// refersToJob reports whether a job has a prior job, or a config
+// taken from a prior job, for which gone is true.
+func refersToJob(job *datastore.Job, gone func(uint32) bool) bool {
+	for _, id := range job.PriorJobIDs {
+		if gone(id) {
+			return true
+		}
+	}
+	for _, cfgs := range []map[string]datastore.JobPathConfig{job.Config.CodeReader, job.Config.SpdxReader} {
+		for _, jpc := range cfgs {
+			if jpc.PriorJobID != 0 && gone(jpc.PriorJobID) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deletionImpact works out what deleting the given resource would
+// remove or change along with it. For a branch, id is the repo's ID.
+// Deleting a project, subproject or repo moves it to the trash, so
+// what is below it is listed as trashed, unless purge is set. For
+// "trash", it is what purging everything in the trash would remove,
+// including the resources in the trash themselves.
+//
+// Only the jobs in the repo pulls that lose jobs are looked at for
+// jobs that would be changed, since a job's prior jobs are in its
+// own repo pull.
+func (env *Env) deletionImpact(resource string, id uint32, branch string, purge bool) (*deletionImpact, error) {
+	ib := newImpactBuilder(env)
+	var err error
+	var deletedJob uint32
+	switch resource {
+	case resourceProject:
+		if _, err = env.db.GetProjectByID(id); err == nil {
+			err = ib.addProject(id)
+		}
+	case resourceSubproject:
+		if _, err = env.db.GetSubprojectByID(id); err == nil {
+			err = ib.addSubproject(id)
+		}
+	case resourceRepo:
+		if _, err = env.db.GetRepoByID(id); err == nil {
+			err = ib.addRepo(id)
+		}
+	case resourceBranch:
+		err = ib.addBranch(id, branch)
+	case resourceRepoPull:
+		if _, err = env.db.GetRepoPullByID(id); err == nil {
+			err = ib.addRepoPull(id)
+		}
+	case resourceJob:
+		var job *datastore.Job
+		if job, err = env.db.GetJobByID(id); err == nil {
+			_, err = ib.scanRepoPull(job.RepoPullID)
+		}
+		deletedJob = id
+	case resourceAgent:
+		if _, err = env.db.GetAgentByID(id); err == nil {
+			err = ib.addAgent(id)
+		}
+	case "trash":
+		for _, e := range env.trash.list() {
+			switch e.Resource {
+			case resourceProject:
+				ib.projects[e.ID] = true
+				err = ib.addProject(e.ID)
+			case resourceSubproject:
+				ib.subprojects[e.ID] = true
+				err = ib.addSubproject(e.ID)
+			case resourceRepo:
+				ib.repos[e.ID] = true
+				err = ib.addRepo(e.ID)
+			}
+			if err != nil {
+				break
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown resource %q", resource)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	di := ib.build(resource, id, deletedJob)
+	switch resource {
+	case resourceBranch:
+		di.ID, di.RepoID, di.Branch = 0, id, branch
+	case resourceProject, resourceSubproject, resourceRepo:
+		if !purge {
+			trashed := di.Removed
+			di.Trashed, di.Removed = &trashed, impactRemoved{}
+		}
+	}
+	return di, nil
+}
+
+// branchesDeletionImpact works out what deleting several branches
+// at once would remove or change along with them. Unlike deleting
+// one branch, the branches themselves are listed as removed.
+func (env *Env) branchesDeletionImpact(rbs []*datastore.RepoBranch) (*deletionImpact, error) {
+	ib := newImpactBuilder(env)
+	for _, rb := range rbs {
+		ib.branches[*rb] = true
+		if err := ib.addBranch(rb.RepoID, rb.Branch); err != nil {
+			return nil, err
+		}
+	}
+	return ib.build("branches", 0, 0), nil
+}
+
+// deleteConfirmToken returns the token that confirms a deletion with
+// the given impact. It is derived from what would be removed and
+// changed, so it no longer matches if that changes.
+func (env *Env) deleteConfirmToken(di *deletionImpact) string {
+	js, _ := json.Marshal(struct {
+		Resource string         `json:"resource"`
+		ID       uint32         `json:"id"`
+		RepoID   uint32         `json:"repo_id"`
+		Branch   string         `json:"branch"`
+		Trashed  *impactRemoved `json:"trashed"`
+		Removed  impactRemoved  `json:"removed"`
+		Altered  impactAltered  `json:"altered"`
+	}{di.Resource, di.ID, di.RepoID, di.Branch, di.Trashed, di.Removed, di.Altered})
+	mac := hmac.New(sha256.New, []byte(env.jwtSecretKey))
+	mac.Write(js)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// checkDeletion handles ?dry_run and ?confirm for a DELETE request
+// of the given resource (see deletionImpact). For a dry run, it
+// writes what the deletion would remove or change and returns false.
+// Otherwise, if that is more than the threshold, the request must
+// have the matching ?confirm token; if not, it writes an error
+// response and returns false. If it returns true, the caller goes
+// ahead with the deletion.
+func (env *Env) checkDeletion(w http.ResponseWriter, r *http.Request, resource string, id uint32, branch string) bool {
+	return env.checkImpact(w, r, resource, id, branch, false)
+}
+
+// checkPurge is checkDeletion for purging a resource from the trash,
+// or everything in the trash if resource is "trash".
+func (env *Env) checkPurge(w http.ResponseWriter, r *http.Request, resource string, id uint32) bool {
+	return env.checkImpact(w, r, resource, id, "", true)
+}
+
+func (env *Env) checkImpact(w http.ResponseWriter, r *http.Request, resource string, id uint32, branch string, purge bool) bool {
+	dryRun := false
+	if s := r.URL.Query().Get("dry_run"); s != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for 'dry_run'"}`)
+			return false
+		}
+	}
+
+	di, err := env.deletionImpact(resource, id, branch, purge)
+	if err != nil {
+		// the caller deals with unknown resources when actually
+		// deleting
+		if !dryRun {
+			return true
+		}
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error": "Unknown %s ID"}`, resource)
+		return false
+	}
+	env.setDeletionConfirm(di, dryRun)
+
+	if dryRun {
+		js, err := json.Marshal(di)
+		if err != nil {
+			fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+			return false
+		}
+		w.Write(js)
+		return false
+	}
+	return env.confirmDeletion(w, r, di)
+}
+
+// setDeletionConfirm records whether a deletion with the given
+// impact must be confirmed, and for a dry run, the token to confirm
+// it with.
+func (env *Env) setDeletionConfirm(di *deletionImpact, dryRun bool) {
+	di.DryRun = dryRun
+	di.ConfirmRequired = di.Total > env.deleteConfirmThreshold
+	if dryRun && di.ConfirmRequired {
+		di.Confirm = env.deleteConfirmToken(di)
+	}
+}
+
+// confirmDeletion checks that a deletion whose impact must be
+// confirmed was sent with the matching ?confirm token. If not, it
+// writes an error response and returns false.
+func (env *Env) confirmDeletion(w http.ResponseWriter, r *http.Request, di *deletionImpact) bool {
+	if !di.ConfirmRequired {
+		return true
+	}
+	token := env.deleteConfirmToken(di)
+	confirm := r.URL.Query().Get("confirm")
+	if confirm == "" {
+		w.WriteHeader(http.StatusPreconditionRequired)
+		fmt.Fprintf(w, `{"error": "This would remove or change %d other resources; check them with ?dry_run=true, then send its confirm token with ?confirm=", "total": %d}`, di.Total, di.Total)
+		return false
+	}
+	if !hmac.Equal([]byte(confirm), []byte(token)) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": "The confirm token does not match what this would now remove or change; check again with ?dry_run=true", "total": %d}`, di.Total)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	hu "github.com/swinslow/peridot-api/test/handlerutils"
+)
+
+// dryRunConfirm returns the confirm token from a dry run of a
+// deletion.
+func dryRunConfirm(t *testing.T, env *Env, endpoint string, hf http.HandlerFunc, path string) string {
+	rec := serveTestRequest(t, env, "DELETE", endpoint+"?dry_run=true", ``, "admin", hf, path)
+	hu.ConfirmOKResponse(t, rec)
+	var di deletionImpact
+	if err := json.Unmarshal(rec.Body.Bytes(), &di); err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	if !di.ConfirmRequired || di.Confirm == "" {
+		t.Fatalf("expected confirm token, got %#v", di)
+	}
+	return di.Confirm
+}
+
+// ===== dry runs =====
+
+func TestCanDryRunRepoDelete(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "DELETE", "/repos/2?dry_run=true", ``, "admin", env.reposOneHandler, "/repos/{id}")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"dry_run": true, "resource": "repo", "id": 2, "trashed": {
+		"branches": {"count": 3, "branches": [{"repo_id": 2, "branch": "alpha"}, {"repo_id": 2, "branch": "beta"}, {"repo_id": 2, "branch": "master"}]},
+		"repopulls": {"count": 2, "ids": [1, 2]},
+		"jobs": {"count": 6, "ids": [1, 2, 5, 6, 7, 8]}
+	}, "removed": {}, "altered": {}, "total": 11, "confirm_required": false}`)
+
+	// and the repo is left alone
+	if env.trash.has(resourceRepo, 2) {
+		t.Errorf("expected repo 2 not to be in the trash")
+	}
+	rec = serveTestRequest(t, env, "GET", "/repos/2", ``, "viewer", env.hideTrashed(resourceRepo, env.reposOneHandler), "/repos/{id}")
+	hu.ConfirmOKResponse(t, rec)
+}
+
+func TestDryRunPurgeListsRemovedResources(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "DELETE", "/repos/2", ``, "admin", env.reposOneHandler, "/repos/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	// once it is in the trash, purging it removes what is below it
+	rec = serveTestRequest(t, env, "DELETE", "/trash/repos/2?dry_run=true", ``, "admin", env.trashOneHandler, "/trash/{resource}/{id}")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"dry_run": true, "resource": "repo", "id": 2, "removed": {
+		"branches": {"count": 3, "branches": [{"repo_id": 2, "branch": "alpha"}, {"repo_id": 2, "branch": "beta"}, {"repo_id": 2, "branch": "master"}]},
+		"repopulls": {"count": 2, "ids": [1, 2]},
+		"jobs": {"count": 6, "ids": [1, 2, 5, 6, 7, 8]}
+	}, "altered": {}, "total": 11, "confirm_required": false}`)
+}
+
+func TestDryRunJobDeleteListsJobsThatLosePriorJob(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "DELETE", "/jobs/5?dry_run=true", ``, "admin", env.jobsOneHandler, "/jobs/{id}")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"dry_run": true, "resource": "job", "id": 5, "removed": {}, "altered": {"jobs": {"count": 2, "ids": [6, 8]}}, "total": 2, "confirm_required": false}`)
+
+	rec = serveTestRequest(t, env, "GET", "/jobs/5", ``, "viewer", env.jobsOneHandler, "/jobs/{id}")
+	hu.ConfirmOKResponse(t, rec)
+}
+
+func TestDryRunAgentDeleteListsItsJobs(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "DELETE", "/agents/1?dry_run=true", ``, "admin", env.agentsOneHandler, "/agents/{id}")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"dry_run": true, "resource": "agent", "id": 1, "removed": {"jobs": {"count": 2, "ids": [5, 6]}}, "altered": {"jobs": {"count": 1, "ids": [8]}}, "total": 3, "confirm_required": false}`)
+}
+
+func TestDryRunBranchDelete(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "DELETE", "/repos/2/branches/alpha?dry_run=true", ``, "admin", env.repoPullsSubHandler, "/repos/{id}/branches/{branch}")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"dry_run": true, "resource": "branch", "repo_id": 2, "branch": "alpha", "removed": {}, "altered": {}, "total": 0, "confirm_required": false}`)
+}
+
+func TestDryRunTrashPurgeListsTrashedResources(t *testing.T) {
+	env := getTestEnv()
+	trashProject3(t, env)
+
+	rec := serveTestRequest(t, env, "DELETE", "/trash?dry_run=true", ``, "admin", env.trashHandler, "/trash")
+	hu.ConfirmOKResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"dry_run": true, "resource": "trash", "removed": {"projects": {"count": 1, "ids": [3]}, "subprojects": {"count": 1, "ids": [1]}}, "altered": {}, "total": 2, "confirm_required": false}`)
+	if !env.trash.has(resourceProject, 3) {
+		t.Errorf("expected project 3 to still be in the trash")
+	}
+}
+
+func TestCannotDryRunDeleteWithInvalidValue(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "DELETE", "/jobs/5?dry_run=maybe", ``, "admin", env.jobsOneHandler, "/jobs/{id}")
+	hu.ConfirmBadRequestResponse(t, rec)
+	hu.CheckResponse(t, rec, `{"error": "Invalid value for 'dry_run'"}`)
+}
+
+func TestCannotDryRunDeleteUnknownResource(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "DELETE", "/agents/413?dry_run=true", ``, "admin", env.agentsOneHandler, "/agents/{id}")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "Unknown agent ID"}`)
+}
+
+func TestCannotDryRunDeleteAsOperator(t *testing.T) {
+	env := getTestEnv()
+	rec := serveTestRequest(t, env, "DELETE", "/repos/2?dry_run=true", ``, "operator", env.reposOneHandler, "/repos/{id}")
+	hu.ConfirmAccessDenied(t, rec)
+}
+
+// ===== confirming large deletions =====
+
+func TestLargeDeletionRequiresConfirm(t *testing.T) {
+	env := getTestEnv()
+	env.deleteConfirmThreshold = 5
+
+	rec := serveTestRequest(t, env, "DELETE", "/repos/2", ``, "admin", env.reposOneHandler, "/repos/{id}")
+	if rec.Code != http.StatusPreconditionRequired {
+		t.Errorf("expected %d, got %d", http.StatusPreconditionRequired, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "This would remove or change 11 other resources; check them with ?dry_run=true, then send its confirm token with ?confirm=", "total": 11}`)
+	if env.trash.has(resourceRepo, 2) {
+		t.Errorf("expected repo 2 not to be in the trash")
+	}
+
+	rec = serveTestRequest(t, env, "DELETE", "/repos/2?confirm=abc123", ``, "admin", env.reposOneHandler, "/repos/{id}")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected %d, got %d", http.StatusConflict, rec.Code)
+	}
+	hu.CheckResponse(t, rec, `{"error": "The confirm token does not match what this would now remove or change; check again with ?dry_run=true", "total": 11}`)
+
+	confirm := dryRunConfirm(t, env, "/repos/2", env.reposOneHandler, "/repos/{id}")
+	rec = serveTestRequest(t, env, "DELETE", "/repos/2?confirm="+confirm, ``, "admin", env.reposOneHandler, "/repos/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+	if !env.trash.has(resourceRepo, 2) {
+		t.Errorf("expected repo 2 to be in the trash")
+	}
+}
+
+func TestSmallDeletionDoesNotRequireConfirm(t *testing.T) {
+	env := getTestEnv()
+	env.deleteConfirmThreshold = 5
+
+	rec := serveTestRequest(t, env, "DELETE", "/agents/1", ``, "admin", env.agentsOneHandler, "/agents/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+}
+
+func TestConfirmTokenNoLongerMatchesWhenImpactChanges(t *testing.T) {
+	env := getTestEnv()
+	env.deleteConfirmThreshold = 5
+
+	confirm := dryRunConfirm(t, env, "/repos/2", env.reposOneHandler, "/repos/{id}")
+
+	// one of the repo's jobs is deleted in the meantime
+	rec := serveTestRequest(t, env, "DELETE", "/jobs/7", ``, "admin", env.jobsOneHandler, "/jobs/{id}")
+	hu.ConfirmNoContentResponse(t, rec)
+
+	rec = serveTestRequest(t, env, "DELETE", "/repos/2?confirm="+confirm, ``, "admin", env.reposOneHandler, "/repos/{id}")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected %d, got %d", http.StatusConflict, rec.Code)
+	}
+	if env.trash.has(resourceRepo, 2) {
+		t.Errorf("expected repo 2 not to be in the trash")
+	}
+}
@@ -0,0 +1,317 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// maxLabels is the most labels that one resource can have.
+const maxLabels = 64
+
+// Label keys and values are up to 63 letters, digits, "-", "_" and
+// ".", starting and ending with a letter or digit; keys may also
+// contain "/", e.g. "example.com/team". Values may be empty.
+var (
+	labelKeyRegexp   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]{0,61}[A-Za-z0-9])?$`)
+	labelValueRegexp = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9._-]{0,61}[A-Za-z0-9])?)?$`)
+)
+
+// checkLabel returns an error if key or value is not valid for a
+// label.
+func checkLabel(key string, value string) error {
+	if !labelKeyRegexp.MatchString(key) {
+		return fmt.Errorf("invalid label key %q", key)
+	}
+	if !labelValueRegexp.MatchString(value) {
+		return fmt.Errorf("invalid value %q for label %q", value, key)
+	}
+	return nil
+}
+
+// checkLabels returns an error if any of the labels is not valid,
+// or if there are too many of them.
+func checkLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("at most %d labels are allowed", maxLabels)
+	}
+	for key, value := range labels {
+		if err := checkLabel(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type labelKey struct {
+	resource string
+	id       uint32
+}
+
+// labelState is the part of the label store that is saved to
+// APISTATEDIR. Labels are keyed by "<resource>/<id>".
+type labelState struct {
+	Labels map[string]map[string]string `json:"labels"`
+}
+
+// labelStore holds the labels on projects, subprojects and repos.
+// They are kept by the API rather than the datastore, which has no
+// place for them.
+type labelStore struct {
+	mu       sync.Mutex
+	stateDir string
+	labels   map[labelKey]map[string]string
+}
+
+// newLabelStore creates a label store, loading any saved labels
+// from stateDir.
+func newLabelStore(stateDir string) (*labelStore, error) {
+	ls := &labelStore{stateDir: stateDir, labels: map[labelKey]map[string]string{}}
+	var st labelState
+	if err := loadState(stateDir, "labels", &st); err != nil {
+		return nil, err
+	}
+	for k, labels := range st.Labels {
+		i := strings.LastIndex(k, "/")
+		if i < 0 {
+			continue
+		}
+		id, err := strconv.ParseUint(k[i+1:], 10, 32)
+		if err != nil {
+			continue
+		}
+		ls.labels[labelKey{k[:i], uint32(id)}] = labels
+	}
+	return ls, nil
+}
+
+// save writes the store's state to its state directory, if any.
+// The caller must hold ls.mu.
+func (ls *labelStore) save() {
+	st := &labelState{Labels: map[string]map[string]string{}}
+	for k, labels := range ls.labels {
+		st.Labels[fmt.Sprintf("%s/%d", k.resource, k.id)] = labels
+	}
+	if err := saveState(ls.stateDir, "labels", st); err != nil {
+		log.Printf("error saving labels: %v", err)
+	}
+}
+
+// get returns a copy of a resource's labels, which is empty if it
+// has none.
+func (ls *labelStore) get(resource string, id uint32) map[string]string {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	labels := map[string]string{}
+	for k, v := range ls.labels[labelKey{resource, id}] {
+		labels[k] = v
+	}
+	return labels
+}
+
+// set replaces a resource's labels.
+func (ls *labelStore) set(resource string, id uint32, labels map[string]string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if len(labels) == 0 {
+		delete(ls.labels, labelKey{resource, id})
+	} else {
+		ls.labels[labelKey{resource, id}] = labels
+	}
+	ls.save()
+}
+
+// remove deletes a resource's labels, and returns whether it had
+// any.
+func (ls *labelStore) remove(resource string, id uint32) bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if _, ok := ls.labels[labelKey{resource, id}]; !ok {
+		return false
+	}
+	delete(ls.labels, labelKey{resource, id})
+	ls.save()
+	return true
+}
+
+// removeMissing deletes the labels of resources for which exists
+// returns false.
+func (ls *labelStore) removeMissing(exists func(resource string, id uint32) bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	changed := false
+	for k := range ls.labels {
+		if !exists(k.resource, k.id) {
+			delete(ls.labels, k)
+			changed = true
+		}
+	}
+	if changed {
+		ls.save()
+	}
+}
+
+// handleEvent drops the labels of resources that are deleted. It
+// is called from the event bus.
+func (ls *labelStore) handleEvent(ev *event) {
+	switch ev.Type {
+	case EventProjectDeleted, EventSubprojectDeleted, EventRepoDeleted:
+		data, ok := ev.Data.(map[string]interface{})
+		if !ok {
+			return
+		}
+		switch obj := data[strings.TrimSuffix(ev.Type, ".deleted")].(type) {
+		case *datastore.Project:
+			ls.remove(resourceProject, obj.ID)
+		case *datastore.Subproject:
+			ls.remove(resourceSubproject, obj.ID)
+		case *datastore.Repo:
+			ls.remove(resourceRepo, obj.ID)
+		}
+	case EventDatabaseReset:
+		ls.mu.Lock()
+		defer ls.mu.Unlock()
+		ls.labels = map[labelKey]map[string]string{}
+		ls.save()
+	}
+}
+
+// labelRequirement is one part of a label selector.
+type labelRequirement struct {
+	key string
+	// op is "=", "!=", "exists" or "!exists"
+	op    string
+	value string
+}
+
+// labelSelector selects resources whose labels meet all of its
+// requirements.
+type labelSelector []*labelRequirement
+
+// parseLabelSelector parses a comma-separated list of requirements:
+// "key=value" (or "key==value"), "key!=value", "key" for having the
+// label at all, and "!key" for not having it.
+func parseLabelSelector(s string) (labelSelector, error) {
+	sel := labelSelector{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		req := &labelRequirement{}
+		switch {
+		case strings.HasPrefix(part, "!"):
+			req.key, req.op = strings.TrimSpace(part[1:]), "!exists"
+		case strings.Contains(part, "!="):
+			i := strings.Index(part, "!=")
+			req.key, req.op, req.value = part[:i], "!=", part[i+2:]
+		case strings.Contains(part, "=="):
+			i := strings.Index(part, "==")
+			req.key, req.op, req.value = part[:i], "=", part[i+2:]
+		case strings.Contains(part, "="):
+			i := strings.Index(part, "=")
+			req.key, req.op, req.value = part[:i], "=", part[i+1:]
+		default:
+			req.key, req.op = part, "exists"
+		}
+		req.key, req.value = strings.TrimSpace(req.key), strings.TrimSpace(req.value)
+		if err := checkLabel(req.key, req.value); err != nil {
+			return nil, err
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+// matches reports whether labels meet all of the selector's
+// requirements. A label that is missing does not equal any value.
+func (sel labelSelector) matches(labels map[string]string) bool {
+	for _, req := range sel {
+		value, ok := labels[req.key]
+		switch req.op {
+		case "=":
+			if !ok || value != req.value {
+				return false
+			}
+		case "!=":
+			if ok && value == req.value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// extractLabelSelector gets the label selector from a list
+// request's "label" query parameters, which are combined if there
+// are several. It returns an empty selector if there are none. If
+// one is invalid, it writes an error response and returns false.
+func extractLabelSelector(w http.ResponseWriter, r *http.Request) (labelSelector, bool) {
+	sel := labelSelector{}
+	for _, s := range r.URL.Query()["label"] {
+		reqs, err := parseLabelSelector(s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": %q}`, fmt.Sprintf("Invalid value for 'label'; %v", err))
+			return nil, false
+		}
+		sel = append(sel, reqs...)
+	}
+	return sel, true
+}
+
+// labelledProjects returns the projects whose labels match sel.
+func (env *Env) labelledProjects(projects []*datastore.Project, sel labelSelector) []*datastore.Project {
+	if len(sel) == 0 {
+		return projects
+	}
+	matching := []*datastore.Project{}
+	for _, p := range projects {
+		if sel.matches(env.labels.get(resourceProject, p.ID)) {
+			matching = append(matching, p)
+		}
+	}
+	return matching
+}
+
+// labelledSubprojects returns the subprojects whose labels match
+// sel.
+func (env *Env) labelledSubprojects(subprojects []*datastore.Subproject, sel labelSelector) []*datastore.Subproject {
+	if len(sel) == 0 {
+		return subprojects
+	}
+	matching := []*datastore.Subproject{}
+	for _, sp := range subprojects {
+		if sel.matches(env.labels.get(resourceSubproject, sp.ID)) {
+			matching = append(matching, sp)
+		}
+	}
+	return matching
+}
+
+// labelledRepos returns the repos whose labels match sel.
+func (env *Env) labelledRepos(repos []*datastore.Repo, sel labelSelector) []*datastore.Repo {
+	if len(sel) == 0 {
+		return repos
+	}
+	matching := []*datastore.Repo{}
+	for _, repo := range repos {
+		if sel.matches(env.labels.get(resourceRepo, repo.ID)) {
+			matching = append(matching, repo)
+		}
+	}
+	return matching
+}
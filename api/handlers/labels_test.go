@@ -0,0 +1,46 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"testing"
+)
+
+func TestLabelSelectorMatches(t *testing.T) {
+	labels := map[string]string{"team": "infra", "tier": "high", "example.com/train": ""}
+	for _, tc := range []struct {
+		sel  string
+		want bool
+	}{
+		{"team=infra", true},
+		{"team==infra", true},
+		{"team=web", false},
+		{"team!=web", true},
+		{"team!=infra", false},
+		{"owner!=me", true},
+		{"tier", true},
+		{"owner", false},
+		{"!owner", true},
+		{"!tier", false},
+		{"example.com/train=", true},
+		{"team=infra, tier=high", true},
+		{"team=infra,tier=low", false},
+	} {
+		sel, err := parseLabelSelector(tc.sel)
+		if err != nil {
+			t.Errorf("%q: expected nil error, got %v", tc.sel, err)
+			continue
+		}
+		if got := sel.matches(labels); got != tc.want {
+			t.Errorf("%q: expected %v, got %v", tc.sel, tc.want, got)
+		}
+	}
+}
+
+func TestCannotParseInvalidLabelSelector(t *testing.T) {
+	for _, s := range []string{"", "team=infra,", "=infra", "team=a=b", "!", "-team", "team!=-x"} {
+		if _, err := parseLabelSelector(s); err == nil {
+			t.Errorf("%q: expected non-nil error, got nil", s)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"sync"
+)
+
+type resourceLockKey struct {
+	resource string
+	id       uint32
+}
+
+// resourceLock is the lock for one resource, with a count of the
+// requests holding or waiting for it.
+type resourceLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// resourceLocks serializes the requests that change a resource, so
+// that checking its current version (for If-Match) and changing it
+// happen as one step: two requests with the same ETag cannot both
+// pass the check before either has written. Changes made directly in
+// the datastore, outside the API, do not take these locks.
+type resourceLocks struct {
+	mu    sync.Mutex
+	locks map[resourceLockKey]*resourceLock
+}
+
+func newResourceLocks() *resourceLocks {
+	return &resourceLocks{locks: map[resourceLockKey]*resourceLock{}}
+}
+
+// lock waits for and takes the lock on a resource, returning a
+// function to release it.
+func (rl *resourceLocks) lock(resource string, id uint32) func() {
+	key := resourceLockKey{resource, id}
+	rl.mu.Lock()
+	l, ok := rl.locks[key]
+	if !ok {
+		l = &resourceLock{}
+		rl.locks[key] = l
+	}
+	l.refs++
+	rl.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		rl.mu.Lock()
+		// forget the lock once nothing holds or waits for it
+		l.refs--
+		if l.refs == 0 {
+			delete(rl.locks, key)
+		}
+		rl.mu.Unlock()
+	}
+}
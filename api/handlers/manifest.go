@@ -0,0 +1,614 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// manifestVersion is the version of the manifest format that is
+// exported and accepted.
+const manifestVersion = 1
+
+// manifest is a declarative definition of a project and everything
+// in it, along with the agents that work on it. Resources are
+// identified by name, not ID, so that a manifest can be kept in
+// version control and applied to any peridot instance.
+type manifest struct {
+	Version int              `json:"version" yaml:"version"`
+	Project *manifestProject `json:"project" yaml:"project"`
+	Agents  []*manifestAgent `json:"agents,omitempty" yaml:"agents,omitempty"`
+	// Prune deletes branches that are not in the manifest. It is
+	// off by default, since deleting a branch deletes its repo
+	// pulls too, and they can't be restored.
+	Prune bool `json:"prune,omitempty" yaml:"prune,omitempty"`
+}
+
+type manifestProject struct {
+	Name        string                `json:"name" yaml:"name"`
+	Fullname    string                `json:"fullname" yaml:"fullname"`
+	Subprojects []*manifestSubproject `json:"subprojects,omitempty" yaml:"subprojects,omitempty"`
+}
+
+type manifestSubproject struct {
+	Name     string          `json:"name" yaml:"name"`
+	Fullname string          `json:"fullname" yaml:"fullname"`
+	Repos    []*manifestRepo `json:"repos,omitempty" yaml:"repos,omitempty"`
+}
+
+type manifestRepo struct {
+	Name     string   `json:"name" yaml:"name"`
+	Address  string   `json:"address" yaml:"address"`
+	Branches []string `json:"branches,omitempty" yaml:"branches,omitempty"`
+}
+
+// manifestAgent is an agent's definition. Whether it is active is
+// up to the controller, so it is not part of the manifest.
+type manifestAgent struct {
+	Name         string `json:"name" yaml:"name"`
+	Address      string `json:"address" yaml:"address"`
+	Port         int    `json:"port" yaml:"port"`
+	IsCodeReader bool   `json:"is_codereader" yaml:"is_codereader"`
+	IsSpdxReader bool   `json:"is_spdxreader" yaml:"is_spdxreader"`
+	IsCodeWriter bool   `json:"is_codewriter" yaml:"is_codewriter"`
+	IsSpdxWriter bool   `json:"is_spdxwriter" yaml:"is_spdxwriter"`
+}
+
+// manifestAction is one change needed to make the datastore match
+// a manifest.
+type manifestAction struct {
+	// Action is "create", "update", "delete" or "restore".
+	// Deleting a subproject or repo moves it to the trash, and
+	// restoring takes it back out.
+	Action string `json:"action"`
+	// Resource is "project", "subproject", "repo", "branch"
+	// or "agent".
+	Resource string `json:"resource"`
+	// Path names the resource within the manifest, e.g.
+	// "prj/subprj/repo/master".
+	Path string `json:"path"`
+	// ID is the resource's ID, once it exists. Branches have none.
+	ID uint32 `json:"id,omitempty"`
+	// Fields lists what an update changes.
+	Fields []string `json:"fields,omitempty"`
+
+	// branch is the branch that a branch delete removes.
+	branch *datastore.RepoBranch
+
+	// run performs the action.
+	run func() error
+}
+
+// repoAddressConflict is returned by planManifest if a repo in the
+// manifest has the same address as a repo in another project.
+type repoAddressConflict struct {
+	path   string
+	repoID uint32
+}
+
+func (e *repoAddressConflict) Error() string {
+	return fmt.Sprintf("repo %s has the same address as repo %d", e.path, e.repoID)
+}
+
+// validate checks that a manifest is complete and that names are
+// not repeated where they are used to match resources. It also
+// normalizes repo addresses.
+func (m *manifest) validate() error {
+	if m.Version != manifestVersion {
+		return fmt.Errorf("unsupported version %d; must be %d", m.Version, manifestVersion)
+	}
+	if m.Project == nil || m.Project.Name == "" {
+		return fmt.Errorf("missing project name")
+	}
+
+	// repos are matched by name across the whole project, so that
+	// they can move between subprojects
+	spNames := map[string]bool{}
+	repoNames := map[string]bool{}
+	addresses := map[string]string{}
+	for i, msp := range m.Project.Subprojects {
+		if msp.Name == "" {
+			return fmt.Errorf("missing name for subproject %d", i)
+		}
+		if spNames[msp.Name] {
+			return fmt.Errorf("duplicate subproject name %q", msp.Name)
+		}
+		spNames[msp.Name] = true
+		for j, mr := range msp.Repos {
+			if mr.Name == "" {
+				return fmt.Errorf("missing name for repo %d in subproject %q", j, msp.Name)
+			}
+			if repoNames[mr.Name] {
+				return fmt.Errorf("duplicate repo name %q", mr.Name)
+			}
+			repoNames[mr.Name] = true
+			if mr.Address == "" {
+				return fmt.Errorf("missing address for repo %q", mr.Name)
+			}
+			ra, err := parseRepoAddress(mr.Address)
+			if err != nil {
+				return fmt.Errorf("invalid address for repo %q: %v", mr.Name, err)
+			}
+			if other, ok := addresses[ra.key()]; ok {
+				return fmt.Errorf("repos %q and %q have the same address", other, mr.Name)
+			}
+			addresses[ra.key()] = mr.Name
+			mr.Address = ra.String()
+			branches := map[string]bool{}
+			for _, b := range mr.Branches {
+				if err := checkBranchName(b); err != nil {
+					return fmt.Errorf("invalid branch name %q for repo %q: %v", b, mr.Name, err)
+				}
+				if branches[b] {
+					return fmt.Errorf("duplicate branch %q for repo %q", b, mr.Name)
+				}
+				branches[b] = true
+			}
+		}
+	}
+
+	agentNames := map[string]bool{}
+	for i, ma := range m.Agents {
+		if ma.Name == "" {
+			return fmt.Errorf("missing name for agent %d", i)
+		}
+		if agentNames[ma.Name] {
+			return fmt.Errorf("duplicate agent name %q", ma.Name)
+		}
+		agentNames[ma.Name] = true
+		if ma.Port < 0 || ma.Port > 65535 {
+			return fmt.Errorf("invalid port for agent %q", ma.Name)
+		}
+	}
+	return nil
+}
+
+// exportManifest builds the manifest for an existing project.
+func (env *Env) exportManifest(project *datastore.Project) (*manifest, error) {
+	tree, err := env.getProjectTree(project, treeDepthBranches, false)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{
+		Version: manifestVersion,
+		Project: &manifestProject{Name: project.Name, Fullname: project.Fullname},
+	}
+	for _, tsp := range tree.Subprojects {
+		msp := &manifestSubproject{Name: tsp.Name, Fullname: tsp.Fullname}
+		for _, tr := range tsp.Repos {
+			mr := &manifestRepo{Name: tr.Name, Address: tr.Address}
+			for _, tb := range tr.Branches {
+				mr.Branches = append(mr.Branches, tb.Branch)
+			}
+			msp.Repos = append(msp.Repos, mr)
+		}
+		m.Project.Subprojects = append(m.Project.Subprojects, msp)
+	}
+
+	agents, err := env.db.GetAllAgents()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range agents {
+		m.Agents = append(m.Agents, &manifestAgent{
+			Name:         a.Name,
+			Address:      a.Address,
+			Port:         a.Port,
+			IsCodeReader: a.IsCodeReader,
+			IsSpdxReader: a.IsSpdxReader,
+			IsCodeWriter: a.IsCodeWriter,
+			IsSpdxWriter: a.IsSpdxWriter,
+		})
+	}
+	return m, nil
+}
+
+// planManifest works out the actions needed to make the datastore
+// match a validated manifest. Creates and updates come first, in
+// the manifest's order; then deletes, children before parents.
+// Subprojects and repos in the project that are not in the manifest
+// are deleted, and so are branches if the manifest prunes them;
+// agents are never deleted, since they are shared between projects. Resources in the trash that are in
+// the manifest are restored, and those that are not are left
+// there. The returned function gives the project's ID once the
+// actions have been run. user is who the actions are run for.
+func (env *Env) planManifest(m *manifest, user *datastore.User) ([]*manifestAction, func() uint32, error) {
+	actions := []*manifestAction{}
+	branchDeletes := []*manifestAction{}
+	repoDeletes := []*manifestAction{}
+	spDeletes := []*manifestAction{}
+	mp := m.Project
+
+	projects, err := env.db.GetAllProjects()
+	if err != nil {
+		return nil, nil, err
+	}
+	var project *datastore.Project
+	for _, p := range projects {
+		if p.Name == mp.Name {
+			project = p
+			break
+		}
+	}
+
+	// the IDs of resources that do not exist yet are only known
+	// once they are created, so actions refer to these variables
+	var projectID uint32
+	existingSps := []*datastore.Subproject{}
+	existingRepos := []*datastore.Repo{}
+	if project == nil {
+		a := &manifestAction{Action: "create", Resource: resourceProject, Path: mp.Name}
+		a.run = func() error {
+			id, err := env.db.AddProject(mp.Name, mp.Fullname)
+			if err != nil {
+				return err
+			}
+			projectID, a.ID = id, id
+			env.events.publish(EventProjectCreated, map[string]interface{}{
+				"project": &datastore.Project{ID: id, Name: mp.Name, Fullname: mp.Fullname},
+			})
+			return nil
+		}
+		actions = append(actions, a)
+	} else {
+		projectID = project.ID
+		if env.trash.has(resourceProject, project.ID) {
+			actions = append(actions, env.manifestRestoreAction(resourceProject, mp.Name, project.ID, project))
+		}
+		if project.Fullname != mp.Fullname {
+			a := &manifestAction{Action: "update", Resource: resourceProject, Path: mp.Name, ID: project.ID, Fields: []string{"fullname"}}
+			a.run = func() error {
+				if err := env.db.UpdateProject(project.ID, mp.Name, mp.Fullname); err != nil {
+					return err
+				}
+				env.events.publish(EventProjectUpdated, map[string]interface{}{
+					"project": &datastore.Project{ID: project.ID, Name: mp.Name, Fullname: mp.Fullname},
+				})
+				return nil
+			}
+			actions = append(actions, a)
+		}
+		existingSps, err = env.db.GetAllSubprojectsForProjectID(project.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, sp := range existingSps {
+			repos, err := env.db.GetAllReposForSubprojectID(sp.ID)
+			if err != nil {
+				return nil, nil, err
+			}
+			existingRepos = append(existingRepos, repos...)
+		}
+	}
+
+	// repos in other projects must not have the same address as
+	// any in the manifest
+	allRepos, err := env.db.GetAllRepos()
+	if err != nil {
+		return nil, nil, err
+	}
+	inProject := map[uint32]bool{}
+	for _, er := range existingRepos {
+		inProject[er.ID] = true
+	}
+	otherAddresses := map[string]uint32{}
+	for _, repo := range allRepos {
+		if !inProject[repo.ID] {
+			otherAddresses[repoAddressKey(repo.Address)] = repo.ID
+		}
+	}
+
+	keptSps := map[uint32]bool{}
+	keptRepos := map[uint32]bool{}
+	for _, msp := range mp.Subprojects {
+		msp := msp
+		spPath := mp.Name + "/" + msp.Name
+		var sp *datastore.Subproject
+		for _, esp := range existingSps {
+			if esp.Name == msp.Name {
+				sp = esp
+				break
+			}
+		}
+
+		var spID uint32
+		if sp == nil {
+			a := &manifestAction{Action: "create", Resource: resourceSubproject, Path: spPath}
+			a.run = func() error {
+				id, err := env.db.AddSubproject(projectID, msp.Name, msp.Fullname)
+				if err != nil {
+					return err
+				}
+				spID, a.ID = id, id
+				env.events.publish(EventSubprojectCreated, map[string]interface{}{
+					"subproject": &datastore.Subproject{ID: id, ProjectID: projectID, Name: msp.Name, Fullname: msp.Fullname},
+				})
+				return nil
+			}
+			actions = append(actions, a)
+		} else {
+			spID = sp.ID
+			keptSps[sp.ID] = true
+			if env.trash.has(resourceSubproject, sp.ID) {
+				actions = append(actions, env.manifestRestoreAction(resourceSubproject, spPath, sp.ID, sp))
+			}
+			if sp.Fullname != msp.Fullname {
+				a := &manifestAction{Action: "update", Resource: resourceSubproject, Path: spPath, ID: sp.ID, Fields: []string{"fullname"}}
+				a.run = func() error {
+					if err := env.db.UpdateSubproject(sp.ID, msp.Name, msp.Fullname); err != nil {
+						return err
+					}
+					if updated, err := env.db.GetSubprojectByID(sp.ID); err == nil {
+						env.events.publish(EventSubprojectUpdated, map[string]interface{}{"subproject": updated})
+					}
+					return nil
+				}
+				actions = append(actions, a)
+			}
+		}
+
+		for _, mr := range msp.Repos {
+			mr := mr
+			repoPath := spPath + "/" + mr.Name
+			var repo *datastore.Repo
+			for _, er := range existingRepos {
+				if er.Name == mr.Name {
+					repo = er
+					break
+				}
+			}
+
+			if otherID, ok := otherAddresses[repoAddressKey(mr.Address)]; ok {
+				return nil, nil, &repoAddressConflict{path: repoPath, repoID: otherID}
+			}
+
+			var repoID uint32
+			existingBranches := []*datastore.RepoBranch{}
+			if repo == nil {
+				a := &manifestAction{Action: "create", Resource: resourceRepo, Path: repoPath}
+				a.run = func() error {
+					id, err := env.db.AddRepo(spID, mr.Name, mr.Address)
+					if err != nil {
+						return err
+					}
+					repoID, a.ID = id, id
+					env.events.publish(EventRepoCreated, map[string]interface{}{
+						"repo": &datastore.Repo{ID: id, SubprojectID: spID, Name: mr.Name, Address: mr.Address},
+					})
+					return nil
+				}
+				actions = append(actions, a)
+			} else {
+				repoID = repo.ID
+				keptRepos[repo.ID] = true
+				if env.trash.has(resourceRepo, repo.ID) {
+					actions = append(actions, env.manifestRestoreAction(resourceRepo, repoPath, repo.ID, repo))
+				}
+				fields := []string{}
+				if sp == nil || repo.SubprojectID != sp.ID {
+					fields = append(fields, "subproject")
+				}
+				if repo.Address != mr.Address {
+					fields = append(fields, "address")
+				}
+				if len(fields) > 0 {
+					a := &manifestAction{Action: "update", Resource: resourceRepo, Path: repoPath, ID: repo.ID, Fields: fields}
+					a.run = func() error {
+						oldSubprojectID := repo.SubprojectID
+						if oldSubprojectID != spID {
+							if err := env.db.UpdateRepoSubprojectID(repo.ID, spID); err != nil {
+								return err
+							}
+						}
+						if repo.Address != mr.Address {
+							if err := env.db.UpdateRepo(repo.ID, repo.Name, mr.Address); err != nil {
+								// so that the repo isn't left half changed
+								if oldSubprojectID != spID {
+									env.db.UpdateRepoSubprojectID(repo.ID, oldSubprojectID)
+								}
+								return err
+							}
+						}
+						if updated, err := env.db.GetRepoByID(repo.ID); err == nil {
+							env.events.publish(EventRepoUpdated, map[string]interface{}{"repo": updated})
+						}
+						return nil
+					}
+					actions = append(actions, a)
+				}
+				existingBranches, err = env.db.GetAllRepoBranchesForRepoID(repo.ID)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+
+			wanted := map[string]bool{}
+			for _, b := range mr.Branches {
+				b := b
+				wanted[b] = true
+				exists := false
+				for _, eb := range existingBranches {
+					if eb.Branch == b {
+						exists = true
+						break
+					}
+				}
+				if exists {
+					continue
+				}
+				a := &manifestAction{Action: "create", Resource: resourceBranch, Path: repoPath + "/" + b}
+				a.run = func() error {
+					if err := env.db.AddRepoBranch(repoID, b); err != nil {
+						return err
+					}
+					env.events.publish(EventBranchCreated, map[string]interface{}{
+						"branch": &datastore.RepoBranch{RepoID: repoID, Branch: b},
+					})
+					return nil
+				}
+				actions = append(actions, a)
+			}
+			for _, eb := range existingBranches {
+				eb := eb
+				if wanted[eb.Branch] || !m.Prune {
+					continue
+				}
+				a := &manifestAction{Action: "delete", Resource: resourceBranch, Path: repoPath + "/" + eb.Branch, branch: eb}
+				a.run = func() error {
+					if err := env.db.DeleteRepoBranch(eb.RepoID, eb.Branch); err != nil {
+						return err
+					}
+					env.events.publish(EventBranchDeleted, map[string]interface{}{"branch": eb})
+					return nil
+				}
+				branchDeletes = append(branchDeletes, a)
+			}
+		}
+	}
+
+	// anything left over is moved to the trash, unless it is there
+	// already; trashing a subproject also hides the repos still in
+	// it
+	spNames := map[uint32]string{}
+	for _, esp := range existingSps {
+		spNames[esp.ID] = esp.Name
+	}
+	for _, er := range existingRepos {
+		er := er
+		if keptRepos[er.ID] || !keptSps[er.SubprojectID] || env.trash.has(resourceRepo, er.ID) {
+			continue
+		}
+		a := &manifestAction{Action: "delete", Resource: resourceRepo, Path: mp.Name + "/" + spNames[er.SubprojectID] + "/" + er.Name, ID: er.ID}
+		a.run = func() error {
+			env.trashResource(resourceRepo, er.ID, er.Name, user, er)
+			return nil
+		}
+		repoDeletes = append(repoDeletes, a)
+	}
+	for _, esp := range existingSps {
+		esp := esp
+		if keptSps[esp.ID] || env.trash.has(resourceSubproject, esp.ID) {
+			continue
+		}
+		a := &manifestAction{Action: "delete", Resource: resourceSubproject, Path: mp.Name + "/" + esp.Name, ID: esp.ID}
+		a.run = func() error {
+			env.trashResource(resourceSubproject, esp.ID, esp.Name, user, esp)
+			return nil
+		}
+		spDeletes = append(spDeletes, a)
+	}
+
+	agentActions, err := env.planManifestAgents(m.Agents)
+	if err != nil {
+		return nil, nil, err
+	}
+	actions = append(actions, agentActions...)
+	actions = append(actions, branchDeletes...)
+	actions = append(actions, repoDeletes...)
+	actions = append(actions, spDeletes...)
+	return actions, func() uint32 { return projectID }, nil
+}
+
+// manifestRestoreAction returns an action that takes a resource in
+// the manifest back out of the trash. obj is the resource, for the
+// event.
+func (env *Env) manifestRestoreAction(resource string, path string, id uint32, obj interface{}) *manifestAction {
+	a := &manifestAction{Action: "restore", Resource: resource, Path: path, ID: id}
+	a.run = func() error {
+		env.trash.remove(resource, id)
+		env.events.publish(resource+".restored", map[string]interface{}{resource: obj})
+		return nil
+	}
+	return a
+}
+
+// planManifestAgents works out the actions needed to create or
+// update a manifest's agents.
+func (env *Env) planManifestAgents(mas []*manifestAgent) ([]*manifestAction, error) {
+	actions := []*manifestAction{}
+	if len(mas) == 0 {
+		return actions, nil
+	}
+	agents, err := env.db.GetAllAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ma := range mas {
+		ma := ma
+		var agent *datastore.Agent
+		for _, a := range agents {
+			if a.Name == ma.Name {
+				agent = a
+				break
+			}
+		}
+
+		if agent == nil {
+			a := &manifestAction{Action: "create", Resource: resourceAgent, Path: ma.Name}
+			a.run = func() error {
+				id, err := env.db.AddAgent(ma.Name, true, ma.Address, ma.Port, ma.IsCodeReader, ma.IsSpdxReader, ma.IsCodeWriter, ma.IsSpdxWriter)
+				if err != nil {
+					return err
+				}
+				a.ID = id
+				if created, err := env.db.GetAgentByID(id); err == nil {
+					env.events.publish(EventAgentCreated, map[string]interface{}{"agent": created})
+				}
+				return nil
+			}
+			actions = append(actions, a)
+			continue
+		}
+
+		fields := []string{}
+		if agent.Address != ma.Address {
+			fields = append(fields, "address")
+		}
+		if agent.Port != ma.Port {
+			fields = append(fields, "port")
+		}
+		statusChanged := len(fields) > 0
+		abilities := []struct {
+			name      string
+			has, want bool
+		}{
+			{"is_codereader", agent.IsCodeReader, ma.IsCodeReader},
+			{"is_spdxreader", agent.IsSpdxReader, ma.IsSpdxReader},
+			{"is_codewriter", agent.IsCodeWriter, ma.IsCodeWriter},
+			{"is_spdxwriter", agent.IsSpdxWriter, ma.IsSpdxWriter},
+		}
+		abilitiesChanged := false
+		for _, ab := range abilities {
+			if ab.has != ab.want {
+				fields = append(fields, ab.name)
+				abilitiesChanged = true
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		a := &manifestAction{Action: "update", Resource: resourceAgent, Path: ma.Name, ID: agent.ID, Fields: fields}
+		a.run = func() error {
+			if statusChanged {
+				if err := env.db.UpdateAgentStatus(agent.ID, agent.IsActive, ma.Address, ma.Port); err != nil {
+					return err
+				}
+			}
+			if abilitiesChanged {
+				if err := env.db.UpdateAgentAbilities(agent.ID, ma.IsCodeReader, ma.IsSpdxReader, ma.IsCodeWriter, ma.IsSpdxWriter); err != nil {
+					return err
+				}
+			}
+			if updated, err := env.db.GetAgentByID(agent.ID); err == nil {
+				env.events.publish(EventAgentUpdated, map[string]interface{}{"agent": updated})
+			}
+			return nil
+		}
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
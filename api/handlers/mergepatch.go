@@ -0,0 +1,155 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+)
+
+// applyMergePatch applies an RFC 7396 JSON merge patch to the
+// target value, and returns the result. Both values are expected
+// to be in the generic form produced by decoding JSON into an
+// interface{}.
+func applyMergePatch(target interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		// a non-object patch replaces the target entirely
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+	result := map[string]interface{}{}
+	for k, v := range targetObj {
+		result[k] = v
+	}
+
+	for k, v := range patchObj {
+		if v == nil {
+			delete(result, k)
+		} else {
+			result[k] = applyMergePatch(result[k], v)
+		}
+	}
+	return result
+}
+
+// checkMergePatchType checks the Content-Type of a PATCH request.
+// Merge patches should be labelled as such, though we also accept
+// plain JSON or an unlabelled body. On failure it writes an error
+// response and returns false.
+func checkMergePatchType(w http.ResponseWriter, r *http.Request) bool {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil || (mt != "application/merge-patch+json" && mt != "application/json") {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			fmt.Fprintf(w, `{"error": "PATCH requires Content-Type application/merge-patch+json"}`)
+			return false
+		}
+	}
+	return true
+}
+
+// extractUpdateRequest parses the JSON body of a PUT or PATCH
+// request for the given existing resource, and returns the values
+// to be passed along to the resource's update logic. For PUT the
+// body is returned as-is. For PATCH the body is treated as a
+// merge patch against the resource's current representation, and
+// only the top-level values that it actually changes are returned;
+// removing a value (by setting it to null) is not permitted, since
+// every field of a peridot resource is required. On failure it
+// writes an error response and returns false. If a PATCH would not
+// change anything, it writes a 204 No Content response and also
+// returns false, since there is nothing left for the caller to do.
+func extractUpdateRequest(w http.ResponseWriter, r *http.Request, resource interface{}) (map[string]interface{}, bool) {
+	if r.Method != "PATCH" {
+		js := map[string]interface{}{}
+		err := json.NewDecoder(r.Body).Decode(&js)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid JSON request"}`)
+			return nil, false
+		}
+		return js, true
+	}
+
+	if !checkMergePatchType(w, r) {
+		return nil, false
+	}
+
+	patch := map[string]interface{}{}
+	err := json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid JSON merge patch"}`)
+		return nil, false
+	}
+
+	// get the existing resource in the same generic form
+	var current map[string]interface{}
+	existing, err := json.Marshal(resource)
+	if err == nil {
+		err = json.Unmarshal(existing, &current)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"error": "JSON marshalling error"}`)
+		return nil, false
+	}
+
+	merged := applyMergePatch(current, patch).(map[string]interface{})
+	js := map[string]interface{}{}
+	for k := range patch {
+		newValue, ok := merged[k]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Cannot remove value for '%s'"}`, k)
+			return nil, false
+		}
+		if !reflect.DeepEqual(newValue, current[k]) {
+			js[k] = newValue
+		}
+	}
+	if len(js) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return nil, false
+	}
+	return js, true
+}
+
+// optionalString returns the string value for key in a parsed
+// JSON request, or def if the key is absent. It returns an error
+// if the value is present but is not a string.
+func optionalString(js map[string]interface{}, key string, def string) (string, error) {
+	v, ok := js[key]
+	if !ok {
+		return def, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("Invalid value for '%s'", key)
+	}
+	return s, nil
+}
+
+// optionalID returns the ID value for key in a parsed JSON request,
+// or def if the key is absent. It returns an error if the value is
+// present but is not a positive whole number that fits in a uint32.
+func optionalID(js map[string]interface{}, key string, def uint32) (uint32, error) {
+	v, ok := js[key]
+	if !ok {
+		return def, nil
+	}
+	f, ok := v.(float64)
+	if !ok || f < 1 || f > math.MaxUint32 || f != math.Trunc(f) {
+		return 0, fmt.Errorf("Invalid value for '%s'", key)
+	}
+	return uint32(f), nil
+}
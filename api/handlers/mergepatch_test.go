@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMergePatchAppliesRFC7396Examples(t *testing.T) {
+	// test cases from RFC 7396, Appendix A
+	cases := []struct {
+		target string
+		patch  string
+		result string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, c := range cases {
+		var target, patch, wanted interface{}
+		if err := json.Unmarshal([]byte(c.target), &target); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if err := json.Unmarshal([]byte(c.patch), &patch); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if err := json.Unmarshal([]byte(c.result), &wanted); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+
+		got := applyMergePatch(target, patch)
+		if !reflect.DeepEqual(wanted, got) {
+			t.Errorf("patching %s with %s: expected %#v, got %#v", c.target, c.patch, wanted, got)
+		}
+	}
+}
@@ -115,3 +115,12 @@ func extractUser(w http.ResponseWriter, r *http.Request, minLevel datastore.User
 
 	return user
 }
+
+// canModifyProject reports whether a user may change what is in a
+// project, such as by moving a subproject or repo into or out of it.
+// peridot-db's access levels apply to every project, as it has no
+// per-project permissions, so this only needs operator access; if it
+// gains them, they are to be checked here.
+func canModifyProject(user *datastore.User, projectID uint32) bool {
+	return user.AccessLevel >= datastore.AccessOperator
+}
@@ -18,6 +18,8 @@ type mockDB struct {
 	mockRepoPulls    []*datastore.RepoPull
 	mockAgents       []*datastore.Agent
 	mockJobs         []*datastore.Job
+	mockFileHashes   []*datastore.FileHash
+	mockFileInsts    []*datastore.FileInstance
 }
 
 // createMockDB creates mock values for the handler tests to use.
@@ -68,6 +70,26 @@ func createMockDB() *mockDB {
 		{ID: 4, RepoID: 2, Branch: "test123", Status: datastore.StatusStartup, Health: datastore.HealthOK, Commit: "abcdef012345abcdef012345abcdef012345cdef"},
 	}
 
+	mdb.mockFileHashes = []*datastore.FileHash{
+		{ID: 1, HashSHA256: "1111111111111111111111111111111111111111111111111111111111111111", HashSHA1: "1111111111111111111111111111111111111111"},
+		{ID: 2, HashSHA256: "2222222222222222222222222222222222222222222222222222222222222222", HashSHA1: "2222222222222222222222222222222222222222"},
+		{ID: 3, HashSHA256: "3333333333333333333333333333333333333333333333333333333333333333", HashSHA1: "3333333333333333333333333333333333333333"},
+		{ID: 4, HashSHA256: "4444444444444444444444444444444444444444444444444444444444444444", HashSHA1: "4444444444444444444444444444444444444444"},
+		{ID: 5, HashSHA256: "5555555555555555555555555555555555555555555555555555555555555555", HashSHA1: "5555555555555555555555555555555555555555"},
+	}
+
+	mdb.mockFileInsts = []*datastore.FileInstance{
+		// mock files for comparing repo pulls 1 and 2
+		{ID: 1, RepoPullID: 1, FileHashID: 1, Path: "README.md"},
+		{ID: 2, RepoPullID: 1, FileHashID: 2, Path: "LICENSE"},
+		{ID: 3, RepoPullID: 1, FileHashID: 3, Path: "src/main.go"},
+		{ID: 4, RepoPullID: 1, FileHashID: 4, Path: "src/old.go"},
+		{ID: 5, RepoPullID: 2, FileHashID: 1, Path: "README.md"},
+		{ID: 6, RepoPullID: 2, FileHashID: 2, Path: "LICENSE"},
+		{ID: 7, RepoPullID: 2, FileHashID: 5, Path: "src/main.go"},
+		{ID: 8, RepoPullID: 2, FileHashID: 4, Path: "src/new.go"},
+	}
+
 	mdb.mockAgents = []*datastore.Agent{
 		{ID: 1, Name: "idsearcher", IsActive: true, Address: "localhost", Port: 9001, IsCodeReader: true, IsSpdxReader: false, IsCodeWriter: false, IsSpdxWriter: true},
 		{ID: 2, Name: "attributer", IsActive: true, Address: "localhost", Port: 9002, IsCodeReader: false, IsSpdxReader: true, IsCodeWriter: true, IsSpdxWriter: false},
@@ -710,7 +732,12 @@ func (mdb *mockDB) DeleteRepoPull(id uint32) error {
 // GetFileHashByID returns the FileHash with the given ID,
 // or nil and an error if not found.
 func (mdb *mockDB) GetFileHashByID(id uint64) (*datastore.FileHash, error) {
-	return nil, nil
+	for _, fh := range mdb.mockFileHashes {
+		if fh.ID == id {
+			return fh, nil
+		}
+	}
+	return nil, fmt.Errorf("File hash not found with ID %d", id)
 }
 
 // GetFileHashesByIDs returns a slice of FileHashes with
@@ -740,7 +767,25 @@ func (mdb *mockDB) DeleteFileHash(id uint64) error {
 // GetFileInstanceByID returns the FileInstance with the given ID,
 // or nil and an error if not found.
 func (mdb *mockDB) GetFileInstanceByID(id uint64) (*datastore.FileInstance, error) {
-	return nil, nil
+	for _, fi := range mdb.mockFileInsts {
+		if fi.ID == id {
+			return fi, nil
+		}
+	}
+	return nil, fmt.Errorf("File instance not found with ID %d", id)
+}
+
+// GetAllFileInstancesForRepoPull returns a slice of all file
+// instances of the given repo pull. It is not yet part of
+// peridot-db's Datastore (see fileInstanceLister).
+func (mdb *mockDB) GetAllFileInstancesForRepoPull(rpID uint32) ([]*datastore.FileInstance, error) {
+	fis := []*datastore.FileInstance{}
+	for _, fi := range mdb.mockFileInsts {
+		if fi.RepoPullID == rpID {
+			fis = append(fis, fi)
+		}
+	}
+	return fis, nil
 }
 
 // AddFileInstance adds a new file instance as specified,
@@ -7,12 +7,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 
 	"golang.org/x/oauth2"
 	githuboauth "golang.org/x/oauth2/github"
 
 	"github.com/swinslow/peridot-db/pkg/datastore"
+
+	"github.com/swinslow/peridot-api/internal/auth"
 )
 
 // getTestEnv creates the Env object used for the handlers
@@ -29,11 +32,34 @@ func getTestEnv() *Env {
 	}
 
 	env := &Env{
-		db:           db,
-		jwtSecretKey: "keyForTesting",
-		oauthConf:    oauthConf,
-		oauthState:   "nonRandomStateString",
+		db:             db,
+		batchMu:        &sync.Mutex{},
+		jwtSecretKey:   "keyForTesting",
+		oauthConf:      oauthConf,
+		oauthState:     "nonRandomStateString",
+		idempotency:    newIdempotencyStore(defaultIdempotencyWindow),
+		events:         newEventBus(),
+		watcher:        newWatcher(),
+		watchInterval:  defaultWatchInterval,
+		lsRemote:       lsRemoteBranches,
+		lsRefs:         lsRemoteRefs,
+		commitOnBranch: gitCommitOnBranch,
+		locks:          newResourceLocks(),
+		cliLogins:      newCLILoginStore(),
+		validateGithub: auth.ValidateGithub,
+
+		deleteConfirmThreshold: defaultDeleteConfirmThreshold,
 	}
+	env.webhooks, _ = newWebhookStore("")
+	env.changes, _ = newChangeLog("")
+	env.tracking, _ = newTrackingStore("")
+	env.trash, _ = newTrashStore("", defaultTrashRetention)
+	env.labels, _ = newLabelStore("")
+	env.events.subscribe(env.webhooks.handleEvent)
+	env.events.subscribe(env.changes.record)
+	env.events.subscribe(env.tracking.handleEvent)
+	env.events.subscribe(env.trash.handleEvent)
+	env.events.subscribe(env.labels.handleEvent)
 	return env
 }
 
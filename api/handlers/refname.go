@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkBranchName returns an error saying what is wrong if name is
+// not a valid git branch name, following the rules of
+// `git check-ref-format --branch`.
+func checkBranchName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("must not be empty")
+	case name == "@":
+		return fmt.Errorf("must not be \"@\"")
+	case name == "HEAD":
+		return fmt.Errorf("must not be \"HEAD\"")
+	case strings.HasPrefix(name, "-"):
+		return fmt.Errorf("must not begin with \"-\"")
+	case strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/"):
+		return fmt.Errorf("must not begin or end with \"/\"")
+	case strings.HasSuffix(name, "."):
+		return fmt.Errorf("must not end with \".\"")
+	case strings.Contains(name, ".."):
+		return fmt.Errorf("must not contain \"..\"")
+	case strings.Contains(name, "@{"):
+		return fmt.Errorf("must not contain \"@{\"")
+	}
+
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return fmt.Errorf("must not contain control characters")
+		}
+		if strings.ContainsRune(" ~^:?*[\\", c) {
+			return fmt.Errorf("must not contain %q", c)
+		}
+	}
+
+	for _, comp := range strings.Split(name, "/") {
+		switch {
+		case comp == "":
+			return fmt.Errorf("must not contain \"//\"")
+		case strings.HasPrefix(comp, "."):
+			return fmt.Errorf("no part may begin with \".\"")
+		case strings.HasSuffix(comp, ".lock"):
+			return fmt.Errorf("no part may end with \".lock\"")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"testing"
+)
+
+func TestCanCheckValidBranchNames(t *testing.T) {
+	names := []string{
+		"master",
+		"release/1.2",
+		"feature/foo-bar_baz",
+		"v1.0.0",
+		"a/b/c",
+		"wip@home",
+		"ünïcode",
+	}
+	for _, name := range names {
+		if err := checkBranchName(name); err != nil {
+			t.Errorf("%q: got non-nil error: %v", name, err)
+		}
+	}
+}
+
+func TestCannotCheckInvalidBranchNames(t *testing.T) {
+	names := []string{
+		"",
+		"@",
+		"HEAD",
+		"-foo",
+		"/foo",
+		"foo/",
+		"foo.",
+		"..",
+		"foo..bar",
+		"foo@{1}",
+		"foo bar",
+		"foo~1",
+		"foo^",
+		"foo:bar",
+		"foo?",
+		"foo*",
+		"foo[1]",
+		"foo\\bar",
+		"foo\tbar",
+		"foo//bar",
+		".hidden",
+		"feature/.hidden",
+		"foo.lock",
+		"foo.lock/bar",
+	}
+	for _, name := range names {
+		if err := checkBranchName(name); err == nil {
+			t.Errorf("%q: expected non-nil error, got nil", name)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// repoAddress is a parsed git repository address, in one of the
+// forms that git can clone from: an http(s), ssh, git or file URL, or
+// the scp-like form user@host:path that is often used for SSH.
+type repoAddress struct {
+	// Scheme is "https", "http", "ssh", "git" or "file".
+	Scheme string
+	// User is the user name for SSH, if any.
+	User string
+	// Host is the lower-case host name or IP address.
+	Host string
+	// Port is the port, if it is not the scheme's default.
+	Port string
+	// Path is the repository's path on the host, e.g. "owner/name",
+	// without a leading "/" or a trailing ".git". A file URL's path
+	// keeps any ".git", since it names a directory.
+	Path string
+	// scp is whether the address is in the scp-like form.
+	scp bool
+}
+
+// defaultPorts are the ports that are left out of normalized
+// addresses.
+var defaultPorts = map[string]string{
+	"https": "443",
+	"http":  "80",
+	"ssh":   "22",
+	"git":   "9418",
+}
+
+var (
+	scpAddressRegexp = regexp.MustCompile(`^(?:([^@/:]+)@)?([^@/:]+):(.+)$`)
+	hostnameRegexp   = regexp.MustCompile(`^[a-z0-9]([a-z0-9\-.]*[a-z0-9])?$`)
+)
+
+// parseRepoAddress parses and normalizes a repository address. It
+// returns an error saying what is wrong if the address is invalid.
+func parseRepoAddress(s string) (*repoAddress, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("must not be empty")
+	}
+
+	ra := &repoAddress{}
+	var p string
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("not a valid URL")
+		}
+		ra.Scheme = strings.ToLower(u.Scheme)
+		switch ra.Scheme {
+		case "https", "http", "ssh", "git":
+		case "git+ssh", "ssh+git":
+			ra.Scheme = "ssh"
+		case "file":
+			return parseFileAddress(u)
+		default:
+			return nil, fmt.Errorf("unsupported scheme %q; must be https, http, ssh, git or file", u.Scheme)
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("must not have a query or fragment")
+		}
+		if u.User != nil {
+			if _, hasPassword := u.User.Password(); hasPassword {
+				return nil, fmt.Errorf("must not include a password")
+			}
+			if ra.Scheme == "ssh" {
+				ra.User = u.User.Username()
+			}
+		}
+		ra.Host = strings.ToLower(u.Hostname())
+		ra.Port = u.Port()
+		if ra.Port == defaultPorts[ra.Scheme] {
+			ra.Port = ""
+		}
+		p = u.Path
+	} else {
+		m := scpAddressRegexp.FindStringSubmatch(s)
+		if m == nil {
+			return nil, fmt.Errorf("must be an https, http, ssh, git or file URL, or in the form user@host:path")
+		}
+		ra.Scheme, ra.User, ra.Host, p = "ssh", m[1], strings.ToLower(m[2]), m[3]
+		ra.scp = true
+	}
+
+	if ra.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	if !hostnameRegexp.MatchString(ra.Host) && net.ParseIP(ra.Host) == nil {
+		return nil, fmt.Errorf("invalid host %q", ra.Host)
+	}
+
+	p = strings.TrimSuffix(strings.TrimSuffix(p, "/"), ".git")
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil, fmt.Errorf("missing repository path")
+	}
+	ra.Path = p
+	return ra, nil
+}
+
+// parseFileAddress parses a file URL, for a repository on the API
+// server's own file system.
+func parseFileAddress(u *url.URL) (*repoAddress, error) {
+	if u.Host != "" && strings.ToLower(u.Host) != "localhost" {
+		return nil, fmt.Errorf("file URL must not have a host other than localhost")
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("file URL must not have a user, query or fragment")
+	}
+	p := strings.Trim(path.Clean("/"+u.Path), "/")
+	if p == "" {
+		return nil, fmt.Errorf("missing repository path")
+	}
+	return &repoAddress{Scheme: "file", Path: p}, nil
+}
+
+// String returns the normalized address, in the same form as was
+// parsed.
+func (ra *repoAddress) String() string {
+	if ra.Scheme == "file" {
+		return "file:///" + ra.Path
+	}
+	host := ra.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if ra.User != "" {
+		host = ra.User + "@" + host
+	}
+	if ra.scp {
+		return host + ":" + ra.Path + ".git"
+	}
+	if ra.Port != "" {
+		host += ":" + ra.Port
+	}
+	return ra.Scheme + "://" + host + "/" + ra.Path + ".git"
+}
+
+// caseInsensitiveHosts are the hosts known to ignore case in
+// repository paths. Elsewhere, paths that differ in case may be
+// different repositories.
+var caseInsensitiveHosts = map[string]bool{
+	"github.com":    true,
+	"gitlab.com":    true,
+	"bitbucket.org": true,
+}
+
+// key identifies the repository that an address refers to, so that
+// e.g. the HTTPS and SSH addresses of the same repository match.
+func (ra *repoAddress) key() string {
+	if ra.Scheme == "file" {
+		return "/" + ra.Path
+	}
+	host := strings.ToLower(ra.Host)
+	if caseInsensitiveHosts[host] {
+		return host + "/" + strings.ToLower(ra.Path)
+	}
+	return host + "/" + ra.Path
+}
+
+// repoAddressKey returns the key for a stored repo address, or the
+// address itself if it cannot be parsed (as may be the case for
+// repos created before addresses were checked).
+func repoAddressKey(address string) string {
+	ra, err := parseRepoAddress(address)
+	if err != nil {
+		return address
+	}
+	return ra.key()
+}
+
+// findRepoWithAddress returns a repo, other than the one with ID
+// exceptID, whose address refers to the same repository as ra; or
+// nil if there is none.
+func (env *Env) findRepoWithAddress(ra *repoAddress, exceptID uint32) (*datastore.Repo, error) {
+	repos, err := env.db.GetAllRepos()
+	if err != nil {
+		return nil, err
+	}
+	key := ra.key()
+	for _, repo := range repos {
+		if repo.ID != exceptID && repoAddressKey(repo.Address) == key {
+			return repo, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkRepoAddress parses and normalizes an address given for the
+// repo with ID repoID (0 for a new repo). If the address is invalid,
+// or another repo already has it (even one in the trash), it writes
+// an error response and returns false.
+func (env *Env) checkRepoAddress(w http.ResponseWriter, address string, repoID uint32) (string, bool) {
+	ra, err := parseRepoAddress(address)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": %q}`, "Invalid value for 'address': "+err.Error())
+		return "", false
+	}
+	other, err := env.findRepoWithAddress(ra, repoID)
+	if err != nil {
+		fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		return "", false
+	}
+	if other != nil && env.repoHidden(other) {
+		// the address stays taken until the repo is purged
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": "Repo %d in the trash already has this address", "repo_id": %d}`, other.ID, other.ID)
+		return "", false
+	}
+	if other != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"error": "Repo %d already has this address", "repo_id": %d}`, other.ID, other.ID)
+		return "", false
+	}
+	return ra.String(), true
+}
@@ -0,0 +1,248 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// Orders in which GET /repopulls can list repo pulls.
+const (
+	// repoPullSortID lists them by ID, oldest first.
+	repoPullSortID = "id"
+	// repoPullSortRecent lists the most recently started first, with
+	// those that have not yet started (and so are waiting to) ahead
+	// of them all.
+	repoPullSortRecent = "recent"
+)
+
+// repoPullFilter is what GET /repopulls selects repo pulls by. Zero
+// values select every repo pull.
+type repoPullFilter struct {
+	projectID    uint32
+	subprojectID uint32
+	repoID       uint32
+	branch       string
+	statuses     map[datastore.Status]bool
+	healths      map[datastore.Health]bool
+	// commit and tag are lowercased prefixes
+	commit         string
+	tag            string
+	startedAfter   time.Time
+	startedBefore  time.Time
+	finishedAfter  time.Time
+	finishedBefore time.Time
+	sort           string
+}
+
+// extractRepoPullFilter gets a repo pull filter from a request's
+// query parameters. If one is invalid, it writes an error response
+// and returns false.
+func extractRepoPullFilter(w http.ResponseWriter, r *http.Request) (*repoPullFilter, bool) {
+	q := r.URL.Query()
+	f := &repoPullFilter{
+		branch: q.Get("branch"),
+		commit: strings.ToLower(q.Get("commit")),
+		tag:    strings.ToLower(q.Get("tag")),
+		sort:   repoPullSortID,
+	}
+
+	ids := []struct {
+		name string
+		id   *uint32
+	}{
+		{"project_id", &f.projectID},
+		{"subproject_id", &f.subprojectID},
+		{"repo_id", &f.repoID},
+	}
+	for _, p := range ids {
+		s := q.Get(p.name)
+		if s == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for '%s'"}`, p.name)
+			return nil, false
+		}
+		*p.id = uint32(id)
+	}
+
+	if s := q.Get("status"); s != "" {
+		f.statuses = map[datastore.Status]bool{}
+		for _, part := range strings.Split(s, ",") {
+			st, err := datastore.StatusFromString(strings.TrimSpace(part))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, `{"error": "Invalid value for 'status'; must be one of startup, running, stopped"}`)
+				return nil, false
+			}
+			f.statuses[st] = true
+		}
+	}
+	if s := q.Get("health"); s != "" {
+		f.healths = map[datastore.Health]bool{}
+		for _, part := range strings.Split(s, ",") {
+			h, err := datastore.HealthFromString(strings.TrimSpace(part))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, `{"error": "Invalid value for 'health'; must be one of ok, degraded, error"}`)
+				return nil, false
+			}
+			f.healths[h] = true
+		}
+	}
+
+	times := []struct {
+		name string
+		t    *time.Time
+	}{
+		{"started_after", &f.startedAfter},
+		{"started_before", &f.startedBefore},
+		{"finished_after", &f.finishedAfter},
+		{"finished_before", &f.finishedBefore},
+	}
+	for _, p := range times {
+		s := q.Get(p.name)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": "Invalid value for '%s'; must be an RFC 3339 time, e.g. 2019-06-01T00:00:00Z"}`, p.name)
+			return nil, false
+		}
+		*p.t = t
+	}
+
+	switch s := q.Get("sort"); s {
+	case "":
+	case repoPullSortID, repoPullSortRecent:
+		f.sort = s
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": "Invalid value for 'sort'; must be one of id, recent"}`)
+		return nil, false
+	}
+
+	return f, true
+}
+
+// wantsRepo reports whether the filter could select repo pulls in
+// a repo in the given subproject and project.
+func (f *repoPullFilter) wantsRepo(repo *datastore.Repo, projectID uint32) bool {
+	return (f.repoID == 0 || repo.ID == f.repoID) &&
+		(f.subprojectID == 0 || repo.SubprojectID == f.subprojectID) &&
+		(f.projectID == 0 || projectID == f.projectID)
+}
+
+// matches reports whether the filter selects a repo pull. A time
+// range leaves out repo pulls that have not started or finished.
+func (f *repoPullFilter) matches(rp *datastore.RepoPull) bool {
+	if f.branch != "" && rp.Branch != f.branch {
+		return false
+	}
+	if f.statuses != nil && !f.statuses[rp.Status] {
+		return false
+	}
+	if f.healths != nil && !f.healths[rp.Health] {
+		return false
+	}
+	if !strings.HasPrefix(strings.ToLower(rp.Commit), f.commit) {
+		return false
+	}
+	if f.tag != "" && !strings.HasPrefix(strings.ToLower(rp.Tag), f.tag) {
+		return false
+	}
+	return inTimeRange(rp.StartedAt, f.startedAfter, f.startedBefore) &&
+		inTimeRange(rp.FinishedAt, f.finishedAfter, f.finishedBefore)
+}
+
+// inTimeRange reports whether t is at or after after, and before
+// before, where either bound may be the zero time for none. The zero
+// time t is in no range.
+func inTimeRange(t time.Time, after time.Time, before time.Time) bool {
+	if after.IsZero() && before.IsZero() {
+		return true
+	}
+	if t.IsZero() {
+		return false
+	}
+	return (after.IsZero() || !t.Before(after)) &&
+		(before.IsZero() || t.Before(before))
+}
+
+// sortRepoPulls orders repo pulls as the filter asks.
+func (f *repoPullFilter) sortRepoPulls(rps []*datastore.RepoPull) {
+	sort.SliceStable(rps, func(i, j int) bool {
+		a, b := rps[i], rps[j]
+		if f.sort == repoPullSortRecent {
+			if a.StartedAt.IsZero() != b.StartedAt.IsZero() {
+				return a.StartedAt.IsZero()
+			}
+			if !a.StartedAt.Equal(b.StartedAt) {
+				return a.StartedAt.After(b.StartedAt)
+			}
+			return a.ID > b.ID
+		}
+		return a.ID < b.ID
+	})
+}
+
+// findRepoPulls returns the repo pulls that the filter selects, in
+// its order, leaving out those hidden by the trash.
+func (env *Env) findRepoPulls(f *repoPullFilter) ([]*datastore.RepoPull, error) {
+	subprojects, err := env.db.GetAllSubprojects()
+	if err != nil {
+		return nil, err
+	}
+	spProject := map[uint32]uint32{}
+	for _, sp := range subprojects {
+		spProject[sp.ID] = sp.ProjectID
+	}
+	repos, err := env.db.GetAllRepos()
+	if err != nil {
+		return nil, err
+	}
+
+	rps := []*datastore.RepoPull{}
+	for _, repo := range env.visibleRepos(repos) {
+		if !f.wantsRepo(repo, spProject[repo.SubprojectID]) {
+			continue
+		}
+		branches, err := env.db.GetAllRepoBranchesForRepoID(repo.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, rb := range branches {
+			if f.branch != "" && rb.Branch != f.branch {
+				continue
+			}
+			pulls, err := env.db.GetAllRepoPullsForRepoBranch(repo.ID, rb.Branch)
+			if err != nil {
+				return nil, err
+			}
+			// match on status, health and times derived from jobs
+			pulls, err = env.rolledUpRepoPulls(pulls)
+			if err != nil {
+				return nil, err
+			}
+			for _, rp := range pulls {
+				if f.matches(rp) {
+					rps = append(rps, rp)
+				}
+			}
+		}
+	}
+	f.sortRepoPulls(rps)
+	return rps, nil
+}
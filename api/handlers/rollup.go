@@ -0,0 +1,144 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"time"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// rollupRules describes how a repo pull's status, health and times
+// are derived from its jobs. The datastore has no way to update a
+// repo pull once it is added, so the API derives them each time it
+// returns one.
+type rollupRules struct {
+	Status     string `json:"status"`
+	Health     string `json:"health"`
+	StartedAt  string `json:"started_at"`
+	FinishedAt string `json:"finished_at"`
+	NoJobs     string `json:"no_jobs"`
+}
+
+var repoPullRollupRules = &rollupRules{
+	Status:     "stopped if all jobs have stopped; startup if none have started; otherwise running",
+	Health:     "the worst of the jobs' health: error, then degraded, then ok",
+	StartedAt:  "when the pull itself started, or else when its first job started",
+	FinishedAt: "once stopped, when the last of the pull and its jobs finished",
+	NoJobs:     "a pull without jobs keeps its own status, health and times",
+}
+
+// repoPullRollup is how a repo pull's status, health and times
+// were derived from its jobs.
+type repoPullRollup struct {
+	Jobs     int            `json:"jobs"`
+	Statuses map[string]int `json:"statuses"`
+	Healths  map[string]int `json:"healths"`
+	Rules    *rollupRules   `json:"rules"`
+}
+
+// healthRank orders health values from best to worst.
+func healthRank(h datastore.Health) int {
+	switch h {
+	case datastore.HealthOK:
+		return 1
+	case datastore.HealthDegraded:
+		return 2
+	case datastore.HealthError:
+		return 3
+	}
+	return 0
+}
+
+// rollUpRepoPull returns a copy of a repo pull, with its status,
+// health and times derived from its jobs as repoPullRollupRules
+// describes, and how they were derived.
+func rollUpRepoPull(rp *datastore.RepoPull, jobs []*datastore.Job) (*datastore.RepoPull, *repoPullRollup) {
+	cp := *rp
+	ru := &repoPullRollup{
+		Jobs:     len(jobs),
+		Statuses: map[string]int{},
+		Healths:  map[string]int{},
+		Rules:    repoPullRollupRules,
+	}
+
+	var startup, running, stopped int
+	var health datastore.Health
+	var firstStart, lastFinish time.Time
+	for _, j := range jobs {
+		switch j.Status {
+		case datastore.StatusStartup:
+			startup++
+		case datastore.StatusRunning:
+			running++
+		case datastore.StatusStopped:
+			stopped++
+		}
+		if j.Status != datastore.StatusSame {
+			ru.Statuses[datastore.StringFromStatus(j.Status)]++
+		}
+		if j.Health != datastore.HealthSame {
+			ru.Healths[datastore.StringFromHealth(j.Health)]++
+		}
+		if healthRank(j.Health) > healthRank(health) {
+			health = j.Health
+		}
+		if !j.StartedAt.IsZero() && (firstStart.IsZero() || j.StartedAt.Before(firstStart)) {
+			firstStart = j.StartedAt
+		}
+		if j.FinishedAt.After(lastFinish) {
+			lastFinish = j.FinishedAt
+		}
+	}
+	if startup+running+stopped == 0 {
+		return &cp, ru
+	}
+
+	switch {
+	case stopped == startup+running+stopped:
+		cp.Status = datastore.StatusStopped
+	case running == 0 && stopped == 0:
+		cp.Status = datastore.StatusStartup
+	default:
+		cp.Status = datastore.StatusRunning
+	}
+	if health != datastore.HealthSame {
+		cp.Health = health
+	}
+	if cp.StartedAt.IsZero() {
+		cp.StartedAt = firstStart
+	}
+	if cp.Status == datastore.StatusStopped {
+		if lastFinish.After(cp.FinishedAt) {
+			cp.FinishedAt = lastFinish
+		}
+	} else {
+		cp.FinishedAt = time.Time{}
+	}
+	return &cp, ru
+}
+
+// rolledUpRepoPull returns a repo pull with its status, health and
+// times derived from its jobs, and how they were derived.
+func (env *Env) rolledUpRepoPull(rp *datastore.RepoPull) (*datastore.RepoPull, *repoPullRollup, error) {
+	jobs, err := env.db.GetAllJobsForRepoPull(rp.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	rolled, ru := rollUpRepoPull(rp, jobs)
+	return rolled, ru, nil
+}
+
+// rolledUpRepoPulls returns repo pulls with their status, health
+// and times derived from their jobs.
+func (env *Env) rolledUpRepoPulls(rps []*datastore.RepoPull) ([]*datastore.RepoPull, error) {
+	rolled := make([]*datastore.RepoPull, 0, len(rps))
+	for _, rp := range rps {
+		r, _, err := env.rolledUpRepoPull(rp)
+		if err != nil {
+			return nil, err
+		}
+		rolled = append(rolled, r)
+	}
+	return rolled, nil
+}
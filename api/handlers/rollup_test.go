@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+func TestRollUpRepoPullStatusAndHealth(t *testing.T) {
+	job := func(st datastore.Status, h datastore.Health) *datastore.Job {
+		return &datastore.Job{Status: st, Health: h}
+	}
+	for _, tc := range []struct {
+		name   string
+		jobs   []*datastore.Job
+		status datastore.Status
+		health datastore.Health
+	}{
+		{"all stopped", []*datastore.Job{
+			job(datastore.StatusStopped, datastore.HealthOK),
+			job(datastore.StatusStopped, datastore.HealthOK),
+		}, datastore.StatusStopped, datastore.HealthOK},
+		{"none started", []*datastore.Job{
+			job(datastore.StatusStartup, datastore.HealthOK),
+			job(datastore.StatusStartup, datastore.HealthOK),
+		}, datastore.StatusStartup, datastore.HealthOK},
+		{"some running", []*datastore.Job{
+			job(datastore.StatusStopped, datastore.HealthOK),
+			job(datastore.StatusRunning, datastore.HealthDegraded),
+		}, datastore.StatusRunning, datastore.HealthDegraded},
+		{"some stopped, rest waiting", []*datastore.Job{
+			job(datastore.StatusStopped, datastore.HealthOK),
+			job(datastore.StatusStartup, datastore.HealthOK),
+		}, datastore.StatusRunning, datastore.HealthOK},
+		{"worst health", []*datastore.Job{
+			job(datastore.StatusStopped, datastore.HealthError),
+			job(datastore.StatusStopped, datastore.HealthDegraded),
+			job(datastore.StatusStopped, datastore.HealthOK),
+		}, datastore.StatusStopped, datastore.HealthError},
+	} {
+		rp := &datastore.RepoPull{ID: 1, Status: datastore.StatusStartup, Health: datastore.HealthOK}
+		got, ru := rollUpRepoPull(rp, tc.jobs)
+		if got.Status != tc.status || got.Health != tc.health {
+			t.Errorf("%s: expected %v/%v, got %v/%v", tc.name, tc.status, tc.health, got.Status, got.Health)
+		}
+		if ru.Jobs != len(tc.jobs) {
+			t.Errorf("%s: expected %d jobs, got %d", tc.name, len(tc.jobs), ru.Jobs)
+		}
+	}
+}
+
+func TestRollUpRepoPullTimes(t *testing.T) {
+	at := func(min int) time.Time { return time.Date(2019, 6, 1, 10, min, 0, 0, time.UTC) }
+	jobs := []*datastore.Job{
+		{Status: datastore.StatusStopped, Health: datastore.HealthOK, StartedAt: at(5), FinishedAt: at(20)},
+		{Status: datastore.StatusStopped, Health: datastore.HealthOK, StartedAt: at(2), FinishedAt: at(10)},
+	}
+
+	// started and finished from the jobs
+	rp := &datastore.RepoPull{ID: 1}
+	got, _ := rollUpRepoPull(rp, jobs)
+	if !got.StartedAt.Equal(at(2)) || !got.FinishedAt.Equal(at(20)) {
+		t.Errorf("expected %v to %v, got %v to %v", at(2), at(20), got.StartedAt, got.FinishedAt)
+	}
+
+	// the pull's own start is kept, and its own finish if later
+	rp = &datastore.RepoPull{ID: 1, StartedAt: at(0), FinishedAt: at(30)}
+	got, _ = rollUpRepoPull(rp, jobs)
+	if !got.StartedAt.Equal(at(0)) || !got.FinishedAt.Equal(at(30)) {
+		t.Errorf("expected %v to %v, got %v to %v", at(0), at(30), got.StartedAt, got.FinishedAt)
+	}
+
+	// not finished while a job is still running
+	jobs = append(jobs, &datastore.Job{Status: datastore.StatusRunning, Health: datastore.HealthOK, StartedAt: at(15)})
+	got, _ = rollUpRepoPull(rp, jobs)
+	if !got.FinishedAt.IsZero() {
+		t.Errorf("expected zero finish time, got %v", got.FinishedAt)
+	}
+
+	// and the repo pull passed in is left alone
+	if !rp.FinishedAt.Equal(at(30)) {
+		t.Errorf("expected original repo pull to be unchanged, got %v", rp.FinishedAt)
+	}
+}
+
+func TestRollUpRepoPullWithoutJobsKeepsItsOwnValues(t *testing.T) {
+	started := time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC)
+	rp := &datastore.RepoPull{ID: 1, Status: datastore.StatusRunning, Health: datastore.HealthDegraded, StartedAt: started}
+	got, ru := rollUpRepoPull(rp, nil)
+	if got.Status != datastore.StatusRunning || got.Health != datastore.HealthDegraded || !got.StartedAt.Equal(started) {
+		t.Errorf("expected repo pull's own values, got %#v", got)
+	}
+	if ru.Jobs != 0 || len(ru.Statuses) != 0 || len(ru.Healths) != 0 {
+		t.Errorf("expected empty rollup, got %#v", ru)
+	}
+}
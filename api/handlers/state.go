@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The peridot datastore's schema is fixed, so state that belongs
+// to the API server itself (such as webhook subscriptions) is
+// kept in memory, and saved in APISTATEDIR as JSON files so that
+// it survives a restart. The functions below do nothing without a
+// directory, which is only the case in tests.
+
+// defaultStateDir is where state is saved if APISTATEDIR is not set,
+// relative to the working directory.
+const defaultStateDir = "apistate"
+
+// loadState reads the state saved under name in dir into v. It
+// does nothing if dir is empty or nothing has been saved yet.
+func loadState(dir string, name string, v interface{}) error {
+	if dir == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, name+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveState saves v under name in dir. It does nothing if dir is
+// empty. The file is replaced atomically, so a crash cannot leave
+// it half-written.
+func saveState(dir string, name string, v interface{}) error {
+	if dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name+".json"))
+}
+
+// appendStateLine appends one line of JSON to the JSON lines file
+// saved under name in dir. It does nothing if dir is empty.
+func appendStateLine(dir string, name string, line []byte) error {
+	if dir == "" {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name+".jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// loadStateLines calls fn with each line of the JSON lines file
+// saved under name in dir. It does nothing if dir is empty or
+// nothing has been saved yet.
+func loadStateLines(dir string, name string, fn func([]byte) error) error {
+	if dir == "" {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(dir, name+".jsonl"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// saveStateLines replaces the JSON lines file saved under name in
+// dir with the given lines. It does nothing if dir is empty.
+func saveStateLines(dir string, name string, lines [][]byte) error {
+	if dir == "" {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, line := range lines {
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name+".jsonl"))
+}
@@ -0,0 +1,163 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// lsRemoteTimeout limits how long listing a remote repository's
+// branches may take.
+const lsRemoteTimeout = 30 * time.Second
+
+// trackingRules say which of a repo's remote branches are tracked
+// as peridot branches. A branch is tracked if it matches one of the
+// Include patterns and none of the Exclude patterns.
+type trackingRules struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// tracks reports whether the rules track the given branch.
+func (tr *trackingRules) tracks(branch string) bool {
+	return matchesAnyPattern(branch, tr.Include, false) && !matchesAnyPattern(branch, tr.Exclude, false)
+}
+
+// trackingState is the part of the tracking store that is saved
+// to APISTATEDIR.
+type trackingState struct {
+	Rules map[uint32]*trackingRules `json:"rules"`
+}
+
+// trackingStore holds each repo's branch tracking rules.
+type trackingStore struct {
+	mu       sync.Mutex
+	stateDir string
+	rules    map[uint32]*trackingRules
+}
+
+// newTrackingStore creates a tracking store, loading any saved
+// rules from stateDir.
+func newTrackingStore(stateDir string) (*trackingStore, error) {
+	ts := &trackingStore{stateDir: stateDir, rules: map[uint32]*trackingRules{}}
+	var st trackingState
+	if err := loadState(stateDir, "tracking", &st); err != nil {
+		return nil, err
+	}
+	for repoID, tr := range st.Rules {
+		ts.rules[repoID] = tr
+	}
+	return ts, nil
+}
+
+// save writes the store's state to its state directory, if any.
+// The caller must hold ts.mu.
+func (ts *trackingStore) save() {
+	if err := saveState(ts.stateDir, "tracking", &trackingState{Rules: ts.rules}); err != nil {
+		log.Printf("error saving tracking rules: %v", err)
+	}
+}
+
+// get returns a copy of the rules for a repo, or nil if it has none.
+func (ts *trackingStore) get(repoID uint32) *trackingRules {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	tr, ok := ts.rules[repoID]
+	if !ok {
+		return nil
+	}
+	cp := *tr
+	return &cp
+}
+
+// set replaces the rules for a repo.
+func (ts *trackingStore) set(repoID uint32, tr *trackingRules) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.rules[repoID] = tr
+	ts.save()
+}
+
+// remove deletes the rules for a repo, and returns whether it had
+// any.
+func (ts *trackingStore) remove(repoID uint32) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, ok := ts.rules[repoID]; !ok {
+		return false
+	}
+	delete(ts.rules, repoID)
+	ts.save()
+	return true
+}
+
+// handleEvent drops the rules for repos that are deleted. It is
+// called from the event bus.
+func (ts *trackingStore) handleEvent(ev *event) {
+	switch ev.Type {
+	case EventRepoDeleted:
+		data, ok := ev.Data.(map[string]interface{})
+		if !ok {
+			return
+		}
+		if repo, ok := data["repo"].(*datastore.Repo); ok {
+			ts.remove(repo.ID)
+		}
+	case EventDatabaseReset:
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		ts.rules = map[uint32]*trackingRules{}
+		ts.save()
+	}
+}
+
+// branchFromRef returns the branch name for a remote ref, given
+// either as "refs/heads/<branch>" or as a plain branch name. It
+// returns false for other refs, such as tags.
+func branchFromRef(ref string) (string, bool) {
+	if strings.HasPrefix(ref, "refs/heads/") {
+		return strings.TrimPrefix(ref, "refs/heads/"), true
+	}
+	if strings.HasPrefix(ref, "refs/") {
+		return "", false
+	}
+	return ref, true
+}
+
+// lsRemoteBranches lists the branches of the repository at address
+// by running `git ls-remote --heads`.
+func lsRemoteBranches(ctx context.Context, address string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, lsRemoteTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--heads", "--", address)
+	// never prompt for credentials
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-remote failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	refs := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// each line is "<commit>\t<ref>"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			refs = append(refs, fields[1])
+		}
+	}
+	return refs, scanner.Err()
+}
@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestTrackingRulesTrackMatchingBranches(t *testing.T) {
+	tr := &trackingRules{Include: []string{"main", "release/*"}, Exclude: []string{"release/old-*"}}
+	cases := map[string]bool{
+		"main":            true,
+		"master":          false,
+		"release/1.2":     true,
+		"release/old-1.0": false,
+		"release/1/2":     false,
+	}
+	for branch, wanted := range cases {
+		if got := tr.tracks(branch); got != wanted {
+			t.Errorf("%s: expected %v, got %v", branch, wanted, got)
+		}
+	}
+}
+
+func TestCanListRemoteBranchesWithGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "peridot-tracking")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"symbolic-ref", "HEAD", "refs/heads/main"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+		{"branch", "release/1.2"},
+		{"tag", "v1.0"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v: %s", args, err, out)
+		}
+	}
+
+	refs, err := lsRemoteBranches(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	wanted := []string{"refs/heads/main", "refs/heads/release/1.2"}
+	if !reflect.DeepEqual(refs, wanted) {
+		t.Errorf("expected %v, got %v", wanted, refs)
+	}
+}
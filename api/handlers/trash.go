@@ -0,0 +1,372 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// defaultTrashRetention is how long deleted resources are kept in
+// the trash before they are purged, if TRASHRETENTION is not set.
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// trashPurgeInterval is how often the trash is checked for
+// resources that are due to be purged.
+const trashPurgeInterval = time.Hour
+
+// trashEntry is a resource in the trash.
+type trashEntry struct {
+	Resource  string    `json:"resource"`
+	ID        uint32    `json:"id"`
+	Name      string    `json:"name"`
+	DeletedAt time.Time `json:"deleted_at"`
+	// DeletedBy is the ID of the user who deleted the resource.
+	DeletedBy uint32    `json:"deleted_by"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+type trashKey struct {
+	resource string
+	id       uint32
+}
+
+// trashState is the part of the trash that is saved to
+// APISTATEDIR.
+type trashState struct {
+	Entries []*trashEntry `json:"entries"`
+}
+
+// trashStore records which resources are in the trash. The
+// resources themselves stay in the datastore until they are purged.
+// Only projects, subprojects and repos can be in the trash; deleting
+// one moves it there, hiding it and everything below it, and purging
+// it deletes it from the datastore along with everything below it.
+type trashStore struct {
+	mu        sync.Mutex
+	stateDir  string
+	retention time.Duration
+	entries   map[trashKey]*trashEntry
+}
+
+// newTrashStore creates a trash store, loading any saved entries
+// from stateDir.
+func newTrashStore(stateDir string, retention time.Duration) (*trashStore, error) {
+	ts := &trashStore{stateDir: stateDir, retention: retention, entries: map[trashKey]*trashEntry{}}
+	var st trashState
+	if err := loadState(stateDir, "trash", &st); err != nil {
+		return nil, err
+	}
+	for _, e := range st.Entries {
+		ts.entries[trashKey{e.Resource, e.ID}] = e
+	}
+	return ts, nil
+}
+
+// save writes the store's state to its state directory, if any.
+// The caller must hold ts.mu.
+func (ts *trashStore) save() {
+	if err := saveState(ts.stateDir, "trash", &trashState{Entries: ts.listLocked()}); err != nil {
+		log.Printf("error saving trash: %v", err)
+	}
+}
+
+// listLocked returns the entries, oldest first. The caller must
+// hold ts.mu.
+func (ts *trashStore) listLocked() []*trashEntry {
+	entries := []*trashEntry{}
+	for _, e := range ts.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].DeletedAt.Equal(entries[j].DeletedAt) {
+			return entries[i].DeletedAt.Before(entries[j].DeletedAt)
+		}
+		if entries[i].Resource != entries[j].Resource {
+			return entries[i].Resource < entries[j].Resource
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
+
+// list returns copies of all entries, oldest first.
+func (ts *trashStore) list() []*trashEntry {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	entries := []*trashEntry{}
+	for _, e := range ts.listLocked() {
+		cp := *e
+		entries = append(entries, &cp)
+	}
+	return entries
+}
+
+// empty reports whether nothing is in the trash.
+func (ts *trashStore) empty() bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.entries) == 0
+}
+
+// has reports whether a resource is in the trash.
+func (ts *trashStore) has(resource string, id uint32) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	_, ok := ts.entries[trashKey{resource, id}]
+	return ok
+}
+
+// get returns a copy of the entry for a resource in the trash.
+func (ts *trashStore) get(resource string, id uint32) (*trashEntry, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	e, ok := ts.entries[trashKey{resource, id}]
+	if !ok {
+		return nil, false
+	}
+	cp := *e
+	return &cp, true
+}
+
+// add puts a resource in the trash, to be purged once the
+// retention period has passed.
+func (ts *trashStore) add(resource string, id uint32, name string, userID uint32) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	now := time.Now().UTC()
+	ts.entries[trashKey{resource, id}] = &trashEntry{
+		Resource:  resource,
+		ID:        id,
+		Name:      name,
+		DeletedAt: now,
+		DeletedBy: userID,
+		PurgeAt:   now.Add(ts.retention),
+	}
+	ts.save()
+}
+
+// remove takes a resource out of the trash, and returns whether it
+// was there.
+func (ts *trashStore) remove(resource string, id uint32) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, ok := ts.entries[trashKey{resource, id}]; !ok {
+		return false
+	}
+	delete(ts.entries, trashKey{resource, id})
+	ts.save()
+	return true
+}
+
+// handleEvent drops the entries for resources that are deleted from
+// the datastore. It is called from the event bus.
+func (ts *trashStore) handleEvent(ev *event) {
+	switch ev.Type {
+	case EventProjectDeleted, EventSubprojectDeleted, EventRepoDeleted:
+		data, ok := ev.Data.(map[string]interface{})
+		if !ok {
+			return
+		}
+		switch obj := data[strings.TrimSuffix(ev.Type, ".deleted")].(type) {
+		case *datastore.Project:
+			ts.remove(resourceProject, obj.ID)
+		case *datastore.Subproject:
+			ts.remove(resourceSubproject, obj.ID)
+		case *datastore.Repo:
+			ts.remove(resourceRepo, obj.ID)
+		}
+	case EventDatabaseReset:
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		ts.entries = map[trashKey]*trashEntry{}
+		ts.save()
+	}
+}
+
+// subprojectHidden reports whether a subproject is hidden because it
+// or its project is in the trash.
+func (env *Env) subprojectHidden(sp *datastore.Subproject) bool {
+	return env.trash.has(resourceSubproject, sp.ID) || env.trash.has(resourceProject, sp.ProjectID)
+}
+
+// repoHidden reports whether a repo is hidden because it, its
+// subproject or its project is in the trash.
+func (env *Env) repoHidden(repo *datastore.Repo) bool {
+	if env.trash.empty() {
+		return false
+	}
+	if env.trash.has(resourceRepo, repo.ID) {
+		return true
+	}
+	sp, err := env.db.GetSubprojectByID(repo.SubprojectID)
+	return err == nil && env.subprojectHidden(sp)
+}
+
+// resourceHidden reports whether the resource with the given ID is
+// hidden because it, or a resource above it, is in the trash.
+func (env *Env) resourceHidden(resource string, id uint32) bool {
+	if env.trash.empty() {
+		return false
+	}
+	switch resource {
+	case resourceProject:
+		return env.trash.has(resourceProject, id)
+	case resourceSubproject:
+		sp, err := env.db.GetSubprojectByID(id)
+		return err == nil && env.subprojectHidden(sp)
+	case resourceRepo:
+		repo, err := env.db.GetRepoByID(id)
+		return err == nil && env.repoHidden(repo)
+	case resourceRepoPull:
+		rp, err := env.db.GetRepoPullByID(id)
+		return err == nil && env.resourceHidden(resourceRepo, rp.RepoID)
+	case resourceJob:
+		job, err := env.db.GetJobByID(id)
+		return err == nil && env.resourceHidden(resourceRepoPull, job.RepoPullID)
+	}
+	return false
+}
+
+// hideTrashed wraps a handler for an endpoint whose "id" is a
+// resource of the given type, so that it responds as though the
+// resource does not exist if it is hidden by the trash.
+func (env *Env) hideTrashed(resource string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, err := extractIDasU32(r); err == nil && env.resourceHidden(resource, id) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"error": "Unknown %s ID"}`, resource)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// trashResource moves a resource to the trash, on behalf of the
+// given user, and publishes an event for it. obj is the resource,
+// for the event.
+func (env *Env) trashResource(resource string, id uint32, name string, user *datastore.User, obj interface{}) {
+	env.trash.add(resource, id, name, user.ID)
+	env.events.publish(resource+".trashed", map[string]interface{}{resource: obj})
+}
+
+// purgeTrashEntry deletes a resource in the trash from the
+// datastore, along with everything below it.
+func (env *Env) purgeTrashEntry(e *trashEntry) error {
+	var err error
+	var obj interface{}
+	switch e.Resource {
+	case resourceProject:
+		obj, _ = env.db.GetProjectByID(e.ID)
+		err = env.db.DeleteProject(e.ID)
+	case resourceSubproject:
+		obj, _ = env.db.GetSubprojectByID(e.ID)
+		err = env.db.DeleteSubproject(e.ID)
+	case resourceRepo:
+		obj, _ = env.db.GetRepoByID(e.ID)
+		err = env.db.DeleteRepo(e.ID)
+	default:
+		return fmt.Errorf("unknown resource %q in trash", e.Resource)
+	}
+	if err != nil {
+		return err
+	}
+	env.events.publish(e.Resource+".deleted", map[string]interface{}{e.Resource: obj})
+
+	// anything else in the trash that was below the purged
+	// resource is gone now too
+	for _, other := range env.trash.list() {
+		if !env.resourceExists(other.Resource, other.ID) {
+			env.trash.remove(other.Resource, other.ID)
+		}
+	}
+
+	// and so are the labels of anything below it
+	env.labels.removeMissing(env.resourceExists)
+	return nil
+}
+
+// resourceExists reports whether the project, subproject or repo
+// with the given ID is in the datastore.
+func (env *Env) resourceExists(resource string, id uint32) bool {
+	var err error
+	switch resource {
+	case resourceProject:
+		_, err = env.db.GetProjectByID(id)
+	case resourceSubproject:
+		_, err = env.db.GetSubprojectByID(id)
+	case resourceRepo:
+		_, err = env.db.GetRepoByID(id)
+	}
+	return err == nil
+}
+
+// purgeExpiredTrash purges the resources whose retention period has
+// passed.
+func (env *Env) purgeExpiredTrash(now time.Time) {
+	env.batchMu.Lock()
+	defer env.batchMu.Unlock()
+	for _, e := range env.trash.list() {
+		if now.Before(e.PurgeAt) {
+			continue
+		}
+		// an earlier purge may have removed it already
+		if _, ok := env.trash.get(e.Resource, e.ID); !ok {
+			continue
+		}
+		if err := env.purgeTrashEntry(e); err != nil {
+			log.Printf("error purging %s %d from trash: %v", e.Resource, e.ID, err)
+		}
+	}
+}
+
+// visibleProjects returns the projects that are not in the trash.
+func (env *Env) visibleProjects(projects []*datastore.Project) []*datastore.Project {
+	if env.trash.empty() {
+		return projects
+	}
+	visible := []*datastore.Project{}
+	for _, p := range projects {
+		if !env.trash.has(resourceProject, p.ID) {
+			visible = append(visible, p)
+		}
+	}
+	return visible
+}
+
+// visibleSubprojects returns the subprojects that are not hidden by
+// the trash.
+func (env *Env) visibleSubprojects(subprojects []*datastore.Subproject) []*datastore.Subproject {
+	if env.trash.empty() {
+		return subprojects
+	}
+	visible := []*datastore.Subproject{}
+	for _, sp := range subprojects {
+		if !env.subprojectHidden(sp) {
+			visible = append(visible, sp)
+		}
+	}
+	return visible
+}
+
+// visibleRepos returns the repos that are not hidden by the trash.
+func (env *Env) visibleRepos(repos []*datastore.Repo) []*datastore.Repo {
+	if env.trash.empty() {
+		return repos
+	}
+	visible := []*datastore.Repo{}
+	for _, repo := range repos {
+		if !env.repoHidden(repo) {
+			visible = append(visible, repo)
+		}
+	}
+	return visible
+}
@@ -0,0 +1,277 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// defaultWatchInterval is how often the datastore is checked for
+// changes, if WATCHINTERVAL is not set.
+const defaultWatchInterval = 10 * time.Second
+
+// watcher keeps copies of the last-seen repo pulls, jobs and agents.
+// Their status is mostly changed by the peridot controller and
+// agents writing to the datastore directly, not through the API,
+// so the only way to notice those changes is to look.
+type watcher struct {
+	mu        sync.Mutex
+	primed    bool
+	repoPulls map[uint32]*datastore.RepoPull
+	jobs      map[uint32]*datastore.Job
+	agents    map[uint32]bool
+
+	// repo pulls and jobs changed through the API since the
+	// datastore was last read; their records above are more
+	// recent than what was read
+	touchedRepoPulls map[uint32]bool
+	touchedJobs      map[uint32]bool
+}
+
+func newWatcher() *watcher {
+	return &watcher{
+		repoPulls:        map[uint32]*datastore.RepoPull{},
+		jobs:             map[uint32]*datastore.Job{},
+		agents:           map[uint32]bool{},
+		touchedRepoPulls: map[uint32]bool{},
+		touchedJobs:      map[uint32]bool{},
+	}
+}
+
+// StartWatchers starts the background tasks that watch the
+// datastore for changes and purge expired resources from the
+// trash. It returns immediately.
+func (env *Env) StartWatchers() {
+	go func() {
+		ticker := time.NewTicker(env.watchInterval)
+		defer ticker.Stop()
+		for {
+			if err := env.pollChanges(); err != nil {
+				log.Printf("error checking for changes: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			env.purgeExpiredTrash(now)
+		}
+	}()
+}
+
+// publishRepoPullEvent publishes an event for a repo pull that was
+// created or deleted through the API, and records the change so
+// that the watcher does not publish it a second time.
+func (env *Env) publishRepoPullEvent(eventType string, rp *datastore.RepoPull) {
+	cp := *rp
+	rp = &cp
+	w := env.watcher
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// the watcher may have published the change already, if it
+	// looked just after the datastore was updated
+	_, known := w.repoPulls[rp.ID]
+	w.touchedRepoPulls[rp.ID] = true
+	var published bool
+	if eventType == EventRepoPullDeleted {
+		published = w.primed && !known
+		delete(w.repoPulls, rp.ID)
+	} else {
+		published = w.primed && known
+		w.repoPulls[rp.ID] = rp
+	}
+	if published {
+		return
+	}
+	env.events.publish(eventType, map[string]interface{}{"repopull": rp})
+}
+
+// publishJobEvent publishes an event for a job that was created or
+// deleted through the API, and records the change so that the
+// watcher does not publish it a second time.
+func (env *Env) publishJobEvent(eventType string, job *datastore.Job) {
+	cp := *job
+	job = &cp
+	w := env.watcher
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// the watcher may have published the change already, if it
+	// looked just after the datastore was updated
+	_, known := w.jobs[job.ID]
+	w.touchedJobs[job.ID] = true
+	var published bool
+	if eventType == EventJobDeleted {
+		published = w.primed && !known
+		delete(w.jobs, job.ID)
+	} else {
+		published = w.primed && known
+		w.jobs[job.ID] = job
+	}
+	if published {
+		return
+	}
+	env.events.publish(eventType, map[string]interface{}{"job": job})
+}
+
+// pollChanges compares the current repo pulls, jobs and agents with
+// what was seen last time, and publishes events for any changes.
+// The first call only records the current state.
+func (env *Env) pollChanges() error {
+	// the datastore is read without holding the lock, so that API
+	// requests aren't held up by it; changes they make in the
+	// meantime are noted as touched, and left to them
+	w := env.watcher
+	w.mu.Lock()
+	w.touchedRepoPulls = map[uint32]bool{}
+	w.touchedJobs = map[uint32]bool{}
+	w.mu.Unlock()
+
+	rps, err := env.getAllRepoPulls()
+	if err != nil {
+		return err
+	}
+	jobs, err := env.getJobsForRepoPulls(rps)
+	if err != nil {
+		return err
+	}
+	agents, err := env.db.GetAllAgents()
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	env.compareChanges(rps, jobs, agents)
+	return nil
+}
+
+// compareChanges publishes events for the differences between the
+// repo pulls, jobs and agents read from the datastore and what the
+// watcher last saw, and records them as seen. Repo pulls and jobs
+// touched through the API while they were being read keep the
+// watcher's record, as the API has published their change already.
+// It must be called with the watcher's lock held.
+func (env *Env) compareChanges(rps []*datastore.RepoPull, jobs []*datastore.Job, agents []*datastore.Agent) {
+	w := env.watcher
+
+	// repo pulls and jobs that were created or changed; a repo
+	// pull's status and health are derived from its jobs, so a
+	// change to a job can change its repo pull too
+	rpJobs := map[uint32][]*datastore.Job{}
+	for _, j := range jobs {
+		rpJobs[j.RepoPullID] = append(rpJobs[j.RepoPullID], j)
+	}
+	newRepoPulls := map[uint32]*datastore.RepoPull{}
+	changedRepoPulls := []*datastore.RepoPull{}
+	for _, rp := range rps {
+		if w.touchedRepoPulls[rp.ID] {
+			continue
+		}
+		rp, _ = rollUpRepoPull(rp, rpJobs[rp.ID])
+		newRepoPulls[rp.ID] = rp
+		prev, ok := w.repoPulls[rp.ID]
+		switch {
+		case !w.primed:
+		case !ok:
+			env.events.publish(EventRepoPullCreated, map[string]interface{}{"repopull": rp})
+		case prev.Status != rp.Status || prev.Health != rp.Health:
+			changedRepoPulls = append(changedRepoPulls, rp)
+		}
+	}
+	newJobs := map[uint32]*datastore.Job{}
+	for _, j := range jobs {
+		if w.touchedJobs[j.ID] {
+			continue
+		}
+		cp := *j
+		j = &cp
+		newJobs[j.ID] = j
+		prev, ok := w.jobs[j.ID]
+		switch {
+		case !w.primed:
+		case !ok:
+			env.events.publish(EventJobCreated, map[string]interface{}{"job": j})
+		case prev.Status != j.Status || prev.Health != j.Health:
+			env.events.publish(EventJobStatusChanged, map[string]interface{}{
+				"job":             j,
+				"previous_status": prev.Status,
+				"previous_health": prev.Health,
+			})
+		}
+	}
+
+	// repo pulls whose status changed, after the job changes that
+	// caused them
+	for _, rp := range changedRepoPulls {
+		prev := w.repoPulls[rp.ID]
+		env.events.publish(EventRepoPullStatusChanged, map[string]interface{}{
+			"repopull":        rp,
+			"previous_status": prev.Status,
+			"previous_health": prev.Health,
+		})
+	}
+
+	// and ones that are gone; jobs first, since they are usually
+	// deleted along with their repo pull
+	if w.primed {
+		deletedJobs := []uint32{}
+		for id := range w.jobs {
+			if _, ok := newJobs[id]; !ok && !w.touchedJobs[id] {
+				deletedJobs = append(deletedJobs, id)
+			}
+		}
+		sortIDs(deletedJobs)
+		for _, id := range deletedJobs {
+			env.events.publish(EventJobDeleted, map[string]interface{}{"job": w.jobs[id]})
+		}
+
+		deletedRepoPulls := []uint32{}
+		for id := range w.repoPulls {
+			if _, ok := newRepoPulls[id]; !ok && !w.touchedRepoPulls[id] {
+				deletedRepoPulls = append(deletedRepoPulls, id)
+			}
+		}
+		sortIDs(deletedRepoPulls)
+		for _, id := range deletedRepoPulls {
+			env.events.publish(EventRepoPullDeleted, map[string]interface{}{"repopull": w.repoPulls[id]})
+		}
+	}
+	for id := range w.touchedRepoPulls {
+		if rp, ok := w.repoPulls[id]; ok {
+			newRepoPulls[id] = rp
+		}
+	}
+	for id := range w.touchedJobs {
+		if j, ok := w.jobs[id]; ok {
+			newJobs[id] = j
+		}
+	}
+	w.repoPulls = newRepoPulls
+	w.jobs = newJobs
+
+	newAgents := map[uint32]bool{}
+	for _, a := range agents {
+		newAgents[a.ID] = a.IsActive
+		wasActive, ok := w.agents[a.ID]
+		if w.primed && ok && wasActive && !a.IsActive {
+			env.events.publish(EventAgentInactive, map[string]interface{}{
+				"agent": a,
+			})
+		}
+	}
+	w.agents = newAgents
+
+	w.primed = true
+}
+
+// sortIDs sorts ids in increasing order.
+func sortIDs(ids []uint32) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
@@ -0,0 +1,446 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Delivery settings for outbound webhooks.
+const (
+	// webhookMaxAttempts is how many times a delivery is tried
+	// before it is marked as failed.
+	webhookMaxAttempts = 5
+	// webhookBaseBackoff is the wait after the first failed
+	// attempt; it doubles after each further failure.
+	webhookBaseBackoff = 2 * time.Second
+	// webhookTimeout limits how long a single attempt may take.
+	webhookTimeout = 10 * time.Second
+	// webhookMaxDeliveries is how many deliveries are kept in the
+	// log for each webhook; older ones are dropped.
+	webhookMaxDeliveries = 100
+	// webhookSaveDelay is how long changes to the delivery logs are
+	// gathered before they are saved together.
+	webhookSaveDelay = time.Second
+)
+
+// Statuses for webhook deliveries.
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+)
+
+// webhook is an admin's subscription to one or more event types.
+type webhook struct {
+	ID       uint32   `json:"id"`
+	URL      string   `json:"url"`
+	Secret   string   `json:"secret"`
+	Events   []string `json:"events"`
+	IsActive bool     `json:"is_active"`
+}
+
+// webhookView is how a webhook is shown through the API. The
+// secret is write-only, so it is left out.
+type webhookView struct {
+	ID       uint32   `json:"id"`
+	URL      string   `json:"url"`
+	Events   []string `json:"events"`
+	IsActive bool     `json:"is_active"`
+}
+
+func (wh *webhook) view() *webhookView {
+	return &webhookView{ID: wh.ID, URL: wh.URL, Events: wh.Events, IsActive: wh.IsActive}
+}
+
+// wants reports whether the webhook should receive an event of
+// the given type.
+func (wh *webhook) wants(eventType string) bool {
+	if !wh.IsActive {
+		return false
+	}
+	for _, e := range wh.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// deliveryAttempt records one try at sending a delivery.
+type deliveryAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// webhookDelivery is one event sent (or being sent) to one webhook.
+type webhookDelivery struct {
+	ID           uint32            `json:"id"`
+	WebhookID    uint32            `json:"webhook_id"`
+	Event        string            `json:"event"`
+	Status       string            `json:"status"`
+	RedeliveryOf uint32            `json:"redelivery_of,omitempty"`
+	Attempts     []deliveryAttempt `json:"attempts"`
+	Payload      json.RawMessage   `json:"payload"`
+}
+
+// webhookState is the part of the webhook store that is saved
+// to APISTATEDIR.
+type webhookState struct {
+	NextID         uint32             `json:"next_id"`
+	NextDeliveryID uint32             `json:"next_delivery_id"`
+	Webhooks       []*webhook         `json:"webhooks"`
+	Deliveries     []*webhookDelivery `json:"deliveries"`
+}
+
+// webhookStore holds webhook subscriptions and their delivery
+// logs, and sends deliveries when events are published.
+type webhookStore struct {
+	mu             sync.Mutex
+	stateDir       string
+	nextID         uint32
+	nextDeliveryID uint32
+	hooks          map[uint32]*webhook
+	// deliveries holds each webhook's log, oldest first
+	deliveries map[uint32][]*webhookDelivery
+
+	// saveMu orders saves, so that an older state is never written
+	// over a newer one; saveQueued is signalled when the delivery
+	// logs have changed and need to be saved
+	saveMu     sync.Mutex
+	saveQueued chan struct{}
+
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	saveDelay   time.Duration
+}
+
+// newWebhookStore creates a webhook store, loading any saved
+// state from stateDir.
+func newWebhookStore(stateDir string) (*webhookStore, error) {
+	ws := &webhookStore{
+		stateDir:       stateDir,
+		saveQueued:     make(chan struct{}, 1),
+		nextID:         1,
+		nextDeliveryID: 1,
+		hooks:          map[uint32]*webhook{},
+		deliveries:     map[uint32][]*webhookDelivery{},
+		client:         &http.Client{Timeout: webhookTimeout},
+		maxAttempts:    webhookMaxAttempts,
+		backoff:        webhookBaseBackoff,
+		saveDelay:      webhookSaveDelay,
+	}
+
+	var st webhookState
+	if err := loadState(stateDir, "webhooks", &st); err != nil {
+		return nil, err
+	}
+	if st.NextID > 0 {
+		ws.nextID = st.NextID
+	}
+	if st.NextDeliveryID > 0 {
+		ws.nextDeliveryID = st.NextDeliveryID
+	}
+	for _, wh := range st.Webhooks {
+		ws.hooks[wh.ID] = wh
+	}
+	for _, d := range st.Deliveries {
+		// deliveries that were in flight when the server stopped
+		// will not be retried
+		if d.Status == deliveryPending {
+			d.Status = deliveryFailed
+		}
+		ws.deliveries[d.WebhookID] = append(ws.deliveries[d.WebhookID], d)
+	}
+	if stateDir != "" {
+		go ws.saveQueuedChanges()
+	}
+	return ws, nil
+}
+
+// save writes the store's state to its state directory, if any. The
+// state is copied while holding ws.mu, which the caller must not
+// hold, and written to disk after releasing it.
+func (ws *webhookStore) save() {
+	ws.saveMu.Lock()
+	defer ws.saveMu.Unlock()
+
+	ws.mu.Lock()
+	st := webhookState{
+		NextID:         ws.nextID,
+		NextDeliveryID: ws.nextDeliveryID,
+		Webhooks:       ws.listLocked(),
+		Deliveries:     []*webhookDelivery{},
+	}
+	for _, wh := range st.Webhooks {
+		st.Deliveries = append(st.Deliveries, ws.deliveries[wh.ID]...)
+	}
+	data, err := json.Marshal(&st)
+	ws.mu.Unlock()
+	if err == nil {
+		err = saveState(ws.stateDir, "webhooks", json.RawMessage(data))
+	}
+	if err != nil {
+		log.Printf("error saving webhooks: %v", err)
+	}
+}
+
+// queueSave has the delivery logs saved soon, in the background,
+// so that events and deliveries don't wait for the disk.
+func (ws *webhookStore) queueSave() {
+	select {
+	case ws.saveQueued <- struct{}{}:
+	default:
+		// a save is already queued, and will include this change
+	}
+}
+
+// saveQueuedChanges saves the store whenever a save is queued,
+// gathering the changes made within ws.saveDelay into one save.
+func (ws *webhookStore) saveQueuedChanges() {
+	for range ws.saveQueued {
+		time.Sleep(ws.saveDelay)
+		ws.save()
+	}
+}
+
+func (ws *webhookStore) listLocked() []*webhook {
+	hooks := []*webhook{}
+	for id := uint32(1); id < ws.nextID; id++ {
+		if wh, ok := ws.hooks[id]; ok {
+			hooks = append(hooks, wh)
+		}
+	}
+	return hooks
+}
+
+// list returns copies of all webhooks, ordered by ID.
+func (ws *webhookStore) list() []*webhook {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	hooks := []*webhook{}
+	for _, wh := range ws.listLocked() {
+		cp := *wh
+		hooks = append(hooks, &cp)
+	}
+	return hooks
+}
+
+// get returns a copy of the webhook with the given ID.
+func (ws *webhookStore) get(id uint32) (*webhook, bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	wh, ok := ws.hooks[id]
+	if !ok {
+		return nil, false
+	}
+	cp := *wh
+	return &cp, true
+}
+
+// add stores a new webhook and returns its ID. Changes to the
+// webhooks themselves are saved before returning.
+func (ws *webhookStore) add(wh *webhook) uint32 {
+	ws.mu.Lock()
+	wh.ID = ws.nextID
+	ws.nextID++
+	ws.hooks[wh.ID] = wh
+	ws.mu.Unlock()
+	ws.save()
+	return wh.ID
+}
+
+// update replaces an existing webhook.
+func (ws *webhookStore) update(wh *webhook) bool {
+	ws.mu.Lock()
+	if _, ok := ws.hooks[wh.ID]; !ok {
+		ws.mu.Unlock()
+		return false
+	}
+	ws.hooks[wh.ID] = wh
+	ws.mu.Unlock()
+	ws.save()
+	return true
+}
+
+// remove deletes a webhook and its delivery log.
+func (ws *webhookStore) remove(id uint32) bool {
+	ws.mu.Lock()
+	if _, ok := ws.hooks[id]; !ok {
+		ws.mu.Unlock()
+		return false
+	}
+	delete(ws.hooks, id)
+	delete(ws.deliveries, id)
+	ws.mu.Unlock()
+	ws.save()
+	return true
+}
+
+// listDeliveries returns copies of a webhook's deliveries, most
+// recent first.
+func (ws *webhookStore) listDeliveries(id uint32) []*webhookDelivery {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	entries := ws.deliveries[id]
+	ds := []*webhookDelivery{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		cp := *entries[i]
+		cp.Attempts = append([]deliveryAttempt{}, entries[i].Attempts...)
+		ds = append(ds, &cp)
+	}
+	return ds
+}
+
+// findDelivery returns the delivery with the given ID for the
+// given webhook. The caller must hold ws.mu.
+func (ws *webhookStore) findDelivery(hookID uint32, deliveryID uint32) *webhookDelivery {
+	for _, d := range ws.deliveries[hookID] {
+		if d.ID == deliveryID {
+			return d
+		}
+	}
+	return nil
+}
+
+// newDelivery adds a pending delivery to a webhook's log, dropping
+// the oldest entry if the log is full. The caller must hold ws.mu.
+func (ws *webhookStore) newDelivery(hookID uint32, eventType string, payload []byte, redeliveryOf uint32) *webhookDelivery {
+	d := &webhookDelivery{
+		ID:           ws.nextDeliveryID,
+		WebhookID:    hookID,
+		Event:        eventType,
+		Status:       deliveryPending,
+		RedeliveryOf: redeliveryOf,
+		Attempts:     []deliveryAttempt{},
+		Payload:      payload,
+	}
+	ws.nextDeliveryID++
+	entries := append(ws.deliveries[hookID], d)
+	if len(entries) > webhookMaxDeliveries {
+		entries = entries[len(entries)-webhookMaxDeliveries:]
+	}
+	ws.deliveries[hookID] = entries
+	ws.queueSave()
+	return d
+}
+
+// handleEvent starts a delivery of ev to each webhook that has
+// subscribed to it. It is called from the event bus, so the
+// deliveries themselves are sent in the background.
+func (ws *webhookStore) handleEvent(ev *event) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("error marshalling event %d: %v", ev.Seq, err)
+		return
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for _, wh := range ws.listLocked() {
+		if wh.wants(ev.Type) {
+			d := ws.newDelivery(wh.ID, ev.Type, payload, 0)
+			go ws.deliver(wh.ID, d.ID)
+		}
+	}
+}
+
+// redeliver starts a new delivery of an earlier delivery's payload,
+// and returns the new delivery's ID.
+func (ws *webhookStore) redeliver(hookID uint32, deliveryID uint32) (uint32, bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	old := ws.findDelivery(hookID, deliveryID)
+	if old == nil {
+		return 0, false
+	}
+	d := ws.newDelivery(hookID, old.Event, old.Payload, old.ID)
+	go ws.deliver(hookID, d.ID)
+	return d.ID, true
+}
+
+// signPayload returns the value of the X-Peridot-Signature-256
+// header for the given secret and payload.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver sends a delivery to its webhook, retrying with
+// exponential backoff until it succeeds or runs out of attempts.
+func (ws *webhookStore) deliver(hookID uint32, deliveryID uint32) {
+	wait := ws.backoff
+	for attempt := 1; ; attempt++ {
+		ws.mu.Lock()
+		wh, whOK := ws.hooks[hookID]
+		d := ws.findDelivery(hookID, deliveryID)
+		if !whOK || d == nil {
+			// the webhook was deleted, or the delivery was
+			// dropped from the log
+			ws.mu.Unlock()
+			return
+		}
+		url, secret, eventType, payload := wh.URL, wh.Secret, d.Event, d.Payload
+		ws.mu.Unlock()
+
+		result := deliveryAttempt{Time: time.Now().UTC()}
+		req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("User-Agent", "peridot-webhooks")
+			req.Header.Set("X-Peridot-Event", eventType)
+			req.Header.Set("X-Peridot-Delivery", strconv.FormatUint(uint64(deliveryID), 10))
+			req.Header.Set("X-Peridot-Signature-256", signPayload(secret, payload))
+			var resp *http.Response
+			resp, err = ws.client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				result.StatusCode = resp.StatusCode
+				if resp.StatusCode < 200 || resp.StatusCode > 299 {
+					err = fmt.Errorf("unexpected status %s", resp.Status)
+				}
+			}
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		ws.mu.Lock()
+		d = ws.findDelivery(hookID, deliveryID)
+		if d == nil {
+			ws.mu.Unlock()
+			return
+		}
+		d.Attempts = append(d.Attempts, result)
+		done := true
+		switch {
+		case err == nil:
+			d.Status = deliverySucceeded
+		case attempt >= ws.maxAttempts:
+			d.Status = deliveryFailed
+		default:
+			done = false
+		}
+		ws.queueSave()
+		ws.mu.Unlock()
+
+		if done {
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
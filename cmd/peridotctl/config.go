@@ -0,0 +1,221 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/swinslow/peridot-api/pkg/client"
+)
+
+// defaultProfile is the name of the profile used if none is given.
+const defaultProfile = "default"
+
+// profile is a peridot server and the token used to access it.
+type profile struct {
+	Server string `json:"server"`
+	Token  string `json:"token,omitempty"`
+}
+
+// config is the peridotctl configuration file. It holds one or
+// more named profiles, one of which is current.
+type config struct {
+	Current  string              `json:"current,omitempty"`
+	Profiles map[string]*profile `json:"profiles"`
+
+	path string
+}
+
+// defaultConfigPath returns the path of the config file: the value
+// of PERIDOTCTL_CONFIG if set, or else .config/peridotctl/config.json
+// in the user's home directory.
+func defaultConfigPath() string {
+	if p := os.Getenv("PERIDOTCTL_CONFIG"); p != "" {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "peridotctl.json"
+	}
+	return filepath.Join(home, ".config", "peridotctl", "config.json")
+}
+
+// loadConfig reads the config file at path. A missing file is
+// treated as an empty config.
+func loadConfig(path string) (*config, error) {
+	cfg := &config{Profiles: map[string]*profile{}, path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config: %v", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse config %s: %v", path, err)
+	}
+	if cfg.Profiles == nil {
+		cfg.Profiles = map[string]*profile{}
+	}
+	return cfg, nil
+}
+
+// save writes the config back to its file. Since it holds tokens,
+// it is only readable by the user.
+func (cfg *config) save() error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.path), 0700); err != nil {
+		return fmt.Errorf("unable to write config: %v", err)
+	}
+	if err := ioutil.WriteFile(cfg.path, data, 0600); err != nil {
+		return fmt.Errorf("unable to write config: %v", err)
+	}
+	return nil
+}
+
+// profileName returns name, or the current profile if name is
+// empty, or the default profile if there is no current one.
+func (cfg *config) profileName(name string) string {
+	if name != "" {
+		return name
+	}
+	if cfg.Current != "" {
+		return cfg.Current
+	}
+	return defaultProfile
+}
+
+// profile returns the named profile, or the current profile if
+// name is empty. It returns nil if there is no such profile.
+func (cfg *config) profile(name string) *profile {
+	return cfg.Profiles[cfg.profileName(name)]
+}
+
+func init() {
+	register("login", "[-server url] [-token token] [-no-browser]", runLogin)
+	register("logout", "", runLogout)
+	register("profile ls", "", runProfileList)
+	register("profile use", "<name>", runProfileUse)
+}
+
+// runLogin obtains a token for a server and saves it in a profile,
+// which becomes the current profile. Unless a token is given with
+// -token, it signs in through the API's GitHub login in a browser
+// (see browserLogin).
+func runLogin(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("login")
+	fs.StringVar(&c.server, "server", c.server, "API server URL")
+	fs.StringVar(&c.token, "token", c.token, "API token to save instead of signing in")
+	noBrowser := fs.Bool("no-browser", false, "print the sign-in URL instead of opening a browser")
+	if _, err := parseArgs(fs, args, 0, false); err != nil {
+		return err
+	}
+
+	name := c.cfg.profileName(c.profile)
+	server := c.server
+	if server == "" {
+		if p := c.cfg.Profiles[name]; p != nil {
+			server = p.Server
+		}
+	}
+	if server == "" {
+		return usageError("no server given; use -server URL")
+	}
+	server = strings.TrimSuffix(server, "/")
+
+	token := c.token
+	if token == "" {
+		var err error
+		token, err = c.browserLogin(ctx, server, !*noBrowser)
+		if err != nil {
+			return err
+		}
+	}
+
+	// make sure the token works before saving it
+	cl, err := client.New(server, client.WithToken(token))
+	if err != nil {
+		return err
+	}
+	if _, err := cl.ListUsers(ctx, &client.ListOptions{Limit: 1}); err != nil {
+		if client.IsUnauthorized(err) {
+			return fmt.Errorf("token was not accepted by %s", server)
+		}
+		return err
+	}
+
+	c.cfg.Profiles[name] = &profile{Server: server, Token: token}
+	c.cfg.Current = name
+	if err := c.cfg.save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stderr, "Logged in to %s (profile %q)\n", server, name)
+	return nil
+}
+
+// runLogout forgets the token for a profile, but keeps its server.
+func runLogout(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseArgs(newFlagSet("logout"), args, 0, false); err != nil {
+		return err
+	}
+	name := c.cfg.profileName(c.profile)
+	p := c.cfg.Profiles[name]
+	if p == nil {
+		return fmt.Errorf("no profile %q", name)
+	}
+	p.Token = ""
+	return c.cfg.save()
+}
+
+func runProfileList(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseArgs(newFlagSet("profile ls"), args, 0, false); err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range c.cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type profileInfo struct {
+		Name     string `json:"name"`
+		Server   string `json:"server"`
+		HasToken bool   `json:"has_token"`
+		Current  bool   `json:"current"`
+	}
+	infos := []*profileInfo{}
+	t := &table{headers: []string{"", "NAME", "SERVER", "TOKEN"}}
+	for _, name := range names {
+		p := c.cfg.Profiles[name]
+		info := &profileInfo{Name: name, Server: p.Server, HasToken: p.Token != "", Current: name == c.cfg.Current}
+		infos = append(infos, info)
+		mark := ""
+		if info.Current {
+			mark = "*"
+		}
+		t.rows = append(t.rows, []string{mark, name, p.Server, yesNo(info.HasToken)})
+	}
+	return c.print(infos, t)
+}
+
+func runProfileUse(ctx context.Context, c *cli, args []string) error {
+	pos, err := parseArgs(newFlagSet("profile use"), args, 1, false)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.cfg.Profiles[pos[0]]; !ok {
+		return fmt.Errorf("no profile %q", pos[0])
+	}
+	c.cfg.Current = pos[0]
+	return c.cfg.save()
+}
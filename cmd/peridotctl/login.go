@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// loginTimeout is how long peridotctl waits for the user to sign in.
+const loginTimeout = 5 * time.Minute
+
+// loginResult is what the API sends back to the local callback.
+type loginResult struct {
+	token string
+	err   error
+}
+
+// browserLogin signs in to server through its GitHub login, and
+// returns the new token. It listens on a local port, and opens
+// <server>/auth/login in a browser with that port and a random nonce;
+// once the user has signed in, the API sends the browser back to the
+// port with the token and the same nonce.
+func (c *cli) browserLogin(ctx context.Context, server string, openBrowser bool) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(b)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("unable to listen for login: %v", err)
+	}
+	results := make(chan loginResult, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		// ignore anything that isn't the reply to this login
+		q := r.URL.Query()
+		if q.Get("nonce") != nonce {
+			http.Error(w, "Unexpected login; please run peridotctl login again.", http.StatusBadRequest)
+			return
+		}
+
+		var res loginResult
+		switch {
+		case q.Get("error") != "":
+			res.err = fmt.Errorf("login failed: %s", q.Get("error"))
+		case q.Get("token") == "":
+			res.err = fmt.Errorf("login failed: no token received")
+		default:
+			res.token = q.Get("token")
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if res.err != nil {
+			fmt.Fprintf(w, "<html><body><p>peridotctl: %s</p></body></html>", html.EscapeString(res.err.Error()))
+		} else {
+			fmt.Fprintf(w, "<html><body><p>Logged in to peridot. You can close this window and return to peridotctl.</p></body></html>")
+		}
+		select {
+		case results <- res:
+		default:
+		}
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	v := url.Values{}
+	v.Set("cli_port", fmt.Sprintf("%d", ln.Addr().(*net.TCPAddr).Port))
+	v.Set("cli_nonce", nonce)
+	loginURL := server + "/auth/login?" + v.Encode()
+	if openBrowser {
+		fmt.Fprintf(c.stderr, "Opening a browser to sign in with GitHub. If it doesn't open, visit:\n%s\n", loginURL)
+		if err := c.openBrowser(loginURL); err != nil {
+			fmt.Fprintf(c.stderr, "peridotctl: unable to open browser: %v\n", err)
+		}
+	} else {
+		fmt.Fprintf(c.stderr, "Visit this URL in a browser on this machine to sign in with GitHub:\n%s\n", loginURL)
+	}
+	fmt.Fprintf(c.stderr, "Waiting for login...\n")
+
+	select {
+	case res := <-results:
+		return res.token, res.err
+	case <-time.After(loginTimeout):
+		return "", fmt.Errorf("timed out waiting for login")
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// openURL opens a URL in the user's default browser.
+func openURL(u string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", u).Start()
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", u).Start()
+	default:
+		return exec.Command("xdg-open", u).Start()
+	}
+}
@@ -0,0 +1,182 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+// Command peridotctl manages a peridot server from the command
+// line, using the peridot API.
+//
+// Usage:
+//
+//	peridotctl [global flags] <resource> <action> [args] [flags]
+//
+// Run "peridotctl help" for the list of commands.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/swinslow/peridot-api/pkg/client"
+)
+
+// cli holds the state for a single run of peridotctl.
+type cli struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	configPath string
+	profile    string
+	server     string
+	token      string
+	output     string
+
+	cfg *config
+
+	// openBrowser opens a URL in the user's browser, to sign in.
+	openBrowser func(url string) error
+}
+
+// command is a peridotctl action on a resource.
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *cli, args []string) error
+}
+
+// commands maps "<resource> <action>" to the command that runs it.
+var commands = map[string]*command{}
+
+func register(name string, usage string, run func(ctx context.Context, c *cli, args []string) error) {
+	commands[name] = &command{usage: usage, run: run}
+}
+
+func main() {
+	c := &cli{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr, openBrowser: openURL}
+	os.Exit(c.run(context.Background(), os.Args[1:]))
+}
+
+// run parses the global flags and runs the requested command,
+// returning the process exit code.
+func (c *cli) run(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("peridotctl", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.StringVar(&c.configPath, "config", defaultConfigPath(), "path to config file")
+	fs.StringVar(&c.profile, "profile", "", "config profile to use (default: the current profile)")
+	fs.StringVar(&c.server, "server", "", "API server URL (overrides profile)")
+	fs.StringVar(&c.token, "token", "", "API token (overrides profile)")
+	fs.StringVar(&c.output, "o", "table", "output format: table, json or yaml")
+	fs.Usage = func() { c.printUsage() }
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	args = fs.Args()
+
+	if len(args) == 0 || args[0] == "help" {
+		c.printUsage()
+		return 0
+	}
+	if c.output != "table" && c.output != "json" && c.output != "yaml" {
+		fmt.Fprintf(c.stderr, "peridotctl: invalid output format %q\n", c.output)
+		return 2
+	}
+
+	var err error
+	c.cfg, err = loadConfig(c.configPath)
+	if err != nil {
+		fmt.Fprintf(c.stderr, "peridotctl: %v\n", err)
+		return 1
+	}
+
+	// commands are either "<resource> <action>" or a single word
+	name := args[0]
+	rest := args[1:]
+	if _, ok := commands[name]; !ok && len(args) > 1 {
+		name = args[0] + " " + args[1]
+		rest = args[2:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(c.stderr, "peridotctl: unknown command %q; run \"peridotctl help\"\n", strings.Join(args, " "))
+		return 2
+	}
+
+	if err := cmd.run(ctx, c, rest); err != nil {
+		if err == flag.ErrHelp {
+			fmt.Fprintf(c.stderr, "usage: peridotctl %s %s\n", name, cmd.usage)
+			return 0
+		}
+		if _, ok := err.(usageError); ok {
+			fmt.Fprintf(c.stderr, "peridotctl: %v\nusage: peridotctl %s %s\n", err, name, cmd.usage)
+			return 2
+		}
+		fmt.Fprintf(c.stderr, "peridotctl: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func (c *cli) printUsage() {
+	fmt.Fprintf(c.stderr, "usage: peridotctl [-config path] [-profile name] [-server url] [-token token] [-o table|json|yaml] <command>\n\ncommands:\n")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(c.stderr, "  %s %s\n", name, commands[name].usage)
+	}
+}
+
+// usageError is an error in the arguments given to a command.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// parseArgs parses a command's flags, which may appear before,
+// after or between its positional arguments, and returns the
+// positional arguments. It fails unless there are exactly want of
+// them, or at least want if variadic is true.
+func parseArgs(fs *flag.FlagSet, args []string, want int, variadic bool) ([]string, error) {
+	fs.SetOutput(ioutil.Discard)
+	pos := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return nil, err
+			}
+			return nil, usageError(err.Error())
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		pos = append(pos, args[0])
+		args = args[1:]
+	}
+
+	if len(pos) < want || (!variadic && len(pos) > want) {
+		return nil, usageError(fmt.Sprintf("expected %d argument(s), got %d", want, len(pos)))
+	}
+	return pos, nil
+}
+
+// client creates an API client for the selected server and token.
+func (c *cli) client() (*client.Client, error) {
+	server, token := c.server, c.token
+	if p := c.cfg.profile(c.profile); p != nil {
+		if server == "" {
+			server = p.Server
+		}
+		if token == "" {
+			token = p.Token
+		}
+	}
+	if server == "" {
+		return nil, fmt.Errorf("no server configured; run \"peridotctl login -server URL\" first")
+	}
+	return client.New(server, client.WithToken(token))
+}
@@ -0,0 +1,267 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer is a minimal stand-in for the peridot API, which
+// records the last request body it received.
+type fakeServer struct {
+	*httptest.Server
+	lastBody map[string]interface{}
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	fs := &fakeServer{}
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// stands in for the GitHub sign-in, sending the browser
+		// straight back to the command-line client with a token
+		if r.URL.Path == "/auth/login" {
+			q := r.URL.Query()
+			v := url.Values{"nonce": {q.Get("cli_nonce")}, "token": {"good"}}
+			http.Redirect(w, r, "http://127.0.0.1:"+q.Get("cli_port")+"/callback?"+v.Encode(), http.StatusFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, `{"error": "Github user is not registered"}`)
+			return
+		}
+		fs.lastBody = nil
+		if r.Body != nil {
+			json.NewDecoder(r.Body).Decode(&fs.lastBody)
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /projects":
+			w.Header().Set("X-Total-Count", "2")
+			fmt.Fprintf(w, `{"projects": [{"id": 1, "name": "prj1", "fullname": "project 1"}, {"id": 2, "name": "prj2", "fullname": "project 2"}]}`)
+		case "GET /users":
+			fmt.Fprintf(w, `{"users": [{"id": 1, "github": "admin"}]}`)
+		case "POST /repopulls/3/jobs":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"id": 9}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return fs
+}
+
+// runCLI runs peridotctl with the given arguments and config file,
+// and returns its exit code, stdout and stderr.
+func runCLI(t *testing.T, configPath string, stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	c := &cli{stdin: strings.NewReader(stdin), stdout: &stdout, stderr: &stderr, openBrowser: followURL}
+	code := c.run(context.Background(), append([]string{"-config", configPath}, args...))
+	return code, stdout.String(), stderr.String()
+}
+
+// followURL stands in for a browser, by requesting a URL and
+// following its redirects.
+func followURL(u string) error {
+	go func() {
+		if resp, err := http.Get(u); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	return nil
+}
+
+func tempConfigPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "peridotctl")
+	if err != nil {
+		t.Fatalf("got non-nil error: %v", err)
+	}
+	return filepath.Join(dir, "config.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestParseArgsAllowsInterspersedFlags(t *testing.T) {
+	fs := newFlagSet("job create")
+	agent := fs.Uint("agent", 0, "")
+	after := fs.String("after", "", "")
+	pos, err := parseArgs(fs, []string{"3", "-agent", "4", "-after", "5,7"}, 1, false)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(pos) != 1 || pos[0] != "3" || *agent != 4 || *after != "5,7" {
+		t.Errorf("unexpected parse: %v, %d, %s", pos, *agent, *after)
+	}
+
+	_, err = parseArgs(newFlagSet("project get"), []string{"1", "2"}, 1, false)
+	if _, ok := err.(usageError); !ok {
+		t.Errorf("expected usage error, got %v", err)
+	}
+}
+
+func TestLoginThroughBrowserSavesProfileAndListsProjects(t *testing.T) {
+	srv := newFakeServer(t)
+	defer srv.Close()
+	path, cleanup := tempConfigPath(t)
+	defer cleanup()
+
+	code, _, stderr := runCLI(t, path, "", "-profile", "dev", "login", "-server", srv.URL)
+	if code != 0 {
+		t.Fatalf("expected 0, got %d: %s", code, stderr)
+	}
+	if !strings.Contains(stderr, srv.URL+"/auth/login?cli_nonce=") {
+		t.Errorf("expected sign-in URL to be shown, got %s", stderr)
+	}
+
+	code, stdout, stderr := runCLI(t, path, "", "project", "ls")
+	if code != 0 {
+		t.Fatalf("expected 0, got %d: %s", code, stderr)
+	}
+	wanted := "ID  NAME  FULLNAME\n1   prj1  project 1\n2   prj2  project 2\n"
+	if stdout != wanted {
+		t.Errorf("expected %q, got %q", wanted, stdout)
+	}
+
+	code, stdout, _ = runCLI(t, path, "", "profile", "ls")
+	if code != 0 || !strings.Contains(stdout, "*  dev") {
+		t.Errorf("expected current dev profile, got %d: %q", code, stdout)
+	}
+
+	// logging out forgets the token
+	code, _, stderr = runCLI(t, path, "", "logout")
+	if code != 0 {
+		t.Fatalf("expected 0, got %d: %s", code, stderr)
+	}
+	code, _, stderr = runCLI(t, path, "", "project", "ls")
+	if code != 1 {
+		t.Errorf("expected 1 after logout, got %d: %s", code, stderr)
+	}
+}
+
+func TestBrowserLoginIgnoresCallbackWithWrongNonce(t *testing.T) {
+	var stderr bytes.Buffer
+	c := &cli{stderr: &stderr}
+	c.openBrowser = func(u string) error {
+		loc, err := url.Parse(u)
+		if err != nil {
+			return err
+		}
+		cb := "http://127.0.0.1:" + loc.Query().Get("cli_port") + "/callback?nonce=wrong&token=good"
+		resp, err := http.Get(cb)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected %d for wrong nonce, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if tkn, err := c.browserLogin(ctx, "http://peridot.example.com", true); err == nil {
+		t.Errorf("expected no login, got token %q", tkn)
+	}
+}
+
+func TestLoginWithTokenSavesProfile(t *testing.T) {
+	srv := newFakeServer(t)
+	defer srv.Close()
+	path, cleanup := tempConfigPath(t)
+	defer cleanup()
+
+	// a bad token is rejected and not saved
+	code, _, stderr := runCLI(t, path, "", "login", "-server", srv.URL, "-token", "bad")
+	if code != 1 || !strings.Contains(stderr, "not accepted") {
+		t.Errorf("expected rejected token, got %d: %s", code, stderr)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no config file, got %v", err)
+	}
+
+	code, _, stderr = runCLI(t, path, "", "-profile", "staging", "login", "-server", srv.URL, "-token", "good")
+	if code != 0 {
+		t.Fatalf("expected 0, got %d: %s", code, stderr)
+	}
+
+	code, stdout, _ := runCLI(t, path, "", "profile", "ls")
+	if code != 0 || !strings.Contains(stdout, "*  staging") {
+		t.Errorf("expected current staging profile, got %d: %q", code, stdout)
+	}
+}
+
+func TestOutputFormats(t *testing.T) {
+	srv := newFakeServer(t)
+	defer srv.Close()
+	path, cleanup := tempConfigPath(t)
+	defer cleanup()
+
+	code, stdout, stderr := runCLI(t, path, "", "-server", srv.URL, "-token", "good", "-o", "json", "project", "ls")
+	if code != 0 {
+		t.Fatalf("expected 0, got %d: %s", code, stderr)
+	}
+	var projects []map[string]interface{}
+	if err := json.Unmarshal([]byte(stdout), &projects); err != nil {
+		t.Fatalf("expected JSON output, got %q", stdout)
+	}
+	if len(projects) != 2 || projects[1]["name"] != "prj2" {
+		t.Errorf("unexpected JSON output: %q", stdout)
+	}
+
+	code, stdout, stderr = runCLI(t, path, "", "-server", srv.URL, "-token", "good", "-o", "yaml", "project", "ls")
+	if code != 0 {
+		t.Fatalf("expected 0, got %d: %s", code, stderr)
+	}
+	wanted := "- fullname: project 1\n  id: 1\n  name: prj1\n- fullname: project 2\n  id: 2\n  name: prj2\n"
+	if stdout != wanted {
+		t.Errorf("expected %q, got %q", wanted, stdout)
+	}
+}
+
+func TestJobCreateSendsPriorJobs(t *testing.T) {
+	srv := newFakeServer(t)
+	defer srv.Close()
+	path, cleanup := tempConfigPath(t)
+	defer cleanup()
+
+	code, stdout, stderr := runCLI(t, path, "", "-server", srv.URL, "-token", "good", "job", "create", "3", "-agent", "4", "-after", "5,7", "-ready")
+	if code != 0 {
+		t.Fatalf("expected 0, got %d: %s", code, stderr)
+	}
+	if stdout != "ID\n9\n" {
+		t.Errorf("expected %q, got %q", "ID\n9\n", stdout)
+	}
+	body := srv.lastBody
+	if body["agent_id"] != float64(4) || body["is_ready"] != true {
+		t.Errorf("unexpected request body: %#v", body)
+	}
+	prior, _ := body["priorjob_ids"].([]interface{})
+	if len(prior) != 2 || prior[0] != float64(5) || prior[1] != float64(7) {
+		t.Errorf("unexpected priorjob_ids: %#v", body["priorjob_ids"])
+	}
+}
+
+func TestUnknownCommandAndMissingArgs(t *testing.T) {
+	path, cleanup := tempConfigPath(t)
+	defer cleanup()
+
+	code, _, _ := runCLI(t, path, "", "project", "frobnicate")
+	if code != 2 {
+		t.Errorf("expected 2, got %d", code)
+	}
+	code, _, stderr := runCLI(t, path, "", "-server", "http://localhost:1", "job", "create", "3")
+	if code != 2 || !strings.Contains(stderr, "-agent is required") {
+		t.Errorf("expected usage error, got %d: %s", code, stderr)
+	}
+}
@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// table is the tabular form of a command's output.
+type table struct {
+	headers []string
+	rows    [][]string
+}
+
+// print writes a command's result in the selected output format:
+// t for table output, or v for JSON and YAML.
+func (c *cli) print(v interface{}, t *table) error {
+	switch c.output {
+	case "json":
+		js, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "%s\n", js)
+		return nil
+
+	case "yaml":
+		// go through JSON first, so that YAML uses the same
+		// field names and value formats as the API
+		js, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var generic interface{}
+		if err := yaml.Unmarshal(js, &generic); err != nil {
+			return err
+		}
+		y, err := yaml.Marshal(generic)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "%s", y)
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	if len(t.headers) > 0 {
+		fmt.Fprintln(tw, strings.Join(t.headers, "\t"))
+	}
+	for _, row := range t.rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// printCreated reports the ID of a newly created resource.
+func (c *cli) printCreated(id uint32) error {
+	v := map[string]uint32{"id": id}
+	t := &table{headers: []string{"ID"}, rows: [][]string{{u32(id)}}}
+	return c.print(v, t)
+}
+
+func u32(i uint32) string {
+	return strconv.FormatUint(uint64(i), 10)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// timeString formats a time for table output, leaving unset
+// times blank.
+func timeString(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// parseIDs parses a comma-separated list of IDs, such as "5,7".
+func parseIDs(s string) ([]uint32, error) {
+	ids := []uint32{}
+	if s == "" {
+		return ids, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		id, err := parseID(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseID parses a single resource ID.
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || id == 0 {
+		return 0, usageError(fmt.Sprintf("invalid ID %q", s))
+	}
+	return uint32(id), nil
+}
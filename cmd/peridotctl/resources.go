@@ -0,0 +1,1073 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/swinslow/peridot-api/pkg/client"
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
+func init() {
+	register("project ls", "[-label selector]", runProjectList)
+	register("project get", "<id>", runProjectGet)
+	register("project create", "<name> <fullname>", runProjectCreate)
+	register("project delete", "<id>", runProjectDelete)
+	register("project restore", "<id>", runProjectRestore)
+
+	register("subproject ls", "[-project id] [-label selector]", runSubprojectList)
+	register("subproject get", "<id>", runSubprojectGet)
+	register("subproject create", "-project id <name> <fullname>", runSubprojectCreate)
+	register("subproject delete", "<id>", runSubprojectDelete)
+	register("subproject restore", "<id>", runSubprojectRestore)
+
+	register("repo ls", "[-subproject id] [-label selector]", runRepoList)
+	register("repo get", "<id>", runRepoGet)
+	register("repo add", "-subproject id <name> <address>", runRepoAdd)
+	register("repo delete", "<id>", runRepoDelete)
+	register("repo restore", "<id>", runRepoRestore)
+
+	register("branch ls", "<repo-id> [-summary]", runBranchList)
+	register("branch add", "<repo-id> <branch>", runBranchAdd)
+
+	register("pull ls", "<repo-id> <branch>", runPullList)
+	register("pull find", "[-project id] [-subproject id] [-repo id] [-branch b] [-status s,...] [-health h,...] [-commit prefix] [-tag prefix] [-started-after t] [-started-before t] [-finished-after t] [-finished-before t] [-recent] [-limit n]", runPullFind)
+	register("pull get", "<id>", runPullGet)
+	register("pull compare", "<id> <other-id> [-files]", runPullCompare)
+	register("pull latest", "<repo-id> <branch> [-successful]", runPullLatest)
+	register("pull start", "<repo-id> <branch> (-commit sha | -resolve) [-tag tag]", runPullStart)
+	register("pull delete", "<id>", runPullDelete)
+
+	register("job ls", "<pull-id>", runJobList)
+	register("job get", "<id>", runJobGet)
+	register("job create", "<pull-id> -agent id [-after id,id,...] [-ready] [-kv key=value,...]", runJobCreate)
+	register("job ready", "<id>", runJobReady)
+	register("job delete", "<id>", runJobDelete)
+
+	register("agent ls", "", runAgentList)
+	register("agent get", "<id>", runAgentGet)
+	register("agent create", "<name> -address host -port n [-inactive] [-abilities codereader,spdxreader,codewriter,spdxwriter]", runAgentCreate)
+	register("agent delete", "<id>", runAgentDelete)
+
+	register("user ls", "", runUserList)
+	register("user get", "<id>", runUserGet)
+	register("user create", "<name> <github> <access>", runUserCreate)
+
+	register("admin reset-db", "-yes", runAdminResetDB)
+
+	register("label get", "<projects|subprojects|repos> <id>", runLabelGet)
+	register("label set", "<projects|subprojects|repos> <id> [key=value ...] [-remove key,...]", runLabelSet)
+
+	register("search", "<query> [-type project,repo,...] [-limit n]", runSearch)
+}
+
+// simpleIDCommand parses the single ID argument that many commands
+// take, and creates the API client.
+func simpleIDCommand(c *cli, name string, args []string) (*client.Client, uint32, error) {
+	pos, err := parseArgs(newFlagSet(name), args, 1, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	id, err := parseID(pos[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	cl, err := c.client()
+	return cl, id, err
+}
+
+// ===== projects =====
+
+func projectsTable(projects []*client.Project) *table {
+	t := &table{headers: []string{"ID", "NAME", "FULLNAME"}}
+	for _, p := range projects {
+		t.rows = append(t.rows, []string{u32(p.ID), p.Name, p.Fullname})
+	}
+	return t
+}
+
+func runProjectList(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("project ls")
+	label := fs.String("label", "", "only list projects matching this label selector")
+	if _, err := parseArgs(fs, args, 0, false); err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	if *label != "" {
+		projects, err := cl.ListProjects(ctx, &client.ListOptions{Label: *label})
+		if err != nil {
+			return err
+		}
+		return c.print(projects, projectsTable(projects))
+	}
+	projects := []*client.Project{}
+	it := cl.Projects(0)
+	for it.Next(ctx) {
+		projects = append(projects, it.Project())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return c.print(projects, projectsTable(projects))
+}
+
+func runProjectGet(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "project get", args)
+	if err != nil {
+		return err
+	}
+	p, err := cl.GetProject(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.print(p, projectsTable([]*client.Project{p}))
+}
+
+func runProjectCreate(ctx context.Context, c *cli, args []string) error {
+	pos, err := parseArgs(newFlagSet("project create"), args, 2, false)
+	if err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	id, err := cl.CreateProject(ctx, pos[0], pos[1])
+	if err != nil {
+		return err
+	}
+	return c.printCreated(id)
+}
+
+func runProjectDelete(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "project delete", args)
+	if err != nil {
+		return err
+	}
+	return cl.DeleteProject(ctx, id)
+}
+
+func runProjectRestore(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "project restore", args)
+	if err != nil {
+		return err
+	}
+	return cl.RestoreProject(ctx, id)
+}
+
+// ===== subprojects =====
+
+func subprojectsTable(subprojects []*client.Subproject) *table {
+	t := &table{headers: []string{"ID", "PROJECT", "NAME", "FULLNAME"}}
+	for _, sp := range subprojects {
+		t.rows = append(t.rows, []string{u32(sp.ID), u32(sp.ProjectID), sp.Name, sp.Fullname})
+	}
+	return t
+}
+
+func runSubprojectList(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("subproject ls")
+	projectID := fs.Uint("project", 0, "only list subprojects in this project")
+	label := fs.String("label", "", "only list subprojects matching this label selector")
+	if _, err := parseArgs(fs, args, 0, false); err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	if *label != "" {
+		opts := &client.ListOptions{Label: *label}
+		var subprojects []*client.Subproject
+		if *projectID != 0 {
+			subprojects, err = cl.ListSubprojectsForProject(ctx, uint32(*projectID), opts)
+		} else {
+			subprojects, err = cl.ListSubprojects(ctx, opts)
+		}
+		if err != nil {
+			return err
+		}
+		return c.print(subprojects, subprojectsTable(subprojects))
+	}
+	it := cl.Subprojects(0)
+	if *projectID != 0 {
+		it = cl.SubprojectsForProject(uint32(*projectID), 0)
+	}
+	subprojects := []*client.Subproject{}
+	for it.Next(ctx) {
+		subprojects = append(subprojects, it.Subproject())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return c.print(subprojects, subprojectsTable(subprojects))
+}
+
+func runSubprojectGet(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "subproject get", args)
+	if err != nil {
+		return err
+	}
+	sp, err := cl.GetSubproject(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.print(sp, subprojectsTable([]*client.Subproject{sp}))
+}
+
+func runSubprojectCreate(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("subproject create")
+	projectID := fs.Uint("project", 0, "project to create the subproject in")
+	pos, err := parseArgs(fs, args, 2, false)
+	if err != nil {
+		return err
+	}
+	if *projectID == 0 {
+		return usageError("-project is required")
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	id, err := cl.CreateSubproject(ctx, uint32(*projectID), pos[0], pos[1])
+	if err != nil {
+		return err
+	}
+	return c.printCreated(id)
+}
+
+func runSubprojectDelete(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "subproject delete", args)
+	if err != nil {
+		return err
+	}
+	return cl.DeleteSubproject(ctx, id)
+}
+
+func runSubprojectRestore(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "subproject restore", args)
+	if err != nil {
+		return err
+	}
+	return cl.RestoreSubproject(ctx, id)
+}
+
+// ===== repos and branches =====
+
+func reposTable(repos []*client.Repo) *table {
+	t := &table{headers: []string{"ID", "SUBPROJECT", "NAME", "ADDRESS"}}
+	for _, r := range repos {
+		t.rows = append(t.rows, []string{u32(r.ID), u32(r.SubprojectID), r.Name, r.Address})
+	}
+	return t
+}
+
+func runRepoList(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("repo ls")
+	subprojectID := fs.Uint("subproject", 0, "only list repos in this subproject")
+	label := fs.String("label", "", "only list repos matching this label selector")
+	if _, err := parseArgs(fs, args, 0, false); err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	if *label != "" {
+		opts := &client.ListOptions{Label: *label}
+		var repos []*client.Repo
+		if *subprojectID != 0 {
+			repos, err = cl.ListReposForSubproject(ctx, uint32(*subprojectID), opts)
+		} else {
+			repos, err = cl.ListRepos(ctx, opts)
+		}
+		if err != nil {
+			return err
+		}
+		return c.print(repos, reposTable(repos))
+	}
+	it := cl.Repos(0)
+	if *subprojectID != 0 {
+		it = cl.ReposForSubproject(uint32(*subprojectID), 0)
+	}
+	repos := []*client.Repo{}
+	for it.Next(ctx) {
+		repos = append(repos, it.Repo())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return c.print(repos, reposTable(repos))
+}
+
+func runRepoGet(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "repo get", args)
+	if err != nil {
+		return err
+	}
+	r, err := cl.GetRepo(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.print(r, reposTable([]*client.Repo{r}))
+}
+
+func runRepoAdd(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("repo add")
+	subprojectID := fs.Uint("subproject", 0, "subproject to add the repo to")
+	pos, err := parseArgs(fs, args, 2, false)
+	if err != nil {
+		return err
+	}
+	if *subprojectID == 0 {
+		return usageError("-subproject is required")
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	id, err := cl.CreateRepo(ctx, uint32(*subprojectID), pos[0], pos[1])
+	if err != nil {
+		return err
+	}
+	return c.printCreated(id)
+}
+
+func runRepoDelete(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "repo delete", args)
+	if err != nil {
+		return err
+	}
+	return cl.DeleteRepo(ctx, id)
+}
+
+func runRepoRestore(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "repo restore", args)
+	if err != nil {
+		return err
+	}
+	return cl.RestoreRepo(ctx, id)
+}
+
+func runBranchList(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("branch ls")
+	summary := fs.Bool("summary", false, "show each branch's latest pull")
+	pos, err := parseArgs(fs, args, 1, false)
+	if err != nil {
+		return err
+	}
+	repoID, err := parseID(pos[0])
+	if err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	if *summary {
+		summaries, err := cl.ListBranchSummaries(ctx, repoID, nil)
+		if err != nil {
+			return err
+		}
+		t := &table{headers: []string{"BRANCH", "PULLS", "LATEST", "COMMIT", "STATUS", "HEALTH", "STARTED", "LAST OK"}}
+		for _, bs := range summaries {
+			row := []string{bs.Branch, strconv.Itoa(bs.Pulls), "", "", "", "", "", ""}
+			if rp := bs.Latest; rp != nil {
+				row[2], row[3] = u32(rp.ID), rp.Commit
+				row[4], row[5] = datastore.StringFromStatus(rp.Status), datastore.StringFromHealth(rp.Health)
+				row[6] = timeString(rp.StartedAt)
+			}
+			if bs.LatestSuccessfulID != 0 {
+				row[7] = u32(bs.LatestSuccessfulID)
+			}
+			t.rows = append(t.rows, row)
+		}
+		return c.print(summaries, t)
+	}
+	branches := []string{}
+	it := cl.Branches(repoID, 0)
+	for it.Next(ctx) {
+		branches = append(branches, it.Branch())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	t := &table{headers: []string{"BRANCH"}}
+	for _, b := range branches {
+		t.rows = append(t.rows, []string{b})
+	}
+	return c.print(branches, t)
+}
+
+func runBranchAdd(ctx context.Context, c *cli, args []string) error {
+	pos, err := parseArgs(newFlagSet("branch add"), args, 2, false)
+	if err != nil {
+		return err
+	}
+	repoID, err := parseID(pos[0])
+	if err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	return cl.CreateBranch(ctx, repoID, pos[1])
+}
+
+// ===== repo pulls =====
+
+func pullsTable(pulls []*client.RepoPull) *table {
+	t := &table{headers: []string{"ID", "REPO", "BRANCH", "COMMIT", "STATUS", "HEALTH", "STARTED", "FINISHED"}}
+	for _, rp := range pulls {
+		t.rows = append(t.rows, []string{
+			u32(rp.ID), u32(rp.RepoID), rp.Branch, rp.Commit,
+			datastore.StringFromStatus(rp.Status), datastore.StringFromHealth(rp.Health),
+			timeString(rp.StartedAt), timeString(rp.FinishedAt),
+		})
+	}
+	return t
+}
+
+func runPullList(ctx context.Context, c *cli, args []string) error {
+	pos, err := parseArgs(newFlagSet("pull ls"), args, 2, false)
+	if err != nil {
+		return err
+	}
+	repoID, err := parseID(pos[0])
+	if err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	pulls := []*client.RepoPull{}
+	it := cl.RepoPulls(repoID, pos[1], 0)
+	for it.Next(ctx) {
+		pulls = append(pulls, it.RepoPull())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return c.print(pulls, pullsTable(pulls))
+}
+
+func runPullFind(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("pull find")
+	projectID := fs.Uint("project", 0, "only find pulls in this project")
+	subprojectID := fs.Uint("subproject", 0, "only find pulls in this subproject")
+	repoID := fs.Uint("repo", 0, "only find pulls of this repo")
+	branch := fs.String("branch", "", "only find pulls of this branch")
+	statuses := fs.String("status", "", "only find pulls with one of these statuses")
+	healths := fs.String("health", "", "only find pulls with one of these healths")
+	commit := fs.String("commit", "", "only find pulls whose commit starts with this")
+	tag := fs.String("tag", "", "only find pulls whose tag starts with this")
+	times := map[string]*string{}
+	for _, name := range []string{"started-after", "started-before", "finished-after", "finished-before"} {
+		times[name] = fs.String(name, "", "RFC 3339 time, e.g. 2019-06-01T00:00:00Z")
+	}
+	recent := fs.Bool("recent", false, "list the most recently started pulls first")
+	limit := fs.Int("limit", 0, "find at most this many pulls")
+	if _, err := parseArgs(fs, args, 0, false); err != nil {
+		return err
+	}
+
+	filter := &client.RepoPullFilter{
+		ProjectID:    uint32(*projectID),
+		SubprojectID: uint32(*subprojectID),
+		RepoID:       uint32(*repoID),
+		Branch:       *branch,
+		Commit:       *commit,
+		Tag:          *tag,
+		Recent:       *recent,
+	}
+	if *statuses != "" {
+		filter.Statuses = strings.Split(*statuses, ",")
+	}
+	if *healths != "" {
+		filter.Healths = strings.Split(*healths, ",")
+	}
+	fields := map[string]*time.Time{
+		"started-after":   &filter.StartedAfter,
+		"started-before":  &filter.StartedBefore,
+		"finished-after":  &filter.FinishedAfter,
+		"finished-before": &filter.FinishedBefore,
+	}
+	for name, s := range times {
+		if *s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, *s)
+		if err != nil {
+			return usageError(fmt.Sprintf("invalid time %q for -%s", *s, name))
+		}
+		*fields[name] = t
+	}
+
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	pulls, err := cl.FindRepoPulls(ctx, filter, &client.ListOptions{Limit: *limit})
+	if err != nil {
+		return err
+	}
+	return c.print(pulls, pullsTable(pulls))
+}
+
+func runPullGet(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "pull get", args)
+	if err != nil {
+		return err
+	}
+	rp, err := cl.GetRepoPull(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.print(rp, pullsTable([]*client.RepoPull{rp}))
+}
+
+func runPullCompare(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("pull compare")
+	files := fs.Bool("files", false, "list the files that differ instead of the jobs")
+	pos, err := parseArgs(fs, args, 2, false)
+	if err != nil {
+		return err
+	}
+	fromID, err := parseID(pos[0])
+	if err != nil {
+		return err
+	}
+	toID, err := parseID(pos[1])
+	if err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	cmp, err := cl.CompareRepoPulls(ctx, fromID, toID, nil)
+	if err != nil {
+		return err
+	}
+	if *files {
+		version := func(f *client.ComparedFile) string {
+			if f == nil || len(f.SHA256) < 12 {
+				return ""
+			}
+			return f.SHA256[:12]
+		}
+		t := &table{headers: []string{"PATH", "CHANGE", "FROM", "TO"}}
+		for _, fc := range cmp.Files {
+			t.rows = append(t.rows, []string{fc.Path, fc.Change, version(fc.From), version(fc.To)})
+		}
+		return c.print(cmp, t)
+	}
+	outcome := func(j *client.ComparedJob) string {
+		if j == nil {
+			return ""
+		}
+		return fmt.Sprintf("%d %s/%s", j.ID, datastore.StringFromStatus(j.Status), datastore.StringFromHealth(j.Health))
+	}
+	t := &table{headers: []string{"AGENT", "CHANGE", "FROM", "TO"}}
+	for _, jc := range cmp.Jobs {
+		t.rows = append(t.rows, []string{u32(jc.AgentID), jc.Change, outcome(jc.From), outcome(jc.To)})
+	}
+	return c.print(cmp, t)
+}
+
+func runPullLatest(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("pull latest")
+	successful := fs.Bool("successful", false, "only the latest pull that stopped without error")
+	pos, err := parseArgs(fs, args, 2, false)
+	if err != nil {
+		return err
+	}
+	repoID, err := parseID(pos[0])
+	if err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	rp, err := cl.GetLatestRepoPull(ctx, repoID, pos[1], *successful)
+	if err != nil {
+		return err
+	}
+	return c.print(rp, pullsTable([]*client.RepoPull{rp}))
+}
+
+func runPullStart(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("pull start")
+	commit := fs.String("commit", "", "full commit ID to pull")
+	resolve := fs.Bool("resolve", false, "pull the tag's commit, or else the top of the branch, in place of -commit")
+	tag := fs.String("tag", "", "tag of the commit to pull")
+	pos, err := parseArgs(fs, args, 2, false)
+	if err != nil {
+		return err
+	}
+	repoID, err := parseID(pos[0])
+	if err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	id, err := cl.StartRepoPull(ctx, repoID, pos[1], &client.RepoPullRequest{Commit: *commit, Resolve: *resolve, Tag: *tag})
+	if err != nil {
+		return err
+	}
+	return c.printCreated(id)
+}
+
+func runPullDelete(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "pull delete", args)
+	if err != nil {
+		return err
+	}
+	return cl.DeleteRepoPull(ctx, id)
+}
+
+// ===== jobs =====
+
+func jobsTable(jobs []*client.Job) *table {
+	t := &table{headers: []string{"ID", "PULL", "AGENT", "AFTER", "READY", "STATUS", "HEALTH", "OUTPUT"}}
+	for _, j := range jobs {
+		after := []string{}
+		for _, id := range j.PriorJobIDs {
+			after = append(after, u32(id))
+		}
+		t.rows = append(t.rows, []string{
+			u32(j.ID), u32(j.RepoPullID), u32(j.AgentID), strings.Join(after, ","), yesNo(j.IsReady),
+			datastore.StringFromStatus(j.Status), datastore.StringFromHealth(j.Health), j.Output,
+		})
+	}
+	return t
+}
+
+func runJobList(ctx context.Context, c *cli, args []string) error {
+	cl, pullID, err := simpleIDCommand(c, "job ls", args)
+	if err != nil {
+		return err
+	}
+	jobs := []*client.Job{}
+	it := cl.Jobs(pullID, 0)
+	for it.Next(ctx) {
+		jobs = append(jobs, it.Job())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return c.print(jobs, jobsTable(jobs))
+}
+
+func runJobGet(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "job get", args)
+	if err != nil {
+		return err
+	}
+	j, err := cl.GetJob(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.print(j, jobsTable([]*client.Job{j}))
+}
+
+func runJobCreate(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("job create")
+	agentID := fs.Uint("agent", 0, "agent to run the job")
+	after := fs.String("after", "", "comma-separated IDs of jobs that must finish first")
+	ready := fs.Bool("ready", false, "mark the job as ready to run")
+	kv := fs.String("kv", "", "comma-separated key=value configuration")
+	pos, err := parseArgs(fs, args, 1, false)
+	if err != nil {
+		return err
+	}
+	pullID, err := parseID(pos[0])
+	if err != nil {
+		return err
+	}
+	if *agentID == 0 {
+		return usageError("-agent is required")
+	}
+	priorIDs, err := parseIDs(*after)
+	if err != nil {
+		return err
+	}
+	req := &client.JobRequest{AgentID: uint32(*agentID), PriorJobIDs: priorIDs, IsReady: *ready}
+	if *kv != "" {
+		req.Config.KV = map[string]string{}
+		for _, pair := range strings.Split(*kv, ",") {
+			kvs := strings.SplitN(pair, "=", 2)
+			if len(kvs) != 2 {
+				return usageError(fmt.Sprintf("invalid -kv value %q; expected key=value", pair))
+			}
+			req.Config.KV[kvs[0]] = kvs[1]
+		}
+	}
+
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	id, err := cl.CreateJob(ctx, pullID, req)
+	if err != nil {
+		return err
+	}
+	return c.printCreated(id)
+}
+
+func runJobReady(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "job ready", args)
+	if err != nil {
+		return err
+	}
+	return cl.SetJobReady(ctx, id, true)
+}
+
+func runJobDelete(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "job delete", args)
+	if err != nil {
+		return err
+	}
+	return cl.DeleteJob(ctx, id)
+}
+
+// ===== agents =====
+
+func agentsTable(agents []*client.Agent) *table {
+	t := &table{headers: []string{"ID", "NAME", "ACTIVE", "ADDRESS", "ABILITIES"}}
+	for _, a := range agents {
+		abilities := []string{}
+		if a.IsCodeReader {
+			abilities = append(abilities, "codereader")
+		}
+		if a.IsSpdxReader {
+			abilities = append(abilities, "spdxreader")
+		}
+		if a.IsCodeWriter {
+			abilities = append(abilities, "codewriter")
+		}
+		if a.IsSpdxWriter {
+			abilities = append(abilities, "spdxwriter")
+		}
+		t.rows = append(t.rows, []string{
+			u32(a.ID), a.Name, yesNo(a.IsActive), fmt.Sprintf("%s:%d", a.Address, a.Port), strings.Join(abilities, ","),
+		})
+	}
+	return t
+}
+
+func runAgentList(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseArgs(newFlagSet("agent ls"), args, 0, false); err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	agents := []*client.Agent{}
+	it := cl.Agents(0)
+	for it.Next(ctx) {
+		agents = append(agents, it.Agent())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return c.print(agents, agentsTable(agents))
+}
+
+func runAgentGet(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "agent get", args)
+	if err != nil {
+		return err
+	}
+	a, err := cl.GetAgent(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.print(a, agentsTable([]*client.Agent{a}))
+}
+
+func runAgentCreate(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("agent create")
+	address := fs.String("address", "", "agent host address")
+	port := fs.Int("port", 0, "agent port")
+	inactive := fs.Bool("inactive", false, "register the agent as inactive")
+	abilities := fs.String("abilities", "", "comma-separated abilities: codereader, spdxreader, codewriter, spdxwriter")
+	pos, err := parseArgs(fs, args, 1, false)
+	if err != nil {
+		return err
+	}
+	if *address == "" || *port == 0 {
+		return usageError("-address and -port are required")
+	}
+	a := &client.Agent{Name: pos[0], IsActive: !*inactive, Address: *address, Port: *port}
+	if *abilities != "" {
+		for _, ab := range strings.Split(*abilities, ",") {
+			switch strings.TrimSpace(ab) {
+			case "codereader":
+				a.IsCodeReader = true
+			case "spdxreader":
+				a.IsSpdxReader = true
+			case "codewriter":
+				a.IsCodeWriter = true
+			case "spdxwriter":
+				a.IsSpdxWriter = true
+			default:
+				return usageError(fmt.Sprintf("unknown ability %q", ab))
+			}
+		}
+	}
+
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	id, err := cl.CreateAgent(ctx, a)
+	if err != nil {
+		return err
+	}
+	return c.printCreated(id)
+}
+
+func runAgentDelete(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "agent delete", args)
+	if err != nil {
+		return err
+	}
+	return cl.DeleteAgent(ctx, id)
+}
+
+// ===== users =====
+
+func usersTable(users []*client.User) *table {
+	t := &table{headers: []string{"ID", "GITHUB", "NAME", "ACCESS"}}
+	for _, u := range users {
+		// non-admins only see IDs and GitHub names
+		access := ""
+		if u.AccessLevel != datastore.AccessDisabled || u.Name != "" {
+			access = datastore.StringFromUserAccessLevel(u.AccessLevel)
+		}
+		t.rows = append(t.rows, []string{u32(u.ID), u.Github, u.Name, access})
+	}
+	return t
+}
+
+func runUserList(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseArgs(newFlagSet("user ls"), args, 0, false); err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	users := []*client.User{}
+	it := cl.Users(0)
+	for it.Next(ctx) {
+		users = append(users, it.User())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return c.print(users, usersTable(users))
+}
+
+func runUserGet(ctx context.Context, c *cli, args []string) error {
+	cl, id, err := simpleIDCommand(c, "user get", args)
+	if err != nil {
+		return err
+	}
+	u, err := cl.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.print(u, usersTable([]*client.User{u}))
+}
+
+func runUserCreate(ctx context.Context, c *cli, args []string) error {
+	pos, err := parseArgs(newFlagSet("user create"), args, 3, false)
+	if err != nil {
+		return err
+	}
+	access, err := datastore.UserAccessLevelFromString(pos[2])
+	if err != nil {
+		return usageError(fmt.Sprintf("invalid access level %q", pos[2]))
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	id, err := cl.CreateUser(ctx, pos[0], pos[1], access)
+	if err != nil {
+		return err
+	}
+	return c.printCreated(id)
+}
+
+// ===== admin =====
+
+func runAdminResetDB(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("admin reset-db")
+	yes := fs.Bool("yes", false, "confirm that all data should be destroyed")
+	if _, err := parseArgs(fs, args, 0, false); err != nil {
+		return err
+	}
+	if !*yes {
+		return usageError("this destroys all data; pass -yes to confirm")
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	return cl.ResetDB(ctx)
+}
+
+// ===== labels =====
+
+func labelsTable(labels map[string]string) *table {
+	keys := []string{}
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	t := &table{headers: []string{"KEY", "VALUE"}}
+	for _, k := range keys {
+		t.rows = append(t.rows, []string{k, labels[k]})
+	}
+	return t
+}
+
+// parseLabelResource parses the type and ID of a resource with
+// labels.
+func parseLabelResource(kind string, idStr string) (string, uint32, error) {
+	switch kind {
+	case client.LabelsProject, client.LabelsSubproject, client.LabelsRepo:
+	default:
+		return "", 0, usageError(fmt.Sprintf("invalid resource %q; must be projects, subprojects or repos", kind))
+	}
+	id, err := parseID(idStr)
+	return kind, id, err
+}
+
+func runLabelGet(ctx context.Context, c *cli, args []string) error {
+	pos, err := parseArgs(newFlagSet("label get"), args, 2, false)
+	if err != nil {
+		return err
+	}
+	kind, id, err := parseLabelResource(pos[0], pos[1])
+	if err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	labels, err := cl.GetLabels(ctx, kind, id)
+	if err != nil {
+		return err
+	}
+	return c.print(labels, labelsTable(labels))
+}
+
+func runLabelSet(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("label set")
+	remove := fs.String("remove", "", "comma-separated keys of labels to remove")
+	pos, err := parseArgs(fs, args, 2, true)
+	if err != nil {
+		return err
+	}
+	kind, id, err := parseLabelResource(pos[0], pos[1])
+	if err != nil {
+		return err
+	}
+	changes := map[string]*string{}
+	for _, kv := range pos[2:] {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return usageError(fmt.Sprintf("invalid label %q; expected key=value", kv))
+		}
+		changes[parts[0]] = &parts[1]
+	}
+	if *remove != "" {
+		for _, k := range strings.Split(*remove, ",") {
+			changes[strings.TrimSpace(k)] = nil
+		}
+	}
+	if len(changes) == 0 {
+		return usageError("no labels to set or remove")
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	labels, err := cl.UpdateLabels(ctx, kind, id, changes)
+	if err != nil {
+		return err
+	}
+	return c.print(labels, labelsTable(labels))
+}
+
+// ===== search =====
+
+func runSearch(ctx context.Context, c *cli, args []string) error {
+	fs := newFlagSet("search")
+	types := fs.String("type", "", "only return these types of result")
+	limit := fs.Int("limit", 0, "return at most this many results")
+	pos, err := parseArgs(fs, args, 1, false)
+	if err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	typeList := []string{}
+	if *types != "" {
+		typeList = strings.Split(*types, ",")
+	}
+	results, err := cl.Search(ctx, pos[0], typeList, &client.ListOptions{Limit: *limit})
+	if err != nil {
+		return err
+	}
+	t := &table{headers: []string{"TYPE", "ID", "NAME", "MATCH", "WHERE"}}
+	for _, r := range results {
+		id := ""
+		if r.ID != 0 {
+			id = u32(r.ID)
+		}
+		where := []string{}
+		if r.ProjectID != 0 {
+			where = append(where, "project "+u32(r.ProjectID))
+		}
+		if r.SubprojectID != 0 {
+			where = append(where, "subproject "+u32(r.SubprojectID))
+		}
+		if r.RepoID != 0 {
+			where = append(where, "repo "+u32(r.RepoID))
+		}
+		whereStr := strings.Join(where, " / ")
+		if r.InTrash {
+			whereStr += " (in trash)"
+		}
+		t.rows = append(t.rows, []string{r.Type, id, r.Name, r.Field + ": " + r.Match, whereStr})
+	}
+	return c.print(results, t)
+}
@@ -23,4 +23,5 @@ require (
 	golang.org/x/net v0.0.0-20191119073136-fc4aabc6c914 // indirect
 	golang.org/x/oauth2 v0.0.0-20191122200657-5d9234df094c
 	google.golang.org/appengine v1.6.5 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-github/v25/github"
+	"golang.org/x/oauth2"
+)
+
+// ErrGithubOwnerNotFound is returned by ListGithubRepos if the
+// Github organization or user does not exist.
+var ErrGithubOwnerNotFound = errors.New("Github organization or user not found")
+
+// GithubRepo is the Github data about a repository that is
+// needed to register it with peridot.
+type GithubRepo struct {
+	Name          string
+	CloneURL      string
+	DefaultBranch string
+	Archived      bool
+	Fork          bool
+}
+
+// ListGithubRepos returns all repositories owned by the given
+// Github organization, or by the given user if isUser is true.
+// apiURL is the base URL of the Github API, or empty for
+// api.github.com. token is an optional Github access token; without
+// one, only public repositories are listed and Github's rate limits
+// are much lower.
+func ListGithubRepos(ctx context.Context, apiURL string, token string, owner string, isUser bool) ([]*GithubRepo, error) {
+	var hc *http.Client
+	if token != "" {
+		hc = oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}))
+	}
+	client := github.NewClient(hc)
+	if apiURL != "" {
+		if !strings.HasSuffix(apiURL, "/") {
+			apiURL += "/"
+		}
+		u, err := url.Parse(apiURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Github API URL %s: %v", apiURL, err)
+		}
+		client.BaseURL = u
+	}
+
+	repos := []*GithubRepo{}
+	opt := github.ListOptions{PerPage: 100}
+	for {
+		var ghRepos []*github.Repository
+		var resp *github.Response
+		var err error
+		if isUser {
+			ghRepos, resp, err = client.Repositories.List(ctx, owner, &github.RepositoryListOptions{ListOptions: opt})
+		} else {
+			ghRepos, resp, err = client.Repositories.ListByOrg(ctx, owner, &github.RepositoryListByOrgOptions{ListOptions: opt})
+		}
+		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				return nil, ErrGithubOwnerNotFound
+			}
+			return nil, fmt.Errorf("could not list Github repositories: %v", err)
+		}
+
+		for _, r := range ghRepos {
+			repos = append(repos, &GithubRepo{
+				Name:          r.GetName(),
+				CloneURL:      r.GetCloneURL(),
+				DefaultBranch: r.GetDefaultBranch(),
+				Archived:      r.GetArchived(),
+				Fork:          r.GetFork(),
+			})
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	return repos, nil
+}
@@ -26,19 +26,24 @@ func main() {
 		log.Panic(err)
 	}
 
+	// start watching for changes made outside the API
+	env.StartWatchers()
+
 	// create router and register handlers
 	router := mux.NewRouter()
 
 	env.RegisterHandlers(router)
 
 	// set up CORS
-	headers := []string{"X-Requested-With", "Content-Type", "Authorization"}
-	methods := []string{"GET", "POST", "PUT", "HEAD", "OPTIONS"}
+	headers := []string{"X-Requested-With", "Content-Type", "Authorization", "If-Match", "If-None-Match", "Idempotency-Key", "Last-Event-ID"}
+	methods := []string{"GET", "POST", "PUT", "PATCH", "HEAD", "OPTIONS"}
 	origins := []string{"http://localhost:3000"}
+	exposed := []string{"ETag", "Idempotent-Replayed", "X-Total-Count"}
 	cors := gh.CORS(
 		gh.AllowedHeaders(headers),
 		gh.AllowedMethods(methods),
-		gh.AllowedOrigins(origins))
+		gh.AllowedOrigins(origins),
+		gh.ExposedHeaders(exposed))
 
 	fmt.Println("Listening on :" + WEBPORT)
 	log.Fatal(http.ListenAndServe(":"+WEBPORT, cors(router)))
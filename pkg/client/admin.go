@@ -0,0 +1,46 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// BatchOperation is one creation within a batch. See the /batch
+// endpoint's documentation for how refs are used.
+type BatchOperation struct {
+	Ref  string      `json:"ref,omitempty"`
+	Path string      `json:"path"`
+	Body interface{} `json:"body,omitempty"`
+}
+
+// BatchResult is the outcome of one operation within a batch.
+type BatchResult struct {
+	Ref    string          `json:"ref,omitempty"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// ResetDB drops and recreates the peridot database. It requires
+// admin access, and destroys all data.
+func (c *Client) ResetDB(ctx context.Context) error {
+	in := map[string]string{"command": "resetDB"}
+	_, err := c.do(ctx, "POST", "/admin/db", nil, in, nil)
+	return err
+}
+
+// Batch runs several creations as one unit. If any of them fails,
+// all of them are undone and an error is returned.
+func (c *Client) Batch(ctx context.Context, ops []*BatchOperation) ([]*BatchResult, error) {
+	in := struct {
+		Operations []*BatchOperation `json:"operations"`
+	}{Operations: ops}
+	out := struct {
+		Results []*BatchResult `json:"results"`
+	}{}
+	if _, err := c.do(ctx, "POST", "/batch", nil, in, &out); err != nil {
+		return nil, err
+	}
+	return out.Results, nil
+}
@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package client
+
+import (
+	"context"
+	"fmt"
+)
+
+// AgentUpdate holds the values to change in an agent. Nil fields
+// are left unchanged.
+type AgentUpdate struct {
+	IsActive     *bool   `json:"is_active,omitempty"`
+	Address      *string `json:"address,omitempty"`
+	Port         *int    `json:"port,omitempty"`
+	IsCodeReader *bool   `json:"is_codereader,omitempty"`
+	IsSpdxReader *bool   `json:"is_spdxreader,omitempty"`
+	IsCodeWriter *bool   `json:"is_codewriter,omitempty"`
+	IsSpdxWriter *bool   `json:"is_spdxwriter,omitempty"`
+}
+
+// ListAgents gets all agents, or the part of the list selected by
+// opts.
+func (c *Client) ListAgents(ctx context.Context, opts *ListOptions) ([]*Agent, error) {
+	agents := []*Agent{}
+	_, err := c.list(ctx, "/agents", "agents", opts, &agents)
+	return agents, err
+}
+
+// Agents returns an iterator over all agents, fetching pageSize at
+// a time.
+func (c *Client) Agents(pageSize int) *AgentIterator {
+	return &AgentIterator{p: newPager(c, "/agents", "agents", pageSize)}
+}
+
+// GetAgent gets the agent with the given ID.
+func (c *Client) GetAgent(ctx context.Context, id uint32) (*Agent, error) {
+	out := struct {
+		Agent *Agent `json:"agent"`
+	}{}
+	if _, err := c.do(ctx, "GET", fmt.Sprintf("/agents/%d", id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Agent, nil
+}
+
+// CreateAgent registers a new agent, and returns its ID. The
+// agent's ID field is ignored.
+func (c *Client) CreateAgent(ctx context.Context, a *Agent) (uint32, error) {
+	return c.create(ctx, "/agents", a)
+}
+
+// UpdateAgent changes the given values of an agent.
+func (c *Client) UpdateAgent(ctx context.Context, id uint32, u *AgentUpdate) error {
+	_, err := c.do(ctx, "PUT", fmt.Sprintf("/agents/%d", id), nil, u, nil)
+	return err
+}
+
+// DeleteAgent deletes an agent.
+func (c *Client) DeleteAgent(ctx context.Context, id uint32) error {
+	_, err := c.do(ctx, "DELETE", fmt.Sprintf("/agents/%d", id), nil, nil, nil)
+	return err
+}
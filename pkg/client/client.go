@@ -0,0 +1,204 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+// Package client is a Go client for the peridot API. It provides
+// typed methods for each of the API's endpoints, and returns the
+// same resource types that the API server uses from the peridot-db
+// datastore package.
+//
+// A Client is created with the server's base URL and, usually, the
+// bearer token returned by the server's GitHub login flow:
+//
+//	c, err := client.New("http://localhost:3001", client.WithToken(token))
+//	projects, err := c.ListProjects(ctx, nil)
+//
+// Every method takes a context, which can be used to cancel the
+// request or to set a deadline for it.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client talks to a peridot API server.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithToken sets the bearer token that the Client sends with
+// each request.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithHTTPClient sets the http.Client that is used to send
+// requests. By default, http.DefaultClient is used.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// New creates a Client for the API server at baseURL, such as
+// "http://localhost:3001".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL %q: %v", baseURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base URL %q: scheme must be http or https", baseURL)
+	}
+
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// BaseURL returns the base URL of the API server.
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+// SetToken replaces the bearer token that the Client sends with
+// each request.
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// do sends a request to the API and decodes the JSON response
+// into out, if out is not nil. If in is not nil, it is encoded as
+// the JSON request body. It returns the HTTP response, whose body
+// has already been read and closed, so that callers can look at
+// its headers.
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var body io.Reader
+	if in != nil {
+		js, err := json.Marshal(in)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode request: %v", err)
+		}
+		body = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		// prefer the context's error, if that is why we failed
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode >= 400 {
+		return resp, newError(resp.StatusCode, data)
+	}
+
+	// the API reports some errors, such as database retrieval
+	// errors, with a 200 status; catch those too
+	if len(data) > 0 {
+		errJS := struct {
+			Error *string `json:"error"`
+		}{}
+		if json.Unmarshal(data, &errJS) == nil && errJS.Error != nil {
+			return resp, &Error{StatusCode: resp.StatusCode, Message: *errJS.Error}
+		}
+		if out != nil {
+			if err := json.Unmarshal(data, out); err != nil {
+				return resp, fmt.Errorf("unable to decode response: %v", err)
+			}
+		}
+	}
+
+	return resp, nil
+}
+
+// idResponse is the response to a request that creates a resource.
+type idResponse struct {
+	ID uint32 `json:"id"`
+}
+
+// create sends a POST request that creates a resource, and returns
+// the new resource's ID.
+func (c *Client) create(ctx context.Context, path string, in interface{}) (uint32, error) {
+	var out idResponse
+	if _, err := c.do(ctx, "POST", path, nil, in, &out); err != nil {
+		return 0, err
+	}
+	return out.ID, nil
+}
+
+// Hello checks whether the API server is responding, and returns
+// its greeting.
+func (c *Client) Hello(ctx context.Context) (string, error) {
+	out := struct {
+		Message string `json:"message"`
+	}{}
+	if _, err := c.do(ctx, "GET", "/hello", nil, nil, &out); err != nil {
+		return "", err
+	}
+	return out.Message, nil
+}
+
+// String returns a pointer to s, for use in update requests.
+func String(s string) *string {
+	return &s
+}
+
+// Bool returns a pointer to b, for use in update requests.
+func Bool(b bool) *bool {
+	return &b
+}
+
+// Int returns a pointer to i, for use in update requests.
+func Int(i int) *int {
+	return &i
+}
+
+// Uint32 returns a pointer to i, for use in update requests.
+func Uint32(i uint32) *uint32 {
+	return &i
+}
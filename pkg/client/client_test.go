@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewRejectsInvalidBaseURL(t *testing.T) {
+	_, err := New("localhost:3001")
+	if err == nil {
+		t.Errorf("expected non-nil error, got nil")
+	}
+	c, err := New("http://localhost:3001/")
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if c.BaseURL() != "http://localhost:3001" {
+		t.Errorf("expected %s, got %s", "http://localhost:3001", c.BaseURL())
+	}
+}
+
+func TestClientSendsBearerToken(t *testing.T) {
+	var gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		fmt.Fprintf(w, `{"message": "hello"}`)
+	}))
+	defer srv.Close()
+
+	c, _ := New(srv.URL, WithToken("abc"))
+	msg, err := c.Hello(context.Background())
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if msg != "hello" {
+		t.Errorf("expected %s, got %s", "hello", msg)
+	}
+	if gotAuth != "Bearer abc" {
+		t.Errorf("expected %s, got %s", "Bearer abc", gotAuth)
+	}
+}
+
+func TestClientDecodesErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/projects/1":
+			// errors with a 200 status are still errors
+			fmt.Fprintf(w, `{"error": "Database retrieval error"}`)
+		case "/projects/2":
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, `{"error": Authorization header with valid Bearer token required}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	c, _ := New(srv.URL)
+	ctx := context.Background()
+
+	_, err := c.GetProject(ctx, 1)
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != 200 || e.Message != "Database retrieval error" {
+		t.Errorf("expected database error, got %#v", err)
+	}
+
+	_, err = c.GetProject(ctx, 2)
+	if !IsUnauthorized(err) {
+		t.Errorf("expected unauthorized error, got %#v", err)
+	}
+	if e, ok := err.(*Error); !ok || e.Message != "Authorization header with valid Bearer token required" {
+		t.Errorf("expected bearer message, got %#v", err)
+	}
+
+	_, err = c.GetProject(ctx, 3)
+	if !IsNotFound(err) {
+		t.Errorf("expected not found error, got %#v", err)
+	}
+	if e, ok := err.(*Error); !ok || e.Message != "Not Found" {
+		t.Errorf("expected status text message, got %#v", err)
+	}
+}
+
+func TestClientHonorsContextCancellation(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c, _ := New(srv.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err := c.ListProjects(ctx, nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestIteratorRequestsPagesUntilTotal(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		w.Header().Set("X-Total-Count", "5")
+		fmt.Fprintf(w, `{"agents": [`)
+		for i := offset; i < offset+limit && i < 5; i++ {
+			if i > offset {
+				fmt.Fprintf(w, ",")
+			}
+			fmt.Fprintf(w, `{"id": %d}`, i+1)
+		}
+		fmt.Fprintf(w, `]}`)
+	}))
+	defer srv.Close()
+	c, _ := New(srv.URL)
+	ctx := context.Background()
+
+	got := []uint32{}
+	it := c.Agents(2)
+	for it.Next(ctx) {
+		got = append(got, it.Agent().ID)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(got) != 5 || got[4] != 5 {
+		t.Errorf("expected agents 1-5, got %v", got)
+	}
+	if requests != 3 {
+		t.Errorf("expected %d requests, got %d", 3, requests)
+	}
+}
+
+func TestIteratorStopsOnError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"error": "Access denied"}`)
+	}))
+	defer srv.Close()
+	c, _ := New(srv.URL)
+
+	it := c.Users(10)
+	if it.Next(context.Background()) {
+		t.Errorf("expected false, got true")
+	}
+	if !IsForbidden(it.Err()) {
+		t.Errorf("expected forbidden error, got %v", it.Err())
+	}
+}
@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error is an error returned by the API server.
+type Error struct {
+	// StatusCode is the HTTP status of the response. Some errors
+	// are reported by the server with a 200 status.
+	StatusCode int
+	// Message is the server's description of the error.
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("peridot API error (%d): %s", e.StatusCode, e.Message)
+}
+
+// newError creates an Error from the status and body of a failed
+// response. The body is usually a JSON object with an "error"
+// value, but anything else is used as the message as-is.
+func newError(status int, body []byte) *Error {
+	errJS := struct {
+		Error string `json:"error"`
+	}{}
+	msg := ""
+	if json.Unmarshal(body, &errJS) == nil {
+		msg = errJS.Error
+	} else {
+		// some auth failures are not quite valid JSON; strip
+		// the wrapper if it is there
+		msg = strings.TrimSpace(string(body))
+		if strings.HasPrefix(msg, `{"error": `) && strings.HasSuffix(msg, "}") {
+			msg = strings.TrimSuffix(strings.TrimPrefix(msg, `{"error": `), "}")
+		}
+	}
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	return &Error{StatusCode: status, Message: msg}
+}
+
+// hasStatus reports whether err is an *Error with the given
+// HTTP status.
+func hasStatus(err error, status int) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == status
+}
+
+// IsUnauthorized reports whether err means that the request had a
+// missing or invalid token, or a token for an unregistered user.
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized)
+}
+
+// IsForbidden reports whether err means that the user does not
+// have sufficient access for the request.
+func IsForbidden(err error) bool {
+	return hasStatus(err, http.StatusForbidden)
+}
+
+// IsNotFound reports whether err means that the requested
+// resource or endpoint does not exist.
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsBadRequest reports whether err means that the server
+// rejected the request's values.
+func IsBadRequest(err error) bool {
+	return hasStatus(err, http.StatusBadRequest)
+}
@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package client
+
+import (
+	"context"
+	"fmt"
+)
+
+// JobRequest describes a new job.
+type JobRequest struct {
+	// AgentID is the agent that will run the job.
+	AgentID uint32 `json:"agent_id"`
+	// PriorJobIDs are the jobs that must finish before this one
+	// can start.
+	PriorJobIDs []uint32 `json:"priorjob_ids,omitempty"`
+	// IsReady marks the job as ready to run once its prior jobs
+	// have finished.
+	IsReady bool `json:"is_ready"`
+	// Config is the configuration passed to the agent.
+	Config JobConfig `json:"config"`
+}
+
+// ListJobs gets the jobs for a repo pull, or the part of the list
+// selected by opts.
+func (c *Client) ListJobs(ctx context.Context, repoPullID uint32, opts *ListOptions) ([]*Job, error) {
+	jobs := []*Job{}
+	_, err := c.list(ctx, fmt.Sprintf("/repopulls/%d/jobs", repoPullID), "jobs", opts, &jobs)
+	return jobs, err
+}
+
+// Jobs returns an iterator over the jobs for a repo pull, fetching
+// pageSize at a time.
+func (c *Client) Jobs(repoPullID uint32, pageSize int) *JobIterator {
+	return &JobIterator{p: newPager(c, fmt.Sprintf("/repopulls/%d/jobs", repoPullID), "jobs", pageSize)}
+}
+
+// GetJob gets the job with the given ID.
+func (c *Client) GetJob(ctx context.Context, id uint32) (*Job, error) {
+	out := struct {
+		Job *Job `json:"job"`
+	}{}
+	if _, err := c.do(ctx, "GET", fmt.Sprintf("/jobs/%d", id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Job, nil
+}
+
+// CreateJob creates a new job for a repo pull, and returns its ID.
+func (c *Client) CreateJob(ctx context.Context, repoPullID uint32, req *JobRequest) (uint32, error) {
+	return c.create(ctx, fmt.Sprintf("/repopulls/%d/jobs", repoPullID), req)
+}
+
+// SetJobReady marks whether a job is ready to run.
+func (c *Client) SetJobReady(ctx context.Context, id uint32, ready bool) error {
+	in := map[string]bool{"is_ready": ready}
+	_, err := c.do(ctx, "PUT", fmt.Sprintf("/jobs/%d", id), nil, in, nil)
+	return err
+}
+
+// DeleteJob deletes a job.
+func (c *Client) DeleteJob(ctx context.Context, id uint32) error {
+	_, err := c.do(ctx, "DELETE", fmt.Sprintf("/jobs/%d", id), nil, nil, nil)
+	return err
+}
@@ -0,0 +1,49 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package client
+
+import (
+	"context"
+	"fmt"
+)
+
+// Types of resource that can have labels, for the labels methods.
+const (
+	LabelsProject    = "projects"
+	LabelsSubproject = "subprojects"
+	LabelsRepo       = "repos"
+)
+
+// labelsResponse is the response to a request for labels.
+type labelsResponse struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// GetLabels gets the labels on a project, subproject or repo;
+// resource is one of LabelsProject, LabelsSubproject or LabelsRepo.
+func (c *Client) GetLabels(ctx context.Context, resource string, id uint32) (map[string]string, error) {
+	out := &labelsResponse{}
+	if _, err := c.do(ctx, "GET", fmt.Sprintf("/%s/%d/labels", resource, id), nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out.Labels, nil
+}
+
+// SetLabels replaces the labels on a project, subproject or repo.
+func (c *Client) SetLabels(ctx context.Context, resource string, id uint32, labels map[string]string) error {
+	in := map[string]map[string]string{"labels": labels}
+	_, err := c.do(ctx, "PUT", fmt.Sprintf("/%s/%d/labels", resource, id), nil, in, nil)
+	return err
+}
+
+// UpdateLabels changes some of the labels on a project, subproject
+// or repo, leaving the others alone; a nil value removes a label.
+// It returns the labels as they now are.
+func (c *Client) UpdateLabels(ctx context.Context, resource string, id uint32, changes map[string]*string) (map[string]string, error) {
+	in := map[string]map[string]*string{"labels": changes}
+	out := &labelsResponse{}
+	if _, err := c.do(ctx, "PATCH", fmt.Sprintf("/%s/%d/labels", resource, id), nil, in, out); err != nil {
+		return nil, err
+	}
+	return out.Labels, nil
+}
@@ -0,0 +1,329 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+)
+
+// DefaultPageSize is the number of items that iterators request
+// from the server at a time, if no page size is given.
+const DefaultPageSize = 100
+
+// ListOptions selects part of a list. The zero value, or a nil
+// *ListOptions, selects the whole list.
+type ListOptions struct {
+	// Offset is the number of items to skip.
+	Offset int
+	// Limit is the largest number of items to return; zero means
+	// no limit.
+	Limit int
+	// Label is a label selector, such as "team=infra,tier!=low",
+	// for lists of projects, subprojects and repos.
+	Label string
+}
+
+// query returns the query parameters for these options.
+func (o *ListOptions) query() url.Values {
+	q := url.Values{}
+	if o == nil {
+		return q
+	}
+	if o.Offset > 0 {
+		q.Set("offset", strconv.Itoa(o.Offset))
+	}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Label != "" {
+		q.Set("label", o.Label)
+	}
+	return q
+}
+
+// list gets a list from path, and decodes the array found under key
+// in the response into out, which must be a pointer to a slice. It
+// returns the total number of items in the full list, as reported
+// by the server, or -1 if the server did not say.
+func (c *Client) list(ctx context.Context, path string, key string, opts *ListOptions, out interface{}) (int, error) {
+	var raw map[string]json.RawMessage
+	resp, err := c.do(ctx, "GET", path, opts.query(), nil, &raw)
+	if err != nil {
+		return 0, err
+	}
+	items, ok := raw[key]
+	if !ok {
+		return 0, fmt.Errorf("unable to decode response: missing %q", key)
+	}
+	if err := json.Unmarshal(items, out); err != nil {
+		return 0, fmt.Errorf("unable to decode response: %v", err)
+	}
+
+	total := -1
+	if s := resp.Header.Get("X-Total-Count"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil {
+			total = n
+		}
+	}
+	return total, nil
+}
+
+// pager fetches successive pages of a list.
+type pager struct {
+	c        *Client
+	path     string
+	key      string
+	pageSize int
+	offset   int
+	done     bool
+	err      error
+}
+
+func newPager(c *Client, path string, key string, pageSize int) *pager {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	return &pager{c: c, path: path, key: key, pageSize: pageSize}
+}
+
+// fetch gets the next page into out, which must be a pointer to a
+// slice, and returns the number of items on the page. Once the
+// list is exhausted or an error occurs, it returns 0.
+func (p *pager) fetch(ctx context.Context, out interface{}) int {
+	if p.done || p.err != nil {
+		return 0
+	}
+
+	opts := &ListOptions{Offset: p.offset, Limit: p.pageSize}
+	total, err := p.c.list(ctx, p.path, p.key, opts, out)
+	if err != nil {
+		p.err = err
+		return 0
+	}
+
+	n := reflect.ValueOf(out).Elem().Len()
+
+	p.offset += n
+	// a server that does not report a total count does not
+	// support paging, and has sent the whole list
+	if n == 0 || total < 0 || p.offset >= total {
+		p.done = true
+	}
+	return n
+}
+
+// ProjectIterator steps through a list of projects, fetching pages
+// from the server as needed. Call Next to advance to each project,
+// and check Err once Next returns false.
+type ProjectIterator struct {
+	p   *pager
+	buf []*Project
+	cur *Project
+}
+
+// Next advances to the next project, and reports whether there
+// is one.
+func (it *ProjectIterator) Next(ctx context.Context) bool {
+	for len(it.buf) == 0 {
+		it.buf = nil
+		if it.p.fetch(ctx, &it.buf) == 0 {
+			return false
+		}
+	}
+	it.cur, it.buf = it.buf[0], it.buf[1:]
+	return true
+}
+
+// Project returns the current project.
+func (it *ProjectIterator) Project() *Project { return it.cur }
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *ProjectIterator) Err() error { return it.p.err }
+
+// SubprojectIterator steps through a list of subprojects; see
+// ProjectIterator.
+type SubprojectIterator struct {
+	p   *pager
+	buf []*Subproject
+	cur *Subproject
+}
+
+// Next advances to the next subproject, and reports whether there
+// is one.
+func (it *SubprojectIterator) Next(ctx context.Context) bool {
+	for len(it.buf) == 0 {
+		it.buf = nil
+		if it.p.fetch(ctx, &it.buf) == 0 {
+			return false
+		}
+	}
+	it.cur, it.buf = it.buf[0], it.buf[1:]
+	return true
+}
+
+// Subproject returns the current subproject.
+func (it *SubprojectIterator) Subproject() *Subproject { return it.cur }
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *SubprojectIterator) Err() error { return it.p.err }
+
+// RepoIterator steps through a list of repos; see ProjectIterator.
+type RepoIterator struct {
+	p   *pager
+	buf []*Repo
+	cur *Repo
+}
+
+// Next advances to the next repo, and reports whether there is one.
+func (it *RepoIterator) Next(ctx context.Context) bool {
+	for len(it.buf) == 0 {
+		it.buf = nil
+		if it.p.fetch(ctx, &it.buf) == 0 {
+			return false
+		}
+	}
+	it.cur, it.buf = it.buf[0], it.buf[1:]
+	return true
+}
+
+// Repo returns the current repo.
+func (it *RepoIterator) Repo() *Repo { return it.cur }
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *RepoIterator) Err() error { return it.p.err }
+
+// BranchIterator steps through a repo's branch names; see
+// ProjectIterator.
+type BranchIterator struct {
+	p   *pager
+	buf []string
+	cur string
+}
+
+// Next advances to the next branch, and reports whether there
+// is one.
+func (it *BranchIterator) Next(ctx context.Context) bool {
+	for len(it.buf) == 0 {
+		it.buf = nil
+		if it.p.fetch(ctx, &it.buf) == 0 {
+			return false
+		}
+	}
+	it.cur, it.buf = it.buf[0], it.buf[1:]
+	return true
+}
+
+// Branch returns the current branch name.
+func (it *BranchIterator) Branch() string { return it.cur }
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *BranchIterator) Err() error { return it.p.err }
+
+// RepoPullIterator steps through a list of repo pulls; see
+// ProjectIterator.
+type RepoPullIterator struct {
+	p   *pager
+	buf []*RepoPull
+	cur *RepoPull
+}
+
+// Next advances to the next repo pull, and reports whether there
+// is one.
+func (it *RepoPullIterator) Next(ctx context.Context) bool {
+	for len(it.buf) == 0 {
+		it.buf = nil
+		if it.p.fetch(ctx, &it.buf) == 0 {
+			return false
+		}
+	}
+	it.cur, it.buf = it.buf[0], it.buf[1:]
+	return true
+}
+
+// RepoPull returns the current repo pull.
+func (it *RepoPullIterator) RepoPull() *RepoPull { return it.cur }
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *RepoPullIterator) Err() error { return it.p.err }
+
+// JobIterator steps through a list of jobs; see ProjectIterator.
+type JobIterator struct {
+	p   *pager
+	buf []*Job
+	cur *Job
+}
+
+// Next advances to the next job, and reports whether there is one.
+func (it *JobIterator) Next(ctx context.Context) bool {
+	for len(it.buf) == 0 {
+		it.buf = nil
+		if it.p.fetch(ctx, &it.buf) == 0 {
+			return false
+		}
+	}
+	it.cur, it.buf = it.buf[0], it.buf[1:]
+	return true
+}
+
+// Job returns the current job.
+func (it *JobIterator) Job() *Job { return it.cur }
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *JobIterator) Err() error { return it.p.err }
+
+// AgentIterator steps through a list of agents; see
+// ProjectIterator.
+type AgentIterator struct {
+	p   *pager
+	buf []*Agent
+	cur *Agent
+}
+
+// Next advances to the next agent, and reports whether there
+// is one.
+func (it *AgentIterator) Next(ctx context.Context) bool {
+	for len(it.buf) == 0 {
+		it.buf = nil
+		if it.p.fetch(ctx, &it.buf) == 0 {
+			return false
+		}
+	}
+	it.cur, it.buf = it.buf[0], it.buf[1:]
+	return true
+}
+
+// Agent returns the current agent.
+func (it *AgentIterator) Agent() *Agent { return it.cur }
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *AgentIterator) Err() error { return it.p.err }
+
+// UserIterator steps through a list of users; see ProjectIterator.
+type UserIterator struct {
+	p   *pager
+	buf []*User
+	cur *User
+}
+
+// Next advances to the next user, and reports whether there is one.
+func (it *UserIterator) Next(ctx context.Context) bool {
+	for len(it.buf) == 0 {
+		it.buf = nil
+		if it.p.fetch(ctx, &it.buf) == 0 {
+			return false
+		}
+	}
+	it.cur, it.buf = it.buf[0], it.buf[1:]
+	return true
+}
+
+// User returns the current user.
+func (it *UserIterator) User() *User { return it.cur }
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *UserIterator) Err() error { return it.p.err }
@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package client
+
+import (
+	"context"
+	"fmt"
+)
+
+// ProjectUpdate holds the values to change in a project. Nil
+// fields are left unchanged.
+type ProjectUpdate struct {
+	Name     *string `json:"name,omitempty"`
+	Fullname *string `json:"fullname,omitempty"`
+}
+
+// ListProjects gets all projects, or the part of the list selected
+// by opts.
+func (c *Client) ListProjects(ctx context.Context, opts *ListOptions) ([]*Project, error) {
+	projects := []*Project{}
+	_, err := c.list(ctx, "/projects", "projects", opts, &projects)
+	return projects, err
+}
+
+// Projects returns an iterator over all projects, fetching pageSize
+// at a time.
+func (c *Client) Projects(pageSize int) *ProjectIterator {
+	return &ProjectIterator{p: newPager(c, "/projects", "projects", pageSize)}
+}
+
+// GetProject gets the project with the given ID.
+func (c *Client) GetProject(ctx context.Context, id uint32) (*Project, error) {
+	out := struct {
+		Project *Project `json:"project"`
+	}{}
+	if _, err := c.do(ctx, "GET", fmt.Sprintf("/projects/%d", id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Project, nil
+}
+
+// CreateProject creates a new project, and returns its ID.
+func (c *Client) CreateProject(ctx context.Context, name string, fullname string) (uint32, error) {
+	in := map[string]string{"name": name, "fullname": fullname}
+	return c.create(ctx, "/projects", in)
+}
+
+// UpdateProject changes the given values of a project.
+func (c *Client) UpdateProject(ctx context.Context, id uint32, u *ProjectUpdate) error {
+	_, err := c.do(ctx, "PUT", fmt.Sprintf("/projects/%d", id), nil, u, nil)
+	return err
+}
+
+// DeleteProject moves a project to the trash. It is deleted for good
+// once it is purged from the trash.
+func (c *Client) DeleteProject(ctx context.Context, id uint32) error {
+	_, err := c.do(ctx, "DELETE", fmt.Sprintf("/projects/%d", id), nil, nil, nil)
+	return err
+}
+
+// RestoreProject takes a project back out of the trash.
+func (c *Client) RestoreProject(ctx context.Context, id uint32) error {
+	_, err := c.do(ctx, "POST", fmt.Sprintf("/projects/%d/restore", id), nil, nil, nil)
+	return err
+}
@@ -0,0 +1,246 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// RepoPullRequest describes a new repo pull.
+type RepoPullRequest struct {
+	// Commit is the full (40 or 64 character) hex ID of the commit
+	// to pull. It must be given unless Resolve is set.
+	Commit string `json:"commit,omitempty"`
+	// Resolve is set to pull the commit that Tag names, or else the
+	// top of the branch, in place of Commit.
+	Resolve bool `json:"resolve,omitempty"`
+	// Tag is an optional tag for the commit.
+	Tag string `json:"tag,omitempty"`
+	// SPDXID is an optional SPDX identifier for the pull.
+	SPDXID string `json:"spdx_id,omitempty"`
+}
+
+// ListRepoPulls gets the pulls for a branch of a repo, or the part
+// of the list selected by opts.
+func (c *Client) ListRepoPulls(ctx context.Context, repoID uint32, branch string, opts *ListOptions) ([]*RepoPull, error) {
+	pulls := []*RepoPull{}
+	_, err := c.list(ctx, branchPath(repoID, branch), "pulls", opts, &pulls)
+	return pulls, err
+}
+
+// RepoPullFilter selects repo pulls across all repos. Zero values
+// select every repo pull.
+type RepoPullFilter struct {
+	ProjectID    uint32
+	SubprojectID uint32
+	RepoID       uint32
+	Branch       string
+	// Statuses and Healths select repo pulls with any of the
+	// given values, such as "stopped" or "error".
+	Statuses []string
+	Healths  []string
+	// Commit and Tag are prefixes of the commit and tag.
+	Commit string
+	Tag    string
+	// Time ranges include their After time and exclude their Before
+	// time; repo pulls that have not started or finished are not in
+	// any range.
+	StartedAfter   time.Time
+	StartedBefore  time.Time
+	FinishedAfter  time.Time
+	FinishedBefore time.Time
+	// Recent lists the most recently started repo pulls first,
+	// rather than in ID order.
+	Recent bool
+}
+
+// set adds the filter's query parameters to q.
+func (f *RepoPullFilter) set(q url.Values) {
+	if f == nil {
+		return
+	}
+	ids := map[string]uint32{"project_id": f.ProjectID, "subproject_id": f.SubprojectID, "repo_id": f.RepoID}
+	for name, id := range ids {
+		if id != 0 {
+			q.Set(name, strconv.FormatUint(uint64(id), 10))
+		}
+	}
+	strs := map[string]string{
+		"branch": f.Branch,
+		"status": strings.Join(f.Statuses, ","),
+		"health": strings.Join(f.Healths, ","),
+		"commit": f.Commit,
+		"tag":    f.Tag,
+	}
+	for name, s := range strs {
+		if s != "" {
+			q.Set(name, s)
+		}
+	}
+	times := map[string]time.Time{
+		"started_after":   f.StartedAfter,
+		"started_before":  f.StartedBefore,
+		"finished_after":  f.FinishedAfter,
+		"finished_before": f.FinishedBefore,
+	}
+	for name, t := range times {
+		if !t.IsZero() {
+			q.Set(name, t.Format(time.RFC3339))
+		}
+	}
+	if f.Recent {
+		q.Set("sort", "recent")
+	}
+}
+
+// FindRepoPulls gets the repo pulls, in any repo, that the filter
+// selects, or the part of that list selected by opts.
+func (c *Client) FindRepoPulls(ctx context.Context, filter *RepoPullFilter, opts *ListOptions) ([]*RepoPull, error) {
+	query := opts.query()
+	filter.set(query)
+	out := struct {
+		RepoPulls []*RepoPull `json:"repopulls"`
+	}{}
+	if _, err := c.do(ctx, "GET", "/repopulls", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return out.RepoPulls, nil
+}
+
+// RepoPulls returns an iterator over the pulls for a branch of a
+// repo, fetching pageSize at a time.
+func (c *Client) RepoPulls(repoID uint32, branch string, pageSize int) *RepoPullIterator {
+	return &RepoPullIterator{p: newPager(c, branchPath(repoID, branch), "pulls", pageSize)}
+}
+
+// GetRepoPull gets the repo pull with the given ID.
+func (c *Client) GetRepoPull(ctx context.Context, id uint32) (*RepoPull, error) {
+	out := struct {
+		RepoPull *RepoPull `json:"repopull"`
+	}{}
+	if _, err := c.do(ctx, "GET", fmt.Sprintf("/repopulls/%d", id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out.RepoPull, nil
+}
+
+// GetLatestRepoPull gets the most recently created pull of a branch
+// of a repo, or if successful is true, the most recent one that
+// stopped without error.
+func (c *Client) GetLatestRepoPull(ctx context.Context, repoID uint32, branch string, successful bool) (*RepoPull, error) {
+	query := url.Values{}
+	if successful {
+		query.Set("successful", "true")
+	}
+	out := struct {
+		RepoPull *RepoPull `json:"repopull"`
+	}{}
+	if _, err := c.do(ctx, "GET", branchPath(repoID, branch)+"/latest", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return out.RepoPull, nil
+}
+
+// ComparedFile is one version of a file, in a comparison of repo
+// pulls. ID is the file instance's ID.
+type ComparedFile struct {
+	ID         uint64 `json:"id"`
+	FileHashID uint64 `json:"file_hash_id"`
+	SHA256     string `json:"sha256"`
+}
+
+// FileChange is a difference between the files of two repo pulls,
+// at one path. Change is "added", "removed" or "modified"; From is
+// nil for an added file, and To for a removed one.
+type FileChange struct {
+	Path   string        `json:"path"`
+	Change string        `json:"change"`
+	From   *ComparedFile `json:"from,omitempty"`
+	To     *ComparedFile `json:"to,omitempty"`
+}
+
+// FileChangeCounts counts the files of two repo pulls by how they
+// differ.
+type FileChangeCounts struct {
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Modified  int `json:"modified"`
+	Unchanged int `json:"unchanged"`
+}
+
+// ComparedJob is how one job turned out, in a comparison of repo
+// pulls.
+type ComparedJob struct {
+	ID     uint32           `json:"id"`
+	Status datastore.Status `json:"status"`
+	Health datastore.Health `json:"health"`
+}
+
+// JobChange is a difference between the jobs of two repo pulls,
+// for one agent. Change is "added", "removed" or "changed"; From
+// is nil for an added job, and To for a removed one.
+type JobChange struct {
+	AgentID uint32       `json:"agent_id"`
+	Change  string       `json:"change"`
+	From    *ComparedJob `json:"from,omitempty"`
+	To      *ComparedJob `json:"to,omitempty"`
+}
+
+// JobChangeCounts counts the jobs of two repo pulls by how they
+// differ.
+type JobChangeCounts struct {
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Changed   int `json:"changed"`
+	Unchanged int `json:"unchanged"`
+}
+
+// RepoPullComparison is what changed from one repo pull to another
+// of the same repo. From and To only have their ID, branch, commit,
+// tag, status and health set.
+type RepoPullComparison struct {
+	RepoID  uint32    `json:"repo_id"`
+	From    *RepoPull `json:"from"`
+	To      *RepoPull `json:"to"`
+	Summary struct {
+		Files FileChangeCounts `json:"files"`
+		Jobs  JobChangeCounts  `json:"jobs"`
+	} `json:"summary"`
+	// Files lists the files that differ, or the part of that list
+	// selected by opts.
+	Files []*FileChange `json:"files"`
+	// Jobs lists all the jobs that differ.
+	Jobs []*JobChange `json:"jobs"`
+}
+
+// CompareRepoPulls gets how the files and jobs changed from one repo
+// pull to another of the same repo.
+func (c *Client) CompareRepoPulls(ctx context.Context, fromID uint32, toID uint32, opts *ListOptions) (*RepoPullComparison, error) {
+	out := &RepoPullComparison{}
+	if _, err := c.do(ctx, "GET", fmt.Sprintf("/repopulls/%d/compare/%d", fromID, toID), opts.query(), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StartRepoPull creates a new pull for a branch of a repo, and
+// returns its ID. If req is nil, the top of the branch is pulled.
+func (c *Client) StartRepoPull(ctx context.Context, repoID uint32, branch string, req *RepoPullRequest) (uint32, error) {
+	if req == nil {
+		req = &RepoPullRequest{Resolve: true}
+	}
+	return c.create(ctx, branchPath(repoID, branch), req)
+}
+
+// DeleteRepoPull deletes a repo pull.
+func (c *Client) DeleteRepoPull(ctx context.Context, id uint32) error {
+	_, err := c.do(ctx, "DELETE", fmt.Sprintf("/repopulls/%d", id), nil, nil, nil)
+	return err
+}
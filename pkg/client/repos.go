@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// RepoUpdate holds the values to change in a repo. Nil fields are
+// left unchanged.
+type RepoUpdate struct {
+	Name    *string `json:"name,omitempty"`
+	Address *string `json:"address,omitempty"`
+	// SubprojectID moves the repo to another subproject.
+	SubprojectID *uint32 `json:"subproject_id,omitempty"`
+}
+
+// ListRepos gets all repos, or the part of the list selected by
+// opts.
+func (c *Client) ListRepos(ctx context.Context, opts *ListOptions) ([]*Repo, error) {
+	repos := []*Repo{}
+	_, err := c.list(ctx, "/repos", "repos", opts, &repos)
+	return repos, err
+}
+
+// ListReposForSubproject gets the repos in a subproject, or the
+// part of the list selected by opts.
+func (c *Client) ListReposForSubproject(ctx context.Context, subprojectID uint32, opts *ListOptions) ([]*Repo, error) {
+	repos := []*Repo{}
+	_, err := c.list(ctx, fmt.Sprintf("/subprojects/%d/repos", subprojectID), "repos", opts, &repos)
+	return repos, err
+}
+
+// Repos returns an iterator over all repos, fetching pageSize at
+// a time.
+func (c *Client) Repos(pageSize int) *RepoIterator {
+	return &RepoIterator{p: newPager(c, "/repos", "repos", pageSize)}
+}
+
+// ReposForSubproject returns an iterator over the repos in a
+// subproject, fetching pageSize at a time.
+func (c *Client) ReposForSubproject(subprojectID uint32, pageSize int) *RepoIterator {
+	return &RepoIterator{p: newPager(c, fmt.Sprintf("/subprojects/%d/repos", subprojectID), "repos", pageSize)}
+}
+
+// GetRepo gets the repo with the given ID.
+func (c *Client) GetRepo(ctx context.Context, id uint32) (*Repo, error) {
+	out := struct {
+		Repo *Repo `json:"repo"`
+	}{}
+	if _, err := c.do(ctx, "GET", fmt.Sprintf("/repos/%d", id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Repo, nil
+}
+
+// CreateRepo creates a new repo within a subproject, and returns
+// its ID.
+func (c *Client) CreateRepo(ctx context.Context, subprojectID uint32, name string, address string) (uint32, error) {
+	in := map[string]string{"name": name, "address": address}
+	return c.create(ctx, fmt.Sprintf("/subprojects/%d/repos", subprojectID), in)
+}
+
+// UpdateRepo changes the given values of a repo.
+func (c *Client) UpdateRepo(ctx context.Context, id uint32, u *RepoUpdate) error {
+	_, err := c.do(ctx, "PUT", fmt.Sprintf("/repos/%d", id), nil, u, nil)
+	return err
+}
+
+// DeleteRepo moves a repo to the trash. It is deleted for good
+// once it is purged from the trash.
+func (c *Client) DeleteRepo(ctx context.Context, id uint32) error {
+	_, err := c.do(ctx, "DELETE", fmt.Sprintf("/repos/%d", id), nil, nil, nil)
+	return err
+}
+
+// RestoreRepo takes a repo back out of the trash.
+func (c *Client) RestoreRepo(ctx context.Context, id uint32) error {
+	_, err := c.do(ctx, "POST", fmt.Sprintf("/repos/%d/restore", id), nil, nil, nil)
+	return err
+}
+
+// branchPath returns the endpoint for a branch of a repo.
+func branchPath(repoID uint32, branch string) string {
+	return fmt.Sprintf("/repos/%d/branches/%s", repoID, url.PathEscape(branch))
+}
+
+// ListBranches gets the names of a repo's branches, or the part of
+// the list selected by opts.
+func (c *Client) ListBranches(ctx context.Context, repoID uint32, opts *ListOptions) ([]string, error) {
+	branches := []string{}
+	_, err := c.list(ctx, fmt.Sprintf("/repos/%d/branches", repoID), "branches", opts, &branches)
+	return branches, err
+}
+
+// BranchSummary is a branch of a repo, with how many times it has
+// been pulled and how its latest pull went.
+type BranchSummary struct {
+	Branch string `json:"branch"`
+	Pulls  int    `json:"pulls"`
+	// Latest is nil if the branch has not been pulled. Only its ID,
+	// status, health, commit, tag and times are set.
+	Latest *RepoPull `json:"latest,omitempty"`
+	// LatestSuccessfulID is the ID of the latest pull that stopped
+	// without error, or 0 if there is none.
+	LatestSuccessfulID uint32 `json:"latest_successful_id,omitempty"`
+}
+
+// ListBranchSummaries gets a repo's branches with a summary of
+// their pulls, or the part of the list selected by opts.
+func (c *Client) ListBranchSummaries(ctx context.Context, repoID uint32, opts *ListOptions) ([]*BranchSummary, error) {
+	query := opts.query()
+	query.Set("summary", "true")
+	out := struct {
+		Branches []*BranchSummary `json:"branches"`
+	}{}
+	if _, err := c.do(ctx, "GET", fmt.Sprintf("/repos/%d/branches", repoID), query, nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Branches, nil
+}
+
+// Branches returns an iterator over the names of a repo's
+// branches, fetching pageSize at a time.
+func (c *Client) Branches(repoID uint32, pageSize int) *BranchIterator {
+	return &BranchIterator{p: newPager(c, fmt.Sprintf("/repos/%d/branches", repoID), "branches", pageSize)}
+}
+
+// CreateBranch adds a branch to a repo, so that it can be pulled.
+func (c *Client) CreateBranch(ctx context.Context, repoID uint32, branch string) error {
+	in := map[string]string{"branch": branch}
+	_, err := c.do(ctx, "POST", fmt.Sprintf("/repos/%d/branches", repoID), nil, in, nil)
+	return err
+}
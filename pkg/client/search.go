@@ -0,0 +1,43 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package client
+
+import (
+	"context"
+	"strings"
+)
+
+// SearchResult is one resource that matches a search. Which of the
+// IDs and Branch are set depends on its Type.
+type SearchResult struct {
+	Type         string `json:"type"`
+	ID           uint32 `json:"id,omitempty"`
+	Name         string `json:"name"`
+	Field        string `json:"field"`
+	Match        string `json:"match"`
+	Score        int    `json:"score"`
+	ProjectID    uint32 `json:"project_id,omitempty"`
+	SubprojectID uint32 `json:"subproject_id,omitempty"`
+	RepoID       uint32 `json:"repo_id,omitempty"`
+	Branch       string `json:"branch,omitempty"`
+	InTrash      bool   `json:"in_trash,omitempty"`
+}
+
+// Search finds resources whose names, addresses, commits and so on
+// match q, best matches first. If types is not empty, only results
+// of those types (such as "repo" or "branch") are returned. opts
+// selects part of the results.
+func (c *Client) Search(ctx context.Context, q string, types []string, opts *ListOptions) ([]*SearchResult, error) {
+	query := opts.query()
+	query.Set("q", q)
+	if len(types) > 0 {
+		query.Set("type", strings.Join(types, ","))
+	}
+	out := struct {
+		Results []*SearchResult `json:"results"`
+	}{}
+	if _, err := c.do(ctx, "GET", "/search", query, nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Results, nil
+}
@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package client
+
+import (
+	"context"
+	"fmt"
+)
+
+// SubprojectUpdate holds the values to change in a subproject. Nil
+// fields are left unchanged.
+type SubprojectUpdate struct {
+	Name     *string `json:"name,omitempty"`
+	Fullname *string `json:"fullname,omitempty"`
+	// ProjectID moves the subproject to another project.
+	ProjectID *uint32 `json:"project_id,omitempty"`
+}
+
+// ListSubprojects gets all subprojects, or the part of the list
+// selected by opts.
+func (c *Client) ListSubprojects(ctx context.Context, opts *ListOptions) ([]*Subproject, error) {
+	subprojects := []*Subproject{}
+	_, err := c.list(ctx, "/subprojects", "subprojects", opts, &subprojects)
+	return subprojects, err
+}
+
+// ListSubprojectsForProject gets the subprojects in a project, or
+// the part of the list selected by opts.
+func (c *Client) ListSubprojectsForProject(ctx context.Context, projectID uint32, opts *ListOptions) ([]*Subproject, error) {
+	subprojects := []*Subproject{}
+	_, err := c.list(ctx, fmt.Sprintf("/projects/%d/subprojects", projectID), "subprojects", opts, &subprojects)
+	return subprojects, err
+}
+
+// Subprojects returns an iterator over all subprojects, fetching
+// pageSize at a time.
+func (c *Client) Subprojects(pageSize int) *SubprojectIterator {
+	return &SubprojectIterator{p: newPager(c, "/subprojects", "subprojects", pageSize)}
+}
+
+// SubprojectsForProject returns an iterator over the subprojects
+// in a project, fetching pageSize at a time.
+func (c *Client) SubprojectsForProject(projectID uint32, pageSize int) *SubprojectIterator {
+	return &SubprojectIterator{p: newPager(c, fmt.Sprintf("/projects/%d/subprojects", projectID), "subprojects", pageSize)}
+}
+
+// GetSubproject gets the subproject with the given ID.
+func (c *Client) GetSubproject(ctx context.Context, id uint32) (*Subproject, error) {
+	out := struct {
+		Subproject *Subproject `json:"subproject"`
+	}{}
+	if _, err := c.do(ctx, "GET", fmt.Sprintf("/subprojects/%d", id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Subproject, nil
+}
+
+// CreateSubproject creates a new subproject within a project, and
+// returns its ID.
+func (c *Client) CreateSubproject(ctx context.Context, projectID uint32, name string, fullname string) (uint32, error) {
+	in := map[string]string{"name": name, "fullname": fullname}
+	return c.create(ctx, fmt.Sprintf("/projects/%d/subprojects", projectID), in)
+}
+
+// UpdateSubproject changes the given values of a subproject.
+func (c *Client) UpdateSubproject(ctx context.Context, id uint32, u *SubprojectUpdate) error {
+	_, err := c.do(ctx, "PUT", fmt.Sprintf("/subprojects/%d", id), nil, u, nil)
+	return err
+}
+
+// DeleteSubproject moves a subproject to the trash. It is deleted for good
+// once it is purged from the trash.
+func (c *Client) DeleteSubproject(ctx context.Context, id uint32) error {
+	_, err := c.do(ctx, "DELETE", fmt.Sprintf("/subprojects/%d", id), nil, nil, nil)
+	return err
+}
+
+// RestoreSubproject takes a subproject back out of the trash.
+func (c *Client) RestoreSubproject(ctx context.Context, id uint32) error {
+	_, err := c.do(ctx, "POST", fmt.Sprintf("/subprojects/%d/restore", id), nil, nil, nil)
+	return err
+}
@@ -0,0 +1,32 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package client
+
+import (
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// The API sends and receives the same resource types that it
+// stores in the peridot datastore, so they are reused here.
+type (
+	// User is a registered peridot user.
+	User = datastore.User
+	// UserAccessLevel is a user's level of access.
+	UserAccessLevel = datastore.UserAccessLevel
+	// Project is a top-level peridot project.
+	Project = datastore.Project
+	// Subproject is a subproject within a project.
+	Subproject = datastore.Subproject
+	// Repo is a code repository within a subproject.
+	Repo = datastore.Repo
+	// RepoPull is a single retrieval of code from a repo branch.
+	RepoPull = datastore.RepoPull
+	// Agent is a registered peridot agent.
+	Agent = datastore.Agent
+	// Job is a single run of an agent on a repo pull.
+	Job = datastore.Job
+	// JobConfig is the configuration passed to an agent for a job.
+	JobConfig = datastore.JobConfig
+	// JobPathConfig is a path, or prior job, used as a job input.
+	JobPathConfig = datastore.JobPathConfig
+)
@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: Apache-2.0 OR GPL-2.0-or-later
+
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/swinslow/peridot-db/pkg/datastore"
+)
+
+// UserUpdate holds the values to change in a user. Nil fields are
+// left unchanged. Only admins can change Github or Access.
+type UserUpdate struct {
+	Name   *string          `json:"name,omitempty"`
+	Github *string          `json:"github,omitempty"`
+	Access *UserAccessLevel `json:"access,omitempty"`
+}
+
+// ListUsers gets all users, or the part of the list selected by
+// opts. Users other than admins only receive each user's ID and
+// GitHub name.
+func (c *Client) ListUsers(ctx context.Context, opts *ListOptions) ([]*User, error) {
+	users := []*User{}
+	_, err := c.list(ctx, "/users", "users", opts, &users)
+	return users, err
+}
+
+// Users returns an iterator over all users, fetching pageSize at
+// a time.
+func (c *Client) Users(pageSize int) *UserIterator {
+	return &UserIterator{p: newPager(c, "/users", "users", pageSize)}
+}
+
+// GetUser gets the user with the given ID. Users other than admins
+// only receive the ID and GitHub name of users besides themselves.
+func (c *Client) GetUser(ctx context.Context, id uint32) (*User, error) {
+	out := struct {
+		User *User `json:"user"`
+	}{}
+	if _, err := c.do(ctx, "GET", fmt.Sprintf("/users/%d", id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out.User, nil
+}
+
+// CreateUser registers a new user, and returns their ID.
+func (c *Client) CreateUser(ctx context.Context, name string, github string, access UserAccessLevel) (uint32, error) {
+	in := map[string]string{
+		"name":   name,
+		"github": github,
+		"access": datastore.StringFromUserAccessLevel(access),
+	}
+	return c.create(ctx, "/users", in)
+}
+
+// UpdateUser changes the given values of a user.
+func (c *Client) UpdateUser(ctx context.Context, id uint32, u *UserUpdate) error {
+	_, err := c.do(ctx, "PUT", fmt.Sprintf("/users/%d", id), nil, u, nil)
+	return err
+}
@@ -62,9 +62,10 @@ func CheckResponse(t *testing.T, rec *httptest.ResponseRecorder, wanted string)
 
 // ServeHandler builds and serves a Gorilla mux router for the
 // requested route, so that we will get the appropriate mux.Vars
-// mapping for unit tests.
+// mapping for unit tests. Like the API's router, it matches on the
+// encoded path.
 func ServeHandler(rec *httptest.ResponseRecorder, req *http.Request, hf http.HandlerFunc, path string) {
-	router := mux.NewRouter()
+	router := mux.NewRouter().UseEncodedPath()
 	router.HandleFunc(path, hf)
 	router.ServeHTTP(rec, req)
 }